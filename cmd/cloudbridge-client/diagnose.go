@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+// diagnose connects to the relay once, authenticates and prints how long
+// each phase took, so a slow connect can be put down to the network, TLS or
+// the relay
+func diagnose(w io.Writer, cfg *config.Config) error {
+	client, err := relay.NewClientFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+
+	address := net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port))
+	fmt.Fprintf(w, "Relay: %s (TLS: %v)\n", address, cfg.TLS.Enabled)
+
+	err = client.Connect(cfg.Server.Host, cfg.Server.Port)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), relay.HandshakeTimeout)
+		err = client.HandshakeContext(ctx, cfg.Server.JWTToken)
+		cancel()
+		client.Close()
+	}
+
+	printTimings(w, client.HandshakeTimings())
+	if err != nil {
+		return fmt.Errorf("diagnosis failed: %w", err)
+	}
+	return nil
+}
+
+// printTimings prints the phase durations with their share of the total and
+// names the slowest phase. Phases that did not complete are shown as "-".
+func printTimings(w io.Writer, timings relay.HandshakeTimings) {
+	total := timings.Total()
+	var slowest relay.PhaseTiming
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tTIME\tSHARE")
+	for _, phase := range timings.Phases() {
+		if phase.Duration <= 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\n", phase.Phase)
+			continue
+		}
+		share := 100 * float64(phase.Duration) / float64(total)
+		fmt.Fprintf(tw, "%s\t%v\t%.0f%%\n", phase.Phase, phase.Duration.Round(time.Microsecond), share)
+		if phase.Duration > slowest.Duration {
+			slowest = phase
+		}
+	}
+	fmt.Fprintf(tw, "total\t%v\t\n", total.Round(time.Microsecond))
+	tw.Flush()
+
+	if slowest.Duration > 0 {
+		fmt.Fprintf(w, "Slowest phase: %s\n", slowest.Phase)
+	}
+}
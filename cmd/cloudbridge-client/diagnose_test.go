@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+func TestPrintTimings(t *testing.T) {
+	var out bytes.Buffer
+	printTimings(&out, relay.HandshakeTimings{
+		Connect:       10 * time.Millisecond,
+		HelloExchange: 10 * time.Millisecond,
+		Auth:          80 * time.Millisecond,
+	})
+
+	rows := make(map[string]string)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			rows[fields[0]] = strings.Join(fields[1:], " ")
+		}
+	}
+	want := map[string]string{
+		"tls_handshake": "- -",
+		"auth":          "80ms 80%",
+		"total":         "100ms",
+		"Slowest":       "phase: auth",
+	}
+	for phase, row := range want {
+		if rows[phase] != row {
+			t.Errorf("expected %s row %q, got %q in:\n%s", phase, row, rows[phase], out.String())
+		}
+	}
+}
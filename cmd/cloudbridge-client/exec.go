@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/spf13/cobra"
+)
+
+// Environment variables pointing an exec'd command at its tunnel
+const (
+	envTunnelHost = "CLOUDBRIDGE_TUNNEL_HOST"
+	envTunnelPort = "CLOUDBRIDGE_TUNNEL_PORT"
+	envTunnelAddr = "CLOUDBRIDGE_TUNNEL_ADDR"
+	envTunnelID   = "CLOUDBRIDGE_TUNNEL_ID"
+)
+
+// exitCodeError makes the process exit with the exit code of a command run
+// by exec
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.code)
+}
+
+// tunnelSpecSyntax is the syntax of a tunnel given on the command line
+const tunnelSpecSyntax = "[[bind_address:]local_port:]remote_host:remote_port[/tcp]"
+
+// defaultBindAddress is listened on by tunnels given without a bind
+// address, so like with ssh -L they are only reachable from this host
+const defaultBindAddress = "127.0.0.1"
+
+// tunnelSpec describes a tunnel given on the command line
+type tunnelSpec struct {
+	// BindAddress is the local address listened on, defaultBindAddress
+	// unless one is given; an unspecified address such as 0.0.0.0 listens
+	// on all interfaces
+	BindAddress string
+	// LocalPort is zero if any free port will do
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+	// Protocol is empty for the default, tcp
+	Protocol string
+}
+
+// parseTunnelSpec parses a tunnel in the syntax of ssh -L,
+// "[[bind_address:]local_port:]remote_host:remote_port[/tcp]". IPv6
+// addresses are written in brackets, e.g. "[::1]:8080:[fd00::2]:22".
+func parseTunnelSpec(spec string) (tunnelSpec, error) {
+	t := tunnelSpec{BindAddress: defaultBindAddress}
+	invalid := func(format string, args ...interface{}) (tunnelSpec, error) {
+		return tunnelSpec{}, fmt.Errorf("invalid tunnel %q: %s", spec, fmt.Sprintf(format, args...))
+	}
+
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		proto := rest[i+1:]
+		if proto != "tcp" {
+			return invalid("unsupported protocol %q, only tcp is supported", proto)
+		}
+		t.Protocol, rest = proto, rest[:i]
+	}
+
+	fields, err := splitTunnelSpec(rest)
+	if err != nil {
+		return invalid("%v", err)
+	}
+	switch len(fields) {
+	case 2, 3, 4:
+	default:
+		return invalid("expected %s", tunnelSpecSyntax)
+	}
+
+	if len(fields) == 4 {
+		if fields[0] == "" {
+			return invalid("missing bind address")
+		}
+		t.BindAddress, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 3 {
+		local, err := strconv.Atoi(fields[0])
+		if err != nil || local < 1 || local > 65535 {
+			return invalid("bad local port %q", fields[0])
+		}
+		t.LocalPort, fields = local, fields[1:]
+	}
+
+	if fields[0] == "" {
+		return invalid("missing remote host")
+	}
+	t.RemoteHost = fields[0]
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 1 || port > 65535 {
+		return invalid("bad remote port %q", fields[1])
+	}
+	t.RemotePort = port
+	return t, nil
+}
+
+// splitTunnelSpec splits spec at colons outside of brackets and strips the
+// brackets around IPv6 addresses
+func splitTunnelSpec(spec string) ([]string, error) {
+	var fields []string
+	for spec != "" {
+		var field string
+		if strings.HasPrefix(spec, "[") {
+			end := strings.Index(spec, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			field, spec = spec[1:end], spec[end+1:]
+			if spec != "" && !strings.HasPrefix(spec, ":") {
+				return nil, fmt.Errorf("unexpected %q after ]", spec)
+			}
+		} else if i := strings.Index(spec, ":"); i >= 0 {
+			field, spec = spec[:i], spec[i:]
+		} else {
+			field, spec = spec, ""
+		}
+		fields = append(fields, field)
+		if strings.HasPrefix(spec, ":") {
+			spec = spec[1:]
+			if spec == "" {
+				fields = append(fields, "")
+			}
+		}
+	}
+	return fields, nil
+}
+
+// parseTunnelSpecs parses the --tunnel flags of the root command. Unlike
+// exec, every tunnel needs a local port.
+func parseTunnelSpecs(specs []string) ([]tunnelSpec, error) {
+	tunnels := make([]tunnelSpec, 0, len(specs))
+	for _, spec := range specs {
+		t, err := parseTunnelSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if t.LocalPort == 0 {
+			return nil, fmt.Errorf("invalid tunnel %q: missing local port", spec)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
+
+// newExecCommand creates the command that runs a program through a tunnel
+func newExecCommand() *cobra.Command {
+	var spec string
+
+	cmd := &cobra.Command{
+		Use:   "exec --tunnel " + tunnelSpecSyntax + " -- command [args...]",
+		Short: "Open a tunnel, run a command that uses it and close the tunnel when it exits",
+		Long: "Open a tunnel, run a command that uses it and close the tunnel when it exits.\n" +
+			"The command finds the local end of the tunnel in " + envTunnelHost + ", " +
+			envTunnelPort + " and " + envTunnelAddr + ". The exit code of the command is passed on.",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		// main reports errors, and exit codes are not errors to print
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tunnel, err := parseTunnelSpec(spec)
+			if err != nil {
+				return err
+			}
+			return execTunneled(cmd.Context(), tunnel, args)
+		},
+	}
+
+	cmd.Flags().StringVar(&spec, "tunnel", "", "Tunnel to open: "+tunnelSpecSyntax)
+	cmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path or http(s):// URL of a config server")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "JWT token for authentication")
+	_ = cmd.MarkFlagRequired("tunnel")
+
+	return cmd
+}
+
+// execTunneled opens the tunnel, runs the command and closes the tunnel
+func execTunneled(ctx context.Context, spec tunnelSpec, args []string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if token != "" {
+		cfg.Server.JWTToken = token
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	lost := make(chan *relay.Client)
+	onLost := func(client *relay.Client) {
+		select {
+		case lost <- client:
+		case <-ctx.Done():
+		}
+	}
+	client, tunnelID, err := execConnect(ctx, cfg, spec, onLost)
+	if err != nil {
+		cancel()
+		return err
+	}
+	// A tunnel without a local port listens on a free one, which the
+	// tunnel keeps when it is opened again
+	if spec.LocalPort == 0 {
+		spec.LocalPort = tunnelLocalPort(client, tunnelID)
+	}
+
+	// Until the command exits, a lost connection is replaced with backoff
+	// and the tunnel opened again on the same local port. The command keeps
+	// the tunnel ID it started with.
+	current, currentID := client, tunnelID
+	reconnected := make(chan struct{})
+	go func() {
+		defer close(reconnected)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case lostClient := <-lost:
+				// Free the local port for the new tunnel
+				lostClient.Close()
+				err := relay.ReconnectWithBackoff(ctx, reconnectBackoff(cfg), func() error {
+					next, nextID, err := execConnect(ctx, cfg, spec, onLost)
+					if err != nil {
+						return err
+					}
+					current, currentID = next, nextID
+					log.Printf("Tunnel reopened: %s", currentID)
+					return nil
+				})
+				if err != nil {
+					log.Printf("Giving up on the relay: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-reconnected
+		current.CloseTunnel(currentID)
+		shutdownClient(current, cfg)
+	}()
+
+	// A tunnel listening on all interfaces is reached over loopback
+	host := spec.BindAddress
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = defaultBindAddress
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(spec.LocalPort))
+	env := append(os.Environ(),
+		envTunnelHost+"="+host,
+		envTunnelPort+"="+strconv.Itoa(spec.LocalPort),
+		envTunnelAddr+"="+addr,
+		envTunnelID+"="+tunnelID,
+	)
+
+	code, err := runCommand(args, env)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &exitCodeError{code: code}
+	}
+	return nil
+}
+
+// execConnect connects a new client to the relay of cfg and opens spec on
+// it. onLost is called with the client once its connection is lost.
+func execConnect(ctx context.Context, cfg *config.Config, spec tunnelSpec, onLost func(*relay.Client)) (*relay.Client, string, error) {
+	client, err := relay.NewClientFromConfig(cfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create client: %w", err)
+	}
+	if err := client.Connect(cfg.Server.Host, cfg.Server.Port); err != nil {
+		return nil, "", err
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, relay.HandshakeTimeout)
+	err = client.HandshakeContext(handshakeCtx, cfg.Server.JWTToken)
+	cancel()
+	if err != nil {
+		client.Close()
+		return nil, "", fmt.Errorf("handshake failed: %w", err)
+	}
+	client.StartHeartbeat()
+	client.SetDisconnectHandler(func(err error) {
+		log.Printf("Connection to relay lost: %v", err)
+		onLost(client)
+	})
+
+	tunnelID, err := client.CreateBoundTunnel(ctx, spec.BindAddress, spec.LocalPort, spec.RemoteHost, spec.RemotePort)
+	if err != nil {
+		shutdownClient(client, cfg)
+		return nil, "", err
+	}
+	return client, tunnelID, nil
+}
+
+// runCommand runs args with env, passing SIGINT and SIGTERM on to it, and
+// returns its exit code. A command killed by a signal exits with 128 plus
+// the signal number, like in a shell.
+func runCommand(args []string, env []string) (int, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %w", args[0], err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 0, fmt.Errorf("failed to run %s: %w", args[0], err)
+	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+// tunnelLocalPort returns the local port the tunnel of client with the
+// given ID listens on, or zero if the client has no such tunnel
+func tunnelLocalPort(client *relay.Client, tunnelID string) int {
+	for _, t := range client.ListTunnels() {
+		if t.ID == tunnelID {
+			return t.LocalPort
+		}
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestParseTunnelSpec(t *testing.T) {
+	tests := map[string]tunnelSpec{
+		// Without a bind address only loopback is listened on, as with ssh -L
+		"8080:db.internal:5432": {BindAddress: "127.0.0.1", LocalPort: 8080, RemoteHost: "db.internal", RemotePort: 5432},
+		"db.internal:5432":      {BindAddress: "127.0.0.1", RemoteHost: "db.internal", RemotePort: 5432},
+		"2222:[::1]:22":         {BindAddress: "127.0.0.1", LocalPort: 2222, RemoteHost: "::1", RemotePort: 22},
+		"[fd00::2]:22":          {BindAddress: "127.0.0.1", RemoteHost: "fd00::2", RemotePort: 22},
+		"0.0.0.0:8080:db:5432/tcp": {
+			BindAddress: "0.0.0.0", LocalPort: 8080, RemoteHost: "db", RemotePort: 5432, Protocol: "tcp",
+		},
+		"[::1]:2222:[fd00::2]:22": {BindAddress: "::1", LocalPort: 2222, RemoteHost: "fd00::2", RemotePort: 22},
+	}
+	for spec, want := range tests {
+		got, err := parseTunnelSpec(spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", spec, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: expected %+v, got %+v", spec, want, got)
+		}
+	}
+
+	for _, spec := range []string{
+		"", "db", "db:", "x:db:22", "8080::22", "db:70000", "0:db:22",
+		"8080:db:22/udp", ":8080:db:22", "a:b:8080:db:22", "[::1:8080:db:22", "[::1]x:8080:db:22",
+	} {
+		if _, err := parseTunnelSpec(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	env := append(os.Environ(), envTunnelPort+"=4321")
+	code, err := runCommand([]string{"sh", "-c", `test "$` + envTunnelPort + `" = 4321 && exit 3`}, env)
+	if err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+
+	code, err = runCommand([]string{"sh", "-c", "kill -TERM $$"}, env)
+	if err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+	if code != 128+15 {
+		t.Errorf("expected exit code 143 for SIGTERM, got %d", code)
+	}
+
+	if _, err := runCommand([]string{"/nonexistent/command"}, env); err == nil {
+		t.Error("expected error for missing command")
+	}
+}
+
+func TestParseTunnelSpecs(t *testing.T) {
+	tunnels, err := parseTunnelSpecs([]string{"8080:db:5432", "localhost:2222:bastion:22"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tunnels) != 2 || tunnels[1].BindAddress != "localhost" || tunnels[1].LocalPort != 2222 {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+
+	// Tunnels of the root command need a local port
+	if _, err := parseTunnelSpecs([]string{"8080:db:5432", "db:5432"}); err == nil {
+		t.Error("expected error for missing local port")
+	}
+}
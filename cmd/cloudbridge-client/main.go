@@ -4,19 +4,34 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
 	"github.com/2gc-dev/cloudbridge-client/pkg/config"
 	"github.com/2gc-dev/cloudbridge-client/pkg/health"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/2gc-dev/cloudbridge-client/pkg/p2p"
 	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/2gc-dev/cloudbridge-client/pkg/selftest"
+	"github.com/2gc-dev/cloudbridge-client/pkg/tunnel"
+	"github.com/2gc-dev/cloudbridge-client/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 )
@@ -31,16 +46,60 @@ var (
 	remotePort int
 	verbose    bool
 
+	// diagnoseOnly makes the client time one connection and exit
+	diagnoseOnly bool
+
+	// observerMode makes the client connect without tunnels and report on
+	// the connection every observerInterval until it is lost
+	observerMode     bool
+	observerInterval time.Duration
+
+	// tunnelFlags are the --tunnel specs; they replace the single tunnel
+	// of --local-port, --remote-host and --remote-port
+	tunnelFlags []string
+
+	// Remote configuration
+	configToken string
+	configCA    string
+	configCache string
+	// configInsecure allows an http:// config URL
+	configInsecure bool
+
 	// Global variables for health checks
 	healthChecker *health.HealthChecker
 	relayClient   *relay.Client
 	appConfig     *config.Config
+
+	// liveConfig is the configuration used for the next connection attempt;
+	// it is replaced when the configuration is reloaded
+	liveConfig atomic.Pointer[config.Config]
+
+	// reconnectClock times connection attempts and the delays between them
+	reconnectClock clock.Clock = clock.Real{}
+
+	// webhooks posts lifecycle events; nil when webhooks are disabled
+	webhooks *webhook.Emitter
+
+	// connectionEvents records the connection timeline; nil when disabled
+	connectionEvents *relay.ConnectionEventLog
+
+	// tunnelScheduler shares the uplink between the tunnels of all relay
+	// connections
+	tunnelScheduler *tunnel.FairScheduler
+
+	// meshDebug runs the mesh client and serves its debug endpoints on the
+	// metrics server
+	meshDebug bool
+	// meshClient is the mesh client run for meshDebug; nil otherwise
+	meshClient *p2p.MeshClient
 )
 
 const (
-	maxRetries      = 5
-	initialDelaySec = 1
-	maxDelaySec     = 30
+	// defaultShutdownTimeout is used when the configured one is unusable
+	defaultShutdownTimeout = 10 * time.Second
+
+	// webhookFlushTimeout bounds delivering queued webhooks on exit
+	webhookFlushTimeout = 5 * time.Second
 )
 
 // HealthResponse represents the health check response
@@ -93,7 +152,7 @@ func readyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check if client is connected and tunnel is active
-	isReady := relayClient != nil && relayClient.IsConnected()
+	isReady := relayConnected()
 
 	response := map[string]interface{}{
 		"ready":     isReady,
@@ -128,8 +187,36 @@ func liveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// setupHealthChecks initializes health checks
-func setupHealthChecks(cfg *config.Config) {
+// stateHandler reports the runtime state of the relay client
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if relayPool != nil {
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"pool": relayPool.Stats()}); err != nil {
+			log.Printf("Error encoding state response: %v", err)
+		}
+		return
+	}
+	if relayClient == nil {
+		http.Error(w, "client not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	state, err := relayClient.ExportState()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to export state: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Printf("Error encoding state response: %v", err)
+	}
+}
+
+// setupHealthChecks initializes health checks. metricsURL is where the
+// client serves its metrics; the metrics_endpoint check is skipped when it
+// is empty.
+func setupHealthChecks(cfg *config.Config, metricsURL string) {
 	healthConfig := &health.Config{
 		Interval: 30 * time.Second,
 		Timeout:  10 * time.Second,
@@ -138,8 +225,16 @@ func setupHealthChecks(cfg *config.Config) {
 	healthChecker = health.NewHealthChecker(healthConfig)
 
 	// Add health checks
-	healthChecker.AddCheck("relay_connection", func(ctx context.Context) (*health.HealthCheck, error) {
-		if relayClient == nil {
+	addCheck := func(name string, check func(ctx context.Context) (*health.HealthCheck, error)) {
+		if !cfg.HealthCheckEnabled(name) {
+			log.Printf("Health check %s disabled by configuration", name)
+			return
+		}
+		healthChecker.AddCheck(name, check)
+	}
+
+	addCheck("relay_connection", func(ctx context.Context) (*health.HealthCheck, error) {
+		if relayClient == nil && relayPool == nil {
 			return &health.HealthCheck{
 				Name:        "relay_connection",
 				Description: "Connection to relay server",
@@ -149,7 +244,7 @@ func setupHealthChecks(cfg *config.Config) {
 			}, nil
 		}
 
-		if !relayClient.IsConnected() {
+		if !relayConnected() {
 			return &health.HealthCheck{
 				Name:        "relay_connection",
 				Description: "Connection to relay server",
@@ -168,8 +263,8 @@ func setupHealthChecks(cfg *config.Config) {
 	})
 
 	// Add tunnel health check
-	healthChecker.AddCheck("tunnel_status", func(ctx context.Context) (*health.HealthCheck, error) {
-		if relayClient == nil {
+	addCheck("tunnel_status", func(ctx context.Context) (*health.HealthCheck, error) {
+		if relayClient == nil && relayPool == nil {
 			return &health.HealthCheck{
 				Name:        "tunnel_status",
 				Description: "Tunnel status",
@@ -190,9 +285,34 @@ func setupHealthChecks(cfg *config.Config) {
 	})
 
 	// Add metrics health check
-	healthChecker.AddCheck("metrics_endpoint", func(ctx context.Context) (*health.HealthCheck, error) {
+	if metricsURL == "" {
+		log.Printf("Metrics server disabled, skipping metrics_endpoint health check")
+	} else {
+		addCheck("metrics_endpoint", metricsEndpointCheck(metricsURL))
+	}
+
+	healthChecker.SetStatusObserver(notifyHealthChange)
+
+	// Start health checker
+	healthChecker.Start()
+}
+
+// notifyHealthChange emits a webhook when the overall health degrades
+func notifyHealthChange(previous, current health.HealthStatus) {
+	if current != health.Degraded && current != health.Unhealthy {
+		return
+	}
+	webhooks.Emit(webhook.EventHealthDegraded, map[string]interface{}{
+		"previous": string(previous),
+		"status":   string(current),
+	})
+}
+
+// metricsEndpointCheck returns a check probing the metrics endpoint at metricsURL
+func metricsEndpointCheck(metricsURL string) func(ctx context.Context) (*health.HealthCheck, error) {
+	return func(ctx context.Context) (*health.HealthCheck, error) {
 		client := &http.Client{Timeout: 5 * time.Second}
-		resp, err := client.Get("http://localhost:9090/metrics")
+		resp, err := client.Get(metricsURL)
 		if err != nil {
 			return &health.HealthCheck{
 				Name:        "metrics_endpoint",
@@ -220,16 +340,145 @@ func setupHealthChecks(cfg *config.Config) {
 			Status:      health.Healthy,
 			LastCheck:   time.Now(),
 		}, nil
+	}
+}
+
+// healthMetricsURL returns the URL probed by the metrics_endpoint check for
+// a metrics server listening on addr and serving path. A wildcard listen
+// address is probed through localhost.
+func healthMetricsURL(cfg *config.Config, addr, path string) (string, error) {
+	if cfg.Health.MetricsURL != "" {
+		return cfg.Health.MetricsURL, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid metrics address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path), nil
+}
+
+// relayEndpoint returns the relay to connect to on attempt n, cycling
+// through the primary server and its failover endpoints
+func relayEndpoint(cfg *config.Config, n int) (string, int) {
+	i := n % (len(cfg.Server.Failover) + 1)
+	if i == 0 {
+		return cfg.Server.Host, cfg.Server.Port
+	}
+	host, portStr, err := net.SplitHostPort(cfg.Server.Failover[i-1])
+	if err != nil {
+		return cfg.Server.Host, cfg.Server.Port
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return cfg.Server.Host, cfg.Server.Port
+	}
+	return host, port
+}
+
+// labelPrefix formats labels as sorted key=value fields for log lines
+func labelPrefix(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q ", name, labels[name])
+	}
+	return b.String()
+}
+
+// startMetricsSink starts pushing metrics to StatsD if it is enabled in config
+func startMetricsSink(cfg *config.Config) (*metrics.Pusher, error) {
+	if !cfg.Metrics.StatsD.Enabled {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(cfg.Metrics.StatsD.FlushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd flush interval: %w", err)
+	}
+
+	sink, err := metrics.NewStatsDSink(metrics.StatsDConfig{
+		Address: cfg.Metrics.StatsD.Address,
+		Prefix:  cfg.Metrics.StatsD.Prefix,
+		Tags:    cfg.Metrics.StatsD.Tags,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Start health checker
-	healthChecker.Start()
+	pusher := metrics.NewPusher(metrics.LabeledGatherer(prometheus.DefaultGatherer, cfg.Labels), sink, interval)
+	pusher.Start()
+	log.Printf("Pushing metrics to StatsD at %s every %v", cfg.Metrics.StatsD.Address, interval)
+	return pusher, nil
+}
+
+// stopMetricsSink flushes and closes the metrics pusher if one is running
+func stopMetricsSink(pusher *metrics.Pusher) {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.Stop(); err != nil {
+		log.Printf("Error stopping metrics sink: %v", err)
+	}
+}
+
+// startWebhooks creates the webhook emitter if webhooks are enabled
+func startWebhooks(cfg *config.Config) (*webhook.Emitter, error) {
+	if !cfg.Webhooks.Enabled {
+		return nil, nil
+	}
+
+	timeout, err := time.ParseDuration(cfg.Webhooks.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook timeout: %w", err)
+	}
+
+	emitter, err := webhook.NewEmitter(webhook.Config{
+		URL:        cfg.Webhooks.URL,
+		Secret:     cfg.Webhooks.Secret,
+		Events:     cfg.Webhooks.Events,
+		QueueSize:  cfg.Webhooks.QueueSize,
+		MaxRetries: cfg.Webhooks.MaxRetries,
+		Timeout:    timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Posting lifecycle events to %s", cfg.Webhooks.URL)
+	return emitter, nil
+}
+
+// stopWebhooks delivers queued webhooks, giving up after webhookFlushTimeout
+func stopWebhooks(emitter *webhook.Emitter) {
+	if emitter == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookFlushTimeout)
+	defer cancel()
+	if err := emitter.Close(ctx); err != nil {
+		log.Printf("Abandoned undelivered webhooks: %v", err)
+	}
 }
 
 func main() {
 	// Если есть аргументы командной строки, обрабатываем их как команды
 	if len(os.Args) > 1 {
 		if err := parseCommand(); err != nil {
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.code)
+			}
 			log.Fatalf("Command error: %v", err)
 		}
 		return
@@ -269,7 +518,17 @@ func main() {
 	}
 
 	// Setup health checks
-	setupHealthChecks(cfg)
+	metricsURL, err := healthMetricsURL(cfg, *metricsAddr, "/metrics")
+	if err != nil {
+		log.Fatalf("Failed to set up health checks: %v", err)
+	}
+	setupHealthChecks(cfg, metricsURL)
+
+	pusher, err := startMetricsSink(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start metrics sink: %v", err)
+	}
+	defer stopMetricsSink(pusher)
 
 	// Запуск метрик и health check
 	metricsServer := &http.Server{
@@ -282,6 +541,7 @@ func main() {
 		http.Handle("/health", http.HandlerFunc(healthHandler))
 		http.Handle("/ready", http.HandlerFunc(readyHandler))
 		http.Handle("/live", http.HandlerFunc(liveHandler))
+		http.Handle("/state", http.HandlerFunc(stateHandler))
 		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Printf("Failed to start metrics server: %v", err)
 		}
@@ -291,7 +551,7 @@ func main() {
 
 	var tlsConfig *tls.Config
 	if cfg.TLS.Enabled {
-		tlsConfig, err = relay.NewTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+		tlsConfig, err = relay.TLSConfigFromConfig(cfg)
 		if err != nil {
 			log.Fatalf("Failed to create TLS config: %v", err)
 		}
@@ -304,82 +564,62 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handshakeLimiter := relay.NewHandshakeLimiter(cfg.Limits.MaxConcurrentHandshakes)
+	connectErr := make(chan error, 1)
 	go func() {
-		retries := 0
-		delay := initialDelaySec
-		for {
-			start := time.Now()
+		connectErr <- relay.ReconnectWithBackoff(ctx, reconnectBackoff(cfg), func() error {
+			start := reconnectClock.Now()
 			client := relay.NewClient(cfg.TLS.Enabled, tlsConfig)
+			client.SetHandshakeLimiter(handshakeLimiter)
 			relayClient = client // Set global variable for health checks
 
 			if err := client.Connect(cfg.Server.Host, cfg.Server.Port); err != nil {
-				log.Printf("Failed to connect to relay server: %v", err)
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
-				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
-				continue
+				return fmt.Errorf("failed to connect to relay server: %w", err)
 			}
-			retries = 0
-			delay = initialDelaySec
-			defer func() {
-				if err := client.Close(); err != nil {
-					log.Printf("Error closing client: %v", err)
-				}
-			}()
 
-			if err := client.Handshake(cfg.Server.JWTToken); err != nil {
-				log.Printf("Handshake failed: %v", err)
+			handshakeCtx, cancelHandshake := context.WithTimeout(ctx, relay.HandshakeTimeout)
+			err := client.HandshakeContext(handshakeCtx, cfg.Server.JWTToken)
+			cancelHandshake()
+			if err != nil {
 				if err := client.Close(); err != nil {
 					log.Printf("Error closing client: %v", err)
 				}
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
-				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
-				continue
+				return fmt.Errorf("handshake failed: %w", err)
 			}
 
-			log.Printf("Connected successfully in %v", time.Since(start))
+			log.Printf("Connected successfully in %v", reconnectClock.Since(start))
 
 			// Создание туннеля
 			tunnelID, err := client.CreateTunnel(localPort, remoteHost, remotePort)
 			if err != nil {
-				log.Printf("Failed to create tunnel: %v", err)
 				if err := client.Close(); err != nil {
 					log.Printf("Error closing client: %v", err)
 				}
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
-				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
-				continue
+				return fmt.Errorf("failed to create tunnel: %w", err)
 			}
 
 			log.Printf("Tunnel created: %s -> %s:%d", tunnelID, remoteHost, remotePort)
-
-			// Ожидание сигнала завершения
-			<-sigChan
-			log.Println("Shutting down...")
-			if err := client.Close(); err != nil {
-				log.Printf("Error closing client: %v", err)
-			}
-			return
-		}
+			return nil
+		})
 	}()
 
 	// Ожидание сигнала завершения
-	<-sigChan
+	select {
+	case err := <-connectErr:
+		if err != nil {
+			log.Fatalf("Giving up on the relay: %v", err)
+		}
+		<-sigChan
+	case <-sigChan:
+	}
+	cancel()
 	log.Println("Shutting down...")
+	if relayClient != nil {
+		shutdownClient(relayClient, cfg)
+	}
 
 	// Stop health checker
 	if healthChecker != nil {
@@ -387,6 +627,101 @@ func main() {
 	}
 }
 
+// reconnectBackoff returns the backoff between attempts to reach the relay
+// configured in cfg
+func reconnectBackoff(cfg *config.Config) relay.BackoffConfig {
+	backoff := relay.DefaultBackoffConfig()
+	// Zero retries forever in the config, but means no retries here
+	backoff.MaxRetries = cfg.Reconnect.MaxRetries
+	if backoff.MaxRetries <= 0 {
+		backoff.MaxRetries = -1
+	}
+	if d, err := time.ParseDuration(cfg.Reconnect.InitialDelay); err == nil {
+		backoff.InitialDelay = d
+	}
+	if d, err := time.ParseDuration(cfg.Reconnect.MaxDelay); err == nil {
+		backoff.MaxDelay = d
+	}
+	if cfg.Reconnect.Jitter != 0 {
+		backoff.Jitter = cfg.Reconnect.Jitter
+	}
+	backoff.Clock = reconnectClock
+	backoff.OnRetry = func(attempt int, err error, delay time.Duration) {
+		log.Printf("Attempt %d failed: %v", attempt, err)
+		log.Printf("Retrying in %v...", delay.Round(time.Millisecond))
+		connectionEvents.Record(relay.ConnectionEvent{
+			Type:    relay.ConnectionEventReconnect,
+			Attempt: attempt,
+			DelayMs: float64(delay) / float64(time.Millisecond),
+			Error:   err.Error(),
+		})
+	}
+	return backoff
+}
+
+// connectRelay connects client to the relay endpoint with the given index,
+// authenticates and creates the tunnels. The client is closed again if a
+// step after connecting fails.
+func connectRelay(ctx context.Context, client *relay.Client, cfg *config.Config, endpoint int, tunnels []tunnelSpec) error {
+	host, port := relayEndpoint(cfg, endpoint)
+	start := reconnectClock.Now()
+	if err := client.Connect(host, port); err != nil {
+		return fmt.Errorf("failed to connect to relay server: %w", err)
+	}
+
+	handshakeCtx, cancelHandshake := context.WithTimeout(ctx, relay.HandshakeTimeout)
+	err := client.HandshakeContext(handshakeCtx, cfg.Server.JWTToken)
+	cancelHandshake()
+	if err != nil {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Printf("Error closing client after handshake failure: %v", closeErr)
+		}
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	log.Printf("Connected successfully in %v", reconnectClock.Since(start))
+	client.StartHeartbeat()
+	webhooks.Emit(webhook.EventConnected, map[string]interface{}{
+		"host": host,
+		"port": port,
+	})
+
+	// Создание туннелей
+	for _, t := range tunnels {
+		createCtx, cancelCreate := context.WithTimeout(ctx, relay.TunnelCreateTimeout)
+		tunnelID, err := client.CreateBoundTunnel(createCtx, t.BindAddress, t.LocalPort, t.RemoteHost, t.RemotePort)
+		cancelCreate()
+		if err != nil {
+			if closeErr := client.Close(); closeErr != nil {
+				log.Printf("Error closing client after tunnel creation failure: %v", closeErr)
+			}
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+
+		log.Printf("Tunnel created: %s -> %s:%d", tunnelID, t.RemoteHost, t.RemotePort)
+		webhooks.Emit(webhook.EventTunnelCreated, map[string]interface{}{
+			"tunnel_id":   tunnelID,
+			"local_port":  t.LocalPort,
+			"remote_host": t.RemoteHost,
+			"remote_port": t.RemotePort,
+		})
+	}
+	return nil
+}
+
+// cliTunnels returns the tunnels requested on the command line of cmd
+func cliTunnels(cmd *cobra.Command) ([]tunnelSpec, error) {
+	if len(tunnelFlags) == 0 {
+		return []tunnelSpec{{BindAddress: defaultBindAddress, LocalPort: localPort, RemoteHost: remoteHost, RemotePort: remotePort}}, nil
+	}
+	for _, name := range []string{"local-port", "remote-host", "remote-port"} {
+		if cmd.Flags().Changed(name) {
+			return nil, fmt.Errorf("--%s cannot be combined with --tunnel", name)
+		}
+	}
+	return parseTunnelSpecs(tunnelFlags)
+}
+
 func parseCommand() error {
 	rootCmd := &cobra.Command{
 		Use:     "cloudbridge-client",
@@ -397,28 +732,135 @@ func parseCommand() error {
 	}
 
 	// Add flags
-	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path")
+	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path or http(s):// URL of a config server")
+	rootCmd.Flags().StringVar(&configToken, "config-token", "", "Bearer token for the config server (default $CLOUDBRIDGE_CONFIG_TOKEN)")
+	rootCmd.Flags().StringVar(&configCA, "config-ca", "", "CA bundle used to verify the config server")
+	rootCmd.Flags().StringVar(&configCache, "config-cache", config.DefaultRemoteCachePath, "Local cache of the remote configuration")
+	rootCmd.Flags().BoolVar(&configInsecure, "config-insecure", false, "Allow an http:// config URL; the config token is then sent unencrypted")
 	rootCmd.Flags().StringVarP(&token, "token", "t", "", "JWT token for authentication")
 	rootCmd.Flags().StringVarP(&tunnelID, "tunnel-id", "i", "tunnel_001", "Tunnel ID")
 	rootCmd.Flags().IntVarP(&localPort, "local-port", "l", 3389, "Local port to bind")
 	rootCmd.Flags().StringVarP(&remoteHost, "remote-host", "r", "192.168.1.100", "Remote host")
 	rootCmd.Flags().IntVarP(&remotePort, "remote-port", "p", 3389, "Remote port")
+	rootCmd.Flags().StringArrayVar(&tunnelFlags, "tunnel", nil, "Tunnel to create, like ssh -L: "+tunnelSpecSyntax+" (repeatable)")
 	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	rootCmd.Flags().BoolVar(&diagnoseOnly, "diagnose", false, "Connect once, print how long each handshake phase took and exit")
+	rootCmd.Flags().BoolVar(&observerMode, "observer", false, "Connect without creating tunnels, report on the connection and exit non-zero once it is lost")
+	rootCmd.Flags().BoolVar(&meshDebug, "mesh-debug", false, "Run the mesh client and serve its event log on the metrics server at /debug/mesh/events")
+	rootCmd.Flags().DurationVar(&observerInterval, "observer-interval", defaultObserverInterval, "How often an observer reports on the connection")
 
 	// Mark required flags
 	if err := rootCmd.MarkFlagRequired("token"); err != nil {
 		return fmt.Errorf("failed to mark token flag as required: %w", err)
 	}
 
+	rootCmd.AddCommand(newStatusCommand())
+	rootCmd.AddCommand(newSelftestCommand())
+	rootCmd.AddCommand(newExecCommand())
+	rootCmd.AddCommand(newProtocolsCommand())
+
 	return rootCmd.Execute()
 }
 
+// newStatusCommand creates the command that prints the state of a running client
+func newStatusCommand() *cobra.Command {
+	var addr string
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Print the runtime state of a running client as JSON",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(fmt.Sprintf("http://%s/state", addr))
+			if err != nil {
+				return fmt.Errorf("failed to query client state: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("client returned status %d", resp.StatusCode)
+			}
+
+			var state relay.StateSnapshot
+			if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+				return fmt.Errorf("failed to decode client state: %w", err)
+			}
+
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(state)
+		},
+	}
+
+	cmd.Flags().StringVarP(&addr, "addr", "a", "localhost:9090", "Address of the client's metrics server")
+
+	return cmd
+}
+
+// newSelftestCommand creates the command that checks every enabled subsystem
+func newSelftestCommand() *cobra.Command {
+	var (
+		selftestConfig string
+		jsonOutput     bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Check that all enabled subsystems work in this environment",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(selftestConfig)
+			if err != nil {
+				return fmt.Errorf("failed to load configuration: %w", err)
+			}
+
+			results := selftest.Run(cmd.Context(), cfg, selftest.DefaultChecks())
+
+			if jsonOutput {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(results); err != nil {
+					return err
+				}
+			} else {
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "SUBSYSTEM\tSTATUS\tTIME\tDETAILS")
+				for _, result := range results {
+					fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", result.Name, result.Status,
+						result.Duration.Round(time.Microsecond), result.Message)
+				}
+				w.Flush()
+			}
+
+			if !selftest.Passed(results) {
+				return fmt.Errorf("selftest failed")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&selftestConfig, "config", "c", "", "Configuration file path")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print results as JSON")
+
+	return cmd
+}
+
 func run(cmd *cobra.Command, args []string) error {
 	// Log platform information
 	log.Printf("Running on %s/%s", runtime.GOOS, runtime.GOARCH)
 
+	tunnels, err := cliTunnels(cmd)
+	if err != nil {
+		return err
+	}
+	if observerMode {
+		if len(tunnelFlags) > 0 {
+			return fmt.Errorf("--tunnel cannot be combined with --observer")
+		}
+		tunnels = nil
+	}
+
 	// Load configuration
-	cfg, err := config.LoadConfig(configFile)
+	cfg, err := loadConfig(configFile)
 	if err != nil {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
@@ -427,25 +869,77 @@ func run(cmd *cobra.Command, args []string) error {
 	if token != "" {
 		cfg.Server.JWTToken = token // For JWT auth, secret is the token
 	}
+	if diagnoseOnly {
+		return diagnose(cmd.OutOrStdout(), cfg)
+	}
+	liveConfig.Store(cfg)
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	log.SetPrefix(labelPrefix(cfg.Labels))
+
+	webhooks, err = startWebhooks(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to start webhooks: %w", err)
+	}
+	defer stopWebhooks(webhooks)
+
+	if cfg.Logging.ConnectionEvents != "" {
+		connectionEvents, err = relay.OpenConnectionEventLog(cfg.Logging.ConnectionEvents)
+		if err != nil {
+			return err
+		}
+		defer connectionEvents.Close()
+	}
+
+	tunnelScheduler = tunnel.NewFairScheduler(nil, tunnel.DefaultSchedulerConfig())
+	tunnelScheduler.Start()
+	defer tunnelScheduler.Close()
 
 	// Setup health checks
-	setupHealthChecks(cfg)
+	metricsURL := ""
+	if cfg.Metrics.Enabled {
+		metricsURL, err = healthMetricsURL(cfg, fmt.Sprintf(":%d", cfg.Metrics.Port), cfg.Metrics.Path)
+		if err != nil {
+			return fmt.Errorf("failed to set up health checks: %w", err)
+		}
+	}
+	setupHealthChecks(cfg, metricsURL)
+
+	// Start push-based metrics delivery if configured
+	pusher, err := startMetricsSink(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics sink: %w", err)
+	}
+	defer stopMetricsSink(pusher)
+
+	if meshDebug {
+		if !cfg.Metrics.Enabled {
+			log.Printf("Mesh debug endpoints are only served with metrics enabled")
+		}
+		meshClient = p2p.NewMeshClient(cfg)
+		if err := meshClient.Start(); err != nil {
+			meshClient = nil
+			return fmt.Errorf("failed to start mesh client: %w", err)
+		}
+		defer func() {
+			if err := meshClient.Stop(); err != nil {
+				log.Printf("Error stopping mesh client: %v", err)
+			}
+			meshClient = nil
+		}()
+	}
 
 	// Start HTTP server for metrics and health checks
 	if cfg.Metrics.Enabled {
 		metricsAddr := fmt.Sprintf(":%d", cfg.Metrics.Port)
 		metricsServer := &http.Server{
 			Addr:         metricsAddr,
+			Handler:      newMetricsMux(cfg),
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		}
+		defer metricsServer.Close()
 
 		go func() {
-			http.Handle(cfg.Metrics.Path, promhttp.Handler())
-			http.Handle(cfg.Health.Path, http.HandlerFunc(healthHandler))
-			http.Handle("/ready", http.HandlerFunc(readyHandler))
-			http.Handle("/live", http.HandlerFunc(liveHandler))
-
 			log.Printf("Starting metrics server on %s", metricsAddr)
 			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Printf("Failed to start metrics server: %v", err)
@@ -453,22 +947,24 @@ func run(cmd *cobra.Command, args []string) error {
 		}()
 	}
 
-	// Create client
-	client, err := relay.NewClientFromConfig(cfg)
-	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
-	}
-	relayClient = client // Set global variable for health checks
-	defer func() {
-		if err := client.Close(); err != nil {
-			log.Printf("Error closing client: %v", err)
-		}
-	}()
-
 	// Set up signal handling for graceful shutdown
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// lost receives the session whose connection to the relay was lost
+	lost := make(chan relaySession)
+	onLost := func(s relaySession) {
+		select {
+		case lost <- s:
+		case <-ctx.Done():
+		}
+	}
+	session, err := newSession(cfg, onLost)
+	if err != nil {
+		return err
+	}
+	sessionConfig := cfg
+
 	sigChan := make(chan os.Signal, 1)
 	if runtime.GOOS == "windows" {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
@@ -476,74 +972,112 @@ func run(cmd *cobra.Command, args []string) error {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	}
 
-	go func() {
-		retries := 0
-		delay := initialDelaySec
-		for {
-			start := time.Now()
-			if err := client.Connect(cfg.Server.Host, cfg.Server.Port); err != nil {
-				log.Printf("Failed to connect to relay server: %v", err)
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
-				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
-				continue
-			}
-			retries = 0
-			delay = initialDelaySec
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+	reloaded := make(chan struct{}, 1)
+	go reloadConfig(reloadChan, reloaded)
 
-			if err := client.Handshake(cfg.Server.JWTToken); err != nil {
-				log.Printf("Handshake failed: %v", err)
-				if closeErr := client.Close(); closeErr != nil {
-					log.Printf("Error closing client after handshake failure: %v", closeErr)
-				}
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
+	endpoint := 0
+	connect := func(ctx context.Context, session relaySession, cfg *config.Config) <-chan error {
+		connectErr := make(chan error, 1)
+		go func() {
+			connectErr <- relay.ReconnectWithBackoff(ctx, reconnectBackoff(cfg), func() error {
+				for tried := 0; ; tried++ {
+					err := session.connect(ctx, cfg, endpoint, tunnels)
+					// A relay that never says hello is likely the
+					// wrong service; move on to the next endpoint
+					// right away
+					if errors.Is(err, relay.ErrNoServerHello) && len(cfg.Server.Failover) > 0 {
+						endpoint++
+						if tried < len(cfg.Server.Failover) {
+							log.Printf("%v; trying next relay endpoint...", err)
+							continue
+						}
+					}
+					return err
 				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
-				continue
-			}
-
-			log.Printf("Connected successfully in %v", time.Since(start))
+			})
+		}()
+		return connectErr
+	}
+	connectCtx, cancelConnect := context.WithCancel(ctx)
+	connectErr := connect(connectCtx, session, sessionConfig)
+
+	// replace swaps session for a new one with the live configuration and
+	// connects it. The metrics server, webhooks and logging keep the
+	// settings they started with.
+	replace := func() error {
+		next := liveConfig.Load()
+		nextSession, err := newSession(next, onLost)
+		if err != nil {
+			return err
+		}
+		cancelConnect()
+		if connectErr != nil {
+			<-connectErr
+		}
+		closeSession(session, sessionConfig)
+		session, sessionConfig = nextSession, next
+		connectCtx, cancelConnect = context.WithCancel(ctx)
+		connectErr = connect(connectCtx, session, sessionConfig)
+		return nil
+	}
 
-			// Создание туннеля
-			tunnelID, err := client.CreateTunnel(localPort, remoteHost, remotePort)
+	// Ожидание сигнала завершения
+	for running := true; running; {
+		select {
+		case err := <-connectErr:
+			connectErr = nil
 			if err != nil {
-				log.Printf("Failed to create tunnel: %v", err)
-				if closeErr := client.Close(); closeErr != nil {
-					log.Printf("Error closing client after tunnel creation failure: %v", closeErr)
+				cancelConnect()
+				if healthChecker != nil {
+					healthChecker.Stop()
 				}
-				retries++
-				if retries > maxRetries {
-					log.Fatalf("Max reconnect attempts reached. Exiting.")
+				return fmt.Errorf("failed to connect to relay: %w", err)
+			}
+			if observerMode {
+				if err := observe(ctx, relayClient, observerInterval, sigChan); err != nil {
+					cancelConnect()
+					relayClient.Close()
+					if healthChecker != nil {
+						healthChecker.Stop()
+					}
+					return fmt.Errorf("observer: %w", err)
 				}
-				log.Printf("Retrying in %d seconds...", delay)
-				time.Sleep(time.Duration(delay) * time.Second)
-				delay = min(delay*2, maxDelaySec)
+				running = false
+			}
+		case <-reloaded:
+			log.Printf("Applying reloaded configuration")
+			if err := replace(); err != nil {
+				log.Printf("Failed to apply reloaded configuration: %v", err)
+			}
+		case lostSession := <-lost:
+			// The pool reconnects its connections itself; a lost
+			// client is replaced and connected again with backoff
+			if lostSession != session {
 				continue
 			}
-
-			log.Printf("Tunnel created: %s -> %s:%d", tunnelID, remoteHost, remotePort)
-
-			// Ожидание сигнала завершения
-			<-sigChan
-			log.Println("Shutting down...")
-			if err := client.Close(); err != nil {
-				log.Printf("Error closing client: %v", err)
+			log.Printf("Reconnecting to the relay...")
+			if err := replace(); err != nil {
+				cancelConnect()
+				if healthChecker != nil {
+					healthChecker.Stop()
+				}
+				return fmt.Errorf("failed to reconnect to relay: %w", err)
 			}
-			return
+		case <-sigChan:
+			running = false
 		}
-	}()
-
-	// Ожидание сигнала завершения
-	<-sigChan
+	}
+	cancelConnect()
+	cancel()
+	if connectErr != nil {
+		<-connectErr
+	}
 	log.Println("Shutting down...")
+	closeSession(session, sessionConfig)
+	webhooks.Emit(webhook.EventDisconnected, map[string]interface{}{"reason": "shutdown"})
 
 	// Stop health checker
 	if healthChecker != nil {
@@ -553,9 +1087,119 @@ func run(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// newMetricsMux returns the handler of the metrics server started by run.
+// Each run gets a mux of its own, so running it again does not register the
+// handlers twice. The mesh debug endpoints are served while a mesh client
+// runs.
+func newMetricsMux(cfg *config.Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	gatherer := metrics.LabeledGatherer(prometheus.DefaultGatherer, cfg.Labels)
+	mux.Handle(cfg.Metrics.Path, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}),
+	))
+	mux.Handle(cfg.Health.Path, http.HandlerFunc(healthHandler))
+	mux.Handle("/ready", http.HandlerFunc(readyHandler))
+	mux.Handle("/live", http.HandlerFunc(liveHandler))
+	mux.Handle("/state", http.HandlerFunc(stateHandler))
+	if meshClient != nil {
+		mux.Handle("/debug/mesh/", meshClient.DebugHandler())
+	}
+	return mux
+}
+
+// defaultClientMetrics registers the relay client metrics with the default
+// registry on first use; registering them again would panic
+var defaultClientMetrics = sync.OnceValue(func() *metrics.Metrics {
+	return metrics.NewMetrics(prometheus.DefaultRegisterer)
+})
+
+// newSession creates what run keeps connected to the relay with cfg: a pool
+// of connections when server.pool_size asks for one, a single client
+// otherwise. Both go through the same lifecycle. onLost is called with a
+// single client whose connection is lost.
+func newSession(cfg *config.Config, onLost func(relaySession)) (relaySession, error) {
+	if cfg.Server.PoolSize > 1 && !observerMode {
+		relayClient = nil
+		return &poolSession{}, nil
+	}
+
+	client, err := relay.NewClientFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	relayClient = client // Set global variable for health checks
+	relayPool = nil
+	client.SetMetrics(defaultClientMetrics())
+	client.SetEventLog(connectionEvents)
+	client.SetScheduler(tunnelScheduler)
+	session := clientSession{client: client}
+	client.SetDisconnectHandler(func(err error) {
+		log.Printf("Connection to relay lost: %v", err)
+		webhooks.Emit(webhook.EventDisconnected, map[string]interface{}{"error": err.Error()})
+		onLost(session)
+	})
+	return session, nil
+}
+
+// closeSession shuts session down with the grace period of cfg and reports
+// its tunnels closed
+func closeSession(session relaySession, cfg *config.Config) {
+	tunnelIDs := session.tunnelIDs()
+	session.shutdown(cfg)
+	for _, tunnelID := range tunnelIDs {
+		webhooks.Emit(webhook.EventTunnelClosed, map[string]interface{}{"tunnel_id": tunnelID})
+	}
+}
+
+// shutdownClient shuts the client down, giving requests in flight the
+// configured grace period before the connection is closed forcibly
+func shutdownClient(client *relay.Client, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(cfg))
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v", err)
+	}
+}
+
+// loadConfig loads the configuration from a file or, for http(s) URLs, from
+// a config server
+func loadConfig(path string) (*config.Config, error) {
+	if !config.IsRemote(path) {
+		return config.LoadConfig(path)
+	}
+
+	authToken := configToken
+	if authToken == "" {
+		authToken = os.Getenv("CLOUDBRIDGE_CONFIG_TOKEN")
+	}
+	return config.LoadRemoteConfig(config.RemoteSource{
+		URL:           path,
+		Token:         authToken,
+		CAFile:        configCA,
+		CachePath:     configCache,
+		AllowInsecure: configInsecure,
+	})
+}
+
+// reloadConfig loads the configuration again on every signal received from
+// reloadChan and notifies reloaded once the new configuration is stored
+func reloadConfig(reloadChan <-chan os.Signal, reloaded chan<- struct{}) {
+	for range reloadChan {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+			continue
+		}
+		if token != "" {
+			cfg.Server.JWTToken = token
+		}
+		liveConfig.Store(cfg)
+		log.Printf("Configuration reloaded")
+		select {
+		case reloaded <- struct{}{}:
+		default:
+			// A reload is already pending and will pick up cfg
+		}
 	}
-	return b
 }
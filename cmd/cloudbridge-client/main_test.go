@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/p2p"
+)
+
+func TestHealthMetricsURL(t *testing.T) {
+	cfg := &config.Config{}
+
+	tests := []struct {
+		addr string
+		path string
+		want string
+	}{
+		{":9100", "/metrics", "http://localhost:9100/metrics"},
+		{"0.0.0.0:9090", "/metrics", "http://localhost:9090/metrics"},
+		{"127.0.0.1:8080", "/prom", "http://127.0.0.1:8080/prom"},
+		{"[::]:9090", "/metrics", "http://localhost:9090/metrics"},
+	}
+	for _, tt := range tests {
+		got, err := healthMetricsURL(cfg, tt.addr, tt.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.addr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.addr, tt.want, got)
+		}
+	}
+
+	if _, err := healthMetricsURL(cfg, "9090", "/metrics"); err == nil {
+		t.Error("expected error for address without port separator")
+	}
+
+	cfg.Health.MetricsURL = "http://metrics.internal/metrics"
+	if got, _ := healthMetricsURL(cfg, ":9090", "/metrics"); got != cfg.Health.MetricsURL {
+		t.Errorf("expected configured override, got %s", got)
+	}
+}
+
+func TestReloadConfigFromServer(t *testing.T) {
+	var port int32 = 9001
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "server:\n  host: relay.example.com\n  port: %d\n", atomic.LoadInt32(&port))
+	}))
+	defer server.Close()
+
+	configFile = server.URL
+	configCache = ""
+	configInsecure = true
+	defer func() { configFile, configInsecure = "", false }()
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	liveConfig.Store(cfg)
+
+	atomic.StoreInt32(&port, 9002)
+	reloadChan := make(chan os.Signal, 1)
+	reloaded := make(chan struct{}, 1)
+	go reloadConfig(reloadChan, reloaded)
+	defer close(reloadChan)
+	reloadChan <- syscall.SIGHUP
+
+	deadline := time.Now().Add(2 * time.Second)
+	for liveConfig.Load().Server.Port != 9002 {
+		if time.Now().After(deadline) {
+			t.Fatalf("configuration was not reloaded, port %d", liveConfig.Load().Server.Port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// run reconnects with the reloaded configuration when notified
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reload was not announced")
+	}
+}
+
+func TestLabelPrefix(t *testing.T) {
+	if prefix := labelPrefix(nil); prefix != "" {
+		t.Errorf("expected empty prefix, got %q", prefix)
+	}
+	prefix := labelPrefix(map[string]string{"role": "edge", "region": "eu west"})
+	if prefix != `region="eu west" role="edge" ` {
+		t.Errorf("unexpected prefix %q", prefix)
+	}
+}
+
+func TestRelayEndpoint(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Host = "relay"
+	cfg.Server.Port = 8080
+	cfg.Server.Failover = []string{"backup:9090"}
+
+	for n, want := range []string{"relay:8080", "backup:9090", "relay:8080"} {
+		host, port := relayEndpoint(cfg, n)
+		if got := fmt.Sprintf("%s:%d", host, port); got != want {
+			t.Errorf("attempt %d: expected %s, got %s", n, want, got)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Reconnect.MaxRetries = -1
+	cfg.Reconnect.InitialDelay = "2s"
+	cfg.Reconnect.MaxDelay = "5m"
+	cfg.Reconnect.Jitter = -1
+
+	backoff := reconnectBackoff(cfg)
+	if backoff.MaxRetries != -1 || backoff.InitialDelay != 2*time.Second || backoff.MaxDelay != 5*time.Minute || backoff.Jitter != -1 {
+		t.Errorf("unexpected backoff: %+v", backoff)
+	}
+
+	// Zero retries forever as well
+	cfg.Reconnect.MaxRetries = 0
+	if backoff := reconnectBackoff(cfg); backoff.MaxRetries != -1 {
+		t.Errorf("expected max_retries 0 to retry forever, got %d", backoff.MaxRetries)
+	}
+}
+
+func TestNewMetricsMux(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Metrics.Path = "/prom"
+	cfg.Health.Path = "/health"
+
+	// Building the mux again, as a second run does, must not panic
+	newMetricsMux(cfg)
+	mux := newMetricsMux(cfg)
+
+	for _, path := range []string{"/prom", "/live"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", path, rec.Code)
+		}
+	}
+	if defaultClientMetrics() != defaultClientMetrics() {
+		t.Error("expected the client metrics to be registered once")
+	}
+
+	// The mesh debug endpoints are only mounted while a mesh client runs
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/mesh/events", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected no mesh debug endpoint, got status %d", rec.Code)
+	}
+	meshClient = p2p.NewMeshClient(cfg)
+	defer func() { meshClient = nil }()
+	rec = httptest.NewRecorder()
+	newMetricsMux(cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/mesh/events", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the mesh debug endpoint of a mesh without topology, got status %d", rec.Code)
+	}
+}
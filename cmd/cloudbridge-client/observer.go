@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/health"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+// defaultObserverInterval is how often an observer reports by default
+const defaultObserverInterval = 30 * time.Second
+
+// errObservedConnectionLost is returned by observe when the relay connection
+// goes away
+var errObservedConnectionLost = errors.New("connection to relay lost")
+
+// observe watches an established connection that carries no tunnels and
+// logs a report on it every interval. It returns nil once stop receives a
+// signal or ctx is done, and an error as soon as the connection is lost, so
+// a synthetic monitor can alert on the exit status.
+func observe(ctx context.Context, client *relay.Client, interval time.Duration, stop <-chan os.Signal) error {
+	if interval <= 0 {
+		interval = defaultObserverInterval
+	}
+	lost := client.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Print(observerReport(client))
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-lost:
+			return errObservedConnectionLost
+		case <-ticker.C:
+			log.Print(observerReport(client))
+		}
+	}
+}
+
+// observerReport describes the relay and the quality of the connection to it
+func observerReport(client *relay.Client) string {
+	state, _ := client.ExportState()
+	heartbeats := client.HeartbeatStats()
+	status := health.Unknown
+	if healthChecker != nil {
+		status = healthChecker.GetStatus()
+	}
+	return fmt.Sprintf("Observer: relay %s:%d version %s, features [%s]; heartbeats answered %d, missed %d, rtt %v (average %v); health %s",
+		state.Endpoint.Host, state.Endpoint.Port, state.Protocol.ServerVersion,
+		strings.Join(state.Protocol.ServerFeatures, ", "),
+		heartbeats.Answered, heartbeats.Missed,
+		heartbeats.LastRTT.Round(time.Microsecond), heartbeats.AverageRTT.Round(time.Microsecond), status)
+}
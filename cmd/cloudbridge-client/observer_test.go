@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+func TestObserve(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	drop := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range []map[string]interface{}{
+			{"type": relay.MessageTypeHello, "version": "2.0", "features": []string{"tls", "heartbeat"}},
+			{"type": relay.MessageTypeAuthResponse, "status": "success"},
+		} {
+			if _, err := r.ReadBytes('\n'); err != nil {
+				return
+			}
+			data, _ := json.Marshal(reply)
+			conn.Write(append(data, '\n'))
+		}
+		<-drop
+	}()
+
+	client := relay.NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if report := observerReport(client); !strings.Contains(report, "version 2.0") || !strings.Contains(report, "[tls, heartbeat]") {
+		t.Errorf("unexpected report: %s", report)
+	}
+
+	// A signal ends observing cleanly
+	stop := make(chan os.Signal, 1)
+	stop <- os.Interrupt
+	if err := observe(context.Background(), client, time.Hour, stop); err != nil {
+		t.Errorf("expected nil after a signal, got %v", err)
+	}
+
+	// So does the end of the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := observe(ctx, client, time.Hour, make(chan os.Signal)); err != nil {
+		t.Errorf("expected nil after the context is done, got %v", err)
+	}
+
+	// A lost connection is an error
+	result := make(chan error, 1)
+	go func() { result <- observe(context.Background(), client, time.Hour, make(chan os.Signal)) }()
+	close(drop)
+	client.ReadMessage()
+	select {
+	case err := <-result:
+		if !errors.Is(err, errObservedConnectionLost) {
+			t.Errorf("expected errObservedConnectionLost, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("observer did not notice the lost connection")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/2gc-dev/cloudbridge-client/pkg/webhook"
+)
+
+// relayPool is the pool of relay connections when server.pool_size is above
+// one; nil otherwise
+var relayPool *relay.ClientPool
+
+// relaySession is what run keeps connected to the relay: a single client or
+// a pool of connections
+type relaySession interface {
+	// connect connects to the relay endpoint with the given index,
+	// authenticates and creates the tunnels
+	connect(ctx context.Context, cfg *config.Config, endpoint int, tunnels []tunnelSpec) error
+	// tunnelIDs returns the IDs of the tunnels created
+	tunnelIDs() []string
+	// shutdown closes the connections, giving requests in flight the
+	// grace period of cfg
+	shutdown(cfg *config.Config)
+}
+
+// clientSession is a single relay client
+type clientSession struct {
+	client *relay.Client
+}
+
+func (s clientSession) connect(ctx context.Context, cfg *config.Config, endpoint int, tunnels []tunnelSpec) error {
+	return connectRelay(ctx, s.client, cfg, endpoint, tunnels)
+}
+
+func (s clientSession) tunnelIDs() []string {
+	state, _ := s.client.ExportState()
+	ids := make([]string, 0, len(state.Tunnels))
+	for _, t := range state.Tunnels {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func (s clientSession) shutdown(cfg *config.Config) {
+	shutdownClient(s.client, cfg)
+}
+
+// poolSession is a pool of cfg.Server.PoolSize relay connections the
+// tunnels are spread across. The pool reconnects lost connections itself.
+type poolSession struct {
+	pool    *relay.ClientPool
+	tunnels []string
+}
+
+// connect starts a new pool, which only fails if none of its connections
+// could be established
+func (s *poolSession) connect(ctx context.Context, cfg *config.Config, endpoint int, tunnels []tunnelSpec) error {
+	host, port := relayEndpoint(cfg, endpoint)
+	pool, err := newRelayPool(cfg, host, port)
+	if err != nil {
+		return fmt.Errorf("failed to create relay pool: %w", err)
+	}
+
+	start := reconnectClock.Now()
+	if err := pool.Start(ctx); err != nil {
+		return fmt.Errorf("failed to connect to relay server: %w", err)
+	}
+	log.Printf("Connected with a pool of %d connections in %v", cfg.Server.PoolSize, reconnectClock.Since(start))
+	webhooks.Emit(webhook.EventConnected, map[string]interface{}{
+		"host": host,
+		"port": port,
+	})
+
+	var created []string
+	for _, t := range tunnels {
+		tunnelID, err := pool.CreateTunnel(t.BindAddress, t.LocalPort, t.RemoteHost, t.RemotePort)
+		if err != nil {
+			if closeErr := pool.Close(); closeErr != nil {
+				log.Printf("Error closing pool after tunnel creation failure: %v", closeErr)
+			}
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+
+		log.Printf("Tunnel created: %s -> %s:%d", tunnelID, t.RemoteHost, t.RemotePort)
+		webhooks.Emit(webhook.EventTunnelCreated, map[string]interface{}{
+			"tunnel_id":   tunnelID,
+			"local_port":  t.LocalPort,
+			"remote_host": t.RemoteHost,
+			"remote_port": t.RemotePort,
+		})
+		created = append(created, tunnelID)
+	}
+
+	s.pool, s.tunnels = pool, created
+	relayPool = pool
+	return nil
+}
+
+func (s *poolSession) tunnelIDs() []string {
+	return s.tunnels
+}
+
+func (s *poolSession) shutdown(cfg *config.Config) {
+	if s.pool == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(cfg))
+	defer cancel()
+	if err := s.pool.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v", err)
+	}
+}
+
+// newRelayPool creates a pool of cfg.Server.PoolSize connections to the
+// relay at host and port
+func newRelayPool(cfg *config.Config, host string, port int) (*relay.ClientPool, error) {
+	handshakeLimiter := relay.NewHandshakeLimiter(cfg.Limits.MaxConcurrentHandshakes)
+	budget := relay.BufferBudgetFromConfig(cfg)
+	return relay.NewClientPool(relay.PoolConfig{
+		Size:  cfg.Server.PoolSize,
+		Host:  host,
+		Port:  port,
+		Token: cfg.Server.JWTToken,
+		NewClient: func() (*relay.Client, error) {
+			client, err := relay.NewClientFromConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			client.SetMetrics(defaultClientMetrics())
+			client.SetEventLog(connectionEvents)
+			client.SetScheduler(tunnelScheduler)
+			// The connections of the pool share one limit and one
+			// buffer budget
+			client.SetHandshakeLimiter(handshakeLimiter)
+			client.SetBufferBudget(budget)
+			return client, nil
+		},
+		Backoff: reconnectBackoff(cfg),
+		OnConnLost: func(i int, err error) {
+			webhooks.Emit(webhook.EventDisconnected, map[string]interface{}{
+				"error":           err.Error(),
+				"pool_connection": i,
+			})
+		},
+	})
+}
+
+// relayConnected reports whether the client, or any connection of the
+// pool, is connected to the relay
+func relayConnected() bool {
+	if pool := relayPool; pool != nil {
+		return pool.Connected()
+	}
+	return relayClient != nil && relayClient.IsConnected()
+}
+
+// shutdownTimeout returns the grace period of cfg for requests in flight
+// when shutting down
+func shutdownTimeout(cfg *config.Config) time.Duration {
+	grace, err := time.ParseDuration(cfg.Server.ShutdownTimeout)
+	if err != nil || grace <= 0 {
+		grace = defaultShutdownTimeout
+	}
+	return grace
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+func TestPoolSessionReportsReady(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for _, reply := range []map[string]interface{}{
+					{"type": relay.MessageTypeHello, "version": "2.0"},
+					{"type": relay.MessageTypeAuthResponse, "status": "success"},
+				} {
+					if _, err := r.ReadBytes('\n'); err != nil {
+						return
+					}
+					data, _ := json.Marshal(reply)
+					conn.Write(append(data, '\n'))
+				}
+				r.ReadBytes(0)
+			}()
+		}
+	}()
+	t.Cleanup(func() { relayPool = nil })
+
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = listener.Addr().(*net.TCPAddr).Port
+	cfg.Server.PoolSize = 2
+	cfg.Server.JWTToken = "token"
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+
+	session := &poolSession{}
+	if err := session.connect(context.Background(), cfg, 0, nil); err != nil {
+		t.Fatalf("failed to connect pool: %v", err)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("expected ready pool, got status %d", code)
+	}
+
+	session.shutdown(cfg)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected pool to be not ready after shutdown, got status %d", code)
+	}
+}
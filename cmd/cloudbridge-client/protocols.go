@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/client"
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/spf13/cobra"
+)
+
+// newProtocolsCommand creates the command that lists the transport
+// protocols and whether they can be used
+func newProtocolsCommand() *cobra.Command {
+	var (
+		probe      bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "protocols",
+		Short: "List the supported protocols and whether they can be used",
+		Long: "List the supported protocols and whether they can be used with the configuration.\n" +
+			"With --probe every enabled protocol is tried against the relay first, so a\n" +
+			"protocol the network blocks shows its failure.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(configFile)
+			if err != nil {
+				return fmt.Errorf("failed to load configuration: %w", err)
+			}
+			if token != "" {
+				cfg.Server.JWTToken = token
+			}
+			clientConfig, err := integratedClientConfig(cfg)
+			if err != nil {
+				return err
+			}
+			ic, err := client.NewIntegratedClient(clientConfig)
+			if err != nil {
+				return err
+			}
+			defer ic.Close()
+
+			if probe {
+				ic.ProbeProtocols(cmd.Context(), net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port)))
+			}
+
+			infos := ic.AvailableProtocols()
+			if jsonOutput {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(infos)
+			}
+			printProtocols(cmd.OutOrStdout(), infos)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path or http(s):// URL of a config server")
+	cmd.Flags().StringVar(&configToken, "config-token", "", "Bearer token for the config server (default $CLOUDBRIDGE_CONFIG_TOKEN)")
+	cmd.Flags().StringVar(&configCA, "config-ca", "", "CA bundle used to verify the config server")
+	cmd.Flags().BoolVar(&configInsecure, "config-insecure", false, "Allow an http:// config URL; the config token is then sent unencrypted")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "JWT token for authentication")
+	cmd.Flags().BoolVar(&probe, "probe", false, "Try every enabled protocol against the relay")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print protocols as JSON")
+
+	return cmd
+}
+
+// integratedClientConfig derives the multi-protocol client configuration
+// from cfg. Metrics and health checks are left off.
+func integratedClientConfig(cfg *config.Config) (*client.Config, error) {
+	clientConfig := client.DefaultConfig()
+	if cfg.TLS.Enabled {
+		tlsConfig, err := relay.TLSConfigFromConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS config: %w", err)
+		}
+		clientConfig.TLSConfig = tlsConfig
+		clientConfig.RelayALPN = cfg.TLS.ALPN
+	}
+	thresholds, err := cfg.QualityThresholds()
+	if err != nil {
+		return nil, err
+	}
+	clientConfig.QualityThresholds = thresholds
+	// Per-network results only help if they outlive a single run
+	clientConfig.StatsFile = cfg.Protocol.StatsFile
+	if cfg.Protocol.PerNetworkOrder {
+		clientConfig.NetworkFingerprint = protocol.NetworkFingerprint
+		if clientConfig.StatsFile == "" {
+			clientConfig.StatsFile = config.DefaultProtocolStatsPath
+		}
+	}
+	clientConfig.TenantID = cfg.Tenant.ID
+	clientConfig.Token = cfg.Server.JWTToken
+	// TLS turned off in the config is the explicit choice to authenticate
+	// in plaintext
+	clientConfig.InsecurePlaintext = !cfg.TLS.Enabled
+	clientConfig.Version = cfg.Protocol.Version
+	clientConfig.MetricsEnabled = false
+	clientConfig.HealthCheckEnabled = false
+	return clientConfig, nil
+}
+
+// printProtocols prints one row per protocol. Details give the reason a
+// protocol is unavailable, or else its last failure.
+func printProtocols(w io.Writer, infos []client.ProtocolInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROTOCOL\tBUILT-IN\tENABLED\tAVAILABLE\tDETAILS")
+	for _, info := range infos {
+		details := info.Reason
+		if details == "" && info.LastFailure != nil {
+			details = fmt.Sprintf("last failure at %s: %s", info.LastFailure.Format("15:04:05"), info.LastFailureReason)
+		}
+		if details == "" {
+			details = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Name, yesNo(info.BuiltIn), yesNo(info.Enabled), yesNo(info.Available), details)
+	}
+	tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
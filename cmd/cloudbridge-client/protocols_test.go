@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/client"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+func TestPrintProtocols(t *testing.T) {
+	lastFailure := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	var out bytes.Buffer
+	printProtocols(&out, []client.ProtocolInfo{
+		{Name: "quic", BuiltIn: true, Enabled: true, Reason: "disabled after udp_blocked failures",
+			LastFailure: &lastFailure, LastFailureKind: protocol.FailureUDPBlocked},
+		{Name: "http2", BuiltIn: true, Enabled: true, Available: true,
+			LastFailure: &lastFailure, LastFailureReason: "connection refused"},
+		{Name: "http1", BuiltIn: true, Reason: "not in the protocol order"},
+	})
+
+	rows := make(map[string]string)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			rows[fields[0]] = strings.Join(fields[1:], " ")
+		}
+	}
+	want := map[string]string{
+		"quic":  "yes yes no disabled after udp_blocked failures",
+		"http2": "yes yes yes last failure at 12:30:00: connection refused",
+		"http1": "yes no no not in the protocol order",
+	}
+	for name, row := range want {
+		if rows[name] != row {
+			t.Errorf("expected %s row %q, got %q", name, row, rows[name])
+		}
+	}
+}
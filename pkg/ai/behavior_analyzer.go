@@ -390,6 +390,10 @@ func (ac *AnomalyClassifier) Classify(features []float64) (string, error) {
 	}
 }
 
+// minStdDev is the standard deviation below which features are treated as
+// constant
+const minStdDev = 1e-9
+
 // detectAnomalies detects anomalies in the features
 func (ba *BehaviorAnalyzer) detectAnomalies(features []float64) ([]Anomaly, error) {
 	var anomalies []Anomaly
@@ -400,6 +404,11 @@ func (ba *BehaviorAnalyzer) detectAnomalies(features []float64) ([]Anomaly, erro
 	// Calculate mean and standard deviation
 	mean := ba.calculateMean(features)
 	stdDev := ba.calculateStdDev(features, mean)
+	// Without spread (e.g. no or constant features) nothing stands out,
+	// and z-scores would be NaN or infinite
+	if stdDev < minStdDev {
+		return anomalies, nil
+	}
 
 	// Detect outliers (values more than 2 standard deviations from mean)
 	for i, feature := range features {
@@ -0,0 +1,40 @@
+package ai
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDetectAnomaliesConstantFeatures(t *testing.T) {
+	ba := NewBehaviorAnalyzer(nil)
+
+	for _, features := range [][]float64{nil, {0.5}, {0.5, 0.5, 0.5, 0.5}} {
+		anomalies, err := ba.detectAnomalies(features)
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", features, err)
+		}
+		if len(anomalies) != 0 {
+			t.Errorf("expected no anomalies for %v, got %+v", features, anomalies)
+		}
+	}
+
+	// An outlier among otherwise equal features is still found
+	features := []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 10}
+	anomalies, err := ba.detectAnomalies(features)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(anomalies) != 1 || anomalies[0].Index != 9 || math.IsInf(anomalies[0].Score, 0) || math.IsNaN(anomalies[0].Score) {
+		t.Errorf("expected the outlier as the only anomaly, got %+v", anomalies)
+	}
+}
+
+func TestCalculateConfidenceEmptyFeatures(t *testing.T) {
+	ba := NewBehaviorAnalyzer(nil)
+	if confidence := ba.calculateConfidence(nil); confidence != 0 {
+		t.Errorf("expected zero confidence without features, got %v", confidence)
+	}
+	if confidence := ba.calculateConfidence([]float64{0.5, 0.5}); confidence != 1 {
+		t.Errorf("expected full confidence for constant features, got %v", confidence)
+	}
+}
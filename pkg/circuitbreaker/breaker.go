@@ -36,6 +36,13 @@ type CircuitBreaker struct {
 	breaker *gobreaker.CircuitBreaker
 	mu      sync.RWMutex
 	stats   *CircuitBreakerStats
+	timeout time.Duration
+
+	// openedAt is when the breaker last opened
+	openedAt time.Time
+	// restoredOpenUntil is set by Restore to keep rejecting calls until the
+	// open period taken over from another breaker ends
+	restoredOpenUntil time.Time
 }
 
 // CircuitBreakerStats tracks circuit breaker statistics
@@ -82,6 +89,11 @@ func NewCircuitBreaker(config *Config) *CircuitBreaker {
 		stats: &CircuitBreakerStats{
 			State: Closed,
 		},
+		timeout: config.Timeout,
+	}
+	if cb.timeout <= 0 {
+		// gobreaker's default open period
+		cb.timeout = 60 * time.Second
 	}
 
 	// Create gobreaker circuit breaker
@@ -108,7 +120,7 @@ func (cb *CircuitBreaker) Execute(ctx context.Context, fn func() error) error {
 	cb.stats.TotalRequests++
 	cb.mu.Unlock()
 
-	_, err := cb.breaker.Execute(func() (interface{}, error) {
+	_, err := cb.execute(func() (interface{}, error) {
 		return nil, fn()
 	})
 
@@ -136,7 +148,7 @@ func ExecuteWithResult[T any](cb *CircuitBreaker, ctx context.Context, fn func()
 
 	var zero T
 
-	result, err := cb.breaker.Execute(func() (interface{}, error) {
+	result, err := cb.execute(func() (interface{}, error) {
 		return fn()
 	})
 
@@ -160,6 +172,29 @@ func ExecuteWithResult[T any](cb *CircuitBreaker, ctx context.Context, fn func()
 	return zero, errors.New("type assertion failed")
 }
 
+// execute runs fn through the gobreaker breaker unless a restored open
+// period is still running
+func (cb *CircuitBreaker) execute(fn func() (interface{}, error)) (interface{}, error) {
+	cb.mu.Lock()
+	if !cb.restoredOpenUntil.IsZero() {
+		if time.Now().Before(cb.restoredOpenUntil) {
+			cb.mu.Unlock()
+			return nil, gobreaker.ErrOpenState
+		}
+		cb.restoredOpenUntil = time.Time{}
+		cb.stats.State = Closed
+	}
+	cb.mu.Unlock()
+
+	return cb.breaker.Execute(fn)
+}
+
+// IsRejected reports whether err means the breaker refused to run the call
+// because it is open or already probing in the half-open state
+func IsRejected(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
 // Ready checks if the circuit breaker is ready to execute
 func (cb *CircuitBreaker) Ready() bool {
 	return cb.stats.State != Open
@@ -230,6 +265,7 @@ func (cb *CircuitBreaker) updateState(state gobreaker.State) {
 		cb.stats.State = HalfOpen
 	case gobreaker.StateOpen:
 		cb.stats.State = Open
+		cb.openedAt = time.Now()
 	}
 }
 
@@ -0,0 +1,61 @@
+package circuitbreaker
+
+import "time"
+
+// Snapshot is the state of a circuit breaker, so a standby client can take
+// over the breaker of the primary it replaces
+type Snapshot struct {
+	State State `json:"state"`
+	// OpenUntil is when an open breaker lets calls through again
+	OpenUntil          time.Time `json:"open_until,omitempty"`
+	TotalRequests      int64     `json:"total_requests"`
+	SuccessfulRequests int64     `json:"successful_requests"`
+	FailedRequests     int64     `json:"failed_requests"`
+	LastFailure        time.Time `json:"last_failure,omitempty"`
+	LastSuccess        time.Time `json:"last_success,omitempty"`
+}
+
+// Snapshot returns the current state of the breaker
+func (cb *CircuitBreaker) Snapshot() Snapshot {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	s := Snapshot{
+		State:              cb.stats.State,
+		TotalRequests:      cb.stats.TotalRequests,
+		SuccessfulRequests: cb.stats.SuccessfulRequests,
+		FailedRequests:     cb.stats.FailedRequests,
+		LastFailure:        cb.stats.LastFailure,
+		LastSuccess:        cb.stats.LastSuccess,
+	}
+	switch {
+	case s.State != Open:
+	case !cb.restoredOpenUntil.IsZero():
+		s.OpenUntil = cb.restoredOpenUntil
+	default:
+		s.OpenUntil = cb.openedAt.Add(cb.timeout)
+	}
+	return s
+}
+
+// Restore takes over the statistics of s. An open breaker in s keeps
+// rejecting calls until its OpenUntil has passed; a half-open one restores
+// as closed, since the probe it was waiting for belongs to the old breaker.
+func (cb *CircuitBreaker) Restore(s Snapshot) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.stats = &CircuitBreakerStats{
+		TotalRequests:      s.TotalRequests,
+		SuccessfulRequests: s.SuccessfulRequests,
+		FailedRequests:     s.FailedRequests,
+		LastFailure:        s.LastFailure,
+		LastSuccess:        s.LastSuccess,
+		State:              Closed,
+	}
+	cb.restoredOpenUntil = time.Time{}
+	if s.State == Open && time.Now().Before(s.OpenUntil) {
+		cb.stats.State = Open
+		cb.restoredOpenUntil = s.OpenUntil
+	}
+}
@@ -0,0 +1,48 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	config := DefaultConfig()
+	config.Timeout = time.Hour
+	primary := NewCircuitBreaker(config)
+	failure := errors.New("relay unavailable")
+	for i := 0; i < 3; i++ {
+		primary.Execute(context.Background(), func() error { return failure })
+	}
+	snapshot := primary.Snapshot()
+	if snapshot.State != Open || snapshot.FailedRequests != 3 {
+		t.Fatalf("expected an open breaker with 3 failures, got %+v", snapshot)
+	}
+
+	// The standby rejects calls for the rest of the primary's open period
+	standby := NewCircuitBreaker(config)
+	standby.Restore(snapshot)
+	if standby.State() != Open {
+		t.Errorf("expected the restored breaker to be open, got %v", standby.State())
+	}
+	called := false
+	err := standby.Execute(context.Background(), func() error {
+		called = true
+		return nil
+	})
+	if called || !IsRejected(err) {
+		t.Errorf("expected the call to be rejected, got %v", err)
+	}
+	if got := standby.Snapshot(); !got.OpenUntil.Equal(snapshot.OpenUntil) {
+		t.Errorf("expected open until %v, got %v", snapshot.OpenUntil, got.OpenUntil)
+	}
+
+	// An open period that has already ended restores as closed
+	snapshot.OpenUntil = time.Now().Add(-time.Second)
+	expired := NewCircuitBreaker(config)
+	expired.Restore(snapshot)
+	if err := expired.Execute(context.Background(), func() error { return nil }); err != nil || expired.State() != Closed {
+		t.Errorf("expected a closed breaker, got %v, %v", expired.State(), err)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/circuitbreaker"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+var (
+	// ErrBackpressure means the data was not sent because the client is
+	// being throttled. The error is a *BackpressureError telling when to
+	// retry; sending the same data again later is expected to succeed.
+	ErrBackpressure = errors.New("backpressure")
+	// ErrConnectionClosed means there is no usable connection. Retrying
+	// does not help until the client has connected again.
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// DefaultRetryAfter is suggested when the source of backpressure does not
+// say how long it lasts
+const DefaultRetryAfter = time.Second
+
+// BackpressureError is returned by Send when the data should be sent again
+// after RetryAfter. errors.Is(err, ErrBackpressure) matches it.
+type BackpressureError struct {
+	// Reason names the source, e.g. "rate_limited", "circuit_open" or
+	// "congested"
+	Reason     string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("backpressure (%s), retry after %v: %v", e.Reason, e.RetryAfter, e.Err)
+}
+
+func (e *BackpressureError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrBackpressure
+func (e *BackpressureError) Is(target error) bool {
+	return target == ErrBackpressure
+}
+
+// classifySendError maps a failed send to ErrBackpressure or
+// ErrConnectionClosed where it can tell them apart. Other errors are
+// returned unchanged.
+func (ic *IntegratedClient) classifySendError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case circuitbreaker.IsRejected(err):
+		return &BackpressureError{Reason: "circuit_open", RetryAfter: ic.breakerTimeout(), Err: err}
+	case errors.Is(err, protocol.ErrCongested):
+		return &BackpressureError{Reason: "congested", RetryAfter: DefaultRetryAfter, Err: err}
+	case errors.Is(err, errNotConnected), errors.Is(err, protocol.ErrNotConnected), errors.Is(err, net.ErrClosed), errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+	default:
+		return err
+	}
+}
+
+// breakerTimeout returns how long the circuit breaker stays open
+func (ic *IntegratedClient) breakerTimeout() time.Duration {
+	if ic.config != nil && ic.config.CircuitBreaker != nil && ic.config.CircuitBreaker.Timeout > 0 {
+		return ic.config.CircuitBreaker.Timeout
+	}
+	return circuitbreaker.DefaultConfig().Timeout
+}
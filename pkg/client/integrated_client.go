@@ -3,11 +3,14 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,7 +18,10 @@ import (
 	"github.com/2gc-dev/cloudbridge-client/pkg/health"
 	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
 	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/rate_limiting"
 	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/2gc-dev/cloudbridge-client/pkg/webhook"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -32,8 +38,20 @@ type IntegratedClient struct {
 	metrics       *metrics.Metrics
 	healthChecker *health.HealthChecker
 	tenantID      string
+	userID        string
 	version       string
 	features      []string
+	limiter       *rate_limiting.Limiter
+	ready         relay.ReadySignal
+	webhooks      *webhook.Emitter
+
+	// address is the relay address of the last successful Connect
+	address     string
+	upgradeOnce sync.Once
+	upgradeStop chan struct{}
+
+	stateSaveOnce sync.Once
+	stateStop     chan struct{}
 }
 
 // Config holds integrated client configuration
@@ -41,24 +59,72 @@ type Config struct {
 	TLSConfig        *tls.Config
 	CircuitBreaker   *circuitbreaker.Config
 	ProtocolOrder    []protocol.Protocol
+	// SwitchThreshold is the failure rate in (0, 1] above which the client
+	// switches away from a protocol; 0 keeps the engine default
 	SwitchThreshold  float64
+	// SwitchCooldown is how long after a switch no further switch is made;
+	// 0 keeps the engine default
+	SwitchCooldown   time.Duration
+	// QualityThresholds make the client switch away from a protocol whose
+	// pings show a slow, jittery or lossy link
+	QualityThresholds protocol.QualityThresholds
 	ConnectTimeout   time.Duration
 	RequestTimeout   time.Duration
 	
 	// New fields for v2.0
 	TenantID         string
+	// Token authenticates the relay connection of the HTTP/1 fallback
+	Token            string
+	// RelayALPN lists the protocols the HTTP/1 fallback offers on its relay
+	// connection. The NextProtos of TLSConfig are meant for QUIC and HTTP/2
+	// and are not offered there.
+	RelayALPN        []string
+	// InsecurePlaintext lets the HTTP/1 fallback send the token over a
+	// connection without TLS when TLSConfig is nil. Without it the
+	// fallback refuses to connect rather than expose the token.
+	InsecurePlaintext bool
 	Version          string
 	Features         []string
 	MetricsEnabled   bool
 	HealthCheckEnabled bool
 	HealthCheckConfig *health.Config
+
+	// RateLimit enables per-tenant limiting of Send calls when set
+	RateLimit *rate_limiting.Config
+	// UserID is the user Send calls are limited as within the tenant. When
+	// empty it is the subject of Token.
+	UserID string
+
+	// EnableProtocolUpgrade makes a client connected over a fallback
+	// protocol periodically probe the protocols preferred over it and
+	// switch back once one of them connects again
+	EnableProtocolUpgrade bool
+	// UpgradeProbeInterval is how often the preferred protocols are probed
+	UpgradeProbeInterval time.Duration
+
+	// StatsFile keeps the protocol statistics across restarts when set:
+	// they are loaded by NewIntegratedClient and saved by Close
+	StatsFile string
+
+	// StateStore shares the protocol statistics and circuit breaker state
+	// of an active client with its standby. A connected client saves its
+	// state every StateSaveInterval and on Close; Promote loads it.
+	StateStore StateStore
+	// StateSaveInterval is how often a connected client saves its state
+	StateSaveInterval time.Duration
+
+	// NetworkFingerprint identifies the current network, like
+	// protocol.NetworkFingerprint. When set, Connect remembers which
+	// protocols work on each network and prefers those there.
+	NetworkFingerprint func() string
 }
 
 // DefaultConfig returns default configuration
 func DefaultConfig() *Config {
 	return &Config{
-		ProtocolOrder:   []protocol.Protocol{0, 1, 2}, // QUIC=0, HTTP2=1, HTTP1=2
+		ProtocolOrder:   []protocol.Protocol{protocol.QUIC, protocol.HTTP2, protocol.HTTP1},
 		SwitchThreshold: 0.8,
+		SwitchCooldown:  30 * time.Second,
 		ConnectTimeout:  10 * time.Second,
 		RequestTimeout:  30 * time.Second,
 		CircuitBreaker:  circuitbreaker.DefaultConfig(),
@@ -70,14 +136,61 @@ func DefaultConfig() *Config {
 		MetricsEnabled:     true,
 		HealthCheckEnabled: true,
 		HealthCheckConfig:  health.DefaultConfig(),
+		UpgradeProbeInterval: 60 * time.Second,
+		StateSaveInterval:    10 * time.Second,
 	}
 }
 
+// Validate checks that the protocol fallback order is well formed and that
+// at least one protocol in it can be used with this configuration
+func (c *Config) Validate() error {
+	if err := protocol.ValidateOrder(c.ProtocolOrder); err != nil {
+		return err
+	}
+	if c.SwitchThreshold != 0 {
+		if err := protocol.ValidateSwitchThreshold(c.SwitchThreshold); err != nil {
+			return err
+		}
+	}
+	if c.SwitchCooldown < 0 {
+		return fmt.Errorf("switch cooldown must not be negative, got %v", c.SwitchCooldown)
+	}
+	if err := c.QualityThresholds.Validate(); err != nil {
+		return err
+	}
+
+	var reasons []string
+	for _, p := range c.ProtocolOrder {
+		err := c.protocolUsable(p)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return fmt.Errorf("no protocol in the protocol order can be used: %s", strings.Join(reasons, "; "))
+}
+
+// protocolUsable reports why p cannot be used with this configuration
+func (c *Config) protocolUsable(p protocol.Protocol) error {
+	if p == protocol.QUIC {
+		if c.TLSConfig == nil {
+			return fmt.Errorf("quic requires a TLS configuration")
+		}
+		if len(c.TLSConfig.NextProtos) == 0 {
+			return fmt.Errorf("quic requires ALPN protocols in the TLS configuration")
+		}
+	}
+	return nil
+}
+
 // NewIntegratedClient creates a new integrated client
-func NewIntegratedClient(config *Config) *IntegratedClient {
+func NewIntegratedClient(config *Config) (*IntegratedClient, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid client configuration: %w", err)
+	}
 
 	// Create protocol engine based on version
 	var protocolEngine *protocol.ProtocolEngine
@@ -93,8 +206,14 @@ func NewIntegratedClient(config *Config) *IntegratedClient {
 		clients:        make(map[protocol.Protocol]interface{}),
 		config:         config,
 		tenantID:       config.TenantID,
+		userID:         config.UserID,
 		version:        config.Version,
 		features:       config.Features,
+		upgradeStop:    make(chan struct{}),
+		stateStop:      make(chan struct{}),
+	}
+	if ic.userID == "" {
+		ic.userID = tokenSubject(config.Token)
 	}
 
 	// Initialize metrics if enabled
@@ -116,9 +235,31 @@ func NewIntegratedClient(config *Config) *IntegratedClient {
 		ic.setupHealthChecks()
 	}
 
+	if config.RateLimit != nil {
+		ic.limiter = rate_limiting.NewLimiter(config.RateLimit)
+	}
+
 	ic.protocolEngine.SetPreferredOrder(config.ProtocolOrder)
+	if config.SwitchThreshold != 0 {
+		if err := ic.protocolEngine.SetSwitchThreshold(config.SwitchThreshold); err != nil {
+			return nil, fmt.Errorf("invalid client configuration: %w", err)
+		}
+	}
+	if config.SwitchCooldown != 0 {
+		if err := ic.protocolEngine.SetSwitchCooldown(config.SwitchCooldown); err != nil {
+			return nil, fmt.Errorf("invalid client configuration: %w", err)
+		}
+	}
 
-	return ic
+	if err := ic.protocolEngine.SetQualityThresholds(config.QualityThresholds); err != nil {
+		return nil, fmt.Errorf("invalid client configuration: %w", err)
+	}
+
+	if err := ic.loadStats(); err != nil {
+		log.Printf("Ignoring saved protocol stats: %v", err)
+	}
+
+	return ic, nil
 }
 
 // setupHealthChecks sets up default health checks
@@ -157,6 +298,21 @@ func (ic *IntegratedClient) setupHealthChecks() {
 	ic.healthChecker.Start()
 }
 
+// tokenSubject returns the subject of the JWT token, or "" if it has none.
+// The token is not verified: the subject only picks the rate limit Send
+// calls count against, and the relay verifies the token itself.
+func tokenSubject(token string) string {
+	if token == "" {
+		return ""
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+	subject, _ := parsed.Claims.GetSubject()
+	return subject
+}
+
 // SetTenantID sets the tenant ID for multi-tenancy support
 func (ic *IntegratedClient) SetTenantID(tenantID string) {
 	ic.mu.Lock()
@@ -164,6 +320,21 @@ func (ic *IntegratedClient) SetTenantID(tenantID string) {
 	ic.tenantID = tenantID
 }
 
+// SetWebhooks sets the emitter protocol switches are reported to
+func (ic *IntegratedClient) SetWebhooks(emitter *webhook.Emitter) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.webhooks = emitter
+}
+
+// notifySwitch emits a protocol_switched webhook. ic.mu must be held.
+func (ic *IntegratedClient) notifySwitch(from, to protocol.Protocol) {
+	ic.webhooks.Emit(webhook.EventProtocolSwitched, map[string]interface{}{
+		"from": from.String(),
+		"to":   to.String(),
+	})
+}
+
 // GetTenantID returns the current tenant ID
 func (ic *IntegratedClient) GetTenantID() string {
 	ic.mu.RLock()
@@ -203,11 +374,20 @@ func (ic *IntegratedClient) Connect(ctx context.Context, address string) error {
 		}
 	}()
 
+	ic.updateNetwork()
+
 	// Get optimal protocol for this connection using enhanced protocol engine
 	optimalProtocol := ic.protocolEngine.GetOptimalProtocolForConnection(ctx, address)
+	// The engine does not know the configured order, and a protocol
+	// outside of it would leave nothing to fall back to
+	order := ic.protocolEngine.GetEffectiveOrder()
+	if !slices.Contains(order, optimalProtocol) && len(order) > 0 {
+		optimalProtocol = order[0]
+	}
 	
 	// Try the optimal protocol first
 	if ic.tryProtocol(ctx, address, optimalProtocol, startTime) {
+		ic.connected(address)
 		return nil
 	}
 
@@ -216,6 +396,7 @@ func (ic *IntegratedClient) Connect(ctx context.Context, address string) error {
 	
 	for _, protocol := range fallbackProtocols {
 		if ic.tryProtocol(ctx, address, protocol, startTime) {
+			ic.connected(address)
 			return nil
 		}
 	}
@@ -230,8 +411,8 @@ func (ic *IntegratedClient) Connect(ctx context.Context, address string) error {
 
 // getFallbackProtocols returns the list of fallback protocols in order of preference
 func (ic *IntegratedClient) getFallbackProtocols(failedProtocol protocol.Protocol) []protocol.Protocol {
-	// Get the preferred order from protocol engine
-	preferredOrder := ic.protocolEngine.GetPreferredOrder()
+	// Get the order for the current network from protocol engine
+	preferredOrder := ic.protocolEngine.GetEffectiveOrder()
 	
 	// Find the position of the failed protocol
 	failedIndex := -1
@@ -253,8 +434,10 @@ func (ic *IntegratedClient) getFallbackProtocols(failedProtocol protocol.Protoco
 
 // tryProtocol attempts to connect using a specific protocol and records metrics
 func (ic *IntegratedClient) tryProtocol(ctx context.Context, address string, protocol protocol.Protocol, startTime time.Time) bool {
-	if err := ic.tryConnect(ctx, address, protocol); err == nil {
+	err := ic.tryConnect(ctx, address, protocol)
+	if err == nil {
 		ic.currentProtocol = protocol
+		ic.ready.Set(true)
 		latency := time.Since(startTime)
 		ic.protocolEngine.RecordSuccess(protocol, latency)
 		
@@ -267,36 +450,64 @@ func (ic *IntegratedClient) tryProtocol(ctx context.Context, address string, pro
 		return true
 	}
 	
-	// Record failure with reason
-	if err := ic.tryConnect(ctx, address, protocol); err != nil {
-		ic.protocolEngine.RecordFailure(protocol, err.Error())
-		if ic.metrics != nil {
-			ic.metrics.IncProtocolErrors(protocol.String())
-		}
+	// Record failure with a classified reason
+	ic.protocolEngine.RecordError(protocol, err)
+	if ic.metrics != nil {
+		ic.metrics.IncProtocolErrors(protocol.String())
 	}
 	
 	return false
 }
 
 // tryConnect attempts to connect using a specific protocol
-func (ic *IntegratedClient) tryConnect(ctx context.Context, address string, protocol protocol.Protocol) error {
+func (ic *IntegratedClient) tryConnect(ctx context.Context, address string, p protocol.Protocol) error {
+	client, err := ic.dialProtocol(ctx, address, p, ic.tenantID)
+	if err != nil {
+		return err
+	}
+	ic.clients[p] = client
+	return nil
+}
+
+// dialProtocol connects to address using a specific protocol and returns the
+// client of the connection. It does not use ic.mu, so callers need not hold
+// it while the connection is established; the relay connection of HTTP/1
+// belongs to tenantID.
+func (ic *IntegratedClient) dialProtocol(ctx context.Context, address string, p protocol.Protocol, tenantID string) (interface{}, error) {
 	ctx, cancel := context.WithTimeout(ctx, ic.config.ConnectTimeout)
 	defer cancel()
 
-	switch protocol {
-	case 0: // QUIC
+	switch p {
+	case protocol.QUIC:
 		return ic.connectQUIC(ctx, address)
-	case 1: // HTTP2
+	case protocol.HTTP2:
 		return ic.connectHTTP2(ctx, address)
-	case 2: // HTTP1
-		return ic.connectHTTP1(ctx, address)
+	case protocol.HTTP1:
+		return ic.connectHTTP1(ctx, address, tenantID)
 	default:
-		return fmt.Errorf("unsupported protocol: %s", protocol)
+		return nil, fmt.Errorf("unsupported protocol: %s", p)
+	}
+}
+
+// updateNetwork tells the protocol engine which network the client is on
+// when Config.NetworkFingerprint is set
+func (ic *IntegratedClient) updateNetwork() {
+	if ic.config.NetworkFingerprint != nil {
+		ic.protocolEngine.SetNetwork(ic.config.NetworkFingerprint())
+	}
+}
+
+// closeProtocolClient closes a client returned by dialProtocol
+func closeProtocolClient(p protocol.Protocol, client interface{}) {
+	if closer, ok := client.(interface{ Close() error }); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing %s client: %v", p, err)
+		}
 	}
 }
 
 // connectQUIC establishes a QUIC connection
-func (ic *IntegratedClient) connectQUIC(ctx context.Context, address string) error {
+func (ic *IntegratedClient) connectQUIC(ctx context.Context, address string) (*protocol.QUICClient, error) {
 	quicConfig := &protocol.QUICConfig{
 		TLSConfig:        ic.config.TLSConfig,
 		KeepAlive:        true,
@@ -307,15 +518,13 @@ func (ic *IntegratedClient) connectQUIC(ctx context.Context, address string) err
 
 	quicClient := protocol.NewQUICClient(quicConfig)
 	if err := quicClient.Connect(ctx, address); err != nil {
-		return err
+		return nil, err
 	}
-
-	ic.clients[0] = quicClient // QUIC
-	return nil
+	return quicClient, nil
 }
 
 // connectHTTP2 establishes an HTTP/2 connection
-func (ic *IntegratedClient) connectHTTP2(ctx context.Context, address string) error {
+func (ic *IntegratedClient) connectHTTP2(ctx context.Context, address string) (*protocol.HTTP2Client, error) {
 	http2Config := &protocol.HTTP2Config{
 		TLSConfig:       ic.config.TLSConfig,
 		Timeout:         ic.config.RequestTimeout,
@@ -327,63 +536,108 @@ func (ic *IntegratedClient) connectHTTP2(ctx context.Context, address string) er
 
 	http2Client := protocol.NewHTTP2Client(http2Config)
 	if err := http2Client.Connect(ctx, address); err != nil {
-		return err
+		return nil, err
 	}
-
-	ic.clients[1] = http2Client // HTTP2
-	return nil
+	return http2Client, nil
 }
 
-// connectHTTP1 establishes an HTTP/1.1 connection (fallback)
-func (ic *IntegratedClient) connectHTTP1(ctx context.Context, address string) error {
+// connectHTTP1 establishes an HTTP/1.1 connection (fallback): a relay
+// connection authenticated with the configured token, which tunnels can be
+// created over
+func (ic *IntegratedClient) connectHTTP1(ctx context.Context, address, tenantID string) (*relay.Client, error) {
 	host, portStr, err := net.SplitHostPort(address)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	
+	var tlsConfig *tls.Config
+	if ic.config.TLSConfig != nil {
+		tlsConfig = ic.config.TLSConfig.Clone()
+		// The ALPN protocols of QUIC and HTTP/2 do not apply to the relay
+		// connection
+		tlsConfig.NextProtos = slices.Clone(ic.config.RelayALPN)
+	} else if !ic.config.InsecurePlaintext {
+		return nil, ErrPlaintextToken
+	}
+
 	// Create relay client based on version
 	var client *relay.Client
 	if ic.version == protocol.ProtocolVersionV1 {
-		client = relay.NewClientV1(false, nil)
+		client = relay.NewClientV1(tlsConfig != nil, tlsConfig)
 	} else {
-		client = relay.NewClient(false, nil)
-		client.SetTenantID(ic.tenantID)
+		client = relay.NewClient(tlsConfig != nil, tlsConfig)
+		client.SetTenantID(tenantID)
 	}
 	
 	if err := client.Connect(host, port); err != nil {
-		return err
+		return nil, err
 	}
-	ic.clients[2] = client
-	return nil
+	// The relay does not route tunnels of an unauthenticated connection
+	if err := client.HandshakeContext(ctx, ic.config.Token); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("relay handshake failed: %w", err)
+	}
+	client.StartHeartbeat()
+	return client, nil
 }
 
-// Send sends data using the current protocol with circuit breaker protection
+// Send sends data using the current protocol with circuit breaker protection.
+//
+// A failed send can be told apart with errors.Is:
+//   - ErrBackpressure: the client is throttled by the rate limiter, the open
+//     circuit breaker or a congested transport. The error is a
+//     *BackpressureError whose RetryAfter says when to send the data again;
+//     callers should wait rather than retry immediately.
+//   - ErrConnectionClosed: there is no usable connection, and retrying is
+//     pointless until the client has connected again.
+//
+// Other errors are failures of the individual send.
 func (ic *IntegratedClient) Send(data []byte) error {
-	return ic.circuitBreaker.Execute(context.Background(), func() error {
+	if ic.limiter != nil {
+		tenantID := ic.GetTenantID()
+		if allowed, retryAfter, err := ic.limiter.AllowTenant(tenantID, ic.userID); !allowed {
+			if ic.metrics != nil && tenantID != "" {
+				ic.metrics.IncTenantErrors(tenantID)
+			}
+			if retryAfter <= 0 {
+				retryAfter = DefaultRetryAfter
+			}
+			return &BackpressureError{Reason: "rate_limited", RetryAfter: retryAfter, Err: err}
+		}
+	}
+
+	err := ic.circuitBreaker.Execute(context.Background(), func() error {
 		return ic.sendWithCurrentProtocol(data)
 	})
+	return ic.classifySendError(err)
 }
 
+// errNotConnected is returned when sending without a connected transport
+var errNotConnected = errors.New("not connected")
+
 // sendWithCurrentProtocol sends data using the current protocol
 func (ic *IntegratedClient) sendWithCurrentProtocol(data []byte) error {
 	ic.mu.RLock()
 	defer ic.mu.RUnlock()
 
 	switch ic.currentProtocol {
-	case 0: // QUIC
-		if client, ok := ic.clients[0].(*protocol.QUICClient); ok {
+	case protocol.QUIC:
+		if client, ok := ic.clients[protocol.QUIC].(*protocol.QUICClient); ok {
+			if !client.IsConnected() {
+				return fmt.Errorf("%w via QUIC", errNotConnected)
+			}
 			err := client.Send(data)
 			if err == nil && ic.metrics != nil {
 				ic.metrics.IncTunnelBytesToServer("quic_tunnel", int64(len(data)))
 			}
 			return err
 		}
-	case 1: // HTTP2
-		if client, ok := ic.clients[1].(*protocol.HTTP2Client); ok {
+	case protocol.HTTP2:
+		if client, ok := ic.clients[protocol.HTTP2].(*protocol.HTTP2Client); ok {
 			err := client.Send(data)
 			if err == nil && ic.metrics != nil {
 				ic.metrics.IncTunnelBytesToServer("http2_tunnel", int64(len(data)))
@@ -392,7 +646,7 @@ func (ic *IntegratedClient) sendWithCurrentProtocol(data []byte) error {
 		}
 	}
 
-	return fmt.Errorf("no client available for protocol: %s", ic.currentProtocol)
+	return fmt.Errorf("%w: no client available for protocol: %s", errNotConnected, ic.currentProtocol)
 }
 
 // Receive receives data using the current protocol
@@ -401,16 +655,16 @@ func (ic *IntegratedClient) Receive(buffer []byte) (int, error) {
 	defer ic.mu.RUnlock()
 
 	switch ic.currentProtocol {
-	case 0: // QUIC
-		if client, ok := ic.clients[0].(*protocol.QUICClient); ok {
+	case protocol.QUIC:
+		if client, ok := ic.clients[protocol.QUIC].(*protocol.QUICClient); ok {
 			n, err := client.Receive(buffer)
 			if err == nil && ic.metrics != nil {
 				ic.metrics.IncTunnelBytesFromServer("quic_tunnel", int64(n))
 			}
 			return n, err
 		}
-	case 1: // HTTP2
-		if client, ok := ic.clients[1].(*protocol.HTTP2Client); ok {
+	case protocol.HTTP2:
+		if client, ok := ic.clients[protocol.HTTP2].(*protocol.HTTP2Client); ok {
 			n, err := client.Receive(buffer)
 			if err == nil && ic.metrics != nil {
 				ic.metrics.IncTunnelBytesFromServer("http2_tunnel", int64(n))
@@ -432,6 +686,18 @@ func (ic *IntegratedClient) Close() error {
 		ic.healthChecker.Stop()
 	}
 
+	if ic.limiter != nil {
+		ic.limiter.Close()
+	}
+
+	ic.ready.Set(false)
+	ic.stopUpgradeProbing()
+
+	if err := ic.saveStats(); err != nil {
+		log.Printf("Error saving protocol stats: %v", err)
+	}
+	ic.stopStateSaving()
+
 	// Close all clients
 	for _, client := range ic.clients {
 		if closer, ok := client.(interface{ Close() error }); ok {
@@ -452,18 +718,23 @@ func (ic *IntegratedClient) Close() error {
 func (ic *IntegratedClient) IsConnected() bool {
 	ic.mu.RLock()
 	defer ic.mu.RUnlock()
+	return ic.isConnectedLocked()
+}
 
+// isConnectedLocked reports whether the current protocol's client is
+// connected. ic.mu must be held.
+func (ic *IntegratedClient) isConnectedLocked() bool {
 	switch ic.currentProtocol {
-	case 0: // QUIC
-		if client, ok := ic.clients[0].(*protocol.QUICClient); ok {
+	case protocol.QUIC:
+		if client, ok := ic.clients[protocol.QUIC].(*protocol.QUICClient); ok {
 			return client.IsConnected()
 		}
-	case 1: // HTTP2
-		if client, ok := ic.clients[1].(*protocol.HTTP2Client); ok {
+	case protocol.HTTP2:
+		if client, ok := ic.clients[protocol.HTTP2].(*protocol.HTTP2Client); ok {
 			return client.IsConnected()
 		}
-	case 2: // HTTP1
-		if client, ok := ic.clients[2].(*relay.Client); ok {
+	case protocol.HTTP1:
+		if client, ok := ic.clients[protocol.HTTP1].(*relay.Client); ok {
 			return client.IsConnected()
 		}
 	}
@@ -513,9 +784,14 @@ func (ic *IntegratedClient) GetStats() map[string]interface{} {
 func (ic *IntegratedClient) SwitchProtocol(newProtocol protocol.Protocol) error {
 	ic.mu.Lock()
 	defer ic.mu.Unlock()
+	ic.switchProtocolLocked(newProtocol)
+	return nil
+}
 
+// switchProtocolLocked implements SwitchProtocol. ic.mu must be held.
+func (ic *IntegratedClient) switchProtocolLocked(newProtocol protocol.Protocol) {
 	if ic.currentProtocol == newProtocol {
-		return nil
+		return
 	}
 
 	oldProtocol := ic.currentProtocol
@@ -528,12 +804,13 @@ func (ic *IntegratedClient) SwitchProtocol(newProtocol protocol.Protocol) error
 	}
 
 	ic.currentProtocol = newProtocol
+	ic.protocolEngine.RecordSwitch()
+	ic.ready.Set(ic.isConnectedLocked())
 
 	if ic.metrics != nil {
 		ic.metrics.IncProtocolSwitches(oldProtocol.String(), newProtocol.String())
 	}
-
-	return nil
+	ic.notifySwitch(oldProtocol, newProtocol)
 }
 
 // Ping sends a ping to test connectivity
@@ -541,18 +818,29 @@ func (ic *IntegratedClient) Ping() error {
 	ic.mu.RLock()
 	defer ic.mu.RUnlock()
 
+	var ping func() error
 	switch ic.currentProtocol {
-	case 0: // QUIC
-		if client, ok := ic.clients[0].(*protocol.QUICClient); ok {
-			return client.Ping()
+	case protocol.QUIC:
+		if client, ok := ic.clients[protocol.QUIC].(*protocol.QUICClient); ok {
+			ping = client.Ping
 		}
-	case 1: // HTTP2
-		if client, ok := ic.clients[1].(*protocol.HTTP2Client); ok {
-			return client.Ping()
+	case protocol.HTTP2:
+		if client, ok := ic.clients[protocol.HTTP2].(*protocol.HTTP2Client); ok {
+			ping = client.Ping
 		}
 	}
+	if ping == nil {
+		return fmt.Errorf("no client available for protocol: %s", ic.currentProtocol)
+	}
 
-	return fmt.Errorf("no client available for protocol: %s", ic.currentProtocol)
+	// Every ping measures the link for the quality thresholds
+	start := time.Now()
+	if err := ping(); err != nil {
+		ic.protocolEngine.RecordLoss(ic.currentProtocol)
+		return err
+	}
+	ic.protocolEngine.RecordRTT(ic.currentProtocol, time.Since(start))
+	return nil
 }
 
 // AutoSwitchProtocol automatically switches to a better protocol if available
@@ -571,8 +859,13 @@ func (ic *IntegratedClient) AutoSwitchProtocol() error {
 		return nil // No better protocol available
 	}
 
+	if reason := ic.protocolEngine.DegradedReason(ic.currentProtocol); reason != "" {
+		log.Printf("Switching away from %s: link degraded (%s)", ic.currentProtocol, reason)
+	}
+
 	// Try to switch to the better protocol
-	return ic.SwitchProtocol(nextProtocol)
+	ic.switchProtocolLocked(nextProtocol)
+	return nil
 }
 
 // GetProtocolRecommendation returns a recommendation for protocol selection
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNewIntegratedClientValidatesProtocolOrder(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	if _, err := NewIntegratedClient(nil); err != nil {
+		t.Fatalf("default configuration rejected: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.QUIC, protocol.QUIC}
+	if _, err := NewIntegratedClient(cfg); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected duplicate protocol error, got %v", err)
+	}
+
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.QUIC}
+	if _, err := NewIntegratedClient(cfg); err == nil || !strings.Contains(err.Error(), "quic requires") {
+		t.Errorf("expected missing dependency error, got %v", err)
+	}
+
+	cfg.TLSConfig = &tls.Config{NextProtos: []string{"cloudbridge/2"}}
+	if _, err := NewIntegratedClient(cfg); err != nil {
+		t.Errorf("QUIC with TLS configuration rejected: %v", err)
+	}
+}
+
+func TestTryProtocolUpgrade(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	cfg.HealthCheckEnabled = false
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	// Pretend the client fell back to HTTP/1 after a blip
+	fallback := relay.NewClient(false, nil)
+	if err := fallback.Connect("127.0.0.1", server.Listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("failed to connect fallback client: %v", err)
+	}
+	ic.mu.Lock()
+	ic.clients[protocol.HTTP1] = fallback
+	ic.currentProtocol = protocol.HTTP1
+	ic.address = address
+	ic.mu.Unlock()
+
+	upgraded, err := ic.TryProtocolUpgrade(context.Background())
+	if err != nil || !upgraded {
+		t.Fatalf("expected upgrade to HTTP/2, got upgraded=%v err=%v", upgraded, err)
+	}
+	if ic.GetCurrentProtocol() != protocol.HTTP2 {
+		t.Errorf("expected HTTP/2, got %s", ic.GetCurrentProtocol())
+	}
+	if err := fallback.SendMessage(map[string]string{"type": "heartbeat"}); err == nil {
+		t.Error("expected the HTTP/1 client to be closed after the upgrade")
+	}
+
+	// The switch starts the cooldown, so nothing is probed right away
+	ic.mu.Lock()
+	ic.currentProtocol = protocol.HTTP1
+	ic.clients[protocol.HTTP1] = fallback
+	ic.mu.Unlock()
+	if upgraded, _ := ic.TryProtocolUpgrade(context.Background()); upgraded {
+		t.Error("expected no upgrade during the switch cooldown")
+	}
+}
+
+func TestTryProtocolUpgradeDoesNotLockClient(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	// A relay that accepts connections but never completes a handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	cfg.HealthCheckEnabled = false
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	fallback := relay.NewClient(false, nil)
+	if err := fallback.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("failed to connect fallback client: %v", err)
+	}
+	ic.mu.Lock()
+	ic.clients[protocol.HTTP1] = fallback
+	ic.currentProtocol = protocol.HTTP1
+	ic.address = listener.Addr().String()
+	ic.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ic.TryProtocolUpgrade(ctx)
+	}()
+
+	// The client answers while the candidate is being dialed
+	time.Sleep(100 * time.Millisecond)
+	answered := make(chan protocol.Protocol, 1)
+	go func() { answered <- ic.GetCurrentProtocol() }()
+	select {
+	case p := <-answered:
+		if p != protocol.HTTP1 {
+			t.Errorf("expected HTTP/1 while probing, got %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("client stayed locked while dialing an upgrade candidate")
+	}
+	select {
+	case <-done:
+		t.Fatal("upgrade finished before the client was queried")
+	default:
+	}
+	cancel()
+	<-done
+}
+
+func TestSendSignalsBackpressure(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	// Without a connection retrying is pointless
+	ic.mu.Lock()
+	ic.currentProtocol = protocol.HTTP2
+	ic.mu.Unlock()
+	if err := ic.Send([]byte("data")); !errors.Is(err, ErrConnectionClosed) || errors.Is(err, ErrBackpressure) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+
+	http2Client := protocol.NewHTTP2Client(&protocol.HTTP2Config{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Timeout:   5 * time.Second,
+	})
+	if err := http2Client.Connect(context.Background(), server.Listener.Addr().String()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	ic.mu.Lock()
+	ic.clients[protocol.HTTP2] = http2Client
+	ic.mu.Unlock()
+
+	var bp *BackpressureError
+	err = ic.Send([]byte("data"))
+	if !errors.Is(err, ErrBackpressure) || !errors.As(err, &bp) || bp.Reason != "congested" || bp.RetryAfter <= 0 {
+		t.Fatalf("expected congestion backpressure, got %v", err)
+	}
+
+	// Repeated failures open the circuit breaker
+	for i := 0; i < 5; i++ {
+		err = ic.Send([]byte("data"))
+	}
+	if !errors.As(err, &bp) || bp.Reason != "circuit_open" || bp.RetryAfter != ic.breakerTimeout() {
+		t.Fatalf("expected open circuit backpressure, got %v", err)
+	}
+}
+
+func TestNewIntegratedClientAppliesSwitchSettings(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	cfg.SwitchThreshold = 0.5
+	cfg.SwitchCooldown = 5 * time.Second
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+	if ic.protocolEngine.GetSwitchThreshold() != 0.5 || ic.protocolEngine.GetSwitchCooldown() != 5*time.Second {
+		t.Errorf("expected the configured switch settings, got %v and %v",
+			ic.protocolEngine.GetSwitchThreshold(), ic.protocolEngine.GetSwitchCooldown())
+	}
+
+	cfg.SwitchThreshold = 1.2
+	if _, err := NewIntegratedClient(cfg); err == nil || !strings.Contains(err.Error(), "switch threshold") {
+		t.Errorf("expected switch threshold error, got %v", err)
+	}
+}
+
+func TestNewIntegratedClientRateLimitsTokenSubject(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.HealthCheckEnabled = false
+	cfg.Token = token
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+	if ic.userID != "alice" {
+		t.Errorf("expected user ID from token subject, got %q", ic.userID)
+	}
+
+	cfg.UserID = "bob"
+	ic2, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic2.Close()
+	if ic2.userID != "bob" {
+		t.Errorf("expected configured user ID, got %q", ic2.userID)
+	}
+}
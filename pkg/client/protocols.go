@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+// ProtocolInfo describes whether the client can use a protocol
+type ProtocolInfo struct {
+	Protocol protocol.Protocol `json:"-"`
+	Name     string            `json:"name"`
+	// BuiltIn reports whether this build implements the protocol
+	BuiltIn bool `json:"built_in"`
+	// Enabled reports whether the protocol is in the configured protocol
+	// order
+	Enabled bool `json:"enabled"`
+	// Available reports whether the client would try the protocol when
+	// connecting
+	Available bool `json:"available"`
+	// Reason explains why the protocol is not available
+	Reason string `json:"reason,omitempty"`
+
+	// LastFailure is when the last attempt with the protocol failed, or nil
+	LastFailure       *time.Time           `json:"last_failure,omitempty"`
+	LastFailureKind   protocol.FailureKind `json:"last_failure_kind,omitempty"`
+	LastFailureReason string               `json:"last_failure_reason,omitempty"`
+}
+
+// AvailableProtocols reports for every protocol whether this build supports
+// it and whether the client can currently use it on the current network.
+// Protocols are listed in the order they would be tried, followed by those
+// not in the configured order.
+func (ic *IntegratedClient) AvailableProtocols() []ProtocolInfo {
+	builtIn := make(map[protocol.Protocol]bool)
+	for _, p := range protocol.BuiltIn() {
+		builtIn[p] = true
+	}
+	ic.updateNetwork()
+	order := ic.protocolEngine.GetEffectiveOrder()
+	enabled := make(map[protocol.Protocol]bool, len(order))
+	for _, p := range order {
+		enabled[p] = true
+	}
+	protocols := order
+	for _, p := range protocol.BuiltIn() {
+		if !enabled[p] {
+			protocols = append(protocols, p)
+		}
+	}
+
+	infos := make([]ProtocolInfo, 0, len(protocols))
+	for _, p := range protocols {
+		availability := ic.protocolEngine.GetAvailability(p)
+		info := ProtocolInfo{
+			Protocol:          p,
+			Name:              p.String(),
+			BuiltIn:           builtIn[p],
+			Enabled:           enabled[p],
+			LastFailureKind:   availability.FailureKind,
+			LastFailureReason: availability.FailureReason,
+		}
+		if !availability.LastFailure.IsZero() {
+			lastFailure := availability.LastFailure
+			info.LastFailure = &lastFailure
+		}
+
+		switch err := ic.config.protocolUsable(p); {
+		case !info.BuiltIn:
+			info.Reason = "not supported by this build"
+		case !info.Enabled:
+			info.Reason = "not in the protocol order"
+		case err != nil:
+			info.Reason = err.Error()
+		case !availability.Reachable:
+			info.Reason = "the relay did not answer the network probe"
+		case !availability.Available && availability.FailureKind != "":
+			info.Reason = fmt.Sprintf("disabled after %s failures", availability.FailureKind)
+		case !availability.Available:
+			info.Reason = "disabled after repeated failures"
+		default:
+			info.Available = true
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ProbeProtocols tries to connect to address with every usable protocol in
+// the order Connect would try them and closes the probe connections again. The results
+// are recorded like those of Connect, so AvailableProtocols reflects them.
+// The protocol of an established connection is not probed, and the client
+// is not locked while probing.
+func (ic *IntegratedClient) ProbeProtocols(ctx context.Context, address string) {
+	ic.updateNetwork()
+	ic.mu.RLock()
+	order := ic.protocolEngine.GetEffectiveOrder()
+	current := ic.currentProtocol
+	connected := ic.isConnectedLocked()
+	tenantID := ic.tenantID
+	ic.mu.RUnlock()
+
+	for _, p := range order {
+		if p == current && connected {
+			continue
+		}
+		if ic.config.protocolUsable(p) != nil {
+			continue
+		}
+
+		start := time.Now()
+		client, err := ic.dialProtocol(ctx, address, p, tenantID)
+		if err != nil {
+			ic.protocolEngine.RecordError(p, err)
+			continue
+		}
+		ic.protocolEngine.RecordSuccess(p, time.Since(start))
+		closeProtocolClient(p, client)
+	}
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+func TestAvailableProtocols(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	cfg.HealthCheckEnabled = false
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	infos := ic.AvailableProtocols()
+	if len(infos) != 3 || infos[0].Protocol != protocol.HTTP2 || infos[1].Protocol != protocol.HTTP1 {
+		t.Fatalf("unexpected protocols: %+v", infos)
+	}
+	if !infos[0].Available || !infos[1].Available {
+		t.Errorf("expected configured protocols to be available: %+v", infos)
+	}
+	if quic := infos[2]; !quic.BuiltIn || quic.Enabled || quic.Available || quic.Reason != "not in the protocol order" {
+		t.Errorf("unexpected QUIC info: %+v", quic)
+	}
+
+	ic.ProbeProtocols(context.Background(), server.Listener.Addr().String())
+	if http2 := ic.AvailableProtocols()[0]; !http2.Available || http2.LastFailure != nil {
+		t.Errorf("expected HTTP/2 probe to succeed: %+v", http2)
+	}
+	// The HTTP/1 fallback authenticates with the relay, which an HTTP
+	// server does not answer
+	if http1 := ic.AvailableProtocols()[1]; http1.LastFailure == nil {
+		t.Errorf("expected HTTP/1 probe without a relay to fail: %+v", http1)
+	}
+	ic.mu.RLock()
+	open := len(ic.clients)
+	ic.mu.RUnlock()
+	if open != 0 {
+		t.Errorf("expected probe connections to be closed, %d left", open)
+	}
+
+	// A failed probe is reported as the last failure
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	ic.ProbeProtocols(context.Background(), closed)
+	http1 := ic.AvailableProtocols()[1]
+	if http1.LastFailure == nil || http1.LastFailureReason == "" {
+		t.Errorf("expected the failed probe to be reported: %+v", http1)
+	}
+
+	ic.protocolEngine.MarkProtocolUnavailable(protocol.HTTP1)
+	if http1 := ic.AvailableProtocols()[1]; http1.Available || http1.Reason == "" {
+		t.Errorf("expected HTTP/1 to be unavailable with a reason: %+v", http1)
+	}
+}
+
+func TestProbeProtocolsDoesNotLockClient(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	// A relay that accepts connections but never completes a handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2}
+	cfg.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	cfg.HealthCheckEnabled = false
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ic.ProbeProtocols(ctx, listener.Addr().String())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	answered := make(chan struct{})
+	go func() {
+		ic.GetCurrentProtocol()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Error("client stayed locked while probing")
+	}
+	cancel()
+	<-done
+}
+
+func TestProbeProtocolsRecordsPerNetwork(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	network := "office"
+	cfg.NetworkFingerprint = func() string { return network }
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	ic.protocolEngine.SetNetwork(network)
+	ic.protocolEngine.MarkProtocolUnavailable(protocol.HTTP2)
+	if ic.AvailableProtocols()[0].Available {
+		t.Fatal("expected HTTP2 to be unavailable")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	network = "cafe"
+	ic.ProbeProtocols(context.Background(), closed)
+	if got := ic.protocolEngine.GetNetwork(); got != "cafe" {
+		t.Errorf("expected the probe to record results for the current network, got %q", got)
+	}
+
+	// HTTP2 was only disabled on the office network
+	network = "office"
+	if ic.AvailableProtocols()[0].Available {
+		t.Error("expected HTTP2 to stay unavailable on the office network")
+	}
+}
+
+func TestStatsFileSurvivesRestart(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	cfg.StatsFile = filepath.Join(t.TempDir(), "stats.json")
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	ic.protocolEngine.MarkProtocolUnavailable(protocol.HTTP2)
+	ic.Close()
+
+	restarted, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer restarted.Close()
+	if restarted.AvailableProtocols()[0].Available {
+		t.Error("expected HTTP2 to stay unavailable after a restart")
+	}
+}
@@ -0,0 +1,9 @@
+package client
+
+import "context"
+
+// WaitUntilReady blocks until Connect has established a connection over any
+// protocol, or until ctx is done
+func (ic *IntegratedClient) WaitUntilReady(ctx context.Context) error {
+	return ic.ready.Wait(ctx)
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/circuitbreaker"
+)
+
+// stateFormatVersion is the version of the ExportState format
+const stateFormatVersion = 1
+
+// StateStore holds the state an active client shares with its standby
+type StateStore interface {
+	// Load returns the saved state, or nil if nothing was saved yet
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FileStateStore is a StateStore in a file, for example on storage shared
+// by the active and the standby host
+type FileStateStore struct {
+	Path string
+}
+
+// Load reads the state file. A missing file is not an error.
+func (s *FileStateStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client state: %w", err)
+	}
+	return data, nil
+}
+
+// Save replaces the state file, so a standby never reads half of it
+func (s *FileStateStore) Save(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write client state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write client state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write client state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to write client state: %w", err)
+	}
+	return nil
+}
+
+// exportedState is the JSON document written by ExportState
+type exportedState struct {
+	Version        int                      `json:"version"`
+	ProtocolStats  json.RawMessage          `json:"protocol_stats"`
+	CircuitBreaker *circuitbreaker.Snapshot `json:"circuit_breaker"`
+}
+
+// ExportState serializes the protocol statistics and the circuit breaker
+// state to JSON
+func (ic *IntegratedClient) ExportState() ([]byte, error) {
+	stats, err := ic.protocolEngine.ExportStats()
+	if err != nil {
+		return nil, err
+	}
+	breaker := ic.circuitBreaker.Snapshot()
+	return json.Marshal(exportedState{
+		Version:        stateFormatVersion,
+		ProtocolStats:  stats,
+		CircuitBreaker: &breaker,
+	})
+}
+
+// ImportState takes over the protocol statistics and circuit breaker state
+// written by ExportState
+func (ic *IntegratedClient) ImportState(data []byte) error {
+	var doc exportedState
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid client state: %w", err)
+	}
+	if doc.Version != stateFormatVersion {
+		return fmt.Errorf("unsupported client state version %d", doc.Version)
+	}
+	if len(doc.ProtocolStats) > 0 {
+		if err := ic.protocolEngine.ImportStats(doc.ProtocolStats); err != nil {
+			return err
+		}
+	}
+	if doc.CircuitBreaker != nil {
+		ic.circuitBreaker.Restore(*doc.CircuitBreaker)
+	}
+	return nil
+}
+
+// SaveState writes the client state to Config.StateStore
+func (ic *IntegratedClient) SaveState() error {
+	if ic.config.StateStore == nil {
+		return nil
+	}
+	data, err := ic.ExportState()
+	if err != nil {
+		return err
+	}
+	return ic.config.StateStore.Save(data)
+}
+
+// Promote makes a standby client take over: it loads the state the active
+// client saved to Config.StateStore and connects to address. A state that
+// cannot be loaded is logged, and the client connects without it.
+func (ic *IntegratedClient) Promote(ctx context.Context, address string) error {
+	if ic.config.StateStore != nil {
+		data, err := ic.config.StateStore.Load()
+		if err == nil && data != nil {
+			err = ic.ImportState(data)
+		}
+		if err != nil {
+			log.Printf("Promoting without the saved client state: %v", err)
+		}
+	}
+	return ic.Connect(ctx, address)
+}
+
+// startStateSaving starts saving the state periodically if a state store is
+// configured. ic.mu must be held.
+func (ic *IntegratedClient) startStateSaving() {
+	if ic.config.StateStore == nil || ic.config.StateSaveInterval <= 0 {
+		return
+	}
+	ic.stateSaveOnce.Do(func() {
+		go ic.stateSaveLoop(ic.config.StateSaveInterval)
+	})
+}
+
+// stopStateSaving stops the save loop and saves the state a last time if
+// the client ever connected. ic.mu must be held.
+func (ic *IntegratedClient) stopStateSaving() {
+	select {
+	case <-ic.stateStop:
+		return
+	default:
+		close(ic.stateStop)
+	}
+	if ic.address == "" {
+		return
+	}
+	if err := ic.SaveState(); err != nil {
+		log.Printf("Error saving client state: %v", err)
+	}
+}
+
+// stateSaveLoop saves the state every interval
+func (ic *IntegratedClient) stateSaveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ic.stateStop:
+			return
+		case <-ticker.C:
+			if err := ic.SaveState(); err != nil {
+				log.Printf("Error saving client state: %v", err)
+			}
+		}
+	}
+}
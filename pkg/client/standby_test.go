@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/circuitbreaker"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+func TestPromoteTakesOverState(t *testing.T) {
+	t.Setenv("TESTING", "true")
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP2, protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	cfg.StateStore = &FileStateStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	primary, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer primary.Close()
+	primary.protocolEngine.MarkProtocolUnavailable(protocol.HTTP2)
+	for i := 0; i < 3; i++ {
+		primary.circuitBreaker.Execute(context.Background(), func() error { return errors.New("relay unavailable") })
+	}
+	if err := primary.SaveState(); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	// A standby that never connected leaves the saved state alone
+	idle, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	idle.Close()
+
+	standby, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer standby.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	standby.Promote(ctx, "127.0.0.1:1")
+
+	if standby.AvailableProtocols()[0].Available {
+		t.Error("expected HTTP2 to stay unavailable after promotion")
+	}
+	if state := standby.circuitBreaker.State(); state != circuitbreaker.Open {
+		t.Errorf("expected the circuit breaker to stay open, got %v", state)
+	}
+}
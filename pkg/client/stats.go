@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// loadStats restores the protocol statistics from Config.StatsFile. A
+// missing file is not an error.
+func (ic *IntegratedClient) loadStats() error {
+	if ic.config.StatsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(ic.config.StatsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read protocol stats: %w", err)
+	}
+	return ic.protocolEngine.ImportStats(data)
+}
+
+// saveStats writes the protocol statistics to Config.StatsFile
+func (ic *IntegratedClient) saveStats() error {
+	if ic.config.StatsFile == "" {
+		return nil
+	}
+	data, err := ic.protocolEngine.ExportStats()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ic.config.StatsFile, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write protocol stats: %w", err)
+	}
+	return nil
+}
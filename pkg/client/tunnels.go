@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+// ErrTunnelsUnsupported is returned by the tunnel operations of a client
+// that is not connected over the relay connection of the HTTP/1 fallback
+var ErrTunnelsUnsupported = errors.New("tunnels need the relay connection of the http/1.1 fallback")
+
+// ErrPlaintextToken is returned by the HTTP/1 fallback when it would have
+// to send the token without TLS and Config.InsecurePlaintext is not set
+var ErrPlaintextToken = errors.New("http/1.1 fallback refuses to send the token without TLS")
+
+// relayClient returns the relay client of the current connection
+func (ic *IntegratedClient) relayClient() (*relay.Client, error) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	if ic.currentProtocol != protocol.HTTP1 {
+		return nil, fmt.Errorf("%w: connected via %s", ErrTunnelsUnsupported, ic.currentProtocol)
+	}
+	client, ok := ic.clients[protocol.HTTP1].(*relay.Client)
+	if !ok {
+		return nil, fmt.Errorf("%w: not connected", ErrTunnelsUnsupported)
+	}
+	return client, nil
+}
+
+// CreateTunnel creates a tunnel over the relay connection like
+// relay.Client.CreateTunnelContext
+func (ic *IntegratedClient) CreateTunnel(ctx context.Context, localPort int, remoteHost string, remotePort int) (string, error) {
+	client, err := ic.relayClient()
+	if err != nil {
+		return "", err
+	}
+	return client.CreateTunnelContext(ctx, localPort, remoteHost, remotePort)
+}
+
+// CloseTunnel closes a tunnel created with CreateTunnel
+func (ic *IntegratedClient) CloseTunnel(tunnelID string) error {
+	client, err := ic.relayClient()
+	if err != nil {
+		return err
+	}
+	return client.CloseTunnel(tunnelID)
+}
+
+// ListTunnels returns copies of the tunnels of the relay connection, or nil
+// if the client is not connected over it
+func (ic *IntegratedClient) ListTunnels() []*relay.Tunnel {
+	client, err := ic.relayClient()
+	if err != nil {
+		return nil
+	}
+	return client.ListTunnels()
+}
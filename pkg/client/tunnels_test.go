@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/relay"
+)
+
+// startAuthRelay runs a relay that accepts the token "secret", sends the
+// tokens it was offered on tokens and registers tunnels
+func startAuthRelay(t *testing.T, tokens chan<- string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				encoder := json.NewEncoder(conn)
+				var msg map[string]interface{}
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil || json.Unmarshal(line, &msg) != nil {
+						return
+					}
+					switch msg["type"] {
+					case relay.MessageTypeHello:
+						encoder.Encode(map[string]interface{}{"type": relay.MessageTypeHello, "version": "2.0"})
+					case relay.MessageTypeAuth:
+						token, _ := msg["token"].(string)
+						tokens <- token
+						status := "success"
+						if token != "secret" {
+							status = "failed"
+						}
+						encoder.Encode(map[string]interface{}{"type": relay.MessageTypeAuthResponse, "status": status})
+					case relay.MessageTypeTunnelInfo:
+						encoder.Encode(map[string]interface{}{
+							"type": relay.MessageTypeTunnelResponse, "request_id": msg["request_id"],
+							"status": "success", "tunnel_id": "srv-1",
+						})
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestHTTP1FallbackRefusesPlaintextToken(t *testing.T) {
+	t.Setenv("TESTING", "true")
+	tokens := make(chan string, 1)
+	address := startAuthRelay(t, tokens)
+
+	cfg := DefaultConfig()
+	cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP1}
+	cfg.HealthCheckEnabled = false
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.Token = "secret"
+	ic, err := NewIntegratedClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer ic.Close()
+
+	if err := ic.Connect(context.Background(), address); err == nil {
+		t.Error("expected connect without TLS to fail")
+	}
+	if _, err := ic.connectHTTP1(context.Background(), address, ""); !errors.Is(err, ErrPlaintextToken) {
+		t.Errorf("expected ErrPlaintextToken, got %v", err)
+	}
+	select {
+	case token := <-tokens:
+		t.Errorf("token %q sent without TLS", token)
+	default:
+	}
+}
+
+func TestHTTP1FallbackAuthenticates(t *testing.T) {
+	t.Setenv("TESTING", "true")
+	tokens := make(chan string, 4)
+	address := startAuthRelay(t, tokens)
+
+	newClient := func(token string) *IntegratedClient {
+		cfg := DefaultConfig()
+		cfg.ProtocolOrder = []protocol.Protocol{protocol.HTTP1}
+		cfg.HealthCheckEnabled = false
+		cfg.ConnectTimeout = 5 * time.Second
+		cfg.Token = token
+		cfg.InsecurePlaintext = true
+		ic, err := NewIntegratedClient(cfg)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		t.Cleanup(func() { ic.Close() })
+		return ic
+	}
+
+	rejected := newClient("wrong")
+	if err := rejected.Connect(context.Background(), address); err == nil {
+		t.Error("expected connect with a rejected token to fail")
+	}
+	if token := <-tokens; token != "wrong" {
+		t.Errorf("expected the configured token, got %q", token)
+	}
+	if _, err := rejected.CreateTunnel(context.Background(), 1, "10.0.0.1", 3389); !errors.Is(err, ErrTunnelsUnsupported) {
+		t.Errorf("expected ErrTunnelsUnsupported without a connection, got %v", err)
+	}
+
+	ic := newClient("secret")
+	if err := ic.Connect(context.Background(), address); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	<-tokens
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	localPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tunnelID, err := ic.CreateTunnel(context.Background(), localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel over the fallback: %v", err)
+	}
+	if tunnels := ic.ListTunnels(); len(tunnels) != 1 || tunnels[0].ID != tunnelID {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+	if err := ic.CloseTunnel(tunnelID); err != nil {
+		t.Errorf("failed to close tunnel: %v", err)
+	}
+	if len(ic.ListTunnels()) != 0 {
+		t.Error("expected the tunnel to be closed")
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+// connected records the address of a successful Connect and starts upgrade
+// probing if enabled. ic.mu must be held.
+func (ic *IntegratedClient) connected(address string) {
+	ic.address = address
+	ic.startStateSaving()
+	if !ic.config.EnableProtocolUpgrade || ic.config.UpgradeProbeInterval <= 0 {
+		return
+	}
+	ic.upgradeOnce.Do(func() {
+		go ic.upgradeLoop(ic.config.UpgradeProbeInterval)
+	})
+}
+
+// stopUpgradeProbing stops the upgrade loop. ic.mu must be held.
+func (ic *IntegratedClient) stopUpgradeProbing() {
+	select {
+	case <-ic.upgradeStop:
+	default:
+		close(ic.upgradeStop)
+	}
+}
+
+// upgradeLoop probes the preferred protocols every interval
+func (ic *IntegratedClient) upgradeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ic.upgradeStop:
+			return
+		case <-ticker.C:
+			if _, err := ic.TryProtocolUpgrade(context.Background()); err != nil {
+				log.Printf("Protocol upgrade probe failed: %v", err)
+			}
+		}
+	}
+}
+
+// TryProtocolUpgrade probes the protocols preferred over the current one, most
+// preferred first, and switches to the first that connects. Nothing is probed
+// while a recent protocol switch is cooling down. It reports whether the
+// client switched protocols. The candidates are dialed without holding
+// ic.mu; it is only taken to swap the connection in.
+func (ic *IntegratedClient) TryProtocolUpgrade(ctx context.Context) (bool, error) {
+	ic.mu.RLock()
+	address, current, tenantID := ic.address, ic.currentProtocol, ic.tenantID
+	connected := ic.isConnectedLocked()
+	ic.mu.RUnlock()
+
+	if address == "" || !connected {
+		return false, nil
+	}
+	if ic.protocolEngine.InSwitchCooldown() {
+		return false, nil
+	}
+
+	var lastErr error
+	for _, candidate := range ic.protocolEngine.GetUpgradeCandidates(current) {
+		start := time.Now()
+		client, err := ic.dialProtocol(ctx, address, candidate, tenantID)
+		if err != nil {
+			ic.protocolEngine.RecordError(candidate, err)
+			lastErr = err
+			continue
+		}
+		ic.protocolEngine.RecordSuccess(candidate, time.Since(start))
+
+		ic.mu.Lock()
+		// The connection may have changed while the candidate was dialed
+		if ic.address != address || ic.currentProtocol != current || !ic.isConnectedLocked() {
+			ic.mu.Unlock()
+			closeProtocolClient(candidate, client)
+			return false, nil
+		}
+		replaced := ic.clients[candidate]
+		ic.clients[candidate] = client
+		old := ic.upgradeTo(candidate)
+		ic.mu.Unlock()
+
+		closeProtocolClient(current, old)
+		if replaced != nil {
+			closeProtocolClient(candidate, replaced)
+		}
+		return true, nil
+	}
+	return false, lastErr
+}
+
+// upgradeTo makes the freshly connected newProtocol current and returns the
+// client of the protocol it replaces, for the caller to close once ic.mu is
+// released. ic.mu must be held.
+func (ic *IntegratedClient) upgradeTo(newProtocol protocol.Protocol) interface{} {
+	oldProtocol := ic.currentProtocol
+	old := ic.clients[oldProtocol]
+	delete(ic.clients, oldProtocol)
+
+	ic.currentProtocol = newProtocol
+	ic.protocolEngine.RecordSwitch()
+	ic.ready.Set(ic.isConnectedLocked())
+
+	if ic.metrics != nil {
+		ic.metrics.IncProtocolSwitches(oldProtocol.String(), newProtocol.String())
+	}
+	ic.notifySwitch(oldProtocol, newProtocol)
+	log.Printf("Upgraded connection from %s to %s", oldProtocol, newProtocol)
+	return old
+}
@@ -0,0 +1,164 @@
+// Package clock abstracts the passage of time so time-based logic can be
+// tested without sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock backed by the time package
+type Real struct{}
+
+// Now returns the current time
+func (Real) Now() time.Time { return time.Now() }
+
+// Since returns the time elapsed since t
+func (Real) Since(t time.Time) time.Duration { return time.Since(t) }
+
+// After waits for d to elapse and then sends the current time
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep pauses the current goroutine for d
+func (Real) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewTicker returns a ticker ticking every d
+func (Real) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+// Fake is a Clock that only moves when Advance is called. Timers, sleeps
+// and tickers fire once the fake time reaches their deadline.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Since returns the fake time elapsed since t
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After returns a channel that receives the fake time once d has passed
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.addWaiter(d, 0).ch
+}
+
+// Sleep blocks until the fake time has advanced by d
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// NewTicker returns a ticker driven by the fake time
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return &fakeTicker{clock: f, waiter: f.addWaiter(d, d)}
+}
+
+// Advance moves the fake time forward by d and fires every timer that is
+// due. Like time.Ticker, a ticker that falls behind delivers one tick.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.ch <- f.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	f.waiters = pending
+}
+
+// Waiters returns the number of pending timers, sleeps and tickers. Tests
+// use it to wait until a goroutine is blocked on the clock.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+func (f *Fake) addWaiter(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &fakeWaiter{at: f.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		w.ch <- f.now
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+func (f *Fake) removeWaiter(w *fakeWaiter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	waiter *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.waiter.ch }
+func (t *fakeTicker) Stop()               { t.clock.removeWaiter(t.waiter) }
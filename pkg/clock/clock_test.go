@@ -0,0 +1,81 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfterFiresOnAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	ch := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Second)
+	select {
+	case now := <-ch:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Errorf("unexpected fire time %v", now)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("expected fired timer to be removed, got %d waiters", f.Waiters())
+	}
+	if f.Since(start) != time.Minute {
+		t.Errorf("expected one minute since start, got %v", f.Since(start))
+	}
+}
+
+func TestFakeSleepUnblocksOnAdvance(t *testing.T) {
+	f := NewFake(time.Now())
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Hour)
+		close(done)
+	}()
+
+	for f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.Advance(time.Hour)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sleep did not return")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Now())
+	ticker := f.NewTicker(10 * time.Second)
+
+	// Falling behind delivers a single tick
+	f.Advance(35 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("expected only one pending tick")
+	default:
+	}
+
+	f.Advance(5 * time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatal("ticker did not tick at 40s")
+	}
+
+	ticker.Stop()
+	if f.Waiters() != 0 {
+		t.Errorf("expected stopped ticker to be removed, got %d waiters", f.Waiters())
+	}
+}
@@ -2,25 +2,67 @@ package config
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/tunnel"
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultProtocolStatsPath is where the protocol results are kept across
+// runs with protocol.per_network_order
+const DefaultProtocolStatsPath = "/var/lib/cloudbridge-client/protocol-stats.json"
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type Config struct {
+	// SchemaVersion is the version of this file's layout. Configs of the
+	// v1 client set it to 1 and are migrated when loaded.
+	SchemaVersion int `yaml:"schema_version"`
+
 	TLS struct {
 		Enabled  bool   `yaml:"enabled"`
 		CertFile string `yaml:"cert_file"`
 		KeyFile  string `yaml:"key_file"`
 		CAFile   string `yaml:"ca_file"`
+		// AppendSystemCAs trusts the system CA pool as well as CAFile,
+		// which then no longer pins the relay to the private CA
+		AppendSystemCAs bool `yaml:"append_system_cas"`
+		// AllowedDirs are further directories the certificate, key and CA
+		// files may be in. They must only be writable by trusted users.
+		AllowedDirs []string `yaml:"allowed_dirs"`
+		// RequireOCSP rejects relay certificates that are revoked or come
+		// without a stapled OCSP response
+		RequireOCSP bool `yaml:"require_ocsp"`
+		// ALPN lists the protocols offered during the TLS handshake, in
+		// order of preference (e.g. "h2", "cloudbridge/2")
+		ALPN []string `yaml:"alpn"`
 	} `yaml:"tls"`
 
 	Server struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
 		JWTToken string `yaml:"jwt_token"`
+		// Failover lists alternate relays (host:port) to migrate to when
+		// the current relay drains
+		Failover []string `yaml:"failover"`
+		// ShutdownTimeout is how long requests in flight may finish on
+		// SIGTERM before the connection is closed forcibly (e.g. "10s")
+		ShutdownTimeout string `yaml:"shutdown_timeout"`
+		// MinVersion is the oldest relay version the client accepts
+		// (e.g. "2.0"); older relays are rejected during the handshake
+		MinVersion string `yaml:"min_version"`
+		// PoolSize is the number of connections to the relay tunnels are
+		// spread across; one or less uses a single connection
+		PoolSize int `yaml:"pool_size"`
 	} `yaml:"server"`
 
 	Auth struct {
@@ -31,8 +73,49 @@ type Config struct {
 		LocalPort      int `yaml:"local_port"`
 		ReconnectDelay int `yaml:"reconnect_delay"`
 		MaxRetries     int `yaml:"max_retries"`
+		// MaxBufferedBytes caps memory used by buffers of all tunnels
+		// together. A negative value disables the limit.
+		MaxBufferedBytes int64 `yaml:"max_buffered_bytes"`
+		// AllowedDestinations restricts the remote hosts tunnels may lead
+		// to: host names, "*.example.com" wildcards, IP addresses or CIDR
+		// ranges. Empty allows every host not denied.
+		AllowedDestinations []string `yaml:"allowed_destinations"`
+		// DeniedDestinations are remote hosts tunnels must not lead to,
+		// in the same format. They win over AllowedDestinations.
+		DeniedDestinations []string `yaml:"denied_destinations"`
+		// ResolveDestinations rejects tunnels to host names that do not
+		// resolve even where no address rule applies. Address rules
+		// always apply to the addresses of names.
+		ResolveDestinations bool `yaml:"resolve_destinations"`
 	} `yaml:"tunnel"`
 
+	// Limits are safety bounds protecting the client and relay from
+	// runaway resource use
+	Limits struct {
+		// MaxTunnels caps the number of tunnels a client holds at once.
+		// A negative value disables the limit.
+		MaxTunnels int `yaml:"max_tunnels"`
+		// MaxConcurrentHandshakes caps the connects and handshakes to the
+		// relay in progress at once; the rest wait in turn. A negative
+		// value disables the limit.
+		MaxConcurrentHandshakes int `yaml:"max_concurrent_handshakes"`
+	} `yaml:"limits"`
+
+	// Reconnect controls the backoff between attempts to reach the relay
+	Reconnect struct {
+		// MaxRetries is how often a failed attempt is retried before the
+		// client gives up, DefaultReconnectMaxRetries if not set. Zero or a
+		// negative value retries forever, which suits unattended services.
+		MaxRetries int `yaml:"max_retries"`
+		// InitialDelay is the delay before the first retry; it doubles per
+		// retry up to MaxDelay
+		InitialDelay string `yaml:"initial_delay"`
+		MaxDelay     string `yaml:"max_delay"`
+		// Jitter randomizes every delay by up to this fraction. Zero uses
+		// the default and a negative value disables it.
+		Jitter float64 `yaml:"jitter"`
+	} `yaml:"reconnect"`
+
 	Logging struct {
 		Level      string `yaml:"level"`
 		File       string `yaml:"file"`
@@ -40,12 +123,31 @@ type Config struct {
 		MaxBackups int    `yaml:"max_backups"`
 		MaxAge     int    `yaml:"max_age"`
 		Compress   bool   `yaml:"compress"`
+		// ConnectionEvents, if set, is a file connection events are
+		// appended to as JSON lines
+		ConnectionEvents string `yaml:"connection_events"`
 	} `yaml:"logging"`
 
 	// New fields for v2.0 support
 	Protocol struct {
 		Version string `yaml:"version"`
 		Features []string `yaml:"features"`
+		// Compression enables connection-level compression of the control
+		// stream if the relay agrees. Supported: "deflate".
+		Compression string `yaml:"compression"`
+		// Quality sets the limits past which a working protocol counts as
+		// degraded and is switched away from. Empty limits are not checked.
+		Quality struct {
+			MaxRTT    string  `yaml:"max_rtt"`
+			MaxJitter string  `yaml:"max_jitter"`
+			MaxLoss   float64 `yaml:"max_loss"`
+		} `yaml:"quality"`
+		// PerNetworkOrder remembers which protocols work on each network,
+		// identified by its default gateway, and tries those first there
+		PerNetworkOrder bool `yaml:"per_network_order"`
+		// StatsFile keeps the protocol results across runs. It defaults
+		// to DefaultProtocolStatsPath with per_network_order.
+		StatsFile string `yaml:"stats_file"`
 	} `yaml:"protocol"`
 
 	Tenant struct {
@@ -53,19 +155,52 @@ type Config struct {
 		Name string `yaml:"name"`
 	} `yaml:"tenant"`
 
+	// Labels tag the client instance (e.g. region, role, cluster). They are
+	// attached to every metric, prefixed to every log line and sent to the
+	// relay in the handshake.
+	Labels map[string]string `yaml:"labels"`
+
 	Metrics struct {
 		Enabled  bool   `yaml:"enabled"`
 		Port     int    `yaml:"port"`
 		Path     string `yaml:"path"`
 		Interval string `yaml:"interval"`
+
+		// StatsD push sink, usable alongside or instead of the Prometheus endpoint
+		StatsD struct {
+			Enabled       bool   `yaml:"enabled"`
+			Address       string `yaml:"address"`
+			Prefix        string `yaml:"prefix"`
+			FlushInterval string `yaml:"flush_interval"`
+			Tags          bool   `yaml:"tags"`
+		} `yaml:"statsd"`
 	} `yaml:"metrics"`
 
 	Health struct {
 		Enabled       bool   `yaml:"enabled"`
 		Path          string `yaml:"path"`
 		CheckInterval string `yaml:"check_interval"`
+
+		// Checks enables or disables individual health checks by name.
+		// Checks that are not listed stay enabled.
+		Checks map[string]bool `yaml:"checks"`
+		// MetricsURL overrides the URL probed by the metrics_endpoint check
+		MetricsURL string `yaml:"metrics_url"`
 	} `yaml:"health"`
 
+	// Webhooks post lifecycle events to an external endpoint
+	Webhooks struct {
+		Enabled bool   `yaml:"enabled"`
+		URL     string `yaml:"url"`
+		// Secret keys the HMAC-SHA256 signature of every payload
+		Secret string `yaml:"secret"`
+		// Events lists the subscribed events; empty subscribes to all
+		Events     []string `yaml:"events"`
+		QueueSize  int      `yaml:"queue_size"`
+		MaxRetries int      `yaml:"max_retries"`
+		Timeout    string   `yaml:"timeout"`
+	} `yaml:"webhooks"`
+
 	// P2P Mesh configuration
 	WireGuard struct {
 		Enabled      bool   `yaml:"enabled"`
@@ -73,6 +208,12 @@ type Config struct {
 		ListenPort   int    `yaml:"listen_port"`
 		MTU          int    `yaml:"mtu"`
 		PrivateKeyFile string `yaml:"private_key_file"`
+		// DiscoveryGroup is the multicast group peers announce themselves
+		// on, DiscoveryTTL how many routers announcements may cross, and
+		// DiscoverySeeds are peers announced to where multicast is unavailable
+		DiscoveryGroup string   `yaml:"discovery_group"`
+		DiscoveryTTL   int      `yaml:"discovery_ttl"`
+		DiscoverySeeds []string `yaml:"discovery_seeds"`
 	} `yaml:"wireguard"`
 
 	// Enhanced QUIC configuration
@@ -91,6 +232,11 @@ type Config struct {
 		KyberSecurityLevel   int  `yaml:"kyber_security_level"`
 		DilithiumSecurityLevel int `yaml:"dilithium_security_level"`
 		HybridMode           bool `yaml:"hybrid_mode"`
+		// Require fails handshakes with relays that do not negotiate
+		// post-quantum levels instead of falling back to classical crypto
+		Require              bool `yaml:"require"`
+		// SelfTest runs a Kyber round trip when the mesh client starts
+		SelfTest             bool `yaml:"self_test"`
 	} `yaml:"quantum"`
 
 	// AI/ML configuration
@@ -166,91 +312,135 @@ func LoadConfig(configPath string) (*Config, error) {
 	data, err := os.ReadFile(cleanPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			config := &Config{}
-			// Set defaults if not provided
-			if config.Server.Host == "" {
-				config.Server.Host = "edge.2gc.uk"
-			}
-			if config.Server.Port == 0 {
-				config.Server.Port = 51820
-			}
-			if config.Tunnel.LocalPort == 0 {
-				config.Tunnel.LocalPort = 3389
-			}
-			if config.Tunnel.ReconnectDelay == 0 {
-				config.Tunnel.ReconnectDelay = 5
-			}
-			if config.Tunnel.MaxRetries == 0 {
-				config.Tunnel.MaxRetries = 3
-			}
-			if config.Protocol.Version == "" {
-				config.Protocol.Version = "2.0"
-			}
-			if config.Metrics.Port == 0 {
-				config.Metrics.Port = 9090
-			}
-			if config.Metrics.Path == "" {
-				config.Metrics.Path = "/metrics"
-			}
-			if config.Metrics.Interval == "" {
-				config.Metrics.Interval = "15s"
-			}
-			if config.Health.Path == "" {
-				config.Health.Path = "/health"
-			}
-			if config.Health.CheckInterval == "" {
-				config.Health.CheckInterval = "30s"
-			}
+			config := newConfig()
+			applyDefaults(config)
 			return config, nil
 		}
 		return nil, fmt.Errorf("error reading config file: %v", err)
 	}
 
-	// Parse YAML
-	config := &Config{}
+	return parseConfig(data, cleanPath)
+}
+
+// parseConfig parses a YAML configuration read from source, migrating v1
+// configurations and applying defaults
+func parseConfig(data []byte, source string) (*Config, error) {
+	config := newConfig()
 	if err := yaml.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("error parsing config file: %v", err)
 	}
 
-	// Set defaults if not provided
-	if config.Server.Host == "" {
-		config.Server.Host = "edge.2gc.uk"
+	if IsV1(config) {
+		migrated, warnings := Migrate(config)
+		log.Printf("Config %s uses the v1 schema, migrating it to v2", source)
+		for _, w := range warnings {
+			log.Printf("Config migration: %s", w)
+		}
+		config = migrated
 	}
-	if config.Server.Port == 0 {
-		config.Server.Port = 51820
+
+	applyDefaults(config)
+
+	return config, nil
+}
+
+// DefaultReconnectMaxRetries is how often a failed attempt to reach the
+// relay is retried when reconnect.max_retries is not set
+const DefaultReconnectMaxRetries = 5
+
+// DefaultMaxConcurrentHandshakes is how many connects and handshakes to the
+// relay may be in progress at once when limits.max_concurrent_handshakes is
+// not set
+const DefaultMaxConcurrentHandshakes = 8
+
+// newConfig returns a config holding the defaults of the fields whose zero
+// value means something else, for a configuration to be parsed into
+func newConfig() *Config {
+	config := &Config{}
+	config.Reconnect.MaxRetries = DefaultReconnectMaxRetries
+	return config
+}
+
+// applyDefaults sets default values for fields that are not provided
+func applyDefaults(c *Config) {
+	if c.SchemaVersion == 0 {
+		c.SchemaVersion = SchemaVersionV2
+	}
+	if c.Server.Host == "" {
+		c.Server.Host = "edge.2gc.uk"
+	}
+	if c.Server.Port == 0 {
+		c.Server.Port = 51820
 	}
-	if config.Tunnel.LocalPort == 0 {
-		config.Tunnel.LocalPort = 3389
+	if c.Server.ShutdownTimeout == "" {
+		c.Server.ShutdownTimeout = "10s"
 	}
-	if config.Tunnel.ReconnectDelay == 0 {
-		config.Tunnel.ReconnectDelay = 5
+	if c.Tunnel.LocalPort == 0 {
+		c.Tunnel.LocalPort = 3389
 	}
-	if config.Tunnel.MaxRetries == 0 {
-		config.Tunnel.MaxRetries = 3
+	if c.Tunnel.ReconnectDelay == 0 {
+		c.Tunnel.ReconnectDelay = 5
+	}
+	if c.Tunnel.MaxRetries == 0 {
+		c.Tunnel.MaxRetries = 3
+	}
+	if c.Tunnel.MaxBufferedBytes == 0 {
+		c.Tunnel.MaxBufferedBytes = tunnel.DefaultMaxBufferedBytes
+	}
+	if c.Limits.MaxTunnels == 0 {
+		c.Limits.MaxTunnels = 256
+	}
+	if c.Limits.MaxConcurrentHandshakes == 0 {
+		c.Limits.MaxConcurrentHandshakes = DefaultMaxConcurrentHandshakes
+	}
+	if c.Reconnect.InitialDelay == "" {
+		c.Reconnect.InitialDelay = "1s"
+	}
+	if c.Reconnect.MaxDelay == "" {
+		c.Reconnect.MaxDelay = "30s"
 	}
 	// Set protocol defaults
-	if config.Protocol.Version == "" {
-		config.Protocol.Version = "2.0"
+	if c.Protocol.Version == "" {
+		c.Protocol.Version = "2.0"
 	}
 	// Set metrics defaults
-	if config.Metrics.Port == 0 {
-		config.Metrics.Port = 9090
+	if c.Metrics.Port == 0 {
+		c.Metrics.Port = 9090
 	}
-	if config.Metrics.Path == "" {
-		config.Metrics.Path = "/metrics"
+	if c.Metrics.Path == "" {
+		c.Metrics.Path = "/metrics"
 	}
-	if config.Metrics.Interval == "" {
-		config.Metrics.Interval = "15s"
+	if c.Metrics.Interval == "" {
+		c.Metrics.Interval = "15s"
+	}
+	if c.Metrics.StatsD.Address == "" {
+		c.Metrics.StatsD.Address = "127.0.0.1:8125"
+	}
+	if c.Metrics.StatsD.FlushInterval == "" {
+		c.Metrics.StatsD.FlushInterval = "10s"
+	}
+	if c.Webhooks.QueueSize == 0 {
+		c.Webhooks.QueueSize = 100
+	}
+	if c.Webhooks.MaxRetries == 0 {
+		c.Webhooks.MaxRetries = 3
+	}
+	if c.Webhooks.Timeout == "" {
+		c.Webhooks.Timeout = "5s"
 	}
 	// Set health defaults
-	if config.Health.Path == "" {
-		config.Health.Path = "/health"
+	if c.Health.Path == "" {
+		c.Health.Path = "/health"
 	}
-	if config.Health.CheckInterval == "" {
-		config.Health.CheckInterval = "30s"
+	if c.Health.CheckInterval == "" {
+		c.Health.CheckInterval = "30s"
 	}
+}
 
-	return config, nil
+// HealthCheckEnabled reports whether the named health check should run
+func (c *Config) HealthCheckEnabled(name string) bool {
+	enabled, ok := c.Health.Checks[name]
+	return !ok || enabled
 }
 
 // Validate проверяет корректность конфигурации
@@ -281,10 +471,133 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for _, endpoint := range c.Server.Failover {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return fmt.Errorf("invalid failover endpoint %q: %w", endpoint, err)
+		}
+	}
+
+	if c.Server.MinVersion != "" {
+		if _, err := protocol.CompareVersions(c.Server.MinVersion, c.Server.MinVersion); err != nil {
+			return fmt.Errorf("invalid server min version: %w", err)
+		}
+	}
+
+	if c.Server.ShutdownTimeout != "" {
+		if d, err := time.ParseDuration(c.Server.ShutdownTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid server shutdown timeout: %s", c.Server.ShutdownTimeout)
+		}
+	}
+
+	if err := c.validateReconnect(); err != nil {
+		return err
+	}
+
+	for _, proto := range c.TLS.ALPN {
+		if proto == "" || len(proto) > 255 {
+			return fmt.Errorf("invalid TLS ALPN protocol: %q", proto)
+		}
+	}
+
+	if c.Metrics.StatsD.Enabled {
+		if c.Metrics.StatsD.Address == "" {
+			return fmt.Errorf("statsd address is required when statsd is enabled")
+		}
+		if _, err := time.ParseDuration(c.Metrics.StatsD.FlushInterval); err != nil {
+			return fmt.Errorf("invalid statsd flush interval: %s", c.Metrics.StatsD.FlushInterval)
+		}
+	}
+
+	if c.Health.MetricsURL != "" {
+		if u, err := url.Parse(c.Health.MetricsURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid health metrics url: %s", c.Health.MetricsURL)
+		}
+	}
+
+	if c.Webhooks.Enabled {
+		if u, err := url.Parse(c.Webhooks.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url: %s", c.Webhooks.URL)
+		}
+		if c.Webhooks.Secret == "" {
+			return fmt.Errorf("webhook secret is required when webhooks are enabled")
+		}
+		if d, err := time.ParseDuration(c.Webhooks.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid webhook timeout: %s", c.Webhooks.Timeout)
+		}
+	}
+
+	for name := range c.Labels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name: %q", name)
+		}
+	}
+
+	if c.SchemaVersion != 0 && c.SchemaVersion != SchemaVersionV2 {
+		return fmt.Errorf("unsupported config schema version: %d", c.SchemaVersion)
+	}
+
 	// Validate protocol version
 	if c.Protocol.Version != "" && c.Protocol.Version != "1.0.0" && c.Protocol.Version != "2.0" {
 		return fmt.Errorf("unsupported protocol version: %s", c.Protocol.Version)
 	}
 
+	switch c.Protocol.Compression {
+	case "", "none", "deflate":
+	default:
+		return fmt.Errorf("unsupported protocol compression: %s", c.Protocol.Compression)
+	}
+	if _, err := c.QualityThresholds(); err != nil {
+		return err
+	}
+
+	return nil
+} 
+
+// QualityThresholds returns the protocol quality limits of the configuration
+func (c *Config) QualityThresholds() (protocol.QualityThresholds, error) {
+	var thresholds protocol.QualityThresholds
+	for _, limit := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"max rtt", c.Protocol.Quality.MaxRTT, &thresholds.MaxRTT},
+		{"max jitter", c.Protocol.Quality.MaxJitter, &thresholds.MaxJitter},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(limit.value)
+		if err != nil || d <= 0 {
+			return thresholds, fmt.Errorf("invalid protocol quality %s: %s", limit.name, limit.value)
+		}
+		*limit.dst = d
+	}
+	thresholds.MaxLoss = c.Protocol.Quality.MaxLoss
+	if err := thresholds.Validate(); err != nil {
+		return thresholds, fmt.Errorf("invalid protocol quality: %w", err)
+	}
+	return thresholds, nil
+}
+
+// validateReconnect checks the reconnect backoff settings
+func (c *Config) validateReconnect() error {
+	var initial time.Duration
+	if c.Reconnect.InitialDelay != "" {
+		d, err := time.ParseDuration(c.Reconnect.InitialDelay)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid reconnect initial delay: %s", c.Reconnect.InitialDelay)
+		}
+		initial = d
+	}
+	if c.Reconnect.MaxDelay != "" {
+		d, err := time.ParseDuration(c.Reconnect.MaxDelay)
+		if err != nil || d <= 0 || d < initial {
+			return fmt.Errorf("invalid reconnect max delay: %s", c.Reconnect.MaxDelay)
+		}
+	}
+	if c.Reconnect.Jitter > 1 {
+		return fmt.Errorf("invalid reconnect jitter: %v", c.Reconnect.Jitter)
+	}
 	return nil
-} 
\ No newline at end of file
+}
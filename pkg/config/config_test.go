@@ -0,0 +1,166 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthCheckEnabled(t *testing.T) {
+	cfg := &Config{}
+	if !cfg.HealthCheckEnabled("metrics_endpoint") {
+		t.Error("checks must be enabled when not configured")
+	}
+
+	cfg.Health.Checks = map[string]bool{
+		"metrics_endpoint": false,
+		"tunnel_status":    true,
+	}
+	if cfg.HealthCheckEnabled("metrics_endpoint") {
+		t.Error("expected metrics_endpoint to be disabled")
+	}
+	if !cfg.HealthCheckEnabled("tunnel_status") || !cfg.HealthCheckEnabled("relay_connection") {
+		t.Error("expected other checks to stay enabled")
+	}
+}
+
+func TestValidateHealthMetricsURL(t *testing.T) {
+	cfg := &Config{}
+	applyDefaults(cfg)
+
+	cfg.Health.MetricsURL = "http://127.0.0.1:9100/metrics"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid metrics url rejected: %v", err)
+	}
+
+	cfg.Health.MetricsURL = "localhost:9100"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for metrics url without scheme")
+	}
+}
+
+func TestValidateTLSALPN(t *testing.T) {
+	cfg := &Config{}
+	applyDefaults(cfg)
+
+	cfg.TLS.ALPN = []string{"h2", "cloudbridge/2"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid ALPN protocols rejected: %v", err)
+	}
+
+	cfg.TLS.ALPN = []string{"h2", ""}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for empty ALPN protocol")
+	}
+}
+
+func TestValidateShutdownTimeout(t *testing.T) {
+	cfg := &Config{}
+	applyDefaults(cfg)
+	if cfg.Server.ShutdownTimeout != "10s" {
+		t.Errorf("expected default shutdown timeout 10s, got %q", cfg.Server.ShutdownTimeout)
+	}
+
+	for _, timeout := range []string{"soon", "0s", "-5s"} {
+		cfg.Server.ShutdownTimeout = timeout
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected error for shutdown timeout %q", timeout)
+		}
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	cfg := &Config{}
+	applyDefaults(cfg)
+	cfg.Webhooks.Enabled = true
+	cfg.Webhooks.URL = "https://hooks.example.com/cloudbridge"
+	cfg.Webhooks.Secret = "secret"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg.Webhooks.URL = "ftp://hooks.example.com"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for non-HTTP webhook url")
+	}
+
+	cfg.Webhooks.URL = "https://hooks.example.com/cloudbridge"
+	cfg.Webhooks.Secret = ""
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for missing webhook secret")
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	cfg := &Config{}
+	applyDefaults(cfg)
+	cfg.Labels = map[string]string{"region": "eu-west", "cluster_id": "a1"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"1region", "team-name", "__reserved", ""} {
+		cfg.Labels = map[string]string{name: "x"}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected error for label name %q", name)
+		}
+	}
+}
+
+func TestValidateReconnect(t *testing.T) {
+	cfg, err := parseConfig([]byte("reconnect:\n  jitter: 0.5\n"), "test")
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if cfg.Reconnect.MaxRetries != DefaultReconnectMaxRetries || cfg.Reconnect.InitialDelay != "1s" || cfg.Reconnect.MaxDelay != "30s" {
+		t.Errorf("unexpected reconnect defaults: %+v", cfg.Reconnect)
+	}
+
+	// Zero retries forever instead of being replaced by the default
+	zero, err := parseConfig([]byte("reconnect:\n  max_retries: 0\n"), "test")
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if zero.Reconnect.MaxRetries != 0 {
+		t.Errorf("expected max_retries 0 to be kept, got %d", zero.Reconnect.MaxRetries)
+	}
+
+	// Retrying forever is allowed
+	cfg.Reconnect.MaxRetries = -1
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg.Reconnect.MaxDelay = "500ms"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for max delay below initial delay")
+	}
+
+	cfg.Reconnect.MaxDelay = "30s"
+	cfg.Reconnect.Jitter = 1.5
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for jitter above 1")
+	}
+}
+
+func TestQualityThresholds(t *testing.T) {
+	cfg := &Config{}
+	cfg.Protocol.Quality.MaxRTT = "250ms"
+	cfg.Protocol.Quality.MaxLoss = 0.05
+	thresholds, err := cfg.QualityThresholds()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if thresholds.MaxRTT != 250*time.Millisecond || thresholds.MaxJitter != 0 || thresholds.MaxLoss != 0.05 {
+		t.Errorf("unexpected thresholds: %+v", thresholds)
+	}
+
+	cfg.Protocol.Quality.MaxJitter = "fast"
+	if _, err := cfg.QualityThresholds(); err == nil {
+		t.Error("expected invalid jitter to be rejected")
+	}
+	cfg.Protocol.Quality.MaxJitter = ""
+	cfg.Protocol.Quality.MaxLoss = 2
+	if _, err := cfg.QualityThresholds(); err == nil {
+		t.Error("expected loss above 1 to be rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import "fmt"
+
+// Config schema versions, set with the top-level schema_version field
+const (
+	SchemaVersionV1 = 1
+	SchemaVersionV2 = 2
+)
+
+// Warning describes a change made while migrating a config
+type Warning struct {
+	Field   string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// IsV1 reports whether cfg declares the v1 schema. Configs without a
+// schema_version are taken to be current: protocol.version names the relay
+// protocol, not the schema, so it does not tell v1 configs apart.
+func IsV1(cfg *Config) bool {
+	return cfg.SchemaVersion == SchemaVersionV1
+}
+
+// Migrate upgrades a v1 config to the v2 schema. The old config is not
+// modified. New fields are filled with their defaults and deprecated fields
+// are reported as warnings. The protocol version and features are kept as
+// written, so a v1 relay can still be targeted.
+func Migrate(old *Config) (*Config, []Warning) {
+	migrated := *old
+	migrated.SchemaVersion = SchemaVersionV2
+	warnings := []Warning{{
+		Field:   "schema_version",
+		Message: fmt.Sprintf("upgraded from %d to %d", SchemaVersionV1, SchemaVersionV2),
+	}}
+
+	if old.Auth.Secret != "" {
+		warnings = append(warnings, Warning{
+			Field:   "auth.secret",
+			Message: "deprecated, the v2 client authenticates with server.jwt_token",
+		})
+	}
+
+	if old.Tenant.ID == "" {
+		warnings = append(warnings, Warning{
+			Field:   "tenant.id",
+			Message: "not set, the client will connect without a tenant",
+		})
+	}
+
+	applyDefaults(&migrated)
+	return &migrated, warnings
+}
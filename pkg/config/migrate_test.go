@@ -0,0 +1,82 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrateV1Config(t *testing.T) {
+	old := &Config{SchemaVersion: SchemaVersionV1}
+	old.Protocol.Version = "1.0.0"
+	old.Protocol.Features = []string{"tls", "jwt", "tunneling", "http2"}
+	old.Auth.Secret = "shared-secret"
+	old.Server.Host = "relay.example.com"
+
+	if !IsV1(old) {
+		t.Fatal("expected config to be detected as v1")
+	}
+
+	migrated, warnings := Migrate(old)
+
+	if migrated.SchemaVersion != SchemaVersionV2 {
+		t.Errorf("expected schema version %d, got %d", SchemaVersionV2, migrated.SchemaVersion)
+	}
+	// The relay protocol is kept, so a v1 relay can still be targeted
+	if migrated.Protocol.Version != "1.0.0" || !reflect.DeepEqual(migrated.Protocol.Features, old.Protocol.Features) {
+		t.Errorf("protocol settings changed: %+v", migrated.Protocol)
+	}
+
+	// Defaults are filled in, explicit values are kept
+	if migrated.Server.Host != "relay.example.com" || migrated.Server.Port != 51820 {
+		t.Errorf("unexpected server settings: %+v", migrated.Server)
+	}
+	if migrated.Metrics.Path != "/metrics" {
+		t.Errorf("expected default metrics path, got %s", migrated.Metrics.Path)
+	}
+
+	fields := make(map[string]int)
+	for _, w := range warnings {
+		fields[w.Field]++
+	}
+	if fields["schema_version"] != 1 || fields["auth.secret"] != 1 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	// The old config is left untouched
+	if old.SchemaVersion != SchemaVersionV1 {
+		t.Error("Migrate must not modify the old config")
+	}
+	if IsV1(migrated) {
+		t.Error("migrated config must not be detected as v1")
+	}
+}
+
+func TestIsV1DoesNotMatchV2Config(t *testing.T) {
+	cfg := &Config{}
+	cfg.Protocol.Version = "1.0.0"
+	cfg.Protocol.Features = []string{"tls", "jwt", "tunneling"}
+	if IsV1(cfg) {
+		t.Error("config without schema version detected as v1")
+	}
+}
+
+func TestParseV2ConfigUnchanged(t *testing.T) {
+	data := []byte(`
+schema_version: 2
+server:
+  host: relay.example.com
+protocol:
+  version: "1.0.0"
+  features: ["tls", "jwt", "tunneling", "http2"]
+`)
+	cfg, err := parseConfig(data, "test")
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if cfg.SchemaVersion != SchemaVersionV2 || cfg.Protocol.Version != "1.0.0" {
+		t.Errorf("config changed while loading: schema %d, protocol %s", cfg.SchemaVersion, cfg.Protocol.Version)
+	}
+	if want := []string{"tls", "jwt", "tunneling", "http2"}; !reflect.DeepEqual(cfg.Protocol.Features, want) {
+		t.Errorf("expected features %v, got %v", want, cfg.Protocol.Features)
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultRemoteCachePath is where the last configuration fetched from a
+// config server is cached
+const DefaultRemoteCachePath = "/var/lib/cloudbridge-client/remote-config.yaml"
+
+// RemoteFetchTimeout bounds fetching the configuration from a config server
+const RemoteFetchTimeout = 15 * time.Second
+
+// maxRemoteConfigSize limits the size of a fetched configuration
+const maxRemoteConfigSize = 1024 * 1024
+
+// RemoteSource describes a configuration served over HTTP(S)
+type RemoteSource struct {
+	// URL is the http:// or https:// address of the configuration
+	URL string
+	// Token, if set, is sent as a bearer token in the Authorization header
+	Token string
+	// CAFile, if set, is the CA bundle used to verify the config server
+	CAFile string
+	// CachePath is where the last fetched configuration is stored and read
+	// back from when the config server is unreachable. Empty disables caching.
+	CachePath string
+	// AllowInsecure permits an http:// URL. The token and the configuration
+	// then travel unencrypted, so anyone on the path can read the token and
+	// inject a configuration.
+	AllowInsecure bool
+}
+
+// IsRemote reports whether path refers to a configuration served over HTTP(S)
+func IsRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// LoadRemoteConfig fetches the configuration from a config server. A fetched
+// configuration is cached; if the server cannot be reached or returns an
+// invalid configuration, the cached copy is used instead.
+func LoadRemoteConfig(src RemoteSource) (*Config, error) {
+	if err := checkRemoteURL(src, src.URL); err != nil {
+		return nil, err
+	}
+
+	data, err := fetchRemoteConfig(src)
+	if err == nil {
+		config, parseErr := parseConfig(data, src.URL)
+		if parseErr == nil {
+			if src.CachePath != "" {
+				if cacheErr := os.WriteFile(src.CachePath, data, 0600); cacheErr != nil {
+					log.Printf("Failed to cache remote config: %v", cacheErr)
+				}
+			}
+			return config, nil
+		}
+		err = parseErr
+	}
+
+	if src.CachePath == "" {
+		return nil, err
+	}
+	cached, cacheErr := os.ReadFile(filepath.Clean(src.CachePath))
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%v (no cached config: %v)", err, cacheErr)
+	}
+	log.Printf("Using cached config %s: %v", src.CachePath, err)
+	return parseConfig(cached, src.CachePath)
+}
+
+// checkRemoteURL rejects url unless it is https:// or src allows http://
+func checkRemoteURL(src RemoteSource, url string) error {
+	if !IsRemote(url) {
+		return fmt.Errorf("invalid config url: %s", url)
+	}
+	if strings.HasPrefix(url, "http://") && !src.AllowInsecure {
+		return fmt.Errorf("insecure config url %s: use https", url)
+	}
+	return nil
+}
+
+// fetchRemoteConfig downloads the raw configuration
+func fetchRemoteConfig(src RemoteSource) ([]byte, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if src.CAFile != "" {
+		caCert, err := os.ReadFile(filepath.Clean(src.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config server CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append config server CA")
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   RemoteFetchTimeout,
+		// A redirect must not downgrade the connection either
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return checkRemoteURL(src, req.URL.String())
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, src.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config url: %w", err)
+	}
+	if src.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+src.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch remote config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch remote config: unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote config: %w", err)
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("remote config too large")
+	}
+	return data, nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRemoteConfig(t *testing.T) {
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.Write([]byte("server:\n  host: relay.example.com\n  port: 9443\n"))
+	}))
+
+	cachePath := filepath.Join(t.TempDir(), "remote-config.yaml")
+	src := RemoteSource{URL: server.URL + "/config.yaml", Token: "secret", CachePath: cachePath, AllowInsecure: true}
+
+	cfg, err := LoadRemoteConfig(src)
+	if err != nil {
+		t.Fatalf("failed to load remote config: %v", err)
+	}
+	if cfg.Server.Host != "relay.example.com" || cfg.Server.Port != 9443 {
+		t.Errorf("unexpected server config: %+v", cfg.Server)
+	}
+	if authHeader != "Bearer secret" {
+		t.Errorf("expected bearer token, got %q", authHeader)
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Fatalf("expected config to be cached: %v", err)
+	}
+
+	// The cached copy is used while the config server is unreachable
+	server.Close()
+	cfg, err = LoadRemoteConfig(src)
+	if err != nil {
+		t.Fatalf("expected cached config, got %v", err)
+	}
+	if cfg.Server.Host != "relay.example.com" {
+		t.Errorf("unexpected cached server host: %s", cfg.Server.Host)
+	}
+
+	src.CachePath = filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := LoadRemoteConfig(src); err == nil {
+		t.Error("expected error without server and cache")
+	}
+}
+
+func TestLoadRemoteConfigRequiresHTTPS(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("server:\n  host: relay.example.com\n"))
+	}))
+	defer server.Close()
+
+	// The cached copy does not stand in for a URL that is refused
+	cachePath := filepath.Join(t.TempDir(), "remote-config.yaml")
+	if err := os.WriteFile(cachePath, []byte("server:\n  host: cached.example.com\n"), 0600); err != nil {
+		t.Fatalf("failed to write cache: %v", err)
+	}
+	if _, err := LoadRemoteConfig(RemoteSource{URL: server.URL, Token: "secret", CachePath: cachePath}); err == nil {
+		t.Error("expected an http:// config url to be rejected")
+	}
+	if requests != 0 {
+		t.Errorf("expected no request over http, got %d", requests)
+	}
+
+	// Nor may an https server redirect to http
+	redirect := httptest.NewTLSServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirect.Close()
+	certFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := redirect.Certificate().Raw
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	if _, err := LoadRemoteConfig(RemoteSource{URL: redirect.URL, Token: "secret", CAFile: certFile}); err == nil {
+		t.Error("expected a redirect to http to be rejected")
+	}
+	if requests != 0 {
+		t.Errorf("expected no request over http, got %d", requests)
+	}
+}
+
+func TestIsRemote(t *testing.T) {
+	if !IsRemote("https://config.example.com/client.yaml") {
+		t.Error("expected https url to be remote")
+	}
+	if IsRemote("/etc/cloudbridge-client/config.yaml") {
+		t.Error("expected file path not to be remote")
+	}
+}
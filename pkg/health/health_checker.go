@@ -42,6 +42,10 @@ type HealthChecker struct {
 	stopChan     chan struct{}
 	isRunning    bool
 	mu           sync.RWMutex
+
+	// status is the overall status after the last round of checks
+	status         HealthStatus
+	onStatusChange func(previous, current HealthStatus)
 }
 
 // Config holds health checker configuration
@@ -70,9 +74,18 @@ func NewHealthChecker(config *Config) *HealthChecker {
 		timeout:     config.Timeout,
 		lastResults: make(map[string]*HealthCheck),
 		stopChan:    make(chan struct{}),
+		status:      Unknown,
 	}
 }
 
+// SetStatusObserver sets a function called after a round of checks changed
+// the overall status
+func (hc *HealthChecker) SetStatusObserver(fn func(previous, current HealthStatus)) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.onStatusChange = fn
+}
+
 // AddCheck adds a health check
 func (hc *HealthChecker) AddCheck(name string, checker HealthCheckerFunc) {
 	hc.mu.Lock()
@@ -198,14 +211,26 @@ func (hc *HealthChecker) runChecks() {
 	for result := range results {
 		hc.lastResults[result.name] = result.result
 	}
+	previous := hc.status
+	hc.status = hc.statusLocked()
+	current, observer := hc.status, hc.onStatusChange
 	hc.mu.Unlock()
+
+	if observer != nil && current != previous {
+		observer(previous, current)
+	}
 }
 
 // GetStatus returns the overall health status
 func (hc *HealthChecker) GetStatus() HealthStatus {
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
-	
+	return hc.statusLocked()
+}
+
+// statusLocked derives the overall status from the last results. hc.mu must
+// be held.
+func (hc *HealthChecker) statusLocked() HealthStatus {
 	if len(hc.lastResults) == 0 {
 		return Unknown
 	}
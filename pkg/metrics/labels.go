@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LabeledGatherer returns a gatherer that adds labels to every metric
+// gathered from g. This applies instance labels to metrics registered
+// before they were known, such as package-level metrics. A label a metric
+// already carries keeps its own value.
+func LabeledGatherer(g prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	if len(labels) == 0 {
+		return g
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				m.Label = addLabels(m.GetLabel(), names, labels)
+			}
+		}
+		return families, err
+	})
+}
+
+func addLabels(pairs []*dto.LabelPair, names []string, labels map[string]string) []*dto.LabelPair {
+	present := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		present[pair.GetName()] = true
+	}
+	for _, name := range names {
+		if present[name] {
+			continue
+		}
+		name, value := name, labels[name]
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].GetName() < pairs[j].GetName()
+	})
+	return pairs
+}
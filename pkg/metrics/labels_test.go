@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLabeledGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	m.IncTunnelBytesToServer("t1", 10)
+
+	gatherer := LabeledGatherer(reg, map[string]string{"region": "eu", "tunnel_id": "ignored"})
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "client_tunnel_bytes_to_server_total" {
+			continue
+		}
+		labels := make(map[string]string)
+		for _, pair := range family.GetMetric()[0].GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["region"] != "eu" {
+			t.Errorf("expected region label, got %v", labels)
+		}
+		if labels["tunnel_id"] != "t1" {
+			t.Errorf("metric label must keep its own value, got %v", labels)
+		}
+		return
+	}
+	t.Fatal("tunnel bytes metric not gathered")
+}
@@ -15,6 +15,7 @@ type Metrics struct {
 	connectionsTotal      prometheus.Counter
 	rejectedConnections   prometheus.Counter
 	connectionErrors      *prometheus.CounterVec
+	tlsErrors             *prometheus.CounterVec
 	activeConnections     prometheus.Gauge
 	connectionDuration    prometheus.Histogram
 
@@ -32,11 +33,26 @@ type Metrics struct {
 	tunnelBytesToServer   *prometheus.CounterVec
 	tunnelErrors          *prometheus.CounterVec
 	tunnelStatus          *prometheus.GaugeVec
+	tunnelPaused          *prometheus.GaugeVec
+	tunnelStalls          *prometheus.CounterVec
+	tunnelBufferBytes     prometheus.Gauge
+	tunnelBufferLimit     prometheus.Gauge
+	tunnelBufferWaits     prometheus.Counter
+
+	// Mesh metrics
+	meshNodes                 prometheus.Gauge
+	meshConnections           prometheus.Gauge
+	meshRoutes                prometheus.Gauge
+	meshConnectionLatency     *prometheus.GaugeVec
+	meshNodeIDCollisions      prometheus.Counter
+	meshDiscoverySocketUp     prometheus.Gauge
+	meshDiscoverySocketErrors prometheus.Counter
 
 	// Authentication metrics
 	authAttempts          prometheus.Counter
 	authFailures          prometheus.Counter
 	authDuration          prometheus.Histogram
+	handshakePhases       *prometheus.HistogramVec
 
 	// Heartbeat metrics
 	heartbeatsTotal       prometheus.Counter
@@ -76,6 +92,10 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Name: "client_connection_errors_total",
 			Help: "Total number of connection errors by type",
 		}, []string{"error_type"}),
+		tlsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "client_tls_errors_total",
+			Help: "Total number of failed TLS handshakes by reason",
+		}, []string{"reason"}),
 		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "client_active_connections",
 			Help: "Number of active connections",
@@ -131,6 +151,54 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Name: "client_tunnel_status",
 			Help: "Tunnel status (1=active, 0=inactive)",
 		}, []string{"tunnel_id"}),
+		tunnelPaused: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "client_tunnel_paused",
+			Help: "Tunnel pause state (1=paused, 0=accepting connections)",
+		}, []string{"tunnel_id"}),
+		tunnelStalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "client_tunnel_stalls_total",
+			Help: "Total number of tunnel connections closed after a write stall",
+		}, []string{"tunnel_id", "direction"}),
+		tunnelBufferBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_tunnel_buffer_bytes",
+			Help: "Bytes currently reserved for tunnel buffers",
+		}),
+		tunnelBufferLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_tunnel_buffer_limit_bytes",
+			Help: "Limit on bytes reserved for tunnel buffers (0=unlimited)",
+		}),
+		tunnelBufferWaits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_tunnel_buffer_waits_total",
+			Help: "Total number of buffer reservations that waited for the budget",
+		}),
+		meshNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_mesh_nodes",
+			Help: "Number of nodes in the mesh topology",
+		}),
+		meshConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_mesh_connections",
+			Help: "Number of connections in the mesh topology",
+		}),
+		meshRoutes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_mesh_routes",
+			Help: "Number of routes known to the mesh router",
+		}),
+		meshConnectionLatency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "client_mesh_connection_latency_seconds",
+			Help: "Latency of mesh connections",
+		}, []string{"src", "dst"}),
+		meshNodeIDCollisions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_mesh_node_id_collisions_total",
+			Help: "Total number of mesh nodes that reused the ID of a node with a different public key",
+		}),
+		meshDiscoverySocketUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "client_mesh_discovery_socket_up",
+			Help: "Whether peer discovery is listening for announcements (1) or not (0)",
+		}),
+		meshDiscoverySocketErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_mesh_discovery_socket_errors_total",
+			Help: "Total number of failed binds and errors of the peer discovery socket",
+		}),
 		authAttempts: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "client_auth_attempts_total",
 			Help: "Total number of authentication attempts",
@@ -144,6 +212,11 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Help:    "Authentication duration in seconds",
 			Buckets: prometheus.DefBuckets,
 		}),
+		handshakePhases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "client_handshake_phase_duration_seconds",
+			Help:    "Duration of the phases of connecting to the relay in seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"phase"}),
 		heartbeatsTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "client_heartbeats_total",
 			Help: "Total number of heartbeats",
@@ -192,6 +265,7 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		m.connectionsTotal,
 		m.rejectedConnections,
 		m.connectionErrors,
+		m.tlsErrors,
 		m.activeConnections,
 		m.connectionDuration,
 		m.protocolLatency,
@@ -205,9 +279,22 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		m.tunnelBytesToServer,
 		m.tunnelErrors,
 		m.tunnelStatus,
+		m.tunnelPaused,
+		m.tunnelStalls,
+		m.tunnelBufferBytes,
+		m.tunnelBufferLimit,
+		m.tunnelBufferWaits,
+		m.meshNodes,
+		m.meshConnections,
+		m.meshRoutes,
+		m.meshConnectionLatency,
+		m.meshNodeIDCollisions,
+		m.meshDiscoverySocketUp,
+		m.meshDiscoverySocketErrors,
 		m.authAttempts,
 		m.authFailures,
 		m.authDuration,
+		m.handshakePhases,
 		m.heartbeatsTotal,
 		m.heartbeatErrors,
 		m.heartbeatLatency,
@@ -253,6 +340,13 @@ func (m *Metrics) IncConnectionErrors(errorType string) {
 	m.connectionErrors.WithLabelValues(errorType).Inc()
 }
 
+// IncTLSErrors counts a failed TLS handshake as a connection error of type
+// "tls" and under its reason, e.g. "expired" or "unknown_authority"
+func (m *Metrics) IncTLSErrors(reason string) {
+	m.connectionErrors.WithLabelValues("tls").Inc()
+	m.tlsErrors.WithLabelValues(reason).Inc()
+}
+
 func (m *Metrics) ObserveConnectionDuration(duration time.Duration) {
 	m.connectionDuration.Observe(duration.Seconds())
 }
@@ -307,6 +401,60 @@ func (m *Metrics) SetTunnelStatus(tunnelID string, active bool) {
 	m.tunnelStatus.WithLabelValues(tunnelID).Set(status)
 }
 
+func (m *Metrics) SetTunnelPaused(tunnelID string, paused bool) {
+	value := 0.0
+	if paused {
+		value = 1.0
+	}
+	m.tunnelPaused.WithLabelValues(tunnelID).Set(value)
+}
+
+func (m *Metrics) IncTunnelStalls(tunnelID, direction string) {
+	m.tunnelStalls.WithLabelValues(tunnelID, direction).Inc()
+}
+
+func (m *Metrics) SetTunnelBufferUsage(used, limit int64) {
+	m.tunnelBufferBytes.Set(float64(used))
+	m.tunnelBufferLimit.Set(float64(limit))
+}
+
+func (m *Metrics) IncTunnelBufferWaits() {
+	m.tunnelBufferWaits.Inc()
+}
+
+// Mesh metrics
+func (m *Metrics) SetMeshTopology(nodes, connections, routes int) {
+	m.meshNodes.Set(float64(nodes))
+	m.meshConnections.Set(float64(connections))
+	m.meshRoutes.Set(float64(routes))
+}
+
+func (m *Metrics) SetMeshConnectionLatency(src, dst string, latency time.Duration) {
+	m.meshConnectionLatency.WithLabelValues(src, dst).Set(latency.Seconds())
+}
+
+// ResetMeshConnectionLatency drops all latency series, so connections that
+// left the topology stop being reported
+func (m *Metrics) ResetMeshConnectionLatency() {
+	m.meshConnectionLatency.Reset()
+}
+
+func (m *Metrics) AddMeshNodeIDCollisions(n int64) {
+	m.meshNodeIDCollisions.Add(float64(n))
+}
+
+func (m *Metrics) SetMeshDiscoverySocketUp(up bool) {
+	if up {
+		m.meshDiscoverySocketUp.Set(1)
+	} else {
+		m.meshDiscoverySocketUp.Set(0)
+	}
+}
+
+func (m *Metrics) AddMeshDiscoverySocketErrors(n int64) {
+	m.meshDiscoverySocketErrors.Add(float64(n))
+}
+
 // Authentication metrics
 func (m *Metrics) IncAuthAttempts() {
 	m.authAttempts.Inc()
@@ -320,6 +468,12 @@ func (m *Metrics) ObserveAuthDuration(duration time.Duration) {
 	m.authDuration.Observe(duration.Seconds())
 }
 
+// ObserveHandshakePhase records the duration of a phase of connecting to the
+// relay, e.g. "connect" or "tls_handshake"
+func (m *Metrics) ObserveHandshakePhase(phase string, duration time.Duration) {
+	m.handshakePhases.WithLabelValues(phase).Observe(duration.Seconds())
+}
+
 // Heartbeat metrics
 func (m *Metrics) IncHeartbeats() {
 	m.heartbeatsTotal.Inc()
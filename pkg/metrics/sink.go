@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricsSink receives metric values pushed by the client. It is used by
+// deployments that cannot scrape the Prometheus endpoint and need metrics
+// delivered to a push-based collector instead.
+type MetricsSink interface {
+	// Count adds delta to the counter identified by name and tags
+	Count(name string, delta float64, tags map[string]string)
+	// Gauge sets the current value of the gauge identified by name and tags
+	Gauge(name string, value float64, tags map[string]string)
+	// Flush delivers any buffered values to the backend
+	Flush() error
+	// Close flushes pending values and releases the sink's resources
+	Close() error
+}
+
+// Pusher periodically gathers the client's registered metrics and writes
+// them to a MetricsSink. Counters are emitted as deltas since the previous
+// flush; gauges are emitted as their current value.
+type Pusher struct {
+	gatherer prometheus.Gatherer
+	sink     MetricsSink
+	interval time.Duration
+
+	mu       sync.Mutex
+	previous map[string]float64
+
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	started bool
+	once    sync.Once
+}
+
+// NewPusher creates a pusher that flushes metrics from gatherer to sink
+func NewPusher(gatherer prometheus.Gatherer, sink MetricsSink, interval time.Duration) *Pusher {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &Pusher{
+		gatherer: gatherer,
+		sink:     sink,
+		interval: interval,
+		previous: make(map[string]float64),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start begins periodic flushing in a background goroutine
+func (p *Pusher) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return
+	}
+	p.started = true
+	go p.loop()
+}
+
+// Stop performs a final flush and closes the sink
+func (p *Pusher) Stop() error {
+	var err error
+	p.once.Do(func() {
+		close(p.stopCh)
+		p.mu.Lock()
+		started := p.started
+		p.mu.Unlock()
+		if started {
+			<-p.doneCh
+		}
+		if pushErr := p.Push(); pushErr != nil {
+			err = pushErr
+		}
+		if closeErr := p.sink.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+func (p *Pusher) loop() {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Push(); err != nil {
+				log.Printf("Failed to push metrics: %v", err)
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// Push gathers all metrics once and writes them to the sink
+func (p *Pusher) Push() error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			tags := labelsToTags(m.GetLabel())
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				p.count(name, tags, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				p.sink.Gauge(name, m.GetGauge().GetValue(), tags)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				p.count(name+"_count", tags, float64(h.GetSampleCount()))
+				p.sink.Gauge(name+"_sum", h.GetSampleSum(), tags)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				p.count(name+"_count", tags, float64(s.GetSampleCount()))
+				p.sink.Gauge(name+"_sum", s.GetSampleSum(), tags)
+			default:
+				p.sink.Gauge(name, m.GetUntyped().GetValue(), tags)
+			}
+		}
+	}
+
+	return p.sink.Flush()
+}
+
+// count emits the increase of a cumulative value since the last push
+func (p *Pusher) count(name string, tags map[string]string, value float64) {
+	key := seriesKey(name, tags)
+	delta := value - p.previous[key]
+	if delta < 0 {
+		// The counter was reset; report the new total
+		delta = value
+	}
+	p.previous[key] = value
+	if delta > 0 {
+		p.sink.Count(name, delta, tags)
+	}
+}
+
+func labelsToTags(labels []*dto.LabelPair) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(labels))
+	for _, l := range labels {
+		tags[l.GetName()] = l.GetValue()
+	}
+	return tags
+}
+
+func seriesKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// maxStatsDPacketSize keeps datagrams below the typical Ethernet MTU
+const maxStatsDPacketSize = 1432
+
+// StatsDConfig holds configuration for the StatsD sink
+type StatsDConfig struct {
+	Address string
+	Prefix  string
+	// Tags enables DogStatsD-style "|#key:value" tags; plain StatsD
+	// servers do not understand them
+	Tags bool
+}
+
+// StatsDSink writes metrics to a StatsD server over UDP
+type StatsDSink struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	prefix string
+	tags   bool
+	buf    bytes.Buffer
+	// err is the first failed write of a full packet since the last Flush
+	err error
+}
+
+// NewStatsDSink creates a new StatsD sink
+func NewStatsDSink(cfg StatsDConfig) (*StatsDSink, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("statsd address is required")
+	}
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd: %w", err)
+	}
+
+	return &StatsDSink{
+		conn:   conn,
+		prefix: cfg.Prefix,
+		tags:   cfg.Tags,
+	}, nil
+}
+
+// Count implements MetricsSink
+func (s *StatsDSink) Count(name string, delta float64, tags map[string]string) {
+	s.add(name, delta, "c", tags)
+}
+
+// Gauge implements MetricsSink
+func (s *StatsDSink) Gauge(name string, value float64, tags map[string]string) {
+	s.add(name, value, "g", tags)
+}
+
+// Flush implements MetricsSink. It also returns the first error writing a
+// full packet since the last Flush.
+func (s *StatsDSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.takeErrLocked(s.flushLocked())
+}
+
+// Close implements MetricsSink
+func (s *StatsDSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.takeErrLocked(s.flushLocked())
+	if closeErr := s.conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *StatsDSink) add(name string, value float64, kind string, tags map[string]string) {
+	line := s.format(name, value, kind, tags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > maxStatsDPacketSize {
+		// Errors are reported on the next explicit Flush
+		if err := s.flushLocked(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+func (s *StatsDSink) format(name string, value float64, kind string, tags map[string]string) string {
+	line := s.prefix + name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if !s.tags || len(tags) == 0 {
+		return line
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	line += "|#"
+	for i, k := range keys {
+		if i > 0 {
+			line += ","
+		}
+		line += k + ":" + tags[k]
+	}
+	return line
+}
+
+// takeErrLocked returns the error kept since the last Flush, or else err,
+// and clears the kept error
+func (s *StatsDSink) takeErrLocked(err error) error {
+	if s.err != nil {
+		err, s.err = s.err, nil
+	}
+	return err
+}
+
+func (s *StatsDSink) flushLocked() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	if err != nil {
+		return fmt.Errorf("failed to write to statsd: %w", err)
+	}
+	return nil
+}
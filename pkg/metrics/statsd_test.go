@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func listenStatsD(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return conn
+}
+
+func readPacket(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	buf := make([]byte, 65535)
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestStatsDSinkFormat(t *testing.T) {
+	server := listenStatsD(t)
+	defer server.Close()
+
+	sink, err := NewStatsDSink(StatsDConfig{Address: server.LocalAddr().String(), Prefix: "cb.", Tags: true})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	defer sink.Close()
+
+	sink.Count("requests", 3, map[string]string{"protocol": "quic", "a": "b"})
+	sink.Gauge("tunnels", 2, nil)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	packet := readPacket(t, server)
+	expected := "cb.requests:3|c|#a:b,protocol:quic\ncb.tunnels:2|g"
+	if packet != expected {
+		t.Errorf("expected %q, got %q", expected, packet)
+	}
+}
+
+// failFirstWrite is a connection whose first write fails
+type failFirstWrite struct {
+	net.Conn
+	writes int
+}
+
+func (c *failFirstWrite) Write(p []byte) (int, error) {
+	c.writes++
+	if c.writes == 1 {
+		return 0, errors.New("network unreachable")
+	}
+	return len(p), nil
+}
+
+func TestStatsDSinkReportsFullPacketErrors(t *testing.T) {
+	conn := &failFirstWrite{}
+	sink := &StatsDSink{conn: conn}
+
+	// Filling more than a packet writes the full one while adding
+	for i := 0; i < 200; i++ {
+		sink.Count("requests", 1, nil)
+	}
+	if conn.writes == 0 {
+		t.Fatal("expected a full packet to be written while adding")
+	}
+	if err := sink.Flush(); err == nil || !strings.Contains(err.Error(), "network unreachable") {
+		t.Errorf("expected the failed write to be reported by Flush, got %v", err)
+	}
+
+	sink.Count("requests", 1, nil)
+	if err := sink.Flush(); err != nil {
+		t.Errorf("expected the error to be reported once, got %v", err)
+	}
+}
+
+func TestPusherEmitsCounterDeltas(t *testing.T) {
+	server := listenStatsD(t)
+	defer server.Close()
+
+	sink, err := NewStatsDSink(StatsDConfig{Address: server.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	pusher := NewPusher(reg, sink, time.Hour)
+
+	m.IncTunnelCreations()
+	m.IncTunnelCreations()
+	if err := pusher.Push(); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if packet := readPacket(t, server); !strings.Contains(packet, "client_tunnel_creations_total:2|c") {
+		t.Errorf("expected counter value 2 in first push, got %q", packet)
+	}
+
+	m.IncTunnelCreations()
+	if err := pusher.Push(); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if packet := readPacket(t, server); !strings.Contains(packet, "client_tunnel_creations_total:1|c") {
+		t.Errorf("expected counter delta 1 in second push, got %q", packet)
+	}
+
+	if err := pusher.Stop(); err != nil {
+		t.Errorf("stop failed: %v", err)
+	}
+}
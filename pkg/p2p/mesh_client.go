@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/2gc-dev/cloudbridge-client/pkg/ai"
 	"github.com/2gc-dev/cloudbridge-client/pkg/cadence"
 	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
 	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
 	"github.com/2gc-dev/cloudbridge-client/pkg/quic"
 	"github.com/2gc-dev/cloudbridge-client/pkg/wireguard"
@@ -30,6 +32,12 @@ type MeshClient struct {
 	
 	status           MeshClientStatus
 	metrics          *MeshClientMetrics
+	promMetrics      *metrics.Metrics
+	// reportedCollisions is the node ID collision count already exported
+	reportedCollisions int64
+	// reportedSocketErrors is the discovery socket error count already
+	// exported
+	reportedSocketErrors int64
 	logger           interface{} // Replace with actual logger
 	ctx              context.Context
 	cancel           context.CancelFunc
@@ -91,6 +99,12 @@ func (mc *MeshClient) Start() error {
 		return fmt.Errorf("failed to initialize WireGuard: %w", err)
 	}
 
+	// Initialize quantum cryptography first, discovery signs with it
+	if err := mc.initializeQuantumCrypto(); err != nil {
+		mc.status = MeshClientStatusError
+		return fmt.Errorf("failed to initialize quantum crypto: %w", err)
+	}
+
 	// Initialize peer discovery
 	if err := mc.initializePeerDiscovery(); err != nil {
 		mc.status = MeshClientStatusError
@@ -109,12 +123,6 @@ func (mc *MeshClient) Start() error {
 		return fmt.Errorf("failed to initialize QUIC client: %w", err)
 	}
 
-	// Initialize quantum cryptography
-	if err := mc.initializeQuantumCrypto(); err != nil {
-		mc.status = MeshClientStatusError
-		return fmt.Errorf("failed to initialize quantum crypto: %w", err)
-	}
-
 	// Initialize AI/ML components
 	if err := mc.initializeAIComponents(); err != nil {
 		mc.status = MeshClientStatusError
@@ -165,6 +173,11 @@ func (mc *MeshClient) Stop() error {
 		mc.quicClient.Disconnect()
 	}
 
+	// Close the file the topology events are appended to
+	if mc.meshTopology != nil {
+		mc.meshTopology.Events().Close()
+	}
+
 	mc.status = MeshClientStatusStopped
 	return nil
 }
@@ -218,9 +231,18 @@ func (mc *MeshClient) initializePeerDiscovery() error {
 		AnnouncementTimeout: 5 * time.Minute,
 		MaxPeers:           100,
 		EnableGeoDiscovery: true,
+		MulticastGroup:     mc.config.WireGuard.DiscoveryGroup,
+		MulticastTTL:       mc.config.WireGuard.DiscoveryTTL,
+		SeedPeers:          mc.config.WireGuard.DiscoverySeeds,
+	}
+	if discoveryConfig.MulticastGroup == "" {
+		discoveryConfig.MulticastGroup = wireguard.DefaultMulticastGroup
 	}
 
 	peerDiscovery := wireguard.NewPeerDiscovery(localNode, discoveryConfig, nil) // Replace with actual logger
+	if mc.dilithiumSigner != nil {
+		peerDiscovery.SetSigner(mc.dilithiumSigner)
+	}
 
 	// Start peer discovery
 	if err := peerDiscovery.Start(); err != nil {
@@ -315,6 +337,12 @@ func (mc *MeshClient) initializeQuantumCrypto() error {
 
 	kyberExchange := quantum.NewKyberKeyExchange(kyberConfig, nil) // Replace with actual logger
 
+	if mc.config.Quantum.SelfTest {
+		if err := kyberExchange.SelfTest(); err != nil {
+			return err
+		}
+	}
+
 	// Generate key pair
 	if err := kyberExchange.GenerateKeyPair(); err != nil {
 		return fmt.Errorf("failed to generate Kyber key pair: %w", err)
@@ -459,6 +487,8 @@ func (mc *MeshClient) updateMetrics() {
 		mc.metrics.WorkflowsExecuted = cadenceMetrics.WorkflowsStarted
 	}
 
+	mc.exportTopologyMetrics()
+	mc.exportDiscoveryMetrics()
 	mc.metrics.LastActivity = time.Now()
 }
 
@@ -477,26 +507,34 @@ func (mc *MeshClient) processPeerDiscovery() {
 	}
 }
 
-// handleNewPeer handles a newly discovered peer
+// handleNewPeer handles a newly discovered peer. A peer the topology
+// rejects for a duplicate node ID is not added to the WireGuard interface.
 func (mc *MeshClient) handleNewPeer(peer *wireguard.Peer) {
-	// Add peer to WireGuard interface
-	if mc.wireGuardInterface != nil {
-		allowedIPs := []net.IPNet{
-			{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
-		}
-		mc.wireGuardInterface.AddPeer(peer.PublicKey, allowedIPs, peer.Endpoint)
-	}
-
 	// Update topology
 	if mc.meshTopology != nil {
+		nodeID := peer.NodeID
+		if nodeID == "" {
+			nodeID = generateNodeID()
+		}
 		node := &wireguard.MeshNode{
-			ID:        generateNodeID(),
+			ID:        nodeID,
 			PublicKey: peer.PublicKey,
 			Endpoint:  peer.Endpoint,
 			Status:    wireguard.NodeStatusOnline,
 			LastSeen:  time.Now(),
 		}
-		mc.meshTopology.AddNode(node)
+		// The topology logs and counts the collision
+		if _, err := mc.meshTopology.AddNode(node); err != nil {
+			return
+		}
+	}
+
+	// Add peer to WireGuard interface
+	if mc.wireGuardInterface != nil {
+		allowedIPs := []net.IPNet{
+			{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
+		}
+		mc.wireGuardInterface.AddPeer(peer.PublicKey, allowedIPs, peer.Endpoint)
 	}
 }
 
@@ -606,6 +644,24 @@ func (mc *MeshClient) GetMeshTopology() *wireguard.MeshTopology {
 	return mc.meshTopology
 }
 
+// DebugHandler returns an HTTP handler serving the mesh debug endpoints.
+// /debug/mesh/events lists the recorded topology and routing events.
+func (mc *MeshClient) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/mesh/events", func(w http.ResponseWriter, r *http.Request) {
+		mc.mu.RLock()
+		topology := mc.meshTopology
+		mc.mu.RUnlock()
+
+		if topology == nil {
+			http.Error(w, "mesh topology not initialized", http.StatusServiceUnavailable)
+			return
+		}
+		topology.Events().ServeHTTP(w, r)
+	})
+	return mux
+}
+
 // GetQUICClient returns the QUIC client
 func (mc *MeshClient) GetQUICClient() *quic.EnhancedQUICClient {
 	return mc.quicClient
@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/wireguard"
+	"go.uber.org/zap"
+)
+
+func TestHandleNewPeerUsesAnnouncedNodeID(t *testing.T) {
+	topology := wireguard.NewMeshTopology(nil, zap.NewNop())
+	mc := NewMeshClient(nil)
+	mc.meshTopology = topology
+
+	endpoint := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 51820}
+	mc.handleNewPeer(&wireguard.Peer{NodeID: "peer-1", PublicKey: &[32]byte{1}, Endpoint: endpoint})
+	mc.handleNewPeer(&wireguard.Peer{NodeID: "peer-1", PublicKey: &[32]byte{2}, Endpoint: endpoint})
+
+	node, ok := topology.GetNode("peer-1")
+	if !ok || node.PublicKey[0] != 1 {
+		t.Fatalf("expected the first peer under its node ID, got %+v", node)
+	}
+	if collisions := topology.NodeIDCollisions(); collisions != 1 {
+		t.Errorf("expected 1 collision, got %d", collisions)
+	}
+	if nodes := topology.GetMetrics().TotalNodes; nodes != 1 {
+		t.Errorf("expected the colliding peer to be rejected, got %d nodes", nodes)
+	}
+}
+
+func TestStopClosesEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	topology := wireguard.NewMeshTopology(nil, zap.NewNop())
+	if err := topology.Events().AttachFile(path); err != nil {
+		t.Fatalf("failed to attach event log file: %v", err)
+	}
+
+	mc := NewMeshClient(nil)
+	mc.meshTopology = topology
+	mc.status = MeshClientStatusRunning
+	topology.AddNode(&wireguard.MeshNode{ID: "before"})
+	if err := mc.Stop(); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	topology.AddNode(&wireguard.MeshNode{ID: "after"})
+
+	events, err := wireguard.ReadEventFile(path)
+	if err != nil {
+		t.Fatalf("failed to read event log file: %v", err)
+	}
+	if len(events) != 1 || events[0].NodeID != "before" {
+		t.Errorf("expected only the event before stopping in the file, got %+v", events)
+	}
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"sort"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/2gc-dev/cloudbridge-client/pkg/wireguard"
+)
+
+// MaxLatencySeries bounds the number of per-connection latency series
+// exported, keeping metric cardinality independent of the mesh size
+const MaxLatencySeries = 50
+
+// SetMetrics sets the Prometheus metrics the mesh topology is exported to
+func (mc *MeshClient) SetMetrics(m *metrics.Metrics) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.promMetrics = m
+}
+
+// exportTopologyMetrics publishes the topology as gauges. mc.mu must be held.
+func (mc *MeshClient) exportTopologyMetrics() {
+	if mc.promMetrics == nil || mc.meshTopology == nil {
+		return
+	}
+
+	nodes := mc.meshTopology.GetAllNodes()
+	connections := mc.meshTopology.GetAllConnections()
+	routes := 0
+	if mc.meshRouter != nil {
+		routes = mc.meshRouter.RouteCount()
+	}
+	mc.promMetrics.SetMeshTopology(len(nodes), len(connections), routes)
+
+	// The topology keeps a running total; export what is new since last time
+	if collisions := mc.meshTopology.NodeIDCollisions(); collisions > mc.reportedCollisions {
+		mc.promMetrics.AddMeshNodeIDCollisions(collisions - mc.reportedCollisions)
+		mc.reportedCollisions = collisions
+	}
+
+	// Report the connections that are up, in a stable order, up to the limit
+	var up []*wireguard.MeshConnection
+	for _, conn := range connections {
+		if conn.Status != wireguard.ConnectionStatusDown {
+			up = append(up, conn)
+		}
+	}
+	sort.Slice(up, func(i, j int) bool {
+		if up[i].SourceNode != up[j].SourceNode {
+			return up[i].SourceNode < up[j].SourceNode
+		}
+		return up[i].TargetNode < up[j].TargetNode
+	})
+	if len(up) > MaxLatencySeries {
+		up = up[:MaxLatencySeries]
+	}
+
+	mc.promMetrics.ResetMeshConnectionLatency()
+	for _, conn := range up {
+		mc.promMetrics.SetMeshConnectionLatency(conn.SourceNode, conn.TargetNode, conn.Latency)
+	}
+}
+
+// exportDiscoveryMetrics publishes the state of the peer discovery socket.
+// mc.mu must be held.
+func (mc *MeshClient) exportDiscoveryMetrics() {
+	if mc.promMetrics == nil || mc.peerDiscovery == nil {
+		return
+	}
+
+	status := mc.peerDiscovery.SocketStatus()
+	mc.promMetrics.SetMeshDiscoverySocketUp(status.Listening)
+	if status.Errors > mc.reportedSocketErrors {
+		mc.promMetrics.AddMeshDiscoverySocketErrors(status.Errors - mc.reportedSocketErrors)
+		mc.reportedSocketErrors = status.Errors
+	}
+}
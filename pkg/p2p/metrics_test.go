@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/2gc-dev/cloudbridge-client/pkg/wireguard"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestExportTopologyMetrics(t *testing.T) {
+	topology := wireguard.NewMeshTopology(nil, zap.NewNop())
+	for i := 0; i < 12; i++ {
+		topology.AddNode(&wireguard.MeshNode{
+			ID:       fmt.Sprintf("node-%02d", i),
+			Endpoint: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 51820},
+		})
+	}
+	// A full mesh has more connections than latency series are exported for
+	for i := 0; i < 12; i++ {
+		for j := 0; j < 12; j++ {
+			if i != j {
+				topology.AddConnection(fmt.Sprintf("node-%02d", i), fmt.Sprintf("node-%02d", j),
+					time.Duration(i+j)*time.Millisecond, 1024, 0.99)
+			}
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	mc := NewMeshClient(nil)
+	mc.meshTopology = topology
+	mc.SetMetrics(metrics.NewMetrics(registry))
+	mc.updateMetrics()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	values := make(map[string]float64)
+	latencySeries := 0
+	for _, family := range families {
+		switch family.GetName() {
+		case "client_mesh_nodes", "client_mesh_connections", "client_mesh_routes":
+			values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		case "client_mesh_connection_latency_seconds":
+			latencySeries = len(family.GetMetric())
+		}
+	}
+
+	if values["client_mesh_nodes"] != 12 {
+		t.Errorf("expected 12 nodes, got %v", values["client_mesh_nodes"])
+	}
+	if values["client_mesh_connections"] != 132 {
+		t.Errorf("expected 132 connections, got %v", values["client_mesh_connections"])
+	}
+	if latencySeries != MaxLatencySeries {
+		t.Errorf("expected %d latency series, got %d", MaxLatencySeries, latencySeries)
+	}
+}
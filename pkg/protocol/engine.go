@@ -2,8 +2,14 @@ package protocol
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
 )
 
 // Protocol represents supported protocols
@@ -15,6 +21,15 @@ const (
 	HTTP1
 )
 
+// The protocol values are fixed: reordering the constants fails to compile
+// instead of silently swapping protocols wherever a value was assumed
+func _() {
+	var x [1]struct{}
+	_ = x[QUIC-0]
+	_ = x[HTTP2-1]
+	_ = x[HTTP1-2]
+}
+
 // Protocol version constants
 const (
 	ProtocolVersionV1 = "1.0.0"
@@ -35,6 +50,65 @@ const (
 	FeatureHTTP2       = "http2"
 )
 
+// knownFeatures holds every feature a client may advertise
+var knownFeatures = map[string]bool{
+	FeatureTLS:         true,
+	FeatureHeartbeat:   true,
+	FeatureTunnelInfo:  true,
+	FeatureMultiTenant: true,
+	FeatureProxy:       true,
+	FeatureQUIC:        true,
+	FeatureMetrics:     true,
+	FeatureJWT:         true,
+	FeatureTunneling:   true,
+	FeatureHTTP2:       true,
+}
+
+// legacyFeatures are features older clients advertised that no longer exist.
+// They are dropped from configured feature lists instead of being rejected.
+var legacyFeatures = map[string]bool{
+	"p2p_mesh":       true,
+	"quantum_crypto": true,
+	"ai_monitoring":  true,
+}
+
+// DropLegacyFeatures returns features without the legacy features older
+// clients advertised, and the legacy features it dropped
+func DropLegacyFeatures(features []string) (kept, dropped []string) {
+	for _, f := range features {
+		if legacyFeatures[f] {
+			dropped = append(dropped, f)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept, dropped
+}
+
+// ValidateFeatures checks that features only names known features, each
+// at most once
+func ValidateFeatures(features []string) error {
+	seen := make(map[string]bool, len(features))
+	for _, f := range features {
+		if !knownFeatures[f] {
+			return fmt.Errorf("unknown feature: %q", f)
+		}
+		if seen[f] {
+			return fmt.Errorf("duplicate feature: %s", f)
+		}
+		seen[f] = true
+	}
+	return nil
+}
+
+// ErrCongested is returned by transports whose peer asks to slow down
+var ErrCongested = errors.New("transport congested")
+
+// Connection-level compression algorithms
+const (
+	CompressionDeflate = "deflate"
+)
+
 // GetProtocolQUIC returns QUIC protocol
 func GetProtocolQUIC() Protocol {
 	return QUIC
@@ -63,6 +137,40 @@ func (p Protocol) String() string {
 	}
 }
 
+// BuiltIn returns the protocols this build implements, most preferred first
+func BuiltIn() []Protocol {
+	return []Protocol{QUIC, HTTP2, HTTP1}
+}
+
+// ValidateOrder checks that a protocol fallback order is non-empty and lists
+// only known protocols, each at most once
+func ValidateOrder(order []Protocol) error {
+	if len(order) == 0 {
+		return fmt.Errorf("protocol order is empty")
+	}
+
+	seen := make(map[Protocol]bool, len(order))
+	for i, p := range order {
+		if p < QUIC || p > HTTP1 {
+			return fmt.Errorf("unknown protocol %d at position %d of the protocol order", int(p), i)
+		}
+		if seen[p] {
+			return fmt.Errorf("protocol %s is listed more than once in the protocol order", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// ValidateSwitchThreshold checks that a switch threshold is a failure rate
+// in (0, 1]
+func ValidateSwitchThreshold(threshold float64) error {
+	if !(threshold > 0 && threshold <= 1) {
+		return fmt.Errorf("switch threshold must be in (0, 1], got %v", threshold)
+	}
+	return nil
+}
+
 // GetProtocolDescription returns a human-readable description of the protocol
 func (p Protocol) GetProtocolDescription() string {
 	switch p {
@@ -82,6 +190,12 @@ type HelloMessage struct {
 	Type     string   `json:"type"`
 	Version  string   `json:"version"`
 	Features []string `json:"features"`
+
+	// PostQuantum lists the post-quantum security levels the client accepts
+	PostQuantum *quantum.Proposal `json:"post_quantum,omitempty"`
+	// Compression lists the connection-level compression algorithms the
+	// client accepts, in order of preference
+	Compression []string `json:"compression,omitempty"`
 }
 
 // NewHelloMessage creates a new hello message for v2.0
@@ -152,9 +266,30 @@ type ProtocolEngine struct {
 	networkConditions map[Protocol]bool
 	lastNetworkCheck  time.Time
 	networkCheckInterval time.Duration
-}
-
-// ProtocolStats tracks performance metrics for each protocol
+	// probeTimeout bounds the reachability probes of updateNetworkConditions
+	probeTimeout time.Duration
+
+	// clock places results into the rolling windows; nil means real time
+	clock clock.Clock
+	// strategy decides how GetBestProtocol ranks available protocols
+	strategy SelectionStrategy
+	// qualityThresholds make a working protocol with a degraded link
+	// eligible for switching
+	qualityThresholds QualityThresholds
+
+	// network is the fingerprint of the current network, networks the
+	// results recorded on each network
+	network  string
+	networks map[string]*networkHistory
+	// unknownUnavailable are the protocols marked unavailable while the
+	// network was unknown, and since when, kept while a known network is
+	// current
+	unknownUnavailable map[Protocol]time.Time
+}
+
+// ProtocolStats tracks performance metrics for each protocol. On a
+// long-running client the cumulative counts and TotalLatency are halved once
+// they reach maxCumulativeResults results, see renormalize.
 type ProtocolStats struct {
 	SuccessCount   int64
 	FailureCount   int64
@@ -165,6 +300,17 @@ type ProtocolStats struct {
 	FailureReason  string
 	AverageLatency time.Duration
 	ConnectionTime  time.Duration
+	FailureKind    FailureKind
+
+	// unavailableSince is when the protocol was marked unavailable; only
+	// meaningful while IsAvailable is false
+	unavailableSince time.Time
+	// handshakeTimeouts counts consecutive handshake timeouts
+	handshakeTimeouts int
+	// window counts recent results for the rolling windows
+	window windowCounter
+	// quality estimates the link from recent probes
+	quality qualityTracker
 }
 
 // NewProtocolEngine creates a new protocol engine
@@ -183,6 +329,7 @@ func NewProtocolEngine() *ProtocolEngine {
 		performanceBased: true,
 		networkConditions: make(map[Protocol]bool),
 		networkCheckInterval: 60 * time.Second,
+		probeTimeout:         defaultProbeTimeout,
 	}
 }
 
@@ -201,6 +348,7 @@ func NewProtocolEngineV1() *ProtocolEngine {
 		performanceBased: true,
 		networkConditions: make(map[Protocol]bool),
 		networkCheckInterval: 60 * time.Second,
+		probeTimeout:         defaultProbeTimeout,
 	}
 }
 
@@ -252,14 +400,64 @@ func (pe *ProtocolEngine) IsAutoSwitchEnabled() bool {
 	return pe.autoSwitchEnabled
 }
 
+// SetSwitchThreshold sets the failure rate above which a protocol counts as
+// failing and is switched away from. It must be in (0, 1].
+func (pe *ProtocolEngine) SetSwitchThreshold(threshold float64) error {
+	if err := ValidateSwitchThreshold(threshold); err != nil {
+		return err
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.switchThreshold = threshold
+	return nil
+}
+
+// GetSwitchThreshold returns the failure rate above which a protocol counts
+// as failing
+func (pe *ProtocolEngine) GetSwitchThreshold() float64 {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.switchThreshold
+}
+
+// SetSwitchCooldown sets how long after a switch no further switch is made
+func (pe *ProtocolEngine) SetSwitchCooldown(cooldown time.Duration) error {
+	if cooldown < 0 {
+		return fmt.Errorf("switch cooldown must not be negative, got %v", cooldown)
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.switchCooldown = cooldown
+	return nil
+}
+
+// GetSwitchCooldown returns how long after a switch no further switch is made
+func (pe *ProtocolEngine) GetSwitchCooldown() time.Duration {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.switchCooldown
+}
+
 // GetBestProtocol returns the best available protocol based on performance and availability
 func (pe *ProtocolEngine) GetBestProtocol() Protocol {
 	pe.mu.RLock()
 	defer pe.mu.RUnlock()
+	return pe.bestProtocolLocked()
+}
+
+// bestProtocolLocked implements GetBestProtocol. pe.mu must be held, at
+// least for reading.
+func (pe *ProtocolEngine) bestProtocolLocked() Protocol {
+	if pe.strategy == StrategyLatencyWeighted {
+		if protocol, ok := pe.cheapestProtocolLocked(); ok {
+			return protocol
+		}
+	}
 
 	// First, try to find a protocol that's available and performing well
-	for _, protocol := range pe.preferredOrder {
-		stats := pe.getOrCreateStats(protocol)
+	order := pe.orderLocked()
+	for _, protocol := range order {
+		stats := pe.peekStats(protocol)
 		
 		// Check if protocol is available
 		if !stats.IsAvailable {
@@ -280,8 +478,8 @@ func (pe *ProtocolEngine) GetBestProtocol() Protocol {
 	}
 
 	// If no protocol meets the criteria, return the first available one
-	for _, protocol := range pe.preferredOrder {
-		stats := pe.getOrCreateStats(protocol)
+	for _, protocol := range order {
+		stats := pe.peekStats(protocol)
 		if stats.IsAvailable {
 			return protocol
 		}
@@ -293,14 +491,20 @@ func (pe *ProtocolEngine) GetBestProtocol() Protocol {
 
 // GetOptimalProtocolForConnection returns the optimal protocol for a new connection
 func (pe *ProtocolEngine) GetOptimalProtocolForConnection(ctx context.Context, address string) Protocol {
+	// Check network conditions if enough time has passed. Probing takes a
+	// while, so it runs without holding the lock.
 	pe.mu.Lock()
-	defer pe.mu.Unlock()
-
-	// Check network conditions if enough time has passed
-	if time.Since(pe.lastNetworkCheck) > pe.networkCheckInterval {
-		pe.updateNetworkConditions(ctx, address)
+	probe := time.Since(pe.lastNetworkCheck) > pe.networkCheckInterval
+	if probe {
 		pe.lastNetworkCheck = time.Now()
 	}
+	pe.mu.Unlock()
+	if probe {
+		pe.updateNetworkConditions(ctx, address)
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
 
 	// Start with QUIC (fastest, 0-RTT, multiplexing)
 	if pe.isProtocolSuitable(QUIC, address) {
@@ -325,8 +529,9 @@ func (pe *ProtocolEngine) isProtocolSuitable(protocol Protocol, address string)
 		return false
 	}
 	
-	// Check network conditions
-	if !pe.networkConditions[protocol] {
+	// Check network conditions; a protocol not probed yet is assumed
+	// reachable
+	if reachable, probed := pe.networkConditions[protocol]; probed && !reachable {
 		return false
 	}
 	
@@ -342,13 +547,33 @@ func (pe *ProtocolEngine) isProtocolSuitable(protocol Protocol, address string)
 	return true
 }
 
-// updateNetworkConditions updates the network conditions for each protocol
+// updateNetworkConditions probes whether address answers QUIC over UDP and
+// accepts TCP connections, which HTTP/2 and HTTP/1.1 share, and records the
+// reachability of each protocol. Nothing is recorded if ctx is done before
+// the probes finish.
 func (pe *ProtocolEngine) updateNetworkConditions(ctx context.Context, address string) {
-	// This would typically involve network probing
-	// For now, we'll assume all protocols are available
-	pe.networkConditions[QUIC] = true
-	pe.networkConditions[HTTP2] = true
-	pe.networkConditions[HTTP1] = true
+	pe.mu.RLock()
+	timeout := pe.probeTimeout
+	pe.mu.RUnlock()
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	udp := make(chan bool, 1)
+	go func() { udp <- probeQUIC(probeCtx, address) }()
+	tcpReachable := probeTCP(probeCtx, address)
+	quicReachable := <-udp
+	if ctx.Err() != nil {
+		return
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.networkConditions[QUIC] = quicReachable
+	pe.networkConditions[HTTP2] = tcpReachable
+	pe.networkConditions[HTTP1] = tcpReachable
 }
 
 // RecordSuccess records a successful operation for a protocol
@@ -357,10 +582,17 @@ func (pe *ProtocolEngine) RecordSuccess(protocol Protocol, latency time.Duration
 	defer pe.mu.Unlock()
 	
 	stats := pe.getOrCreateStats(protocol)
+	if latency > 0 && stats.TotalLatency > math.MaxInt64-latency {
+		stats.halve()
+	}
 	stats.SuccessCount++
 	stats.TotalLatency += latency
-	stats.LastUsed = time.Now()
+	stats.renormalize()
+	stats.LastUsed = pe.now()
+	stats.window.add(stats.LastUsed, true)
+	pe.recordNetworkResultLocked(protocol, true)
 	stats.IsAvailable = true
+	stats.handshakeTimeouts = 0
 	
 	// Update average latency
 	total := stats.SuccessCount + stats.FailureCount
@@ -371,26 +603,39 @@ func (pe *ProtocolEngine) RecordSuccess(protocol Protocol, latency time.Duration
 
 // RecordFailure records a failed operation for a protocol
 func (pe *ProtocolEngine) RecordFailure(protocol Protocol, reason string) {
-	pe.mu.Lock()
-	defer pe.mu.Unlock()
-	
+	pe.RecordFailureKind(protocol, FailureUnknown, reason)
+}
+
+// recordFailureLocked updates the failure counters of a protocol. pe.mu must
+// be held.
+func (pe *ProtocolEngine) recordFailureLocked(protocol Protocol, reason string) *ProtocolStats {
 	stats := pe.getOrCreateStats(protocol)
 	stats.FailureCount++
-	stats.LastUsed = time.Now()
-	stats.LastFailure = time.Now()
+	stats.renormalize()
+	stats.LastUsed = pe.now()
+	stats.LastFailure = stats.LastUsed
+	stats.window.add(stats.LastUsed, false)
+	pe.recordNetworkResultLocked(protocol, false)
 	stats.FailureReason = reason
 	
-	// Mark protocol as unavailable if failure rate is high
-	total := stats.SuccessCount + stats.FailureCount
+	// Mark protocol as unavailable if failure rate is high. Availability
+	// is kept per network, so on a known network only its results count.
+	successes, failures := stats.SuccessCount, stats.FailureCount
+	if results := pe.networkResultsLocked(protocol); results != nil {
+		successes, failures = results.Successes, results.Failures
+	}
+	total := successes + failures
 	if total >= 5 {
-		failureRate := float64(stats.FailureCount) / float64(total)
+		failureRate := float64(failures) / float64(total)
 		if failureRate > pe.switchThreshold {
-			stats.IsAvailable = false
+			stats.markUnavailable(pe.now())
 		}
 	}
+	return stats
 }
 
-// ShouldSwitchProtocol determines if we should switch protocols
+// ShouldSwitchProtocol determines if we should switch protocols: the current
+// one fails too often, or its link is past the quality thresholds
 func (pe *ProtocolEngine) ShouldSwitchProtocol(current Protocol) bool {
 	pe.mu.RLock()
 	defer pe.mu.RUnlock()
@@ -403,7 +648,12 @@ func (pe *ProtocolEngine) ShouldSwitchProtocol(current Protocol) bool {
 		return false
 	}
 
-	currentStats := pe.getOrCreateStats(current)
+	currentStats := pe.peekStats(current)
+	// A link can be technically up but too slow or lossy to be useful
+	if currentStats.quality.snapshot().degradedReason(pe.qualityThresholds) != "" {
+		return true
+	}
+
 	total := currentStats.SuccessCount + currentStats.FailureCount
 	
 	if total < 5 {
@@ -414,16 +664,53 @@ func (pe *ProtocolEngine) ShouldSwitchProtocol(current Protocol) bool {
 	return failureRate > pe.switchThreshold
 }
 
+// RecordSwitch notes that the client switched protocols, starting the switch
+// cooldown
+func (pe *ProtocolEngine) RecordSwitch() {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.lastSwitch = time.Now()
+}
+
+// InSwitchCooldown reports whether the last protocol switch was too recent
+// for another one
+func (pe *ProtocolEngine) InSwitchCooldown() bool {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return time.Since(pe.lastSwitch) < pe.switchCooldown
+}
+
+// GetUpgradeCandidates returns the protocols preferred over current, most
+// preferred first. Protocols that failed permanently are left out.
+func (pe *ProtocolEngine) GetUpgradeCandidates(current Protocol) []Protocol {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	var candidates []Protocol
+	for _, protocol := range pe.orderLocked() {
+		if protocol == current {
+			return candidates
+		}
+		if stats, exists := pe.stats[protocol]; exists && stats.FailureKind.Permanent() {
+			continue
+		}
+		candidates = append(candidates, protocol)
+	}
+	// current is not in the preferred order
+	return nil
+}
+
 // GetNextProtocol returns the next protocol to try
 func (pe *ProtocolEngine) GetNextProtocol(current Protocol) Protocol {
 	pe.mu.RLock()
 	defer pe.mu.RUnlock()
 
-	for i, protocol := range pe.preferredOrder {
+	order := pe.orderLocked()
+	for i, protocol := range order {
 		if protocol == current {
 			// Try next protocol in order
-			for j := i + 1; j < len(pe.preferredOrder); j++ {
-				nextProtocol := pe.preferredOrder[j]
+			for j := i + 1; j < len(order); j++ {
+				nextProtocol := order[j]
 				if stats, exists := pe.stats[nextProtocol]; exists && stats.IsAvailable {
 					return nextProtocol
 				}
@@ -433,7 +720,7 @@ func (pe *ProtocolEngine) GetNextProtocol(current Protocol) Protocol {
 	}
 	
 	// Fallback to first available protocol
-	return pe.GetBestProtocol()
+	return pe.bestProtocolLocked()
 }
 
 // getOrCreateStats gets or creates stats for a protocol
@@ -452,29 +739,76 @@ func (pe *ProtocolEngine) getOrCreateStats(protocol Protocol) *ProtocolStats {
 	return pe.stats[protocol]
 }
 
-// GetStats returns protocol statistics
+// unusedStats are the stats of a protocol without any results. They must not
+// be modified.
+var unusedStats = ProtocolStats{IsAvailable: true}
+
+// peekStats returns the stats of a protocol without creating them, so it is
+// safe under the read lock. The result must not be modified.
+func (pe *ProtocolEngine) peekStats(protocol Protocol) *ProtocolStats {
+	if stats, exists := pe.stats[protocol]; exists {
+		return stats
+	}
+	return &unusedStats
+}
+
+// statsSnapshot is a copy of the reported values of ProtocolStats
+type statsSnapshot struct {
+	protocol       Protocol
+	successCount   int64
+	failureCount   int64
+	totalLatency   time.Duration
+	averageLatency time.Duration
+	lastUsed       time.Time
+	isAvailable    bool
+	failureRate    float64
+	lastFailure    time.Time
+	failureReason  string
+	failureKind    FailureKind
+	windows        map[string]interface{}
+}
+
+// GetStats returns protocol statistics. The values are copied under the
+// lock, so the result is safe to read while results are being recorded.
 func (pe *ProtocolEngine) GetStats() map[string]interface{} {
 	pe.mu.RLock()
-	defer pe.mu.RUnlock()
-	
-	result := make(map[string]interface{})
-	
+	now := pe.now()
+	snapshots := make([]statsSnapshot, 0, len(pe.stats))
 	for protocol, stats := range pe.stats {
-		protocolName := protocol.String()
-		result[protocolName] = map[string]interface{}{
-			"success_count":   stats.SuccessCount,
-			"failure_count":   stats.FailureCount,
-			"total_latency":   stats.TotalLatency.String(),
-			"average_latency": stats.AverageLatency.String(),
-			"last_used":       stats.LastUsed,
-			"is_available":    stats.IsAvailable,
-			"failure_rate":    pe.calculateFailureRate(stats),
-			"description":     protocol.GetProtocolDescription(),
-			"last_failure":    stats.LastFailure,
-			"failure_reason":  stats.FailureReason,
+		snapshots = append(snapshots, statsSnapshot{
+			protocol:       protocol,
+			successCount:   stats.SuccessCount,
+			failureCount:   stats.FailureCount,
+			totalLatency:   stats.TotalLatency,
+			averageLatency: stats.AverageLatency,
+			lastUsed:       stats.LastUsed,
+			isAvailable:    stats.IsAvailable,
+			failureRate:    pe.calculateFailureRate(stats),
+			lastFailure:    stats.LastFailure,
+			failureReason:  stats.FailureReason,
+			failureKind:    stats.FailureKind,
+			windows:        stats.window.windowStats(now),
+		})
+	}
+	pe.mu.RUnlock()
+
+	result := make(map[string]interface{}, len(snapshots))
+	for _, snap := range snapshots {
+		result[snap.protocol.String()] = map[string]interface{}{
+			"success_count":   snap.successCount,
+			"failure_count":   snap.failureCount,
+			"total_latency":   snap.totalLatency.String(),
+			"average_latency": snap.averageLatency.String(),
+			"last_used":       snap.lastUsed,
+			"is_available":    snap.isAvailable,
+			"failure_rate":    snap.failureRate,
+			"description":     snap.protocol.GetProtocolDescription(),
+			"last_failure":    snap.lastFailure,
+			"failure_reason":  snap.failureReason,
+			"failure_kind":    snap.failureKind,
+			"windows":         snap.windows,
 		}
 	}
-	
 	return result
 }
 
@@ -494,12 +828,13 @@ func (pe *ProtocolEngine) GetProtocolRecommendation() map[string]interface{} {
 	
 	recommendation := make(map[string]interface{})
 	
+	best := pe.bestProtocolLocked()
 	for _, protocol := range pe.preferredOrder {
-		stats := pe.getOrCreateStats(protocol)
+		stats := pe.peekStats(protocol)
 		protocolName := protocol.String()
 		
 		recommendation[protocolName] = map[string]interface{}{
-			"recommended":     protocol == pe.GetBestProtocol(),
+			"recommended":     protocol == best,
 			"description":     protocol.GetProtocolDescription(),
 			"is_available":    stats.IsAvailable,
 			"failure_rate":    pe.calculateFailureRate(stats),
@@ -523,6 +858,8 @@ func (pe *ProtocolEngine) getProtocolPriority(protocol Protocol) int {
 
 // ResetStats resets all protocol statistics
 func (pe *ProtocolEngine) ResetStats() {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
 	for _, protocol := range pe.preferredOrder {
 		pe.stats[protocol] = &ProtocolStats{
 			IsAvailable: true,
@@ -535,12 +872,45 @@ func (pe *ProtocolEngine) ResetStats() {
 
 // MarkProtocolAvailable marks a protocol as available
 func (pe *ProtocolEngine) MarkProtocolAvailable(protocol Protocol) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
 	stats := pe.getOrCreateStats(protocol)
 	stats.IsAvailable = true
 }
 
 // MarkProtocolUnavailable marks a protocol as unavailable
 func (pe *ProtocolEngine) MarkProtocolUnavailable(protocol Protocol) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
 	stats := pe.getOrCreateStats(protocol)
-	stats.IsAvailable = false
-} 
\ No newline at end of file
+	stats.markUnavailable(pe.now())
+} 
+// maxCumulativeResults is the number of results past which the cumulative
+// stats of a protocol are halved
+const maxCumulativeResults = 1 << 20
+
+// renormalize halves the cumulative stats once they cover more than
+// maxCumulativeResults results. Halving keeps the failure rate and the
+// average latency, keeps the counters far from overflowing, and lets newer
+// results outweigh those of months ago.
+func (s *ProtocolStats) renormalize() {
+	if s.SuccessCount+s.FailureCount > maxCumulativeResults {
+		s.halve()
+	}
+}
+
+// markUnavailable marks the protocol unavailable as of now, unless it
+// already is
+func (s *ProtocolStats) markUnavailable(now time.Time) {
+	if s.IsAvailable || s.unavailableSince.IsZero() {
+		s.unavailableSince = now
+	}
+	s.IsAvailable = false
+}
+
+// halve halves the cumulative counts and latency
+func (s *ProtocolStats) halve() {
+	s.SuccessCount /= 2
+	s.FailureCount /= 2
+	s.TotalLatency /= 2
+}
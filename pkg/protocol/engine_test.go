@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"math"
 	"testing"
 	"time"
 )
@@ -86,4 +87,142 @@ func TestProtocolEngineReset(t *testing.T) {
 			t.Errorf("Expected zeroed stats for protocol %s after reset", protocol)
 		}
 	}
-} 
\ No newline at end of file
+} 
+func TestValidateOrder(t *testing.T) {
+	if err := ValidateOrder([]Protocol{QUIC, HTTP2, HTTP1}); err != nil {
+		t.Errorf("valid order rejected: %v", err)
+	}
+
+	invalid := map[string][]Protocol{
+		"empty":     {},
+		"unknown":   {QUIC, Protocol(7)},
+		"duplicate": {HTTP2, QUIC, HTTP2},
+	}
+	for name, order := range invalid {
+		if err := ValidateOrder(order); err == nil {
+			t.Errorf("%s: expected error for order %v", name, order)
+		}
+	}
+}
+
+func TestValidateFeatures(t *testing.T) {
+	if err := ValidateFeatures([]string{FeatureTLS, FeatureHeartbeat, FeatureQUIC}); err != nil {
+		t.Errorf("valid features rejected: %v", err)
+	}
+	if err := ValidateFeatures([]string{FeatureTLS, "quantum_crypto"}); err == nil {
+		t.Error("expected error for unknown feature")
+	}
+	if err := ValidateFeatures([]string{FeatureQUIC, FeatureQUIC}); err == nil {
+		t.Error("expected error for duplicate feature")
+	}
+
+	kept, dropped := DropLegacyFeatures([]string{FeatureTLS, "quantum_crypto", FeatureQUIC})
+	if len(kept) != 2 || kept[0] != FeatureTLS || kept[1] != FeatureQUIC || len(dropped) != 1 || dropped[0] != "quantum_crypto" {
+		t.Errorf("unexpected result of dropping legacy features: kept %v, dropped %v", kept, dropped)
+	}
+}
+
+func TestGetStatsConcurrentWithRecording(t *testing.T) {
+	pe := NewProtocolEngine()
+	done := make(chan struct{})
+	defer close(done)
+
+	for _, protocol := range []Protocol{QUIC, HTTP2, HTTP1} {
+		go func(protocol Protocol) {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if i%3 == 0 {
+					pe.RecordFailure(protocol, "flaky")
+				} else {
+					pe.RecordSuccess(protocol, time.Millisecond)
+				}
+			}
+		}(protocol)
+	}
+
+	// Run with -race: reading the returned maps must not race with updates
+	for i := 0; i < 200; i++ {
+		for _, value := range pe.GetStats() {
+			stats := value.(map[string]interface{})
+			_ = stats["success_count"].(int64) + stats["failure_count"].(int64)
+			_ = stats["windows"].(map[string]interface{})["1m"]
+		}
+		pe.GetBestProtocol()
+		pe.GetProtocolRecommendation()
+		pe.ShouldSwitchProtocol(QUIC)
+	}
+}
+
+func TestSwitchSettings(t *testing.T) {
+	pe := NewProtocolEngine()
+	for _, threshold := range []float64{0, -0.1, 1.5} {
+		if err := pe.SetSwitchThreshold(threshold); err == nil {
+			t.Errorf("expected threshold %v to be rejected", threshold)
+		}
+	}
+	if err := pe.SetSwitchCooldown(-time.Second); err == nil {
+		t.Error("expected negative cooldown to be rejected")
+	}
+
+	// A low threshold switches away from a protocol failing now and then
+	if err := pe.SetSwitchThreshold(0.2); err != nil {
+		t.Fatalf("failed to set threshold: %v", err)
+	}
+	if err := pe.SetSwitchCooldown(0); err != nil {
+		t.Fatalf("failed to set cooldown: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		pe.RecordSuccess(QUIC, time.Millisecond)
+	}
+	pe.RecordFailure(QUIC, "reset")
+	pe.RecordFailure(QUIC, "reset")
+	pe.RecordSwitch()
+	if !pe.ShouldSwitchProtocol(QUIC) {
+		t.Error("expected a 40% failure rate to exceed the 0.2 threshold right after a switch")
+	}
+	if pe.GetSwitchThreshold() != 0.2 || pe.GetSwitchCooldown() != 0 {
+		t.Errorf("unexpected settings: %v, %v", pe.GetSwitchThreshold(), pe.GetSwitchCooldown())
+	}
+}
+
+func TestStatsRenormalize(t *testing.T) {
+	pe := NewProtocolEngine()
+	pe.mu.Lock()
+	stats := pe.getOrCreateStats(QUIC)
+	stats.SuccessCount = maxCumulativeResults * 3 / 4
+	stats.FailureCount = maxCumulativeResults / 4
+	stats.TotalLatency = maxCumulativeResults * 40 * time.Millisecond
+	pe.mu.Unlock()
+
+	// The result that crosses the limit halves the counts but keeps the ratios
+	pe.RecordSuccess(QUIC, 40*time.Millisecond)
+	pe.mu.RLock()
+	success, failure, average := stats.SuccessCount, stats.FailureCount, stats.AverageLatency
+	rate := pe.calculateFailureRate(stats)
+	pe.mu.RUnlock()
+	if success+failure > maxCumulativeResults/2+1 {
+		t.Errorf("expected the counts to be halved, got %d successes and %d failures", success, failure)
+	}
+	if rate < 0.249 || rate > 0.251 {
+		t.Errorf("expected the failure rate to stay at 0.25, got %v", rate)
+	}
+	if average < 39*time.Millisecond || average > 41*time.Millisecond {
+		t.Errorf("expected the average latency to stay at 40ms, got %v", average)
+	}
+
+	// A latency that would overflow the total halves it first
+	pe.mu.Lock()
+	stats.TotalLatency = math.MaxInt64 - time.Second
+	pe.mu.Unlock()
+	pe.RecordSuccess(QUIC, time.Hour)
+	pe.mu.RLock()
+	total := stats.TotalLatency
+	pe.mu.RUnlock()
+	if total <= 0 {
+		t.Errorf("expected the total latency not to overflow, got %v", total)
+	}
+}
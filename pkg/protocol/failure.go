@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// FailureKind classifies why a connection attempt failed, so the engine can
+// tell transient failures from ones that will not go away by retrying
+type FailureKind string
+
+const (
+	// FailureUnknown is an unclassified failure
+	FailureUnknown FailureKind = "unknown"
+	// FailureIdleTimeout means an established connection saw no recent
+	// network activity. Retrying is worthwhile.
+	FailureIdleTimeout FailureKind = "idle_timeout"
+	// FailureHandshakeTimeout means the server never completed the handshake
+	FailureHandshakeTimeout FailureKind = "handshake_timeout"
+	// FailureVersionMismatch means client and server share no protocol
+	// version. Retrying cannot succeed.
+	FailureVersionMismatch FailureKind = "version_mismatch"
+	// FailureUDPBlocked means UDP traffic to the server is rejected or
+	// dropped by the network
+	FailureUDPBlocked FailureKind = "udp_blocked"
+	// FailureTransport is a protocol error reported by either peer
+	FailureTransport FailureKind = "transport_error"
+)
+
+// blockedAfterHandshakeTimeouts is the number of consecutive QUIC handshake
+// timeouts, without any earlier success, after which UDP is assumed blocked
+const blockedAfterHandshakeTimeouts = 3
+
+// Permanent reports whether retrying the same protocol is pointless
+func (k FailureKind) Permanent() bool {
+	return k == FailureVersionMismatch || k == FailureUDPBlocked
+}
+
+// ClassifyQUICError maps an error from the QUIC connect path to a FailureKind
+func ClassifyQUICError(err error) FailureKind {
+	if err == nil {
+		return FailureUnknown
+	}
+
+	var (
+		versionErr   *quic.VersionNegotiationError
+		idleErr      *quic.IdleTimeoutError
+		handshakeErr *quic.HandshakeTimeoutError
+		resetErr     *quic.StatelessResetError
+		transportErr *quic.TransportError
+		appErr       *quic.ApplicationError
+	)
+	switch {
+	case errors.As(err, &versionErr):
+		return FailureVersionMismatch
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EACCES),
+		errors.Is(err, syscall.EPERM), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EHOSTUNREACH):
+		// ICMP unreachable or a local firewall rejecting the datagrams
+		return FailureUDPBlocked
+	case errors.As(err, &handshakeErr), errors.Is(err, context.DeadlineExceeded):
+		return FailureHandshakeTimeout
+	case errors.As(err, &idleErr):
+		return FailureIdleTimeout
+	case errors.As(err, &resetErr), errors.As(err, &transportErr), errors.As(err, &appErr):
+		return FailureTransport
+	default:
+		return FailureUnknown
+	}
+}
+
+// Availability is what the engine has learned about whether a protocol works
+type Availability struct {
+	Available bool
+	// Reachable is false if the last network probe found the protocol
+	// blocked
+	Reachable     bool
+	LastFailure   time.Time
+	FailureKind   FailureKind
+	FailureReason string
+}
+
+// GetAvailability returns the availability of protocol. A protocol without
+// recorded results is available.
+func (pe *ProtocolEngine) GetAvailability(protocol Protocol) Availability {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	stats := pe.peekStats(protocol)
+	reachable, probed := pe.networkConditions[protocol]
+	return Availability{
+		Available:     stats.IsAvailable,
+		Reachable:     reachable || !probed,
+		LastFailure:   stats.LastFailure,
+		FailureKind:   stats.FailureKind,
+		FailureReason: stats.FailureReason,
+	}
+}
+
+// RecordError records a failed connection attempt, classifying err for
+// protocols that support it
+func (pe *ProtocolEngine) RecordError(protocol Protocol, err error) {
+	kind := FailureUnknown
+	if protocol == QUIC {
+		kind = ClassifyQUICError(err)
+	}
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	pe.RecordFailureKind(protocol, kind, reason)
+}
+
+// RecordFailureKind records a failed operation with a classified reason.
+// Permanent failures mark the protocol unavailable immediately instead of
+// waiting for the failure rate to cross the switch threshold.
+func (pe *ProtocolEngine) RecordFailureKind(protocol Protocol, kind FailureKind, reason string) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	stats := pe.recordFailureLocked(protocol, reason)
+	stats.FailureKind = kind
+
+	if kind == FailureHandshakeTimeout {
+		stats.handshakeTimeouts++
+		if stats.SuccessCount == 0 && stats.handshakeTimeouts >= blockedAfterHandshakeTimeouts {
+			stats.FailureKind = FailureUDPBlocked
+		}
+	} else {
+		stats.handshakeTimeouts = 0
+	}
+
+	if stats.FailureKind.Permanent() {
+		stats.markUnavailable(pe.now())
+	}
+}
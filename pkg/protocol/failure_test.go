@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestClassifyQUICError(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvmsg", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		err  error
+		want FailureKind
+	}{
+		{fmt.Errorf("failed to establish QUIC connection: %w", &quic.VersionNegotiationError{}), FailureVersionMismatch},
+		{fmt.Errorf("failed to establish QUIC connection: %w", refused), FailureUDPBlocked},
+		{&quic.HandshakeTimeoutError{}, FailureHandshakeTimeout},
+		{context.DeadlineExceeded, FailureHandshakeTimeout},
+		{&quic.IdleTimeoutError{}, FailureIdleTimeout},
+		{&quic.TransportError{ErrorCode: quic.ProtocolViolation}, FailureTransport},
+		{errors.New("something else"), FailureUnknown},
+	}
+	for _, tt := range tests {
+		if got := ClassifyQUICError(tt.err); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestRecordErrorDisablesBlockedQUIC(t *testing.T) {
+	pe := NewProtocolEngine()
+	pe.RecordError(QUIC, fmt.Errorf("dial: %w", os.NewSyscallError("sendmsg", syscall.EPERM)))
+
+	if pe.GetBestProtocol() != HTTP2 {
+		t.Errorf("expected QUIC to be disabled after one UDP blocked failure, got %s", pe.GetBestProtocol())
+	}
+	if kind := pe.GetStats()["quic"].(map[string]interface{})["failure_kind"]; kind != FailureUDPBlocked {
+		t.Errorf("expected udp_blocked failure kind, got %v", kind)
+	}
+}
+
+func TestRecordErrorTransientFailures(t *testing.T) {
+	pe := NewProtocolEngine()
+	available := func() bool {
+		return pe.GetStats()["quic"].(map[string]interface{})["is_available"].(bool)
+	}
+
+	// Idle timeouts are retryable and must not disable QUIC by themselves
+	pe.RecordError(QUIC, &quic.IdleTimeoutError{})
+	if !available() {
+		t.Error("expected QUIC to stay available after an idle timeout")
+	}
+
+	// Repeated handshake timeouts without any success mean UDP is dropped
+	for i := 0; i < blockedAfterHandshakeTimeouts-1; i++ {
+		pe.RecordError(QUIC, &quic.HandshakeTimeoutError{})
+	}
+	if !available() {
+		t.Error("expected QUIC to stay available before the timeout limit")
+	}
+	pe.RecordError(QUIC, &quic.HandshakeTimeoutError{})
+	if available() {
+		t.Error("expected QUIC to be disabled after repeated handshake timeouts")
+	}
+}
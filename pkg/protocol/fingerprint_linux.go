@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NetworkFingerprint identifies the network the host is on by a hash of
+// the MAC address of its default gateway, so the MAC itself is not kept.
+// It returns "" if the network cannot be identified.
+func NetworkFingerprint() string {
+	gateway := defaultGateway("/proc/net/route")
+	if gateway == nil {
+		return ""
+	}
+	mac := neighborMAC("/proc/net/arp", gateway)
+	if mac == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(mac))
+	return hex.EncodeToString(sum[:8])
+}
+
+// defaultGateway returns the IPv4 gateway of the default route in the
+// routing table at path
+func defaultGateway(path string) net.IP {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in host byte order
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip
+	}
+	return nil
+}
+
+// neighborMAC returns the hardware address of ip in the ARP table at path
+func neighborMAC(path string, ip net.IP) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !ip.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+		if fields[3] == "00:00:00:00:00:00" {
+			return ""
+		}
+		return strings.ToLower(fields[3])
+	}
+	return ""
+}
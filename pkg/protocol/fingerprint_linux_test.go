@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultGatewayMAC(t *testing.T) {
+	dir := t.TempDir()
+	route := filepath.Join(dir, "route")
+	arp := filepath.Join(dir, "arp")
+	os.WriteFile(route, []byte("Iface\tDestination\tGateway \tFlags\n"+
+		"eth0\t0000A8C0\t00000000\t0001\n"+
+		"eth0\t00000000\t0101A8C0\t0003\n"), 0o600)
+	os.WriteFile(arp, []byte("IP address       HW type     Flags       HW address            Mask     Device\n"+
+		"192.168.1.1      0x1         0x2         AA:BB:CC:DD:EE:FF     *        eth0\n"), 0o600)
+
+	gateway := defaultGateway(route)
+	if gateway.String() != "192.168.1.1" {
+		t.Fatalf("expected gateway 192.168.1.1, got %v", gateway)
+	}
+	if mac := neighborMAC(arp, gateway); mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("expected the gateway MAC, got %q", mac)
+	}
+	if defaultGateway(filepath.Join(dir, "missing")) != nil {
+		t.Error("expected no gateway without a routing table")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package protocol
+
+// NetworkFingerprint identifies the network the host is on. The gateway is
+// only looked up on Linux, so elsewhere the network is always unknown.
+func NetworkFingerprint() string {
+	return ""
+}
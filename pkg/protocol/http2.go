@@ -3,10 +3,13 @@ package protocol
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -17,14 +20,26 @@ type HTTP2Client struct {
 	client  *http.Client
 	config  *HTTP2Config
 	baseURL string
+
+	// recvMu guards pending, the part of the last received message
+	// Receive has not returned yet
+	recvMu  sync.Mutex
+	pending []byte
 }
 
 // HTTP2Config holds HTTP/2-specific configuration
 type HTTP2Config struct {
 	TLSConfig        *tls.Config
+	// ALPN lists additional protocols offered after "h2" during the TLS
+	// handshake. If empty, the NextProtos of TLSConfig are used.
+	ALPN             []string
 	Timeout          time.Duration
+	// KeepAlive enables TCP keep-alives every KeepAlivePeriod, and HTTP/2
+	// pings on a connection that has been silent for as long
 	KeepAlive        bool
 	KeepAlivePeriod  time.Duration
+	// MaxIdleConns bounds the idle connections kept for reuse, and
+	// IdleConnTimeout closes connections idle for longer
 	MaxIdleConns     int
 	IdleConnTimeout  time.Duration
 }
@@ -46,15 +61,9 @@ func NewHTTP2Client(config *HTTP2Config) *HTTP2Client {
 		config = DefaultHTTP2Config()
 	}
 	
-	// Create HTTP/2 transport
-	transport := &http2.Transport{
-		TLSClientConfig: config.TLSConfig,
-		AllowHTTP:       false, // Require TLS for HTTP/2
-	}
-	
 	// Create HTTP client
 	client := &http.Client{
-		Transport: transport,
+		Transport: newHTTP2Transport(config),
 		Timeout:   config.Timeout,
 	}
 	
@@ -64,6 +73,58 @@ func NewHTTP2Client(config *HTTP2Config) *HTTP2Client {
 	}
 }
 
+// newHTTP2Transport returns an http.Transport speaking HTTP/2, so the idle
+// connection settings of the standard transport apply
+func newHTTP2Transport(config *HTTP2Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: config.Timeout, KeepAlive: -1}
+	if config.KeepAlive {
+		dialer.KeepAlive = config.KeepAlivePeriod
+	}
+	tlsConfig := http2TLSConfig(config)
+	// ConfigureTransports adds HTTP/1.1 to the NextProtos of tlsConfig, but
+	// the relay has to speak HTTP/2
+	protos := append([]string(nil), tlsConfig.NextProtos...)
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.Timeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		IdleConnTimeout:     config.IdleConnTimeout,
+	}
+
+	// ConfigureTransports only fails for a transport that already speaks
+	// HTTP/2, which a new one does not
+	h2, _ := http2.ConfigureTransports(transport)
+	if h2 != nil && config.KeepAlive {
+		h2.ReadIdleTimeout = config.KeepAlivePeriod
+	}
+	transport.TLSClientConfig.NextProtos = protos
+	return transport
+}
+
+// http2TLSConfig returns the TLS configuration for the HTTP/2 transport with
+// "h2" offered first, so the relay can select HTTP/2 via ALPN
+func http2TLSConfig(config *HTTP2Config) *tls.Config {
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	protos := config.ALPN
+	if len(protos) == 0 {
+		protos = tlsConfig.NextProtos
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	for _, proto := range protos {
+		if proto != http2.NextProtoTLS {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+		}
+	}
+	return tlsConfig
+}
+
 // Connect establishes an HTTP/2 connection (validates connectivity)
 func (hc *HTTP2Client) Connect(ctx context.Context, address string) error {
 	hc.baseURL = fmt.Sprintf("https://%s", address)
@@ -108,6 +169,9 @@ func (hc *HTTP2Client) Send(data []byte) error {
 	}
 	defer resp.Body.Close()
 	
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w: status code %d", ErrCongested, resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
@@ -115,33 +179,75 @@ func (hc *HTTP2Client) Send(data []byte) error {
 	return nil
 }
 
-// Receive receives data via HTTP/2 GET request
+// Receive receives data via HTTP/2 GET request. Each response body is one
+// message; a message longer than buffer is returned over several calls.
 func (hc *HTTP2Client) Receive(buffer []byte) (int, error) {
+	hc.recvMu.Lock()
+	defer hc.recvMu.Unlock()
+	if len(hc.pending) > 0 {
+		n := copy(buffer, hc.pending)
+		hc.pending = hc.pending[n:]
+		return n, nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), hc.config.Timeout)
 	defer cancel()
-	
+
+	body, err := hc.requestData(ctx, hc.client)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	// The body ending before buffer is full is a complete short message,
+	// not an error
+	n, err := io.ReadFull(body, buffer)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read response: %w", err)
+	}
+	rest, err := io.ReadAll(body)
+	if err != nil {
+		return n, fmt.Errorf("failed to read response: %w", err)
+	}
+	hc.pending = rest
+	return n, nil
+}
+
+// ReceiveStream requests the next message and returns its body as it
+// arrives, for messages too large to hold in memory. Reading returns io.EOF
+// at the end of the message; the caller must close the stream. The
+// configured timeout does not apply, ctx bounds the whole message instead.
+func (hc *HTTP2Client) ReceiveStream(ctx context.Context) (io.ReadCloser, error) {
+	streaming := *hc.client
+	streaming.Timeout = 0
+	return hc.requestData(ctx, &streaming)
+}
+
+// requestData requests the next message with client and returns its body
+func (hc *HTTP2Client) requestData(ctx context.Context, client *http.Client) (io.ReadCloser, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", hc.baseURL+"/data", nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	
-	resp, err := hc.client.Do(req)
+
+	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to receive request: %w", err)
+		return nil, fmt.Errorf("failed to receive request: %w", err)
 	}
-	defer resp.Body.Close()
-	
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
-	
-	return io.ReadFull(resp.Body, buffer)
+	return resp.Body, nil
 }
 
-// Close closes the HTTP/2 client
+// Close closes the HTTP/2 client. Its idle connections are closed, those
+// with requests in flight once the requests are done.
 func (hc *HTTP2Client) Close() error {
-	// HTTP client doesn't need explicit closing
-	// Transport will handle connection cleanup
+	hc.client.CloseIdleConnections()
 	return nil
 }
 
@@ -200,9 +306,10 @@ func (hc *HTTP2Client) GetStats() map[string]interface{} {
 	stats["keep_alive"] = hc.config.KeepAlive
 	
 	// Get transport stats if available
-	if _, ok := hc.client.Transport.(*http2.Transport); ok {
+	if transport, ok := hc.client.Transport.(*http.Transport); ok {
 		stats["transport_type"] = "http2"
-		// Note: http2.Transport doesn't expose detailed stats
+		stats["max_idle_conns"] = transport.MaxIdleConns
+		stats["idle_conn_timeout"] = transport.IdleConnTimeout.String()
 	}
 	
 	return stats
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTP2TLSConfigOffersH2First(t *testing.T) {
+	base := &tls.Config{NextProtos: []string{"cloudbridge/2", "h2"}}
+
+	got := http2TLSConfig(&HTTP2Config{TLSConfig: base}).NextProtos
+	if want := []string{"h2", "cloudbridge/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if !reflect.DeepEqual(base.NextProtos, []string{"cloudbridge/2", "h2"}) {
+		t.Error("the caller's TLS config must not be modified")
+	}
+
+	got = http2TLSConfig(&HTTP2Config{TLSConfig: base, ALPN: []string{"custom/1"}}).NextProtos
+	if want := []string{"h2", "custom/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	got = http2TLSConfig(&HTTP2Config{}).NextProtos
+	if want := []string{"h2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestHTTP2TransportOffersOnlyConfiguredProtocols(t *testing.T) {
+	offered := make(chan []string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	serverConfig := server.TLS.Clone()
+	server.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		select {
+		case offered <- hello.SupportedProtos:
+		default:
+		}
+		return serverConfig, nil
+	}
+
+	transport := newHTTP2Transport(&HTTP2Config{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"cloudbridge/2"}},
+		Timeout:   5 * time.Second,
+	})
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+
+	select {
+	case got := <-offered:
+		if want := []string{"h2", "cloudbridge/2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected ALPN %v, got %v", want, got)
+		}
+	default:
+		t.Fatal("the server saw no ClientHello")
+	}
+}
+
+func TestHTTP2ReceiveShortMessage(t *testing.T) {
+	messages := []string{"0123456789", strings.Repeat("x", 6000)}
+	var served int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/data" {
+			w.Write([]byte(messages[atomic.AddInt32(&served, 1)-1]))
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTP2Client(&HTTP2Config{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Timeout:   5 * time.Second,
+	})
+	if err := client.Connect(context.Background(), server.Listener.Addr().String()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := client.Receive(buffer)
+	if err != nil || string(buffer[:n]) != messages[0] {
+		t.Fatalf("expected the 10 byte message, got %q, %v", buffer[:n], err)
+	}
+
+	// A message longer than the buffer arrives over two calls
+	first, err := client.Receive(buffer)
+	if err != nil || first != len(buffer) {
+		t.Fatalf("expected a full buffer, got %d, %v", first, err)
+	}
+	second, err := client.Receive(buffer)
+	if err != nil || first+second != len(messages[1]) {
+		t.Errorf("expected the rest of the message, got %d, %v", second, err)
+	}
+	if served != 2 {
+		t.Errorf("expected the rest to come without another request, got %d requests", served)
+	}
+}
+
+func TestHTTP2ReceiveStream(t *testing.T) {
+	message := strings.Repeat("0123456789", 10000)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data" {
+			return
+		}
+		// Flush in parts, so the client reads the message in several calls
+		for i := 0; i < len(message); i += 25000 {
+			w.Write([]byte(message[i : i+25000]))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTP2Client(&HTTP2Config{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Timeout:   5 * time.Second,
+	})
+	if err := client.Connect(context.Background(), server.Listener.Addr().String()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	stream, err := client.ReceiveStream(context.Background())
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	defer stream.Close()
+	var received strings.Builder
+	buffer := make([]byte, 4096)
+	for {
+		n, err := stream.Read(buffer)
+		received.Write(buffer[:n])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read stream: %v", err)
+		}
+	}
+	if received.String() != message {
+		t.Errorf("expected the %d byte message, got %d bytes", len(message), received.Len())
+	}
+}
+
+func TestHTTP2ClosesIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewHTTP2Client(&HTTP2Config{
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+		Timeout:         5 * time.Second,
+		MaxIdleConns:    1,
+		IdleConnTimeout: 50 * time.Millisecond,
+	})
+	if err := client.Connect(context.Background(), server.Listener.Addr().String()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection was not closed after the idle timeout")
+	}
+}
@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// maxRememberedNetworks bounds the networks results are kept for; the
+	// network seen least recently is forgotten first
+	maxRememberedNetworks = 64
+	// minNetworkResults is the number of results on a network before they
+	// change the order for it
+	minNetworkResults = 3
+	// unavailableTTL is how long a protocol marked unavailable stays so
+	// across restarts and network changes; then it is tried again
+	unavailableTTL = 24 * time.Hour
+)
+
+// networkHistory counts the results of each protocol on one network
+type networkHistory struct {
+	results  map[Protocol]*networkResults
+	lastSeen time.Time
+	// unavailable are the protocols marked unavailable on the network, and
+	// since when, while another network is current; the stats hold those of
+	// the current one
+	unavailable map[Protocol]time.Time
+}
+
+// networkResults are the results of a protocol on one network
+type networkResults struct {
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+}
+
+// failureRate returns the share of failed results
+func (r *networkResults) failureRate() float64 {
+	total := r.Successes + r.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(r.Failures) / float64(total)
+}
+
+// SetNetwork sets the fingerprint of the network the client is on, as
+// returned by NetworkFingerprint. Results are then also recorded for that
+// network, and protocols that fail on it are tried after the others there.
+// Protocols marked unavailable on one network are available again on
+// another. An empty fingerprint means the network is unknown and the
+// preferred order is used as is.
+func (pe *ProtocolEngine) SetNetwork(fingerprint string) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if fingerprint != pe.network {
+		pe.switchAvailabilityLocked(fingerprint)
+	}
+	pe.network = fingerprint
+	if fingerprint != "" {
+		pe.networkHistoryLocked(fingerprint).lastSeen = pe.now()
+	}
+}
+
+// switchAvailabilityLocked parks the availability of the protocols on the
+// current network and takes up that recorded on the network with
+// fingerprint. pe.mu must be held.
+func (pe *ProtocolEngine) switchAvailabilityLocked(fingerprint string) {
+	unavailable := pe.unavailableLocked()
+	if pe.network == "" {
+		pe.unknownUnavailable = unavailable
+	} else if history, ok := pe.networks[pe.network]; ok {
+		history.unavailable = unavailable
+	}
+
+	next := pe.unknownUnavailable
+	if fingerprint != "" {
+		next = pe.networkHistoryLocked(fingerprint).unavailable
+	}
+	pe.applyUnavailableLocked(next)
+}
+
+// unavailableLocked returns the protocols the stats mark unavailable and
+// since when. pe.mu must be held.
+func (pe *ProtocolEngine) unavailableLocked() map[Protocol]time.Time {
+	var unavailable map[Protocol]time.Time
+	for protocol, stats := range pe.stats {
+		if !stats.IsAvailable {
+			if unavailable == nil {
+				unavailable = make(map[Protocol]time.Time)
+			}
+			unavailable[protocol] = stats.unavailableSince
+		}
+	}
+	return unavailable
+}
+
+// applyUnavailableLocked marks the protocols in unavailable unavailable and
+// all others available. Marks older than unavailableTTL have expired and
+// are dropped. pe.mu must be held.
+func (pe *ProtocolEngine) applyUnavailableLocked(unavailable map[Protocol]time.Time) {
+	for _, stats := range pe.stats {
+		stats.IsAvailable = true
+	}
+	now := pe.now()
+	for protocol, since := range unavailable {
+		if !unavailableExpired(since, now) {
+			stats := pe.getOrCreateStats(protocol)
+			stats.IsAvailable = false
+			stats.unavailableSince = since
+		}
+	}
+}
+
+// unavailableExpired reports whether a protocol marked unavailable at since
+// is to be tried again at now
+func unavailableExpired(since, now time.Time) bool {
+	return now.Sub(since) >= unavailableTTL
+}
+
+// networkResultsLocked returns the results of protocol on the current
+// network, or nil if the network is unknown or there are none. pe.mu must
+// be held.
+func (pe *ProtocolEngine) networkResultsLocked(protocol Protocol) *networkResults {
+	if history, ok := pe.networks[pe.network]; ok && pe.network != "" {
+		return history.results[protocol]
+	}
+	return nil
+}
+
+// GetNetwork returns the fingerprint set with SetNetwork
+func (pe *ProtocolEngine) GetNetwork() string {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.network
+}
+
+// GetEffectiveOrder returns the order protocols are tried in on the current
+// network: the preferred order, with the protocols whose failure rate on
+// this network is above the switch threshold moved to the end
+func (pe *ProtocolEngine) GetEffectiveOrder() []Protocol {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return append([]Protocol(nil), pe.orderLocked()...)
+}
+
+// orderLocked implements GetEffectiveOrder. The result must not be
+// modified. pe.mu must be held, at least for reading.
+func (pe *ProtocolEngine) orderLocked() []Protocol {
+	history, ok := pe.networks[pe.network]
+	if pe.network == "" || !ok {
+		return pe.preferredOrder
+	}
+	failing := func(p Protocol) bool {
+		r, ok := history.results[p]
+		return ok && r.Successes+r.Failures >= minNetworkResults && r.failureRate() > pe.switchThreshold
+	}
+
+	order := append([]Protocol(nil), pe.preferredOrder...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return !failing(order[i]) && failing(order[j])
+	})
+	return order
+}
+
+// recordNetworkResultLocked counts a result of protocol on the current
+// network. pe.mu must be held.
+func (pe *ProtocolEngine) recordNetworkResultLocked(protocol Protocol, success bool) {
+	if pe.network == "" {
+		return
+	}
+	history := pe.networkHistoryLocked(pe.network)
+	history.lastSeen = pe.now()
+	r, ok := history.results[protocol]
+	if !ok {
+		r = &networkResults{}
+		history.results[protocol] = r
+	}
+	if success {
+		r.Successes++
+	} else {
+		r.Failures++
+	}
+	// Like the cumulative stats, keep the counts bounded and recent
+	if r.Successes+r.Failures > maxCumulativeResults {
+		r.Successes /= 2
+		r.Failures /= 2
+	}
+}
+
+// networkHistoryLocked returns the history of fingerprint, creating it and
+// forgetting the least recently seen network if there are too many. pe.mu
+// must be held.
+func (pe *ProtocolEngine) networkHistoryLocked(fingerprint string) *networkHistory {
+	if history, ok := pe.networks[fingerprint]; ok {
+		return history
+	}
+	if pe.networks == nil {
+		pe.networks = make(map[string]*networkHistory)
+	}
+	if len(pe.networks) >= maxRememberedNetworks {
+		var oldest string
+		for name, history := range pe.networks {
+			if oldest == "" || history.lastSeen.Before(pe.networks[oldest].lastSeen) {
+				oldest = name
+			}
+		}
+		delete(pe.networks, oldest)
+	}
+	history := &networkHistory{results: make(map[Protocol]*networkResults)}
+	pe.networks[fingerprint] = history
+	return history
+}
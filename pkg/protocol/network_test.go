@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+func TestPerNetworkOrder(t *testing.T) {
+	pe := NewProtocolEngine()
+	global := []Protocol{QUIC, HTTP2, HTTP1}
+
+	// QUIC is blocked on network a, but works on network b
+	pe.SetNetwork("a")
+	for i := 0; i < 3; i++ {
+		pe.RecordFailure(QUIC, "blocked")
+	}
+	pe.RecordSuccess(HTTP2, 10*time.Millisecond)
+	pe.SetNetwork("b")
+	pe.RecordSuccess(QUIC, 10*time.Millisecond)
+
+	if got := pe.GetEffectiveOrder(); !reflect.DeepEqual(got, global) {
+		t.Errorf("expected the global order on network b, got %v", got)
+	}
+	pe.SetNetwork("a")
+	if got, want := pe.GetEffectiveOrder(), []Protocol{HTTP2, HTTP1, QUIC}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v on network a, got %v", want, got)
+	}
+	if got := pe.GetNextProtocol(HTTP1); got != QUIC {
+		t.Errorf("expected QUIC to be tried last on network a, got %s", got)
+	}
+
+	// An unknown network uses the global order
+	pe.SetNetwork("")
+	if got := pe.GetEffectiveOrder(); !reflect.DeepEqual(got, global) {
+		t.Errorf("expected the global order on an unknown network, got %v", got)
+	}
+	pe.SetNetwork("c")
+	if got := pe.GetEffectiveOrder(); !reflect.DeepEqual(got, global) {
+		t.Errorf("expected the global order on a new network, got %v", got)
+	}
+
+	// The results per network survive a restart
+	data, err := pe.ExportStats()
+	if err != nil {
+		t.Fatalf("failed to export stats: %v", err)
+	}
+	restored := NewProtocolEngine()
+	if err := restored.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	restored.SetNetwork("a")
+	if got := restored.GetEffectiveOrder(); got[len(got)-1] != QUIC {
+		t.Errorf("expected QUIC last on network a after a restart, got %v", got)
+	}
+}
+
+func TestAvailabilityPerNetwork(t *testing.T) {
+	pe := NewProtocolEngine()
+	pe.MarkProtocolUnavailable(HTTP1)
+	pe.SetNetwork("a")
+	if !pe.GetAvailability(HTTP1).Available {
+		t.Error("expected HTTP1 to be available on network a")
+	}
+	pe.MarkProtocolUnavailable(QUIC)
+
+	pe.SetNetwork("b")
+	if !pe.GetAvailability(QUIC).Available {
+		t.Error("expected QUIC disabled on network a to be available on network b")
+	}
+	pe.SetNetwork("a")
+	if pe.GetAvailability(QUIC).Available {
+		t.Error("expected QUIC to stay unavailable on network a")
+	}
+
+	// The availability per network survives a restart
+	data, err := pe.ExportStats()
+	if err != nil {
+		t.Fatalf("failed to export stats: %v", err)
+	}
+	restored := NewProtocolEngine()
+	if err := restored.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if restored.GetAvailability(HTTP1).Available || !restored.GetAvailability(QUIC).Available {
+		t.Error("expected the availability of the unknown network after a restart")
+	}
+	restored.SetNetwork("a")
+	if !restored.GetAvailability(HTTP1).Available || restored.GetAvailability(QUIC).Available {
+		t.Error("expected the availability of network a after a restart")
+	}
+}
+
+func TestRememberedNetworksAreBounded(t *testing.T) {
+	pe := NewProtocolEngine()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	pe.SetClock(fake)
+	for i := 0; i <= maxRememberedNetworks; i++ {
+		fake.Advance(time.Second)
+		pe.SetNetwork(string(rune('A' + i)))
+	}
+	if len(pe.networks) != maxRememberedNetworks {
+		t.Errorf("expected %d networks, got %d", maxRememberedNetworks, len(pe.networks))
+	}
+	if _, ok := pe.networks["A"]; ok {
+		t.Error("expected the least recently seen network to be forgotten")
+	}
+}
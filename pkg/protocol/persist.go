@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// statsFormatVersion is the version of the ExportStats format
+const statsFormatVersion = 1
+
+// exportedStats is the JSON document written by ExportStats
+type exportedStats struct {
+	Version   int                              `json:"version"`
+	Protocols map[string]exportedProtocolStats `json:"protocols"`
+	// Networks are the results per network fingerprint, see SetNetwork
+	Networks map[string]exportedNetwork `json:"networks,omitempty"`
+}
+
+// exportedNetwork is the persisted networkHistory of a network
+type exportedNetwork struct {
+	LastSeen  time.Time                 `json:"last_seen"`
+	Protocols map[string]networkResults `json:"protocols"`
+	// Unavailable are the protocols marked unavailable on the network, and
+	// since when
+	Unavailable map[string]time.Time `json:"unavailable_since,omitempty"`
+}
+
+// exportedProtocolStats are the persisted fields of ProtocolStats. The
+// rolling windows only cover recent results and are not persisted.
+type exportedProtocolStats struct {
+	SuccessCount      int64         `json:"success_count"`
+	FailureCount      int64         `json:"failure_count"`
+	TotalLatency      time.Duration `json:"total_latency"`
+	AverageLatency    time.Duration `json:"average_latency"`
+	LastUsed          time.Time     `json:"last_used"`
+	IsAvailable       bool          `json:"is_available"`
+	UnavailableSince  time.Time     `json:"unavailable_since"`
+	LastFailure       time.Time     `json:"last_failure"`
+	FailureReason     string        `json:"failure_reason,omitempty"`
+	FailureKind       FailureKind   `json:"failure_kind,omitempty"`
+	HandshakeTimeouts int           `json:"handshake_timeouts,omitempty"`
+}
+
+// ExportStats serializes the per-protocol statistics to JSON, so a restarted
+// client does not have to learn again which protocols work. The
+// availability of the protocols is that on an unknown network; each known
+// network carries its own.
+func (pe *ProtocolEngine) ExportStats() ([]byte, error) {
+	pe.mu.RLock()
+	doc := exportedStats{
+		Version:   statsFormatVersion,
+		Protocols: make(map[string]exportedProtocolStats, len(pe.stats)),
+	}
+	for protocol, stats := range pe.stats {
+		available, since := stats.IsAvailable, stats.unavailableSince
+		if pe.network != "" {
+			var unavailable bool
+			since, unavailable = pe.unknownUnavailable[protocol]
+			available = !unavailable
+		}
+		if available {
+			since = time.Time{}
+		}
+		doc.Protocols[protocol.String()] = exportedProtocolStats{
+			SuccessCount:      stats.SuccessCount,
+			FailureCount:      stats.FailureCount,
+			TotalLatency:      stats.TotalLatency,
+			AverageLatency:    stats.AverageLatency,
+			LastUsed:          stats.LastUsed,
+			IsAvailable:       available,
+			UnavailableSince:  since,
+			LastFailure:       stats.LastFailure,
+			FailureReason:     stats.FailureReason,
+			FailureKind:       stats.FailureKind,
+			HandshakeTimeouts: stats.handshakeTimeouts,
+		}
+	}
+	for fingerprint, history := range pe.networks {
+		if doc.Networks == nil {
+			doc.Networks = make(map[string]exportedNetwork, len(pe.networks))
+		}
+		network := exportedNetwork{
+			LastSeen:  history.lastSeen,
+			Protocols: make(map[string]networkResults, len(history.results)),
+		}
+		for protocol, results := range history.results {
+			network.Protocols[protocol.String()] = *results
+		}
+		unavailable := history.unavailable
+		if fingerprint == pe.network {
+			unavailable = pe.unavailableLocked()
+		}
+		for protocol, since := range unavailable {
+			if network.Unavailable == nil {
+				network.Unavailable = make(map[string]time.Time, len(unavailable))
+			}
+			network.Unavailable[protocol.String()] = since
+		}
+		doc.Networks[fingerprint] = network
+	}
+	pe.mu.RUnlock()
+
+	return json.Marshal(doc)
+}
+
+// ImportStats replaces the statistics of every protocol in data, as written
+// by ExportStats. Protocols this build does not know are ignored; the
+// statistics of protocols missing from data are kept. Protocols marked
+// unavailable longer than unavailableTTL ago are available again.
+func (pe *ProtocolEngine) ImportStats(data []byte) error {
+	var doc exportedStats
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid protocol stats: %w", err)
+	}
+	if doc.Version != statsFormatVersion {
+		return fmt.Errorf("unsupported protocol stats version %d", doc.Version)
+	}
+
+	known := make(map[string]Protocol)
+	for _, p := range BuiltIn() {
+		known[p.String()] = p
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	now := pe.now()
+	for name, imported := range doc.Protocols {
+		protocol, ok := known[name]
+		if !ok {
+			continue
+		}
+		stats := &ProtocolStats{
+			SuccessCount:      imported.SuccessCount,
+			FailureCount:      imported.FailureCount,
+			TotalLatency:      imported.TotalLatency,
+			AverageLatency:    imported.AverageLatency,
+			LastUsed:          imported.LastUsed,
+			IsAvailable:       true,
+			LastFailure:       imported.LastFailure,
+			FailureReason:     imported.FailureReason,
+			FailureKind:       imported.FailureKind,
+			handshakeTimeouts: imported.HandshakeTimeouts,
+		}
+		if !imported.IsAvailable {
+			// Older files did not record since when
+			since := imported.UnavailableSince
+			if since.IsZero() {
+				since = imported.LastFailure
+			}
+			if since.IsZero() {
+				since = now
+			}
+			if !unavailableExpired(since, now) {
+				stats.IsAvailable = false
+				stats.unavailableSince = since
+			}
+		}
+		pe.stats[protocol] = stats
+	}
+	for fingerprint, imported := range doc.Networks {
+		history := pe.networkHistoryLocked(fingerprint)
+		history.lastSeen = imported.LastSeen
+		for name, results := range imported.Protocols {
+			if protocol, ok := known[name]; ok {
+				results := results
+				history.results[protocol] = &results
+			}
+		}
+		history.unavailable = nil
+		for name, since := range imported.Unavailable {
+			if protocol, ok := known[name]; ok && !unavailableExpired(since, now) {
+				if history.unavailable == nil {
+					history.unavailable = make(map[Protocol]time.Time)
+				}
+				history.unavailable[protocol] = since
+			}
+		}
+	}
+	// The imported availability is that on an unknown network
+	if pe.network != "" {
+		pe.unknownUnavailable = pe.unavailableLocked()
+		pe.applyUnavailableLocked(pe.networkHistoryLocked(pe.network).unavailable)
+	}
+	return nil
+}
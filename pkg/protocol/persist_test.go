@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+func TestExportImportStats(t *testing.T) {
+	pe := NewProtocolEngine()
+	pe.RecordSuccess(HTTP2, 40*time.Millisecond)
+	pe.RecordSuccess(HTTP2, 20*time.Millisecond)
+	pe.RecordError(QUIC, syscall.ECONNREFUSED)
+
+	data, err := pe.ExportStats()
+	if err != nil {
+		t.Fatalf("failed to export stats: %v", err)
+	}
+
+	restored := NewProtocolEngine()
+	if err := restored.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	quic := restored.GetAvailability(QUIC)
+	if quic.Available || quic.FailureKind != FailureUDPBlocked || quic.LastFailure.IsZero() {
+		t.Errorf("expected QUIC to stay blocked after a restart: %+v", quic)
+	}
+	if got := restored.GetBestProtocol(); got != HTTP2 {
+		t.Errorf("expected HTTP2 after a restart, got %s", got)
+	}
+	stats := restored.GetStats()["http2"].(map[string]interface{})
+	if stats["success_count"] != int64(2) || stats["average_latency"] != "30ms" {
+		t.Errorf("unexpected HTTP2 stats: %v", stats)
+	}
+}
+
+func TestImportStatsIgnoresUnknownProtocols(t *testing.T) {
+	pe := NewProtocolEngine()
+	data := []byte(`{"version":1,"protocols":{"http3":{"success_count":9,"is_available":true},"http1":{"failure_count":1,"is_available":false}}}`)
+	if err := pe.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if pe.GetAvailability(HTTP1).Available {
+		t.Error("expected HTTP1 to be imported as unavailable")
+	}
+
+	if err := pe.ImportStats([]byte(`{"version":2,"protocols":{}}`)); err == nil {
+		t.Error("expected unsupported format version to be rejected")
+	}
+	if err := pe.ImportStats([]byte(`not json`)); err == nil {
+		t.Error("expected invalid JSON to be rejected")
+	}
+}
+
+func TestImportStatsExpiresUnavailable(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	pe := NewProtocolEngine()
+	pe.SetClock(clock.NewFake(start))
+	pe.MarkProtocolUnavailable(QUIC)
+	pe.SetNetwork("a")
+	pe.MarkProtocolUnavailable(HTTP2)
+	data, err := pe.ExportStats()
+	if err != nil {
+		t.Fatalf("failed to export stats: %v", err)
+	}
+
+	// Within the TTL the marks are kept
+	fake := clock.NewFake(start.Add(unavailableTTL - time.Minute))
+	restored := NewProtocolEngine()
+	restored.SetClock(fake)
+	if err := restored.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if restored.GetAvailability(QUIC).Available {
+		t.Error("expected QUIC to stay unavailable within the TTL")
+	}
+
+	// Parked on another network, the mark of network a expires as well
+	fake.Advance(time.Minute)
+	restored.SetNetwork("a")
+	if !restored.GetAvailability(HTTP2).Available {
+		t.Error("expected HTTP2 to be available on network a after the TTL")
+	}
+
+	restored = NewProtocolEngine()
+	restored.SetClock(clock.NewFake(start.Add(unavailableTTL)))
+	if err := restored.ImportStats(data); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if !restored.GetAvailability(QUIC).Available {
+		t.Error("expected QUIC to be available after the TTL")
+	}
+	restored.SetNetwork("a")
+	if !restored.GetAvailability(HTTP2).Available {
+		t.Error("expected HTTP2 to be available on network a after the TTL")
+	}
+
+	// Without a mark time, the last failure starts the TTL
+	legacy := []byte(`{"version":1,"protocols":{"quic":{"failure_count":5,"is_available":false,"last_failure":"2024-01-01T12:00:00Z"}}}`)
+	restored = NewProtocolEngine()
+	restored.SetClock(clock.NewFake(start.Add(unavailableTTL)))
+	if err := restored.ImportStats(legacy); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if !restored.GetAvailability(QUIC).Available {
+		t.Error("expected QUIC without a mark time to expire after the TTL")
+	}
+}
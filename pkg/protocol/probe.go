@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// defaultProbeTimeout bounds the reachability probes of a network check
+const defaultProbeTimeout = 3 * time.Second
+
+// probeALPN is offered by QUIC probes. The server does not need to accept
+// it: any answer, even a refused handshake, shows that UDP gets through.
+const probeALPN = "cloudbridge-probe"
+
+// probeQUIC reports whether address answers a QUIC handshake before ctx is
+// done
+func probeQUIC(ctx context.Context, address string) bool {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, // nothing is sent over the probe connection
+		NextProtos:         []string{probeALPN},
+	}
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, nil)
+	if err == nil {
+		conn.CloseWithError(0, "probe")
+		return true
+	}
+	switch ClassifyQUICError(err) {
+	case FailureHandshakeTimeout, FailureUDPBlocked:
+		return false
+	}
+	return ctx.Err() == nil
+}
+
+// probeTCP reports whether address accepts a TCP connection before ctx is
+// done
+func probeTCP(ctx context.Context, address string) bool {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
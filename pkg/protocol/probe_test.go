@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetworkProbeSkipsBlockedQUIC(t *testing.T) {
+	// A relay accepting TCP whose UDP port silently drops every datagram,
+	// like a firewall would
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	address := listener.Addr().String()
+	silent, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("UDP port of the TCP listener is taken: %v", err)
+	}
+	defer silent.Close()
+
+	pe := NewProtocolEngine()
+	pe.probeTimeout = 200 * time.Millisecond
+	if got := pe.GetOptimalProtocolForConnection(context.Background(), address); got != HTTP2 {
+		t.Errorf("expected HTTP2 with UDP blocked, got %s", got)
+	}
+	if pe.GetAvailability(QUIC).Reachable || !pe.GetAvailability(HTTP2).Reachable {
+		t.Errorf("unexpected reachability: quic %+v, http2 %+v", pe.GetAvailability(QUIC), pe.GetAvailability(HTTP2))
+	}
+
+	// The result is cached for the check interval
+	silent.Close()
+	if got := pe.GetOptimalProtocolForConnection(context.Background(), address); got != HTTP2 {
+		t.Errorf("expected cached probe result, got %s", got)
+	}
+}
+
+func TestNetworkProbeAcceptsAnsweringQUIC(t *testing.T) {
+	// The server refuses the probe's ALPN, but answering at all shows that
+	// UDP gets through. Nothing accepts TCP on the port.
+	address := startFrameServer(t, false)
+
+	pe := NewProtocolEngine()
+	pe.probeTimeout = time.Second
+	pe.updateNetworkConditions(context.Background(), address)
+	if !pe.GetAvailability(QUIC).Reachable {
+		t.Error("expected QUIC to be reachable")
+	}
+	if pe.GetAvailability(HTTP2).Reachable || pe.GetAvailability(HTTP1).Reachable {
+		t.Error("expected TCP protocols to be unreachable")
+	}
+
+	// A cancelled check records nothing
+	pe = NewProtocolEngine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pe.updateNetworkConditions(ctx, address)
+	if !pe.GetAvailability(HTTP2).Reachable {
+		t.Error("expected a cancelled probe to leave the protocol unprobed")
+	}
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// qualityWindow is the number of recent probes the loss rate covers
+const qualityWindow = 32
+
+// minQualitySamples is the number of probes needed before the quality of a
+// link is judged
+const minQualitySamples = 5
+
+// QualityThresholds are the limits past which a link counts as degraded even
+// though it still works. A zero limit is not checked.
+type QualityThresholds struct {
+	// MaxRTT is the highest acceptable smoothed round trip time
+	MaxRTT time.Duration
+	// MaxJitter is the highest acceptable round trip time variation
+	MaxJitter time.Duration
+	// MaxLoss is the highest acceptable fraction of lost probes, in [0, 1]
+	MaxLoss float64
+}
+
+// Validate checks that the thresholds are not negative and the loss is a
+// fraction
+func (q QualityThresholds) Validate() error {
+	if q.MaxRTT < 0 || q.MaxJitter < 0 {
+		return fmt.Errorf("quality thresholds must not be negative")
+	}
+	if q.MaxLoss < 0 || q.MaxLoss > 1 {
+		return fmt.Errorf("max loss must be in [0, 1], got %v", q.MaxLoss)
+	}
+	return nil
+}
+
+// ConnectionQuality summarizes the recent probes of a protocol
+type ConnectionQuality struct {
+	// RTT is the smoothed round trip time and Jitter its mean deviation,
+	// as TCP estimates them (RFC 6298)
+	RTT    time.Duration
+	Jitter time.Duration
+	// Loss is the fraction of the recent probes that got no answer
+	Loss float64
+	// Samples is the number of recent probes
+	Samples int
+}
+
+// qualityTracker estimates the quality of a link from probe results
+type qualityTracker struct {
+	rtt    time.Duration
+	jitter time.Duration
+	// lost records the outcome of the last qualityWindow probes in a ring
+	lost  [qualityWindow]bool
+	next  int
+	count int
+}
+
+func (q *qualityTracker) addRTT(rtt time.Duration) {
+	if q.rtt == 0 {
+		q.rtt, q.jitter = rtt, rtt/2
+	} else {
+		diff := q.rtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		q.jitter = (3*q.jitter + diff) / 4
+		q.rtt = (7*q.rtt + rtt) / 8
+	}
+	q.add(false)
+}
+
+func (q *qualityTracker) add(lost bool) {
+	q.lost[q.next] = lost
+	q.next = (q.next + 1) % qualityWindow
+	if q.count < qualityWindow {
+		q.count++
+	}
+}
+
+func (q *qualityTracker) snapshot() ConnectionQuality {
+	lost := 0
+	for i := 0; i < q.count; i++ {
+		if q.lost[i] {
+			lost++
+		}
+	}
+	quality := ConnectionQuality{RTT: q.rtt, Jitter: q.jitter, Samples: q.count}
+	if q.count > 0 {
+		quality.Loss = float64(lost) / float64(q.count)
+	}
+	return quality
+}
+
+// degradedReason says which of thresholds the quality exceeds, or returns ""
+func (c ConnectionQuality) degradedReason(thresholds QualityThresholds) string {
+	switch {
+	case c.Samples < minQualitySamples:
+		return ""
+	case thresholds.MaxLoss > 0 && c.Loss > thresholds.MaxLoss:
+		return fmt.Sprintf("loss %.0f%% above %.0f%%", c.Loss*100, thresholds.MaxLoss*100)
+	case thresholds.MaxRTT > 0 && c.RTT > thresholds.MaxRTT:
+		return fmt.Sprintf("rtt %v above %v", c.RTT, thresholds.MaxRTT)
+	case thresholds.MaxJitter > 0 && c.Jitter > thresholds.MaxJitter:
+		return fmt.Sprintf("jitter %v above %v", c.Jitter, thresholds.MaxJitter)
+	default:
+		return ""
+	}
+}
+
+// RecordRTT records an answered probe of protocol, such as a ping
+func (pe *ProtocolEngine) RecordRTT(protocol Protocol, rtt time.Duration) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.getOrCreateStats(protocol).quality.addRTT(rtt)
+}
+
+// RecordLoss records a probe of protocol that got no answer
+func (pe *ProtocolEngine) RecordLoss(protocol Protocol) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.getOrCreateStats(protocol).quality.add(true)
+}
+
+// GetQuality returns the link quality of protocol measured so far
+func (pe *ProtocolEngine) GetQuality(protocol Protocol) ConnectionQuality {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.peekStats(protocol).quality.snapshot()
+}
+
+// SetQualityThresholds sets the limits past which ShouldSwitchProtocol
+// switches away from a working but degraded protocol
+func (pe *ProtocolEngine) SetQualityThresholds(thresholds QualityThresholds) error {
+	if err := thresholds.Validate(); err != nil {
+		return err
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.qualityThresholds = thresholds
+	return nil
+}
+
+// GetQualityThresholds returns the limits set with SetQualityThresholds
+func (pe *ProtocolEngine) GetQualityThresholds() QualityThresholds {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.qualityThresholds
+}
+
+// DegradedReason says which quality threshold protocol currently exceeds,
+// or returns "" if its link is fine or not measured enough
+func (pe *ProtocolEngine) DegradedReason(protocol Protocol) string {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.peekStats(protocol).quality.snapshot().degradedReason(pe.qualityThresholds)
+}
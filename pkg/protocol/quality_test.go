@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityDegradationSwitches(t *testing.T) {
+	pe := NewProtocolEngine()
+	if err := pe.SetSwitchCooldown(0); err != nil {
+		t.Fatalf("failed to set cooldown: %v", err)
+	}
+	if err := pe.SetQualityThresholds(QualityThresholds{MaxRTT: 200 * time.Millisecond, MaxLoss: 0.2}); err != nil {
+		t.Fatalf("failed to set thresholds: %v", err)
+	}
+
+	// Slow pings on a link that never fails outright
+	for i := 0; i < 4; i++ {
+		pe.RecordRTT(QUIC, 400*time.Millisecond)
+	}
+	if pe.ShouldSwitchProtocol(QUIC) {
+		t.Error("expected no decision before enough samples")
+	}
+	pe.RecordRTT(QUIC, 400*time.Millisecond)
+	if !pe.ShouldSwitchProtocol(QUIC) {
+		t.Errorf("expected a 400ms link to be degraded, quality %+v", pe.GetQuality(QUIC))
+	}
+	if reason := pe.DegradedReason(QUIC); reason == "" {
+		t.Error("expected a degradation reason")
+	}
+
+	// A fast link that loses pings is degraded too
+	for i := 0; i < 8; i++ {
+		pe.RecordRTT(HTTP2, 10*time.Millisecond)
+	}
+	if pe.ShouldSwitchProtocol(HTTP2) {
+		t.Error("expected a fast link not to be degraded")
+	}
+	for i := 0; i < 3; i++ {
+		pe.RecordLoss(HTTP2)
+	}
+	if quality := pe.GetQuality(HTTP2); quality.Loss <= 0.2 || !pe.ShouldSwitchProtocol(HTTP2) {
+		t.Errorf("expected a lossy link to be degraded, quality %+v", quality)
+	}
+}
+
+func TestQualityTracker(t *testing.T) {
+	var q qualityTracker
+	q.addRTT(100 * time.Millisecond)
+	q.addRTT(100 * time.Millisecond)
+	if quality := q.snapshot(); quality.RTT != 100*time.Millisecond || quality.Jitter >= 50*time.Millisecond {
+		t.Errorf("unexpected quality of a steady link: %+v", quality)
+	}
+
+	// Only the last qualityWindow probes count towards the loss
+	for i := 0; i < qualityWindow; i++ {
+		q.add(true)
+	}
+	for i := 0; i < qualityWindow/2; i++ {
+		q.addRTT(100 * time.Millisecond)
+	}
+	if quality := q.snapshot(); quality.Loss != 0.5 || quality.Samples != qualityWindow {
+		t.Errorf("expected half the window lost, got %+v", quality)
+	}
+
+	if err := (QualityThresholds{MaxLoss: 1.5}).Validate(); err == nil {
+		t.Error("expected loss above 1 to be rejected")
+	}
+}
@@ -1,21 +1,58 @@
 package protocol
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
-// QUICClient represents a QUIC connection client
+// ErrNotConnected is returned by QUICClient calls that need a connection
+// before Connect succeeded or after the connection is gone
+var ErrNotConnected = errors.New("QUIC client not connected")
+
+// MaxFrameSize is the largest message Send writes and Receive accepts
+const MaxFrameSize = 16 << 20
+
+// frameHeaderSize is the size of the big-endian length in front of every
+// message
+const frameHeaderSize = 4
+
+// Control stream messages. The relay answers every ping frame with a pong
+// frame carrying the same nonce.
+const (
+	pingFrame = "ping"
+	pongFrame = "pong"
+)
+
+// QUICClient represents a QUIC connection client. Messages on its data
+// stream are framed with a length prefix; pings use a control stream of
+// their own, so they never queue behind data.
 type QUICClient struct {
-	conn     quic.Connection
-	stream   quic.Stream
-	config   *QUICConfig
-	address  string
+	conn    quic.Connection
+	stream  quic.Stream
+	config  *QUICConfig
+	address string
+
+	// sendMu keeps frames of concurrent Sends from interleaving
+	sendMu sync.Mutex
+	// recvMu guards pending, the part of the last frame Receive has not
+	// returned yet
+	recvMu  sync.Mutex
+	pending []byte
+
+	// pingMu serializes pings on control, which the first Ping opens
+	pingMu  sync.Mutex
+	control quic.Stream
 }
 
 // QUICConfig holds QUIC-specific configuration
@@ -68,12 +105,15 @@ func (qc *QUICClient) Connect(ctx context.Context, address string) error {
 	// Create QUIC config
 	quicConfig := &quic.Config{
 		MaxIdleTimeout:  qc.config.IdleTimeout,
+		HandshakeIdleTimeout: qc.config.HandshakeTimeout,
 		MaxIncomingStreams: int64(qc.config.MaxStreams),
 	}
 	
-	// Establish QUIC connection
+	// Establish QUIC connection. Errors are wrapped so ClassifyQUICError
+	// can inspect them.
 	conn, err := quic.Dial(ctx, udpConn, udpAddr, qc.config.TLSConfig, quicConfig)
 	if err != nil {
+		udpConn.Close()
 		return fmt.Errorf("failed to establish QUIC connection: %w", err)
 	}
 	
@@ -90,23 +130,70 @@ func (qc *QUICClient) Connect(ctx context.Context, address string) error {
 	return nil
 }
 
-// Send sends data over QUIC stream
+// Send writes data as one frame on the data stream
 func (qc *QUICClient) Send(data []byte) error {
-	if qc.stream == nil {
-		return fmt.Errorf("QUIC stream not established")
+	if !qc.IsConnected() {
+		return ErrNotConnected
 	}
-	
-	_, err := qc.stream.Write(data)
-	return err
+
+	qc.sendMu.Lock()
+	defer qc.sendMu.Unlock()
+	return writeFrame(qc.stream, data)
 }
 
-// Receive receives data from QUIC stream
+// Receive copies the next message from the data stream into buffer. A
+// message longer than buffer is returned over several calls. io.EOF means
+// the relay closed the stream.
 func (qc *QUICClient) Receive(buffer []byte) (int, error) {
-	if qc.stream == nil {
-		return 0, fmt.Errorf("QUIC stream not established")
+	if !qc.IsConnected() {
+		return 0, ErrNotConnected
 	}
-	
-	return qc.stream.Read(buffer)
+
+	qc.recvMu.Lock()
+	defer qc.recvMu.Unlock()
+	if len(qc.pending) == 0 {
+		frame, err := readFrame(qc.stream)
+		if err != nil {
+			return 0, err
+		}
+		qc.pending = frame
+	}
+	n := copy(buffer, qc.pending)
+	qc.pending = qc.pending[n:]
+	return n, nil
+}
+
+// writeFrame writes data prefixed with its length in a single write
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte frame limit", len(data), MaxFrameSize)
+	}
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads one length-prefixed frame. It returns io.EOF only if the
+// stream ended cleanly between frames.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", size, MaxFrameSize)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("truncated frame: %w", err)
+	}
+	return frame, nil
 }
 
 // Close closes the QUIC connection
@@ -118,6 +205,13 @@ func (qc *QUICClient) Close() error {
 			errs = append(errs, fmt.Errorf("failed to close stream: %w", err))
 		}
 	}
+
+	qc.pingMu.Lock()
+	if qc.control != nil {
+		qc.control.Close()
+		qc.control = nil
+	}
+	qc.pingMu.Unlock()
 	
 	if qc.conn != nil {
 		if err := qc.conn.CloseWithError(0, "client closing"); err != nil {
@@ -132,9 +226,10 @@ func (qc *QUICClient) Close() error {
 	return nil
 }
 
-// IsConnected returns true if the client is connected
+// IsConnected returns true if the client is connected and the connection
+// has not been closed by either side
 func (qc *QUICClient) IsConnected() bool {
-	return qc.conn != nil && qc.stream != nil
+	return qc.conn != nil && qc.stream != nil && qc.conn.Context().Err() == nil
 }
 
 // GetConnectionState returns the connection state
@@ -165,15 +260,63 @@ func (qc *QUICClient) GetStats() map[string]interface{} {
 	return stats
 }
 
-// Ping sends a ping to test connectivity
+// Ping sends a ping frame on the control stream and waits for the matching
+// pong. Opening the stream and the round trip together are bounded by
+// QUICConfig.HandshakeTimeout.
 func (qc *QUICClient) Ping() error {
 	if !qc.IsConnected() {
-		return fmt.Errorf("not connected")
+		return ErrNotConnected
 	}
-	
-	// Send a simple ping message
-	pingData := []byte("ping")
-	return qc.Send(pingData)
+
+	timeout := qc.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultQUICConfig().HandshakeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	qc.pingMu.Lock()
+	defer qc.pingMu.Unlock()
+	if qc.control == nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		stream, err := qc.conn.OpenStreamSync(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to open QUIC control stream: %w", err)
+		}
+		qc.control = stream
+	}
+
+	if err := qc.roundTripPing(deadline); err != nil {
+		// A late pong could still arrive on this stream and answer the
+		// next ping, so the next ping starts on a fresh one
+		qc.control.CancelRead(0)
+		qc.control.CancelWrite(0)
+		qc.control = nil
+		return fmt.Errorf("QUIC ping failed: %w", err)
+	}
+	return nil
+}
+
+// roundTripPing sends one ping on the control stream and reads its pong
+func (qc *QUICClient) roundTripPing(deadline time.Time) error {
+	if err := qc.control.SetDeadline(deadline); err != nil {
+		return err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := writeFrame(qc.control, append([]byte(pingFrame), nonce...)); err != nil {
+		return err
+	}
+	reply, err := readFrame(qc.control)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reply, append([]byte(pongFrame), nonce...)) {
+		return fmt.Errorf("unexpected reply %q to ping", reply)
+	}
+	return nil
 }
 
 // SetKeepAlive enables or disables keep-alive
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const testALPN = "cloudbridge-test"
+
+// startFrameServer runs a QUIC listener that echoes the data stream and
+// answers pings on the control stream unless mute is set
+func startFrameServer(t *testing.T, mute bool) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cloudbridge-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{testALPN},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		for first := true; ; first = false {
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			if first {
+				go io.Copy(stream, stream)
+				continue
+			}
+			go func() {
+				for {
+					frame, err := readFrame(stream)
+					if err != nil || mute {
+						return
+					}
+					writeFrame(stream, append([]byte(pongFrame), bytes.TrimPrefix(frame, []byte(pingFrame))...))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func connectFrameClient(t *testing.T, addr string, handshakeTimeout time.Duration) *QUICClient {
+	t.Helper()
+
+	config := DefaultQUICConfig()
+	config.TLSConfig = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	config.HandshakeTimeout = handshakeTimeout
+	client := NewQUICClient(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx, addr); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestQUICClientFramesMessages(t *testing.T) {
+	client := connectFrameClient(t, startFrameServer(t, false), 5*time.Second)
+
+	for _, msg := range []string{"first", "", "second message"} {
+		if err := client.Send([]byte(msg)); err != nil {
+			t.Fatalf("failed to send %q: %v", msg, err)
+		}
+	}
+
+	// Each message comes back on its own, and a long one over several calls
+	buf := make([]byte, 8)
+	var got []string
+	for len(got) < 3 {
+		n, err := client.Receive(buf)
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if got[0] != "first" || got[1] != "" || got[2] != "second m" {
+		t.Errorf("unexpected messages: %q", got)
+	}
+	n, err := client.Receive(buf)
+	if err != nil || string(buf[:n]) != "essage" {
+		t.Errorf("expected rest of the message, got %q, %v", buf[:n], err)
+	}
+
+	if err := client.Send(make([]byte, MaxFrameSize+1)); err == nil {
+		t.Error("expected oversized message to be rejected")
+	}
+}
+
+func TestQUICClientPing(t *testing.T) {
+	client := connectFrameClient(t, startFrameServer(t, false), 5*time.Second)
+	for i := 0; i < 3; i++ {
+		if err := client.Ping(); err != nil {
+			t.Fatalf("ping %d failed: %v", i, err)
+		}
+	}
+
+	silent := connectFrameClient(t, startFrameServer(t, true), 100*time.Millisecond)
+	start := time.Now()
+	if err := silent.Ping(); err == nil {
+		t.Error("expected ping without pong to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ping took %v despite a 100ms timeout", elapsed)
+	}
+}
+
+func TestQUICClientNotConnected(t *testing.T) {
+	client := NewQUICClient(nil)
+	if err := client.Send([]byte("data")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected from Send, got %v", err)
+	}
+	if _, err := client.Receive(make([]byte, 8)); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected from Receive, got %v", err)
+	}
+	if err := client.Ping(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected from Ping, got %v", err)
+	}
+
+	connected := connectFrameClient(t, startFrameServer(t, false), 5*time.Second)
+	connected.Close()
+	if err := connected.Send([]byte("data")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after Close, got %v", err)
+	}
+}
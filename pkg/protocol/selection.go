@@ -0,0 +1,85 @@
+package protocol
+
+import "time"
+
+// SelectionStrategy decides how GetBestProtocol picks among the available
+// protocols
+type SelectionStrategy int
+
+const (
+	// StrategyPreferredOrder picks the first protocol in the preferred
+	// order whose failure rate is under the switch threshold
+	StrategyPreferredOrder SelectionStrategy = iota
+	// StrategyLatencyWeighted picks the protocol with the lowest cost,
+	// weighing its failure rate against its average latency. Protocols
+	// with too few results are not ranked; while none has enough, the
+	// preferred order applies.
+	StrategyLatencyWeighted
+)
+
+func (s SelectionStrategy) String() string {
+	switch s {
+	case StrategyPreferredOrder:
+		return "preferred_order"
+	case StrategyLatencyWeighted:
+		return "latency_weighted"
+	default:
+		return "unknown"
+	}
+}
+
+// minScoredResults is the number of results a protocol needs before its
+// latency is trusted for ranking
+const minScoredResults = 3
+
+// failureRateCost is the latency a protocol that always fails is charged, so
+// a failure rate of 10% weighs as much as a tenth of it
+const failureRateCost = time.Second
+
+// SetSelectionStrategy sets how GetBestProtocol ranks protocols
+func (pe *ProtocolEngine) SetSelectionStrategy(strategy SelectionStrategy) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.strategy = strategy
+}
+
+// GetSelectionStrategy returns how GetBestProtocol ranks protocols
+func (pe *ProtocolEngine) GetSelectionStrategy() SelectionStrategy {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.strategy
+}
+
+// latencyWeightedCost is the cost of a protocol with the given failure rate
+// and average latency, in seconds. Lower is better.
+func latencyWeightedCost(failureRate float64, averageLatency time.Duration) float64 {
+	return failureRate*failureRateCost.Seconds() + averageLatency.Seconds()
+}
+
+// cheapestProtocolLocked returns the available protocol with the lowest
+// latency-weighted cost among those with enough results and a failure rate
+// under the switch threshold. Ties go to the protocol preferred first. It
+// reports false if no protocol has been measured enough. pe.mu must be held,
+// at least for reading.
+func (pe *ProtocolEngine) cheapestProtocolLocked() (Protocol, bool) {
+	var (
+		best     Protocol
+		bestCost float64
+		found    bool
+	)
+	for _, protocol := range pe.orderLocked() {
+		stats := pe.peekStats(protocol)
+		if !stats.IsAvailable || stats.SuccessCount+stats.FailureCount < minScoredResults {
+			continue
+		}
+		failureRate := pe.calculateFailureRate(stats)
+		if failureRate > pe.switchThreshold {
+			continue
+		}
+		cost := latencyWeightedCost(failureRate, stats.AverageLatency)
+		if !found || cost < bestCost {
+			best, bestCost, found = protocol, cost, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWeightedSelection(t *testing.T) {
+	pe := NewProtocolEngine()
+	for i := 0; i < 5; i++ {
+		pe.RecordSuccess(QUIC, 300*time.Millisecond)
+		pe.RecordSuccess(HTTP2, 20*time.Millisecond)
+	}
+
+	if got := pe.GetBestProtocol(); got != QUIC {
+		t.Errorf("expected the preferred order to pick QUIC, got %s", got)
+	}
+
+	pe.SetSelectionStrategy(StrategyLatencyWeighted)
+	if got := pe.GetBestProtocol(); got != HTTP2 {
+		t.Errorf("expected the low-latency HTTP2, got %s", got)
+	}
+
+	// Failures make the fast protocol more expensive than the slow one
+	for i := 0; i < 5; i++ {
+		pe.RecordFailure(HTTP2, "reset")
+	}
+	if got := pe.GetBestProtocol(); got != QUIC {
+		t.Errorf("expected QUIC once HTTP2 fails half the time, got %s", got)
+	}
+
+	// Without enough results the preferred order applies
+	pe = NewProtocolEngine()
+	pe.SetSelectionStrategy(StrategyLatencyWeighted)
+	pe.RecordSuccess(HTTP2, time.Millisecond)
+	if got := pe.GetBestProtocol(); got != QUIC {
+		t.Errorf("expected QUIC without enough measurements, got %s", got)
+	}
+}
+
+func TestLatencyWeightedCost(t *testing.T) {
+	if cost := latencyWeightedCost(0, 50*time.Millisecond); cost != 0.05 {
+		t.Errorf("expected latency alone to cost 0.05, got %v", cost)
+	}
+	if cost := latencyWeightedCost(0.1, 0); cost != 0.1 {
+		t.Errorf("expected a 10%% failure rate to cost 0.1, got %v", cost)
+	}
+}
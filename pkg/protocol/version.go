@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares two semantic versions such as "2.0" or
+// "v1.4.2-rc.1". Missing minor or patch numbers count as zero, and a
+// pre-release sorts before its release. Pre-releases are ordered by their
+// dot-separated identifiers as in semver, so rc.2 sorts before rc.10. It
+// returns -1, 0 or 1 when a is lower than, equal to or higher than b.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			if va.core[i] < vb.core[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	switch {
+	case va.pre == vb.pre:
+		return 0, nil
+	case va.pre == "":
+		return 1, nil
+	case vb.pre == "":
+		return -1, nil
+	default:
+		return comparePrerelease(va.pre, vb.pre), nil
+	}
+}
+
+// comparePrerelease compares two pre-release versions identifier by
+// identifier. Numeric identifiers compare numerically and sort before
+// alphanumeric ones, which compare in ASCII order; when all identifiers
+// are equal, the version with more of them is higher.
+func comparePrerelease(a, b string) int {
+	ia, ib := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		x, y := ia[i], ib[i]
+		if x == y {
+			continue
+		}
+		xNum, yNum := isNumeric(x), isNumeric(y)
+		switch {
+		case xNum && yNum:
+			// Without leading zeros the longer number is the larger one
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return cmp.Compare(len(x), len(y))
+			}
+			return strings.Compare(x, y)
+		case xNum:
+			return -1
+		case yNum:
+			return 1
+		default:
+			return strings.Compare(x, y)
+		}
+	}
+	return cmp.Compare(len(ia), len(ib))
+}
+
+// isNumeric reports whether s is a non-empty string of digits
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+type version struct {
+	core [3]int
+	pre  string
+}
+
+func parseVersion(s string) (version, error) {
+	var v version
+	rest := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		rest, v.pre = rest[:i], rest[i+1:]
+	}
+
+	parts := strings.Split(rest, ".")
+	if len(parts) > len(v.core) {
+		return v, fmt.Errorf("invalid version: %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version: %q", s)
+		}
+		v.core[i] = n
+	}
+	return v, nil
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.0", "2.0.0", 0},
+		{"1.0.0", "2.0", -1},
+		{"2.1", "2.0.9", 1},
+		{"v2.0.0", "2.0", 0},
+		{"2.0.0-rc1", "2.0.0", -1},
+		{"2.0.0-rc2", "2.0.0-rc1", 1},
+		{"2.0.0-rc.10", "2.0.0-rc.2", 1},
+		{"2.0.0-rc.2", "2.0.0-rc.10", -1},
+		{"2.0.0-alpha", "2.0.0-alpha.1", -1},
+		{"2.0.0-alpha.1", "2.0.0-alpha.beta", -1},
+		{"2.0.0-beta.11", "2.0.0-rc.1", -1},
+		{"2.0.0-1", "2.0.0-alpha", -1},
+		{"2.0.0+build5", "2.0.0", 0},
+		{"10.0", "9.9", 1},
+	}
+	for _, tt := range tests {
+		got, err := CompareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("CompareVersions(%q, %q) failed: %v", tt.a, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "two", "1.2.3.4", "1.-2"} {
+		if _, err := CompareVersions(invalid, "1.0"); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+// StatsWindows are the rolling windows reported by GetStats, by name
+var StatsWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+const (
+	// windowBucket is the resolution of the rolling windows
+	windowBucket  = 10 * time.Second
+	windowBuckets = int(time.Hour / windowBucket)
+)
+
+// windowCounter counts successes and failures over the last hour in
+// buckets of windowBucket, so windows are accurate to one bucket
+type windowCounter struct {
+	buckets [windowBuckets]windowCounts
+}
+
+type windowCounts struct {
+	slot    int64
+	success int64
+	failure int64
+}
+
+func (w *windowCounter) add(now time.Time, success bool) {
+	slot := now.UnixNano() / int64(windowBucket)
+	b := &w.buckets[slot%int64(windowBuckets)]
+	if b.slot != slot {
+		*b = windowCounts{slot: slot}
+	}
+	if success {
+		b.success++
+	} else {
+		b.failure++
+	}
+}
+
+// sum returns the counts of the buckets within d before now
+func (w *windowCounter) sum(now time.Time, d time.Duration) (success, failure int64) {
+	slot := now.UnixNano() / int64(windowBucket)
+	oldest := slot - int64(d/windowBucket)
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if b.slot > oldest && b.slot <= slot {
+			success += b.success
+			failure += b.failure
+		}
+	}
+	return success, failure
+}
+
+// windowStats returns the success and failure counts of every window in
+// StatsWindows
+func (w *windowCounter) windowStats(now time.Time) map[string]interface{} {
+	result := make(map[string]interface{}, len(StatsWindows))
+	for _, window := range StatsWindows {
+		success, failure := w.sum(now, window.Duration)
+		failureRate := 0.0
+		if total := success + failure; total > 0 {
+			failureRate = float64(failure) / float64(total)
+		}
+		result[window.Name] = map[string]interface{}{
+			"success_count": success,
+			"failure_count": failure,
+			"failure_rate":  failureRate,
+		}
+	}
+	return result
+}
+
+// SetClock sets the clock used to place results into the rolling windows
+func (pe *ProtocolEngine) SetClock(c clock.Clock) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.clock = c
+}
+
+func (pe *ProtocolEngine) now() time.Time {
+	if pe.clock == nil {
+		return time.Now()
+	}
+	return pe.clock.Now()
+}
+
+// ResetStatsForProtocol resets the lifetime and windowed stats of one
+// protocol and marks it available again
+func (pe *ProtocolEngine) ResetStatsForProtocol(protocol Protocol) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.stats[protocol] = &ProtocolStats{IsAvailable: true}
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+func windowTotals(t *testing.T, pe *ProtocolEngine, protocol Protocol, window string) (int64, int64) {
+	t.Helper()
+	protoStats := pe.GetStats()[protocol.String()].(map[string]interface{})
+	counts := protoStats["windows"].(map[string]interface{})[window].(map[string]interface{})
+	return counts["success_count"].(int64), counts["failure_count"].(int64)
+}
+
+func TestWindowedStats(t *testing.T) {
+	pe := NewProtocolEngine()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	pe.SetClock(fake)
+
+	pe.RecordFailure(QUIC, "old failure")
+	fake.Advance(10 * time.Minute)
+	pe.RecordFailure(QUIC, "recent failure")
+	fake.Advance(2 * time.Minute)
+	pe.RecordSuccess(QUIC, 10*time.Millisecond)
+
+	if s, f := windowTotals(t, pe, QUIC, "1m"); s != 1 || f != 0 {
+		t.Errorf("1m window: expected 1/0, got %d/%d", s, f)
+	}
+	if s, f := windowTotals(t, pe, QUIC, "5m"); s != 1 || f != 1 {
+		t.Errorf("5m window: expected 1/1, got %d/%d", s, f)
+	}
+	if s, f := windowTotals(t, pe, QUIC, "1h"); s != 1 || f != 2 {
+		t.Errorf("1h window: expected 1/2, got %d/%d", s, f)
+	}
+
+	// Results older than the longest window drop out
+	fake.Advance(2 * time.Hour)
+	if s, f := windowTotals(t, pe, QUIC, "1h"); s != 0 || f != 0 {
+		t.Errorf("1h window: expected 0/0 after two hours, got %d/%d", s, f)
+	}
+	if lifetime := pe.GetStats()["quic"].(map[string]interface{})["failure_count"].(int64); lifetime != 2 {
+		t.Errorf("expected lifetime failures to be kept, got %d", lifetime)
+	}
+}
+
+func TestResetStatsForProtocol(t *testing.T) {
+	pe := NewProtocolEngine()
+	for i := 0; i < 6; i++ {
+		pe.RecordFailure(QUIC, "failure")
+	}
+	pe.RecordFailure(HTTP2, "failure")
+
+	pe.ResetStatsForProtocol(QUIC)
+
+	stats := pe.GetStats()
+	quicStats := stats["quic"].(map[string]interface{})
+	if quicStats["failure_count"].(int64) != 0 || !quicStats["is_available"].(bool) {
+		t.Errorf("expected QUIC stats to be reset, got %v", quicStats)
+	}
+	if s, f := windowTotals(t, pe, QUIC, "1h"); s != 0 || f != 0 {
+		t.Errorf("expected QUIC windows to be reset, got %d/%d", s, f)
+	}
+	if stats["http2"].(map[string]interface{})["failure_count"].(int64) != 1 {
+		t.Error("other protocols must keep their stats")
+	}
+}
@@ -0,0 +1,98 @@
+package quantum
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the number of entries kept by a resultCache
+const maxCacheEntries = 1024
+
+// cacheKey identifies a cached result by the hash of its inputs
+type cacheKey [sha256.Size]byte
+
+// newCacheKey hashes the given inputs into a cache key. Each input is
+// length-prefixed so that different splits of the same bytes do not collide.
+func newCacheKey(parts ...[]byte) cacheKey {
+	h := sha256.New()
+	for _, part := range parts {
+		n := len(part)
+		h.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		h.Write(part)
+	}
+	var key cacheKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+type cacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// resultCache is a size-bounded cache whose entries expire after a TTL
+type resultCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[cacheKey]cacheEntry[V]
+}
+
+func newResultCache[V any](ttl time.Duration) *resultCache[V] {
+	return &resultCache[V]{
+		ttl:     ttl,
+		entries: make(map[cacheKey]cacheEntry[V]),
+	}
+}
+
+// get returns the cached value for key if it has not expired
+func (c *resultCache[V]) get(key cacheKey) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// put stores value under key, evicting expired entries and then the entry
+// closest to expiry when the cache is full
+func (c *resultCache[V]) put(key cacheKey, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		var oldestKey cacheKey
+		var oldest time.Time
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest.IsZero() || entry.expiresAt.Before(oldest) {
+				oldestKey, oldest = k, entry.expiresAt
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+
+	c.entries[key] = cacheEntry[V]{value: value, expiresAt: now.Add(c.ttl)}
+}
+
+// clear removes all entries
+func (c *resultCache[V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]cacheEntry[V])
+}
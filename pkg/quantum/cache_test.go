@@ -0,0 +1,125 @@
+package quantum
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestKyberCachesPeerKeyOnly(t *testing.T) {
+	kke := NewKyberKeyExchange(&KyberConfig{
+		SecurityLevel: 768,
+		KeySize:       32,
+		EnableCache:   true,
+		CacheTTL:      time.Minute,
+	}, zap.NewNop())
+	if err := kke.GenerateKeyPair(); err != nil {
+		t.Fatalf("failed to generate key pair: %v", err)
+	}
+
+	secret1, ct1, err := kke.Encapsulate(kke.GetPublicKey())
+	if err != nil {
+		t.Fatalf("encapsulate failed: %v", err)
+	}
+	secret2, ct2, err := kke.Encapsulate(kke.GetPublicKey())
+	if err != nil {
+		t.Fatalf("encapsulate failed: %v", err)
+	}
+
+	// The parsed key is reused, the encapsulation never is
+	if bytes.Equal(secret1, secret2) || bytes.Equal(ct1, ct2) {
+		t.Error("expected a fresh secret and ciphertext for every encapsulation")
+	}
+	for _, pair := range []struct{ secret, ct []byte }{{secret1, ct1}, {secret2, ct2}} {
+		decapsulated, err := kke.Decapsulate(pair.ct)
+		if err != nil {
+			t.Fatalf("decapsulate failed: %v", err)
+		}
+		if !bytes.Equal(decapsulated, pair.secret) {
+			t.Error("decapsulated secret does not match")
+		}
+	}
+	metrics := kke.GetMetrics()
+	if metrics.CacheHits != 1 || metrics.CacheMisses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d/%d", metrics.CacheHits, metrics.CacheMisses)
+	}
+
+	// A different peer key derives a fresh secret
+	other := &KyberPublicKey{Key: bytes.Repeat([]byte{1}, 1184), Size: 1184}
+	secret3, _, err := kke.Encapsulate(other)
+	if err != nil {
+		t.Fatalf("encapsulate failed: %v", err)
+	}
+	if bytes.Equal(secret1, secret3) {
+		t.Error("expected different secret for a different peer key")
+	}
+}
+
+func TestKyberCacheDisabled(t *testing.T) {
+	kke := NewKyberKeyExchange(&KyberConfig{SecurityLevel: 512, KeySize: 32}, zap.NewNop())
+	if err := kke.GenerateKeyPair(); err != nil {
+		t.Fatalf("failed to generate key pair: %v", err)
+	}
+
+	secret1, _, _ := kke.Encapsulate(kke.GetPublicKey())
+	secret2, _, _ := kke.Encapsulate(kke.GetPublicKey())
+	if bytes.Equal(secret1, secret2) {
+		t.Error("expected fresh secrets with the cache disabled")
+	}
+	if kke.GetMetrics().CacheHits != 0 || kke.GetMetrics().CacheMisses != 0 {
+		t.Error("expected no cache activity with the cache disabled")
+	}
+}
+
+func TestDilithiumCachesVerification(t *testing.T) {
+	ds := NewDilithiumSigner(&DilithiumConfig{
+		SecurityLevel: 3,
+		SignatureSize: 3293,
+		EnableCache:   true,
+		CacheTTL:      time.Minute,
+	}, zap.NewNop())
+	if err := ds.GenerateKeyPair(); err != nil {
+		t.Fatalf("failed to generate key pair: %v", err)
+	}
+
+	message := []byte("hello")
+	signature, err := ds.Sign(message)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		valid, err := ds.Verify(message, signature)
+		if err != nil || !valid {
+			t.Fatalf("verify %d failed: valid=%v err=%v", i, valid, err)
+		}
+	}
+
+	metrics := ds.GetMetrics()
+	if metrics.CacheMisses != 1 || metrics.CacheHits != 2 {
+		t.Errorf("expected 1 miss and 2 hits, got %d/%d", metrics.CacheMisses, metrics.CacheHits)
+	}
+	if metrics.Verifications != 1 {
+		t.Errorf("expected 1 real verification, got %d", metrics.Verifications)
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	cache := newResultCache[int](10 * time.Millisecond)
+	key := newCacheKey([]byte("a"))
+	cache.put(key, 1)
+
+	if v, ok := cache.get(key); !ok || v != 1 {
+		t.Fatal("expected cached value")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.get(key); ok {
+		t.Error("expected entry to expire")
+	}
+
+	if newCacheKey([]byte("ab"), []byte("c")) == newCacheKey([]byte("a"), []byte("bc")) {
+		t.Error("expected length-prefixed keys to differ")
+	}
+}
@@ -1,10 +1,15 @@
 package quantum
 
 import (
-	"crypto/rand"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"time"
 
+	"github.com/cloudflare/circl/sign"
+	"github.com/cloudflare/circl/sign/dilithium/mode2"
+	"github.com/cloudflare/circl/sign/dilithium/mode3"
+	"github.com/cloudflare/circl/sign/dilithium/mode5"
 	"go.uber.org/zap"
 )
 
@@ -15,6 +20,7 @@ type DilithiumSigner struct {
 	config     *DilithiumConfig
 	logger     *zap.Logger
 	metrics    *DilithiumMetrics
+	cache      *resultCache[bool]
 }
 
 // DilithiumPrivateKey represents a Dilithium private key
@@ -35,6 +41,8 @@ type DilithiumPublicKey struct {
 type DilithiumConfig struct {
 	SecurityLevel int // 2, 3, 5
 	HybridMode    bool
+	// SignatureSize is informational: signatures always have the size of
+	// the security level, see GetSignatureSize
 	SignatureSize int
 	EnableCache   bool
 	CacheTTL      time.Duration
@@ -49,6 +57,8 @@ type DilithiumMetrics struct {
 	AverageKeyGenTime time.Duration
 	AverageSignTime   time.Duration
 	AverageVerifyTime time.Duration
+	CacheHits         int64
+	CacheMisses       int64
 	LastOperation     time.Time
 }
 
@@ -58,17 +68,35 @@ func NewDilithiumSigner(config *DilithiumConfig, logger *zap.Logger) *DilithiumS
 		config = &DilithiumConfig{
 			SecurityLevel: 5,
 			HybridMode:    true,
-			SignatureSize: 2701,
+			SignatureSize: mode5.SignatureSize,
 			EnableCache:   true,
 			CacheTTL:      1 * time.Hour,
 		}
 	}
 
-	return &DilithiumSigner{
+	ds := &DilithiumSigner{
 		config:  config,
 		logger:  logger,
 		metrics: &DilithiumMetrics{},
 	}
+	if config.EnableCache && config.CacheTTL > 0 {
+		ds.cache = newResultCache[bool](config.CacheTTL)
+	}
+	return ds
+}
+
+// dilithiumScheme returns the Dilithium mode of a security level
+func dilithiumScheme(level int) (sign.Scheme, error) {
+	switch level {
+	case 2:
+		return mode2.Scheme(), nil
+	case 3:
+		return mode3.Scheme(), nil
+	case 5:
+		return mode5.Scheme(), nil
+	default:
+		return nil, fmt.Errorf("unsupported security level: %d", level)
+	}
 }
 
 // GenerateKeyPair generates a new Dilithium key pair
@@ -76,38 +104,27 @@ func (ds *DilithiumSigner) GenerateKeyPair() error {
 	startTime := time.Now()
 	ds.logger.Info("Generating Dilithium key pair", zap.Int("security_level", ds.config.SecurityLevel))
 
-	// In a real implementation, you would use the actual CRYSTALS-Dilithium library
-	// For now, we'll simulate the key generation process
-	
-	var privateKeySize, publicKeySize int
-	switch ds.config.SecurityLevel {
-	case 2:
-		privateKeySize = 2528
-		publicKeySize = 1312
-	case 3:
-		privateKeySize = 4000
-		publicKeySize = 1952
-	case 5:
-		privateKeySize = 4864
-		publicKeySize = 2592
-	default:
-		return fmt.Errorf("unsupported security level: %d", ds.config.SecurityLevel)
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
+		return err
 	}
 
-	// Generate private key
-	privateKeyBytes := make([]byte, privateKeySize)
-	if _, err := rand.Read(privateKeyBytes); err != nil {
+	publicKey, privateKey, err := scheme.GenerateKey()
+	if err != nil {
 		ds.metrics.Errors++
-		return fmt.Errorf("failed to generate private key: %w", err)
+		return fmt.Errorf("failed to generate key pair: %w", err)
 	}
-
-	// Generate public key from private key
-	// In real implementation, this would use Dilithium's key generation algorithm
-	publicKeyBytes := make([]byte, publicKeySize)
-	if _, err := rand.Read(publicKeyBytes); err != nil {
+	privateKeyBytes, err := privateKey.MarshalBinary()
+	if err != nil {
+		ds.metrics.Errors++
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
 		ds.metrics.Errors++
-		return fmt.Errorf("failed to generate public key: %w", err)
+		return fmt.Errorf("failed to encode public key: %w", err)
 	}
+	privateKeySize, publicKeySize := len(privateKeyBytes), len(publicKeyBytes)
 
 	// Create key objects
 	ds.privateKey = &DilithiumPrivateKey{
@@ -150,19 +167,17 @@ func (ds *DilithiumSigner) Sign(message []byte) ([]byte, error) {
 		return nil, fmt.Errorf("message is empty")
 	}
 
-	// In a real implementation, you would use Dilithium's signing algorithm
-	// For now, we'll simulate the signing process
-	
-	// Generate signature
-	signatureSize := ds.config.SignatureSize
-	signature := make([]byte, signatureSize)
-	if _, err := rand.Read(signature); err != nil {
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
 		ds.metrics.Errors++
-		return nil, fmt.Errorf("failed to generate signature: %w", err)
+		return nil, err
 	}
-
-	// In real implementation, the signature would be computed using the message and private key
-	// For simulation, we'll just use random bytes
+	privateKey, err := scheme.UnmarshalBinaryPrivateKey(ds.privateKey.Key)
+	if err != nil {
+		ds.metrics.Errors++
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	signature := scheme.Sign(privateKey, message, nil)
 
 	// Update metrics
 	ds.metrics.Signatures++
@@ -196,17 +211,17 @@ func (ds *DilithiumSigner) Verify(message, signature []byte) (bool, error) {
 		return false, fmt.Errorf("signature is empty")
 	}
 
-	// In a real implementation, you would use Dilithium's verification algorithm
-	// For now, we'll simulate the verification process
-	
-	// For simulation purposes, we'll assume the signature is valid if it has the correct size
-	valid := len(signature) == ds.config.SignatureSize
+	key, cached, ok := ds.cachedVerification(message, signature, ds.publicKey.Key)
+	if ok {
+		return cached, nil
+	}
 
-	// In real implementation, you would:
-	// 1. Parse the signature
-	// 2. Extract the message hash
-	// 3. Verify the signature using the public key
-	// 4. Compare the computed hash with the message hash
+	valid, err := ds.verify(message, signature, ds.publicKey.Key)
+	if err != nil {
+		ds.metrics.Errors++
+		return false, err
+	}
+	ds.storeVerification(key, valid)
 
 	// Update metrics
 	ds.metrics.Verifications++
@@ -240,11 +255,17 @@ func (ds *DilithiumSigner) VerifyWithPublicKey(message, signature []byte, public
 		return false, fmt.Errorf("signature is empty")
 	}
 
-	// In a real implementation, you would use the provided public key for verification
-	// For now, we'll simulate the verification process
-	
-	// For simulation purposes, we'll assume the signature is valid if it has the correct size
-	valid := len(signature) == ds.config.SignatureSize
+	key, cached, ok := ds.cachedVerification(message, signature, publicKey.Key)
+	if ok {
+		return cached, nil
+	}
+
+	valid, err := ds.verify(message, signature, publicKey.Key)
+	if err != nil {
+		ds.metrics.Errors++
+		return false, err
+	}
+	ds.storeVerification(key, valid)
 
 	// Update metrics
 	ds.metrics.Verifications++
@@ -258,6 +279,48 @@ func (ds *DilithiumSigner) VerifyWithPublicKey(message, signature []byte, public
 	return valid, nil
 }
 
+// verify checks signature against message with the encoded public key.
+// A signature of the wrong size is invalid rather than an error.
+func (ds *DilithiumSigner) verify(message, signature, publicKey []byte) (bool, error) {
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
+		return false, err
+	}
+	key, err := scheme.UnmarshalBinaryPublicKey(publicKey)
+	if err != nil {
+		return false, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(signature) != scheme.SignatureSize() {
+		return false, nil
+	}
+	return scheme.Verify(key, message, signature, nil), nil
+}
+
+// cachedVerification looks up a previous verification result for the
+// (message hash, signature, key) triple
+func (ds *DilithiumSigner) cachedVerification(message, signature, publicKey []byte) (cacheKey, bool, bool) {
+	if ds.cache == nil {
+		return cacheKey{}, false, false
+	}
+
+	messageHash := sha256.Sum256(message)
+	key := newCacheKey(messageHash[:], signature, publicKey)
+	if valid, ok := ds.cache.get(key); ok {
+		ds.metrics.CacheHits++
+		ds.metrics.LastOperation = time.Now()
+		return key, valid, true
+	}
+	ds.metrics.CacheMisses++
+	return key, false, false
+}
+
+// storeVerification caches a verification result
+func (ds *DilithiumSigner) storeVerification(key cacheKey, valid bool) {
+	if ds.cache != nil {
+		ds.cache.put(key, valid)
+	}
+}
+
 // GetPublicKey returns the public key
 func (ds *DilithiumSigner) GetPublicKey() *DilithiumPublicKey {
 	return ds.publicKey
@@ -288,7 +351,26 @@ func (ds *DilithiumSigner) ValidateKeyPair() error {
 		return fmt.Errorf("key pair is empty")
 	}
 
-	// In a real implementation, you would validate the key pair using Dilithium's validation functions
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
+		return err
+	}
+	privateKey, err := scheme.UnmarshalBinaryPrivateKey(ds.privateKey.Key)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	derived, ok := privateKey.Public().(sign.PublicKey)
+	if !ok {
+		return fmt.Errorf("unexpected public key type %T", privateKey.Public())
+	}
+	publicKey, err := derived.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+	if !bytes.Equal(publicKey, ds.publicKey.Key) {
+		return fmt.Errorf("public key does not belong to the private key")
+	}
+
 	ds.logger.Debug("Key pair validation successful")
 	return nil
 }
@@ -299,8 +381,6 @@ func (ds *DilithiumSigner) ExportPublicKey() ([]byte, error) {
 		return nil, fmt.Errorf("public key not generated")
 	}
 
-	// In a real implementation, you might want to encode the key in a specific format
-	// For now, we'll return the raw bytes
 	return ds.publicKey.Key, nil
 }
 
@@ -310,20 +390,11 @@ func (ds *DilithiumSigner) ImportPublicKey(keyBytes []byte) (*DilithiumPublicKey
 		return nil, fmt.Errorf("key bytes are empty")
 	}
 
-	// Validate key size based on security level
-	var expectedSize int
-	switch ds.config.SecurityLevel {
-	case 2:
-		expectedSize = 1312
-	case 3:
-		expectedSize = 1952
-	case 5:
-		expectedSize = 2592
-	default:
-		return nil, fmt.Errorf("unsupported security level: %d", ds.config.SecurityLevel)
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(keyBytes) != expectedSize {
+	if expectedSize := scheme.PublicKeySize(); len(keyBytes) != expectedSize {
 		return nil, fmt.Errorf("invalid key size: expected %d, got %d", expectedSize, len(keyBytes))
 	}
 
@@ -342,6 +413,27 @@ func (ds *DilithiumSigner) GetSecurityLevel() int {
 	return ds.config.SecurityLevel
 }
 
+// SetSecurityLevel switches to another security level, for example one
+// negotiated with the server. The current key pair is discarded.
+func (ds *DilithiumSigner) SetSecurityLevel(level int) error {
+	if !containsLevel(SupportedDilithiumLevels, level) {
+		return fmt.Errorf("unsupported security level: %d", level)
+	}
+	if level == ds.config.SecurityLevel {
+		return nil
+	}
+
+	config := *ds.config
+	config.SecurityLevel = level
+	ds.config = &config
+	ds.privateKey = nil
+	ds.publicKey = nil
+	if ds.cache != nil {
+		ds.cache.clear()
+	}
+	return nil
+}
+
 // IsHybridMode returns whether hybrid mode is enabled
 func (ds *DilithiumSigner) IsHybridMode() bool {
 	return ds.config.HybridMode
@@ -349,7 +441,11 @@ func (ds *DilithiumSigner) IsHybridMode() bool {
 
 // GetSignatureSize returns the signature size for the current security level
 func (ds *DilithiumSigner) GetSignatureSize() int {
-	return ds.config.SignatureSize
+	scheme, err := dilithiumScheme(ds.config.SecurityLevel)
+	if err != nil {
+		return ds.config.SignatureSize
+	}
+	return scheme.SignatureSize()
 }
 
 // Reset resets the signer instance
@@ -357,65 +453,20 @@ func (ds *DilithiumSigner) Reset() {
 	ds.privateKey = nil
 	ds.publicKey = nil
 	ds.metrics = &DilithiumMetrics{}
+	if ds.cache != nil {
+		ds.cache.clear()
+	}
 	ds.logger.Info("Dilithium signer instance reset")
 }
 
-// CreateTestSignature creates a test signature for testing purposes
+// CreateTestSignature signs message like Sign. It is kept for callers of
+// the former deterministic test signatures.
 func (ds *DilithiumSigner) CreateTestSignature(message []byte) ([]byte, error) {
-	ds.logger.Debug("Creating test signature")
-	
-	// This is for testing purposes only
-	// In a real implementation, you would use the actual signing algorithm
-	
-	if len(message) == 0 {
-		return nil, fmt.Errorf("message is empty")
-	}
-
-	// Create a deterministic test signature based on message hash
-	// This is just for testing - not cryptographically secure
-	signature := make([]byte, ds.config.SignatureSize)
-	
-	// Simple hash-like function for testing
-	hash := 0
-	for _, b := range message {
-		hash = (hash*31 + int(b)) % 256
-	}
-	
-	// Fill signature with deterministic data
-	for i := range signature {
-		signature[i] = byte((hash + i) % 256)
-	}
-
-	return signature, nil
+	return ds.Sign(message)
 }
 
-// VerifyTestSignature verifies a test signature
+// VerifyTestSignature verifies a signature of CreateTestSignature like
+// Verify
 func (ds *DilithiumSigner) VerifyTestSignature(message, signature []byte) (bool, error) {
-	ds.logger.Debug("Verifying test signature")
-	
-	// This is for testing purposes only
-	// In a real implementation, you would use the actual verification algorithm
-	
-	if len(message) == 0 || len(signature) == 0 {
-		return false, fmt.Errorf("message or signature is empty")
-	}
-
-	// Recreate the expected test signature
-	expectedSignature, err := ds.CreateTestSignature(message)
-	if err != nil {
-		return false, err
-	}
-
-	// Compare signatures
-	if len(signature) != len(expectedSignature) {
-		return false, nil
-	}
-
-	for i := range signature {
-		if signature[i] != expectedSignature[i] {
-			return false, nil
-		}
-	}
-
-	return true, nil
+	return ds.Verify(message, signature)
 }
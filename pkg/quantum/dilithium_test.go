@@ -0,0 +1,72 @@
+package quantum
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestDilithiumSignatureBindsMessageAndKey(t *testing.T) {
+	for _, level := range SupportedDilithiumLevels {
+		signer := NewDilithiumSigner(&DilithiumConfig{SecurityLevel: level}, zap.NewNop())
+		other := NewDilithiumSigner(&DilithiumConfig{SecurityLevel: level}, zap.NewNop())
+		if err := signer.GenerateKeyPair(); err != nil {
+			t.Fatalf("level %d: failed to generate key pair: %v", level, err)
+		}
+		if err := other.GenerateKeyPair(); err != nil {
+			t.Fatalf("level %d: failed to generate key pair: %v", level, err)
+		}
+		if err := signer.ValidateKeyPair(); err != nil {
+			t.Errorf("level %d: generated key pair is invalid: %v", level, err)
+		}
+
+		message := []byte("announce peer")
+		signature, err := signer.Sign(message)
+		if err != nil {
+			t.Fatalf("level %d: sign failed: %v", level, err)
+		}
+		if len(signature) != signer.GetSignatureSize() {
+			t.Errorf("level %d: expected %d-byte signature, got %d", level, signer.GetSignatureSize(), len(signature))
+		}
+
+		if valid, err := other.VerifyWithPublicKey(message, signature, signer.GetPublicKey()); err != nil || !valid {
+			t.Errorf("level %d: expected signature to verify with the signer's key: valid=%v err=%v", level, valid, err)
+		}
+		if valid, _ := other.Verify(message, signature); valid {
+			t.Errorf("level %d: signature verified with another key", level)
+		}
+		if valid, _ := signer.Verify([]byte("announce peeR"), signature); valid {
+			t.Errorf("level %d: signature verified for another message", level)
+		}
+		tampered := append([]byte(nil), signature...)
+		tampered[len(tampered)/2] ^= 1
+		if valid, _ := signer.Verify(message, tampered); valid {
+			t.Errorf("level %d: tampered signature verified", level)
+		}
+		if valid, err := signer.Verify(message, signature[:10]); err != nil || valid {
+			t.Errorf("level %d: expected truncated signature to be invalid: valid=%v err=%v", level, valid, err)
+		}
+	}
+}
+
+func TestDilithiumSignatureRejectsModifiedMessage(t *testing.T) {
+	signer := NewDilithiumSigner(nil, zap.NewNop())
+	if err := signer.GenerateKeyPair(); err != nil {
+		t.Fatalf("failed to generate key pair: %v", err)
+	}
+
+	messageA := []byte("peer 10.0.0.1:51820")
+	signature, err := signer.CreateTestSignature(messageA)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	messageB := append([]byte(nil), messageA...)
+	messageB[len(messageB)-1] ^= 0x01
+
+	if valid, err := signer.VerifyTestSignature(messageA, signature); err != nil || !valid {
+		t.Errorf("expected signature to verify for message A: valid=%v err=%v", valid, err)
+	}
+	if valid, err := signer.VerifyTestSignature(messageB, signature); err != nil || valid {
+		t.Errorf("expected signature not to verify for message B: valid=%v err=%v", valid, err)
+	}
+}
@@ -1,10 +1,14 @@
 package quantum
 
 import (
-	"crypto/rand"
+	"bytes"
 	"fmt"
 	"time"
 
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/kyber/kyber1024"
+	"github.com/cloudflare/circl/kem/kyber/kyber512"
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
 	"go.uber.org/zap"
 )
 
@@ -15,6 +19,10 @@ type KyberKeyExchange struct {
 	config     *KyberConfig
 	logger     *zap.Logger
 	metrics    *KyberMetrics
+	// cache keeps parsed peer public keys. Encapsulation results are never
+	// cached: reusing one would give every exchange with a peer the same
+	// secret and let a recorded ciphertext be replayed.
+	cache *resultCache[kem.PublicKey]
 }
 
 // KyberPrivateKey represents a Kyber private key
@@ -35,7 +43,7 @@ type KyberPublicKey struct {
 type KyberConfig struct {
 	SecurityLevel int // 512, 768, 1024
 	HybridMode    bool
-	KeySize       int
+	KeySize       int // informational: Kyber always agrees on 32-byte secrets
 	EnableCache   bool
 	CacheTTL      time.Duration
 }
@@ -49,6 +57,8 @@ type KyberMetrics struct {
 	AverageKeyGenTime time.Duration
 	AverageEncapsTime time.Duration
 	AverageDecapsTime time.Duration
+	CacheHits         int64
+	CacheMisses       int64
 	LastOperation     time.Time
 }
 
@@ -64,11 +74,29 @@ func NewKyberKeyExchange(config *KyberConfig, logger *zap.Logger) *KyberKeyExcha
 		}
 	}
 
-	return &KyberKeyExchange{
+	kke := &KyberKeyExchange{
 		config:  config,
 		logger:  logger,
 		metrics: &KyberMetrics{},
 	}
+	if config.EnableCache && config.CacheTTL > 0 {
+		kke.cache = newResultCache[kem.PublicKey](config.CacheTTL)
+	}
+	return kke
+}
+
+// kyberScheme returns the Kyber parameter set of a security level
+func kyberScheme(level int) (kem.Scheme, error) {
+	switch level {
+	case 512:
+		return kyber512.Scheme(), nil
+	case 768:
+		return kyber768.Scheme(), nil
+	case 1024:
+		return kyber1024.Scheme(), nil
+	default:
+		return nil, fmt.Errorf("unsupported security level: %d", level)
+	}
 }
 
 // GenerateKeyPair generates a new Kyber key pair
@@ -76,38 +104,27 @@ func (kke *KyberKeyExchange) GenerateKeyPair() error {
 	startTime := time.Now()
 	kke.logger.Info("Generating Kyber key pair", zap.Int("security_level", kke.config.SecurityLevel))
 
-	// In a real implementation, you would use the actual CRYSTALS-Kyber library
-	// For now, we'll simulate the key generation process
-	
-	var privateKeySize, publicKeySize int
-	switch kke.config.SecurityLevel {
-	case 512:
-		privateKeySize = 1632
-		publicKeySize = 800
-	case 768:
-		privateKeySize = 2400
-		publicKeySize = 1184
-	case 1024:
-		privateKeySize = 3168
-		publicKeySize = 1568
-	default:
-		return fmt.Errorf("unsupported security level: %d", kke.config.SecurityLevel)
+	scheme, err := kyberScheme(kke.config.SecurityLevel)
+	if err != nil {
+		return err
 	}
 
-	// Generate private key
-	privateKeyBytes := make([]byte, privateKeySize)
-	if _, err := rand.Read(privateKeyBytes); err != nil {
+	publicKey, privateKey, err := scheme.GenerateKeyPair()
+	if err != nil {
 		kke.metrics.Errors++
-		return fmt.Errorf("failed to generate private key: %w", err)
+		return fmt.Errorf("failed to generate key pair: %w", err)
 	}
-
-	// Generate public key from private key
-	// In real implementation, this would use Kyber's key generation algorithm
-	publicKeyBytes := make([]byte, publicKeySize)
-	if _, err := rand.Read(publicKeyBytes); err != nil {
+	privateKeyBytes, err := privateKey.MarshalBinary()
+	if err != nil {
+		kke.metrics.Errors++
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
 		kke.metrics.Errors++
-		return fmt.Errorf("failed to generate public key: %w", err)
+		return fmt.Errorf("failed to encode public key: %w", err)
 	}
+	privateKeySize, publicKeySize := len(privateKeyBytes), len(publicKeyBytes)
 
 	// Create key objects
 	kke.privateKey = &KyberPrivateKey{
@@ -145,22 +162,21 @@ func (kke *KyberKeyExchange) Encapsulate(peerPublicKey *KyberPublicKey) ([]byte,
 		return nil, nil, fmt.Errorf("peer public key is nil")
 	}
 
-	// In a real implementation, you would use Kyber's encapsulation algorithm
-	// For now, we'll simulate the process
-	
-	// Generate random shared secret
-	sharedSecret := make([]byte, kke.config.KeySize)
-	if _, err := rand.Read(sharedSecret); err != nil {
+	scheme, err := kyberScheme(kke.config.SecurityLevel)
+	if err != nil {
 		kke.metrics.Errors++
-		return nil, nil, fmt.Errorf("failed to generate shared secret: %w", err)
+		return nil, nil, err
 	}
-
-	// Generate ciphertext (in real implementation, this would be the actual Kyber ciphertext)
-	ciphertextSize := peerPublicKey.Size
-	ciphertext := make([]byte, ciphertextSize)
-	if _, err := rand.Read(ciphertext); err != nil {
+	publicKey, err := kke.peerPublicKey(scheme, peerPublicKey)
+	if err != nil {
+		kke.metrics.Errors++
+		return nil, nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	// Every encapsulation derives a fresh secret, even for a known peer
+	ciphertext, sharedSecret, err := scheme.Encapsulate(publicKey)
+	if err != nil {
 		kke.metrics.Errors++
-		return nil, nil, fmt.Errorf("failed to generate ciphertext: %w", err)
+		return nil, nil, fmt.Errorf("failed to encapsulate shared secret: %w", err)
 	}
 
 	// Update metrics
@@ -176,6 +192,26 @@ func (kke *KyberKeyExchange) Encapsulate(peerPublicKey *KyberPublicKey) ([]byte,
 	return sharedSecret, ciphertext, nil
 }
 
+// peerPublicKey parses a peer's public key, reusing the parsed key while it
+// is cached
+func (kke *KyberKeyExchange) peerPublicKey(scheme kem.Scheme, peerPublicKey *KyberPublicKey) (kem.PublicKey, error) {
+	if kke.cache == nil {
+		return scheme.UnmarshalBinaryPublicKey(peerPublicKey.Key)
+	}
+	key := newCacheKey(peerPublicKey.Key)
+	if cached, ok := kke.cache.get(key); ok {
+		kke.metrics.CacheHits++
+		return cached, nil
+	}
+	kke.metrics.CacheMisses++
+	publicKey, err := scheme.UnmarshalBinaryPublicKey(peerPublicKey.Key)
+	if err != nil {
+		return nil, err
+	}
+	kke.cache.put(key, publicKey)
+	return publicKey, nil
+}
+
 // Decapsulate extracts the shared secret from a ciphertext using the private key
 func (kke *KyberKeyExchange) Decapsulate(ciphertext []byte) ([]byte, error) {
 	startTime := time.Now()
@@ -191,15 +227,24 @@ func (kke *KyberKeyExchange) Decapsulate(ciphertext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("ciphertext is empty")
 	}
 
-	// In a real implementation, you would use Kyber's decapsulation algorithm
-	// For now, we'll simulate the process
-	
-	// Extract shared secret from ciphertext
-	// In real implementation, this would use the private key to decrypt the ciphertext
-	sharedSecret := make([]byte, kke.config.KeySize)
-	if _, err := rand.Read(sharedSecret); err != nil {
+	scheme, err := kyberScheme(kke.config.SecurityLevel)
+	if err != nil {
+		kke.metrics.Errors++
+		return nil, err
+	}
+	if len(ciphertext) != scheme.CiphertextSize() {
 		kke.metrics.Errors++
-		return nil, fmt.Errorf("failed to extract shared secret: %w", err)
+		return nil, fmt.Errorf("invalid ciphertext size: expected %d, got %d", scheme.CiphertextSize(), len(ciphertext))
+	}
+	privateKey, err := scheme.UnmarshalBinaryPrivateKey(kke.privateKey.Key)
+	if err != nil {
+		kke.metrics.Errors++
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	sharedSecret, err := scheme.Decapsulate(privateKey, ciphertext)
+	if err != nil {
+		kke.metrics.Errors++
+		return nil, fmt.Errorf("failed to decapsulate shared secret: %w", err)
 	}
 
 	// Update metrics
@@ -214,6 +259,32 @@ func (kke *KyberKeyExchange) Decapsulate(ciphertext []byte) ([]byte, error) {
 	return sharedSecret, nil
 }
 
+// SelfTest checks that the Kyber implementation agrees on shared secrets:
+// it generates a key pair at the configured security level, encapsulates to
+// its public key and decapsulates the ciphertext. The key pair of kke is not
+// touched.
+func (kke *KyberKeyExchange) SelfTest() error {
+	probe := NewKyberKeyExchange(&KyberConfig{
+		SecurityLevel: kke.config.SecurityLevel,
+		KeySize:       kke.config.KeySize,
+	}, kke.logger)
+	if err := probe.GenerateKeyPair(); err != nil {
+		return fmt.Errorf("kyber self-test: %w", err)
+	}
+	sharedSecret, ciphertext, err := probe.Encapsulate(probe.GetPublicKey())
+	if err != nil {
+		return fmt.Errorf("kyber self-test: %w", err)
+	}
+	decapsulated, err := probe.Decapsulate(ciphertext)
+	if err != nil {
+		return fmt.Errorf("kyber self-test: %w", err)
+	}
+	if !bytes.Equal(sharedSecret, decapsulated) {
+		return fmt.Errorf("kyber self-test: decapsulated secret does not match the encapsulated one")
+	}
+	return nil
+}
+
 // GetPublicKey returns the public key
 func (kke *KyberKeyExchange) GetPublicKey() *KyberPublicKey {
 	return kke.publicKey
@@ -244,7 +315,22 @@ func (kke *KyberKeyExchange) ValidateKeyPair() error {
 		return fmt.Errorf("key pair is empty")
 	}
 
-	// In a real implementation, you would validate the key pair using Kyber's validation functions
+	scheme, err := kyberScheme(kke.config.SecurityLevel)
+	if err != nil {
+		return err
+	}
+	privateKey, err := scheme.UnmarshalBinaryPrivateKey(kke.privateKey.Key)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	publicKey, err := privateKey.Public().MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+	if !bytes.Equal(publicKey, kke.publicKey.Key) {
+		return fmt.Errorf("public key does not belong to the private key")
+	}
+
 	kke.logger.Debug("Key pair validation successful")
 	return nil
 }
@@ -255,8 +341,6 @@ func (kke *KyberKeyExchange) ExportPublicKey() ([]byte, error) {
 		return nil, fmt.Errorf("public key not generated")
 	}
 
-	// In a real implementation, you might want to encode the key in a specific format
-	// For now, we'll return the raw bytes
 	return kke.publicKey.Key, nil
 }
 
@@ -266,20 +350,11 @@ func (kke *KyberKeyExchange) ImportPublicKey(keyBytes []byte) (*KyberPublicKey,
 		return nil, fmt.Errorf("key bytes are empty")
 	}
 
-	// Validate key size based on security level
-	var expectedSize int
-	switch kke.config.SecurityLevel {
-	case 512:
-		expectedSize = 800
-	case 768:
-		expectedSize = 1184
-	case 1024:
-		expectedSize = 1568
-	default:
-		return nil, fmt.Errorf("unsupported security level: %d", kke.config.SecurityLevel)
+	scheme, err := kyberScheme(kke.config.SecurityLevel)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(keyBytes) != expectedSize {
+	if expectedSize := scheme.PublicKeySize(); len(keyBytes) != expectedSize {
 		return nil, fmt.Errorf("invalid key size: expected %d, got %d", expectedSize, len(keyBytes))
 	}
 
@@ -298,6 +373,27 @@ func (kke *KyberKeyExchange) GetSecurityLevel() int {
 	return kke.config.SecurityLevel
 }
 
+// SetSecurityLevel switches to another security level, for example one
+// negotiated with the server. The current key pair is discarded.
+func (kke *KyberKeyExchange) SetSecurityLevel(level int) error {
+	if !containsLevel(SupportedKyberLevels, level) {
+		return fmt.Errorf("unsupported security level: %d", level)
+	}
+	if level == kke.config.SecurityLevel {
+		return nil
+	}
+
+	config := *kke.config
+	config.SecurityLevel = level
+	kke.config = &config
+	kke.privateKey = nil
+	kke.publicKey = nil
+	if kke.cache != nil {
+		kke.cache.clear()
+	}
+	return nil
+}
+
 // IsHybridMode returns whether hybrid mode is enabled
 func (kke *KyberKeyExchange) IsHybridMode() bool {
 	return kke.config.HybridMode
@@ -308,5 +404,8 @@ func (kke *KyberKeyExchange) Reset() {
 	kke.privateKey = nil
 	kke.publicKey = nil
 	kke.metrics = &KyberMetrics{}
+	if kke.cache != nil {
+		kke.cache.clear()
+	}
 	kke.logger.Info("Kyber key exchange instance reset")
 }
@@ -0,0 +1,67 @@
+package quantum
+
+import (
+	"bytes"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestKyberSharedSecretsMatch(t *testing.T) {
+	for _, level := range SupportedKyberLevels {
+		alice := NewKyberKeyExchange(&KyberConfig{SecurityLevel: level, KeySize: 32}, zap.NewNop())
+		bob := NewKyberKeyExchange(&KyberConfig{SecurityLevel: level, KeySize: 32}, zap.NewNop())
+		if err := alice.GenerateKeyPair(); err != nil {
+			t.Fatalf("level %d: failed to generate key pair: %v", level, err)
+		}
+		if err := alice.ValidateKeyPair(); err != nil {
+			t.Errorf("level %d: generated key pair is invalid: %v", level, err)
+		}
+
+		exported, err := alice.ExportPublicKey()
+		if err != nil {
+			t.Fatalf("level %d: failed to export public key: %v", level, err)
+		}
+		peerKey, err := bob.ImportPublicKey(exported)
+		if err != nil {
+			t.Fatalf("level %d: failed to import public key: %v", level, err)
+		}
+		secret, ciphertext, err := bob.Encapsulate(peerKey)
+		if err != nil {
+			t.Fatalf("level %d: encapsulate failed: %v", level, err)
+		}
+		decapsulated, err := alice.Decapsulate(ciphertext)
+		if err != nil {
+			t.Fatalf("level %d: decapsulate failed: %v", level, err)
+		}
+		if len(secret) != 32 || !bytes.Equal(secret, decapsulated) {
+			t.Errorf("level %d: shared secrets differ", level)
+		}
+
+		// A modified ciphertext yields a different secret
+		ciphertext[0] ^= 1
+		if tampered, err := alice.Decapsulate(ciphertext); err != nil || bytes.Equal(tampered, secret) {
+			t.Errorf("level %d: tampered ciphertext gave the shared secret (err %v)", level, err)
+		}
+		if _, err := alice.Decapsulate(ciphertext[1:]); err == nil {
+			t.Errorf("level %d: expected error for a truncated ciphertext", level)
+		}
+	}
+}
+
+func TestKyberSelfTest(t *testing.T) {
+	for _, level := range SupportedKyberLevels {
+		kke := NewKyberKeyExchange(&KyberConfig{SecurityLevel: level, KeySize: 32}, zap.NewNop())
+		if err := kke.SelfTest(); err != nil {
+			t.Errorf("level %d: self-test failed: %v", level, err)
+		}
+		if kke.GetPublicKey() != nil {
+			t.Errorf("level %d: self-test must not set the key pair", level)
+		}
+	}
+
+	kke := NewKyberKeyExchange(&KyberConfig{SecurityLevel: 256, KeySize: 32}, zap.NewNop())
+	if err := kke.SelfTest(); err == nil {
+		t.Error("expected self-test to fail for an unsupported security level")
+	}
+}
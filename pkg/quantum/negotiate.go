@@ -0,0 +1,99 @@
+package quantum
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Security levels supported by this implementation, weakest first
+var (
+	SupportedKyberLevels     = []int{512, 768, 1024}
+	SupportedDilithiumLevels = []int{2, 3, 5}
+)
+
+// ErrNoCommonLevel is returned when client and server share no
+// post-quantum security level
+var ErrNoCommonLevel = errors.New("no common post-quantum security level")
+
+// Proposal lists the post-quantum security levels a client accepts. It is
+// sent in the hello message; the server answers with a Selection.
+type Proposal struct {
+	KyberLevels     []int `json:"kyber_levels"`
+	DilithiumLevels []int `json:"dilithium_levels"`
+}
+
+// Selection holds the security levels picked by the server
+type Selection struct {
+	KyberLevel     int `json:"kyber_level"`
+	DilithiumLevel int `json:"dilithium_level"`
+}
+
+// NewProposal proposes every supported level at or above the given minimums.
+// A minimum of zero accepts all supported levels.
+func NewProposal(minKyber, minDilithium int) (*Proposal, error) {
+	proposal := &Proposal{
+		KyberLevels:     levelsAtLeast(SupportedKyberLevels, minKyber),
+		DilithiumLevels: levelsAtLeast(SupportedDilithiumLevels, minDilithium),
+	}
+	if len(proposal.KyberLevels) == 0 {
+		return nil, fmt.Errorf("unsupported kyber security level: %d", minKyber)
+	}
+	if len(proposal.DilithiumLevels) == 0 {
+		return nil, fmt.Errorf("unsupported dilithium security level: %d", minDilithium)
+	}
+	return proposal, nil
+}
+
+// Select picks the strongest levels offered by both the proposal and the
+// supported lists. It is what a server does on receiving a proposal.
+func (p *Proposal) Select(kyberSupported, dilithiumSupported []int) (Selection, error) {
+	kyber, ok := highestCommon(p.KyberLevels, kyberSupported)
+	if !ok {
+		return Selection{}, fmt.Errorf("%w: kyber proposed %v, supported %v", ErrNoCommonLevel, p.KyberLevels, kyberSupported)
+	}
+	dilithium, ok := highestCommon(p.DilithiumLevels, dilithiumSupported)
+	if !ok {
+		return Selection{}, fmt.Errorf("%w: dilithium proposed %v, supported %v", ErrNoCommonLevel, p.DilithiumLevels, dilithiumSupported)
+	}
+	return Selection{KyberLevel: kyber, DilithiumLevel: dilithium}, nil
+}
+
+// Validate checks that a server selection is one of the proposed levels
+func (p *Proposal) Validate(selection Selection) error {
+	if !containsLevel(p.KyberLevels, selection.KyberLevel) {
+		return fmt.Errorf("%w: server selected kyber level %d, proposed %v", ErrNoCommonLevel, selection.KyberLevel, p.KyberLevels)
+	}
+	if !containsLevel(p.DilithiumLevels, selection.DilithiumLevel) {
+		return fmt.Errorf("%w: server selected dilithium level %d, proposed %v", ErrNoCommonLevel, selection.DilithiumLevel, p.DilithiumLevels)
+	}
+	return nil
+}
+
+func levelsAtLeast(levels []int, min int) []int {
+	var result []int
+	for _, level := range levels {
+		if level >= min {
+			result = append(result, level)
+		}
+	}
+	return result
+}
+
+func highestCommon(a, b []int) (int, bool) {
+	best, found := 0, false
+	for _, level := range a {
+		if containsLevel(b, level) && (!found || level > best) {
+			best, found = level, true
+		}
+	}
+	return best, found
+}
+
+func containsLevel(levels []int, level int) bool {
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
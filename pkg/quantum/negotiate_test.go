@@ -0,0 +1,44 @@
+package quantum
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProposalSelectsStrongestCommonLevel(t *testing.T) {
+	proposal, err := NewProposal(768, 3)
+	if err != nil {
+		t.Fatalf("failed to create proposal: %v", err)
+	}
+	if len(proposal.KyberLevels) != 2 || proposal.KyberLevels[0] != 768 {
+		t.Errorf("unexpected kyber levels: %v", proposal.KyberLevels)
+	}
+
+	selection, err := proposal.Select([]int{512, 768}, []int{2, 3, 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if selection.KyberLevel != 768 || selection.DilithiumLevel != 5 {
+		t.Errorf("unexpected selection: %+v", selection)
+	}
+	if err := proposal.Validate(selection); err != nil {
+		t.Errorf("valid selection rejected: %v", err)
+	}
+}
+
+func TestProposalWithoutOverlap(t *testing.T) {
+	proposal, err := NewProposal(1024, 5)
+	if err != nil {
+		t.Fatalf("failed to create proposal: %v", err)
+	}
+
+	if _, err := proposal.Select([]int{512, 768}, []int{5}); !errors.Is(err, ErrNoCommonLevel) {
+		t.Errorf("expected ErrNoCommonLevel, got %v", err)
+	}
+	if err := proposal.Validate(Selection{KyberLevel: 512, DilithiumLevel: 5}); !errors.Is(err, ErrNoCommonLevel) {
+		t.Errorf("expected ErrNoCommonLevel for downgraded selection, got %v", err)
+	}
+	if _, err := NewProposal(2048, 0); err == nil {
+		t.Error("expected error for unsupported minimum level")
+	}
+}
@@ -0,0 +1,286 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+const testALPN = "cloudbridge-test"
+
+// startEchoServer runs a QUIC listener echoing every stream and returns a
+// client connected to it
+func startEchoServer(t *testing.T, config *QUICConfig) *EnhancedQUICClient {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "quic-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	listener, err := quicgo.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{testALPN},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+
+	config.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true, // throwaway certificate of the test listener
+		NextProtos:         []string{testALPN},
+	}
+	client := NewEnhancedQUICClient(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx, listener.Addr().String()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	return client
+}
+
+type fakeStreamHandle struct {
+	mu          sync.Mutex
+	readCode    uint64
+	writeCode   uint64
+	readCancel  bool
+	writeCancel bool
+	closed      bool
+}
+
+func (f *fakeStreamHandle) CancelRead(code uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readCancel, f.readCode = true, code
+}
+
+func (f *fakeStreamHandle) CancelWrite(code uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeCancel, f.writeCode = true, code
+}
+
+func (f *fakeStreamHandle) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func TestDisconnectResetsStreams(t *testing.T) {
+	client := startEchoServer(t, &QUICConfig{MaxStreams: 10})
+
+	var handles []*fakeStreamHandle
+	var streams []*QUICStream
+	for i := 0; i < 5; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		handle := &fakeStreamHandle{}
+		stream.handle = handle
+		handles = append(handles, handle)
+		streams = append(streams, stream)
+	}
+	if err := client.CloseStream(streams[0].ID); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	// A read in progress must finish before Disconnect returns
+	inFlight, err := client.beginStreamOp(streams[1].ID)
+	if err != nil {
+		t.Fatalf("failed to begin stream operation: %v", err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		inFlight.ops.Done()
+	}()
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("failed to disconnect: %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Disconnect returned before the read in progress finished")
+	}
+
+	if n := len(client.GetAllStreams()); n != 0 {
+		t.Errorf("expected no streams after disconnect, got %d", n)
+	}
+	for i, handle := range handles {
+		handle.mu.Lock()
+		if i == 0 {
+			if !handle.closed || handle.readCancel {
+				t.Errorf("stream %d: expected a graceful close only", i)
+			}
+		} else if !handle.readCancel || !handle.writeCancel ||
+			handle.readCode != ErrorCodeConnectionClosed || handle.writeCode != ErrorCodeConnectionClosed {
+			t.Errorf("stream %d was not reset with the connection closed code", i)
+		}
+		handle.mu.Unlock()
+	}
+	for _, stream := range streams {
+		if stream.Status != StreamStatusClosed {
+			t.Errorf("stream %d still %s", stream.ID, stream.Status)
+		}
+	}
+
+	if err := client.Write(streams[2].ID, []byte("data")); err == nil {
+		t.Error("expected write on a disconnected stream to fail")
+	}
+	if client.IsConnected() {
+		t.Error("expected client to be disconnected")
+	}
+}
+
+func TestStreamCarriesData(t *testing.T) {
+	client := startEchoServer(t, &QUICConfig{MaxStreams: 10})
+	defer client.Disconnect()
+	if !client.IsConnected() {
+		t.Fatal("expected client to be connected")
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := client.Write(stream.ID, []byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	read := func(p []byte) (int, error) { return client.Read(stream.ID, p) }
+	if _, err := io.ReadFull(readerFunc(read), buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected ping, got %q", buf)
+	}
+
+	metrics := client.GetMetrics()
+	if metrics.BytesSent != 4 || metrics.BytesReceived != 4 || metrics.ConnectionsTotal != 1 || metrics.StreamsTotal != 1 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestCloseStreamFreesSlot(t *testing.T) {
+	client := startEchoServer(t, &QUICConfig{MaxStreams: 2})
+	defer client.Disconnect()
+
+	// More streams than MaxStreams over the lifetime of the client
+	for i := 0; i < 5; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream %d: %v", i, err)
+		}
+		if err := client.CloseStream(stream.ID); err != nil {
+			t.Fatalf("failed to close stream %d: %v", i, err)
+		}
+		if _, exists := client.GetStream(stream.ID); exists {
+			t.Fatalf("closed stream %d is still listed", i)
+		}
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	client := startEchoServer(t, &QUICConfig{MaxStreams: 10})
+	defer client.Disconnect()
+
+	// Streams are written and read in parallel, each from two goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := client.Write(stream.ID, []byte("ping")); err != nil {
+					t.Errorf("failed to write: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			read := func(p []byte) (int, error) { return client.Read(stream.ID, p) }
+			if _, err := io.ReadFull(readerFunc(read), make([]byte, 40)); err != nil {
+				t.Errorf("failed to read echo: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	metrics := client.GetMetrics()
+	if metrics.BytesSent != 200 || metrics.BytesReceived != 200 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestConnectFailsWithoutServer(t *testing.T) {
+	client := NewEnhancedQUICClient(&QUICConfig{
+		HandshakeTimeout: 200 * time.Millisecond,
+		TLSConfig:        &tls.Config{NextProtos: []string{testALPN}},
+	})
+	if err := client.Connect(context.Background(), "127.0.0.1:1"); err == nil {
+		t.Fatal("expected connect to fail without a server")
+	}
+	if client.GetStatus() != ConnectionStatusError || client.GetMetrics().ConnectionErrors != 1 {
+		t.Errorf("unexpected status %s with %d connection errors", client.GetStatus(), client.GetMetrics().ConnectionErrors)
+	}
+}
+
+// readerFunc adapts a read method to io.Reader
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
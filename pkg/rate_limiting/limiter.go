@@ -4,65 +4,83 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
 )
 
 // Limiter implements rate limiting with exponential backoff
 type Limiter struct {
-	mu              sync.RWMutex
-	limits          map[string]*UserLimit
-	maxRetries      int
+	mu                sync.RWMutex
+	limits            map[limitKey]*UserLimit
+	maxRetries        int
 	backoffMultiplier float64
-	maxBackoff      time.Duration
-	cleanupInterval time.Duration
-	lastCleanup    time.Time
-	windowSize     time.Duration
-	maxRequests    int
+	maxBackoff        time.Duration
+	cleanupInterval   time.Duration
+	lastCleanup       time.Time
+	windowSize        time.Duration
+	maxRequests       int
+	tenantMaxRequests int
+	clock             clock.Clock
+}
+
+// limitKey identifies a tracked limit: a user of Allow, a user within a
+// tenant, or the aggregate limit of a tenant. Keeping the parts apart means
+// no choice of tenant and user IDs can make two limits share a key.
+type limitKey struct {
+	tenantID  string
+	userID    string
+	aggregate bool
 }
 
 // UserLimit tracks rate limiting for a specific user
 type UserLimit struct {
-	UserID        string
-	RequestCount  int
-	LastRequest   time.Time
-	RetryCount    int
-	BackoffUntil  time.Time
-	WindowStart   time.Time
-	WindowSize    time.Duration
-	MaxRequests   int
+	UserID       string
+	RequestCount int
+	LastRequest  time.Time
+	RetryCount   int
+	BackoffUntil time.Time
+	WindowStart  time.Time
+	WindowSize   time.Duration
+	MaxRequests  int
 }
 
 // Config holds rate limiting configuration
 type Config struct {
-	MaxRetries       int           `yaml:"max_retries"`
-	BackoffMultiplier float64      `yaml:"backoff_multiplier"`
-	MaxBackoff       time.Duration `yaml:"max_backoff"`
-	WindowSize       time.Duration `yaml:"window_size"`
-	MaxRequests      int           `yaml:"max_requests"`
-	CleanupInterval  time.Duration `yaml:"cleanup_interval"`
+	MaxRetries        int           `yaml:"max_retries"`
+	BackoffMultiplier float64       `yaml:"backoff_multiplier"`
+	MaxBackoff        time.Duration `yaml:"max_backoff"`
+	WindowSize        time.Duration `yaml:"window_size"`
+	MaxRequests       int           `yaml:"max_requests"`
+	CleanupInterval   time.Duration `yaml:"cleanup_interval"`
+	// TenantMaxRequests caps the total requests of all users of a tenant
+	// within one window. Zero disables the tenant-level limit.
+	TenantMaxRequests int `yaml:"tenant_max_requests"`
 }
 
 // NewLimiter creates a new rate limiter
 func NewLimiter(config *Config) *Limiter {
 	if config == nil {
 		config = &Config{
-			MaxRetries:       3,
+			MaxRetries:        3,
 			BackoffMultiplier: 2.0,
-			MaxBackoff:       30 * time.Second,
-			WindowSize:       1 * time.Minute,
-			MaxRequests:      100,
-			CleanupInterval:  5 * time.Minute,
+			MaxBackoff:        30 * time.Second,
+			WindowSize:        1 * time.Minute,
+			MaxRequests:       100,
+			CleanupInterval:   5 * time.Minute,
 		}
 	}
 
 	limiter := &Limiter{
-		limits:          make(map[string]*UserLimit),
-		maxRetries:      config.MaxRetries,
+		limits:            make(map[limitKey]*UserLimit),
+		maxRetries:        config.MaxRetries,
 		backoffMultiplier: config.BackoffMultiplier,
-		maxBackoff:      config.MaxBackoff,
-		cleanupInterval: config.CleanupInterval,
-		lastCleanup:    time.Now(),
-		windowSize:     config.WindowSize,
-		maxRequests:    config.MaxRequests,
+		maxBackoff:        config.MaxBackoff,
+		cleanupInterval:   config.CleanupInterval,
+		lastCleanup:       time.Now(),
+		clock:             clock.Real{},
+		windowSize:        config.WindowSize,
+		maxRequests:       config.MaxRequests,
+		tenantMaxRequests: config.TenantMaxRequests,
 	}
 
 	// Start cleanup goroutine
@@ -71,6 +89,14 @@ func NewLimiter(config *Config) *Limiter {
 	return limiter
 }
 
+// SetClock sets the clock used for windows and backoff periods
+func (l *Limiter) SetClock(c clock.Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+	l.lastCleanup = c.Now()
+}
+
 // Allow checks if a request is allowed for the given user
 func (l *Limiter) Allow(userID string) (bool, time.Duration, error) {
 	l.mu.Lock()
@@ -79,28 +105,84 @@ func (l *Limiter) Allow(userID string) (bool, time.Duration, error) {
 	// Cleanup old entries if needed
 	l.cleanupIfNeeded()
 
-	// Get or create user limit
-	userLimit, exists := l.limits[userID]
+	userLimit := l.getOrCreateLimit(limitKey{userID: userID}, l.getMaxRequests())
+	if allowed, backoff, err := l.check(userLimit); !allowed {
+		return false, backoff, err
+	}
+
+	// Allow request
+	l.consume(userLimit)
+
+	return true, 0, nil
+}
+
+// AllowTenant checks if a request is allowed for the given user of a tenant.
+// The user is limited per tenant, so the same user ID in different tenants
+// is tracked separately. If a tenant-level
+// limit is configured, the request must also fit into the tenant's
+// aggregate budget. An empty tenantID behaves like Allow.
+func (l *Limiter) AllowTenant(tenantID, userID string) (bool, time.Duration, error) {
+	if tenantID == "" {
+		return l.Allow(userID)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cleanupIfNeeded()
+
+	userLimit := l.getOrCreateLimit(limitKey{tenantID: tenantID, userID: userID}, l.getMaxRequests())
+	if allowed, backoff, err := l.check(userLimit); !allowed {
+		recordDecision(tenantID, resultDeniedUser)
+		return false, backoff, err
+	}
+
+	var tenantLimit *UserLimit
+	if l.tenantMaxRequests > 0 {
+		tenantLimit = l.getOrCreateLimit(limitKey{tenantID: tenantID, aggregate: true}, l.tenantMaxRequests)
+		if allowed, backoff, err := l.check(tenantLimit); !allowed {
+			recordDecision(tenantID, resultDeniedTenant)
+			return false, backoff, fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+	}
+
+	l.consume(userLimit)
+	if tenantLimit != nil {
+		l.consume(tenantLimit)
+	}
+	recordDecision(tenantID, resultAllowed)
+
+	return true, 0, nil
+}
+
+// getOrCreateLimit returns the limit tracked under key, creating it if needed
+func (l *Limiter) getOrCreateLimit(key limitKey, maxRequests int) *UserLimit {
+	userLimit, exists := l.limits[key]
 	if !exists {
 		userLimit = &UserLimit{
-			UserID:      userID,
-			WindowStart: time.Now(),
+			UserID:      key.userID,
+			WindowStart: l.clock.Now(),
 			WindowSize:  l.getWindowSize(),
-			MaxRequests: l.getMaxRequests(),
+			MaxRequests: maxRequests,
 		}
-		l.limits[userID] = userLimit
+		l.limits[key] = userLimit
 	}
+	return userLimit
+}
 
+// check reports whether one more request fits into the limit without
+// consuming it. Exceeding the limit starts a backoff period.
+func (l *Limiter) check(userLimit *UserLimit) (bool, time.Duration, error) {
 	// Check if user is in backoff period
-	if time.Now().Before(userLimit.BackoffUntil) {
-		remaining := userLimit.BackoffUntil.Sub(time.Now())
+	if l.clock.Now().Before(userLimit.BackoffUntil) {
+		remaining := userLimit.BackoffUntil.Sub(l.clock.Now())
 		return false, remaining, fmt.Errorf("rate limit exceeded, retry after %v", remaining)
 	}
 
 	// Check if window has expired
-	if time.Since(userLimit.WindowStart) > userLimit.WindowSize {
+	if l.clock.Since(userLimit.WindowStart) > userLimit.WindowSize {
 		userLimit.RequestCount = 0
-		userLimit.WindowStart = time.Now()
+		userLimit.WindowStart = l.clock.Now()
 		userLimit.RetryCount = 0
 	}
 
@@ -108,17 +190,19 @@ func (l *Limiter) Allow(userID string) (bool, time.Duration, error) {
 	if userLimit.RequestCount >= userLimit.MaxRequests {
 		userLimit.RetryCount++ // <--- увеличиваем до вычисления backoff
 		calculatedBackoff := l.calculateBackoff(userLimit.RetryCount)
-		userLimit.BackoffUntil = time.Now().Add(calculatedBackoff)
+		userLimit.BackoffUntil = l.clock.Now().Add(calculatedBackoff)
 		return false, calculatedBackoff, fmt.Errorf("rate limit exceeded, retry after %v", calculatedBackoff)
 	}
 
-	// Allow request
-	userLimit.RequestCount++
-	userLimit.LastRequest = time.Now()
-
 	return true, 0, nil
 }
 
+// consume counts one request against the limit
+func (l *Limiter) consume(userLimit *UserLimit) {
+	userLimit.RequestCount++
+	userLimit.LastRequest = l.clock.Now()
+}
+
 // calculateBackoff calculates exponential backoff duration
 func (l *Limiter) calculateBackoff(retryCount int) time.Duration {
 	if retryCount > l.maxRetries {
@@ -126,7 +210,7 @@ func (l *Limiter) calculateBackoff(retryCount int) time.Duration {
 	}
 
 	backoff := time.Duration(float64(time.Second) * l.backoffMultiplier * float64(retryCount))
-	
+
 	if backoff > l.maxBackoff {
 		backoff = l.maxBackoff
 	}
@@ -152,16 +236,16 @@ func (l *Limiter) getMaxRequests() int {
 
 // cleanupIfNeeded removes old user limits
 func (l *Limiter) cleanupIfNeeded() {
-	if time.Since(l.lastCleanup) < l.cleanupInterval {
+	if l.clock.Since(l.lastCleanup) < l.cleanupInterval {
 		return
 	}
 
-	l.lastCleanup = time.Now()
-	cutoff := time.Now().Add(-l.cleanupInterval)
+	l.lastCleanup = l.clock.Now()
+	cutoff := l.clock.Now().Add(-l.cleanupInterval)
 
-	for userID, userLimit := range l.limits {
+	for key, userLimit := range l.limits {
 		if userLimit.LastRequest.Before(cutoff) {
-			delete(l.limits, userID)
+			delete(l.limits, key)
 		}
 	}
 }
@@ -192,11 +276,12 @@ func (l *Limiter) GetStats() map[string]interface{} {
 	// Count users in backoff
 	usersInBackoff := 0
 	for _, userLimit := range l.limits {
-		if time.Now().Before(userLimit.BackoffUntil) {
+		if l.clock.Now().Before(userLimit.BackoffUntil) {
 			usersInBackoff++
 		}
 	}
 	stats["users_in_backoff"] = usersInBackoff
+	stats["tenant_max_requests"] = l.tenantMaxRequests
 
 	return stats
 }
@@ -206,11 +291,27 @@ func (l *Limiter) ResetUser(userID string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if userLimit, exists := l.limits[userID]; exists {
+	if userLimit, exists := l.limits[limitKey{userID: userID}]; exists {
 		userLimit.RequestCount = 0
 		userLimit.RetryCount = 0
 		userLimit.BackoffUntil = time.Time{}
-		userLimit.WindowStart = time.Now()
+		userLimit.WindowStart = l.clock.Now()
+	}
+}
+
+// ResetTenant resets the aggregate limit of a tenant and the limits of all
+// of its users
+func (l *Limiter) ResetTenant(tenantID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, userLimit := range l.limits {
+		if key.tenantID == tenantID {
+			userLimit.RequestCount = 0
+			userLimit.RetryCount = 0
+			userLimit.BackoffUntil = time.Time{}
+			userLimit.WindowStart = l.clock.Now()
+		}
 	}
 }
 
@@ -218,4 +319,4 @@ func (l *Limiter) ResetUser(userID string) {
 func (l *Limiter) Close() {
 	// The cleanup goroutine will stop when the ticker is stopped
 	// This is handled in cleanupLoop
-} 
\ No newline at end of file
+}
@@ -3,16 +3,18 @@ package rate_limiting
 import (
 	"testing"
 	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
 )
 
 func TestNewLimiter(t *testing.T) {
 	config := &Config{
-		MaxRetries:       5,
+		MaxRetries:        5,
 		BackoffMultiplier: 2.0,
-		MaxBackoff:       10 * time.Second,
-		WindowSize:       30 * time.Second,
-		MaxRequests:      50,
-		CleanupInterval:  1 * time.Minute,
+		MaxBackoff:        10 * time.Second,
+		WindowSize:        30 * time.Second,
+		MaxRequests:       50,
+		CleanupInterval:   1 * time.Minute,
 	}
 
 	limiter := NewLimiter(config)
@@ -29,12 +31,12 @@ func TestNewLimiter(t *testing.T) {
 
 func TestAllowWithinLimit(t *testing.T) {
 	config := &Config{
-		MaxRequests: 10,
-		WindowSize:  1 * time.Minute,
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       10,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -55,12 +57,12 @@ func TestAllowWithinLimit(t *testing.T) {
 
 func TestAllowExceedsLimit(t *testing.T) {
 	config := &Config{
-		MaxRequests: 5,
-		WindowSize:  1 * time.Minute,
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       5,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -90,11 +92,11 @@ func TestAllowExceedsLimit(t *testing.T) {
 
 func TestBackoffCalculation(t *testing.T) {
 	config := &Config{
-		MaxRetries:       3,
+		MaxRetries:        3,
 		BackoffMultiplier: 2.0,
-		MaxBackoff:       10 * time.Second,
-		MaxRequests:      1,
-		CleanupInterval:  1 * time.Minute,
+		MaxBackoff:        10 * time.Second,
+		MaxRequests:       1,
+		CleanupInterval:   1 * time.Minute,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -121,15 +123,17 @@ func TestBackoffCalculation(t *testing.T) {
 
 func TestWindowReset(t *testing.T) {
 	config := &Config{
-		MaxRequests: 5,
-		WindowSize:  100 * time.Millisecond, // Short window for testing
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       5,
+		WindowSize:        100 * time.Millisecond, // Short window for testing
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
+	fake := clock.NewFake(time.Now())
+	limiter.SetClock(fake)
 
 	userID := "test-user"
 
@@ -141,8 +145,8 @@ func TestWindowReset(t *testing.T) {
 		}
 	}
 
-	// Wait for window to reset
-	time.Sleep(150 * time.Millisecond)
+	// Let the window expire
+	fake.Advance(150 * time.Millisecond)
 
 	// Should be able to make requests again
 	allowed, _, _ := limiter.Allow(userID)
@@ -153,12 +157,12 @@ func TestWindowReset(t *testing.T) {
 
 func TestResetUser(t *testing.T) {
 	config := &Config{
-		MaxRequests: 5,
-		WindowSize:  1 * time.Minute,
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       5,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -185,12 +189,12 @@ func TestResetUser(t *testing.T) {
 
 func TestGetStats(t *testing.T) {
 	config := &Config{
-		MaxRequests: 5,
-		WindowSize:  1 * time.Minute,
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       5,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -198,7 +202,7 @@ func TestGetStats(t *testing.T) {
 	// Make some requests
 	limiter.Allow("user1")
 	limiter.Allow("user2")
-	
+
 	// Exceed limit for user1 (make 5 more requests to reach limit of 5)
 	for i := 0; i < 5; i++ {
 		limiter.Allow("user1")
@@ -215,12 +219,12 @@ func TestGetStats(t *testing.T) {
 
 func TestConcurrentAccess(t *testing.T) {
 	config := &Config{
-		MaxRequests: 100,
-		WindowSize:  1 * time.Minute,
-		CleanupInterval: 1 * time.Minute,
+		MaxRequests:       100,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
 		BackoffMultiplier: 2.0,
-		MaxRetries: 3,
-		MaxBackoff: 10 * time.Second,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
 	}
 	limiter := NewLimiter(config)
 	defer limiter.Close()
@@ -248,4 +252,100 @@ func TestConcurrentAccess(t *testing.T) {
 	if stats["total_users"] != 1 {
 		t.Errorf("Expected 1 user, got %v", stats["total_users"])
 	}
-} 
\ No newline at end of file
+}
+
+func TestAllowTenantCompositeKey(t *testing.T) {
+	config := &Config{
+		MaxRequests:       2,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
+		BackoffMultiplier: 2.0,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
+	}
+	limiter := NewLimiter(config)
+	defer limiter.Close()
+
+	// The same user ID in two tenants is limited independently
+	for i := 0; i < 2; i++ {
+		if allowed, _, err := limiter.AllowTenant("tenant-a", "user"); !allowed {
+			t.Errorf("Expected tenant-a request %d to be allowed, got %v", i+1, err)
+		}
+		if allowed, _, err := limiter.AllowTenant("tenant-b", "user"); !allowed {
+			t.Errorf("Expected tenant-b request %d to be allowed, got %v", i+1, err)
+		}
+	}
+
+	if allowed, _, _ := limiter.AllowTenant("tenant-a", "user"); allowed {
+		t.Error("Expected third tenant-a request to be denied")
+	}
+}
+
+func TestAllowTenantKeysDoNotCollide(t *testing.T) {
+	config := &Config{
+		MaxRequests:       1,
+		TenantMaxRequests: 1,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
+		BackoffMultiplier: 2.0,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
+	}
+	limiter := NewLimiter(config)
+	defer limiter.Close()
+
+	// Each of these would share a key if tenant and user IDs were joined
+	// into one string
+	requests := []struct{ tenantID, userID string }{
+		{"a", "b/c"},
+		{"a/b", "c"},
+		{"", "a/b/c"},
+		{"", "tenant:a"},
+		{"", "tenant:a/b"},
+	}
+	for _, r := range requests {
+		if allowed, _, err := limiter.AllowTenant(r.tenantID, r.userID); !allowed {
+			t.Errorf("Expected request for tenant %q user %q to be allowed, got %v", r.tenantID, r.userID, err)
+		}
+	}
+}
+
+func TestAllowTenantAggregateLimit(t *testing.T) {
+	config := &Config{
+		MaxRequests:       10,
+		TenantMaxRequests: 3,
+		WindowSize:        1 * time.Minute,
+		CleanupInterval:   1 * time.Minute,
+		BackoffMultiplier: 2.0,
+		MaxRetries:        3,
+		MaxBackoff:        10 * time.Second,
+	}
+	limiter := NewLimiter(config)
+	defer limiter.Close()
+
+	users := []string{"user1", "user2", "user3"}
+	for _, user := range users {
+		if allowed, _, err := limiter.AllowTenant("tenant-a", user); !allowed {
+			t.Errorf("Expected request for %s to be allowed, got %v", user, err)
+		}
+	}
+
+	// A new user is still denied because the tenant budget is used up
+	allowed, backoff, err := limiter.AllowTenant("tenant-a", "user4")
+	if allowed {
+		t.Error("Expected request to be denied by tenant limit")
+	}
+	if backoff <= 0 || err == nil {
+		t.Error("Expected backoff and error from tenant limit")
+	}
+
+	// Other tenants are unaffected
+	if allowed, _, err := limiter.AllowTenant("tenant-b", "user1"); !allowed {
+		t.Errorf("Expected tenant-b request to be allowed, got %v", err)
+	}
+
+	limiter.ResetTenant("tenant-a")
+	if allowed, _, err := limiter.AllowTenant("tenant-a", "user4"); !allowed {
+		t.Errorf("Expected request to be allowed after tenant reset, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package rate_limiting
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Decision results recorded in metrics
+const (
+	resultAllowed      = "allowed"
+	resultDeniedUser   = "denied_user"
+	resultDeniedTenant = "denied_tenant"
+)
+
+var (
+	// Tenant rate limiting metrics
+	tenantDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_rate_limit_decisions_total",
+		Help: "Total number of rate limiting decisions by tenant and result",
+	}, []string{"tenant_id", "result"})
+)
+
+// recordDecision records a tenant rate limiting decision
+func recordDecision(tenantID, result string) {
+	tenantDecisions.WithLabelValues(tenantID, result).Inc()
+}
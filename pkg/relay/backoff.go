@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+// ErrMaxRetries is returned by ReconnectWithBackoff once every attempt failed
+var ErrMaxRetries = errors.New("max reconnect attempts reached")
+
+// BackoffConfig controls the delays between reconnect attempts
+type BackoffConfig struct {
+	// MaxRetries is how often a failed attempt is retried; negative retries
+	// until the context is done
+	MaxRetries int
+	// InitialDelay is the delay before the first retry; it doubles per
+	// retry up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Jitter randomizes every delay by up to this fraction in either
+	// direction, so clients that lost the relay together do not retry in
+	// lockstep. It is clamped to [0, 1].
+	Jitter float64
+	// Clock waits between attempts; nil uses the real clock
+	Clock clock.Clock
+	// OnRetry is called with the failed attempt number, its error and the
+	// delay before the next attempt
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+// DefaultBackoffConfig returns the default reconnect backoff
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		MaxRetries:   5,
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Jitter:       0.2,
+	}
+}
+
+// ReconnectWithBackoff calls connect until it succeeds, waiting with
+// exponential backoff between failed attempts. It returns ctx.Err() once ctx
+// is done and an error wrapping ErrMaxRetries and the last failure once the
+// retries are used up.
+func ReconnectWithBackoff(ctx context.Context, cfg BackoffConfig, connect func() error) error {
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	defaults := DefaultBackoffConfig()
+	delay := cfg.InitialDelay
+	if delay <= 0 {
+		delay = defaults.InitialDelay
+	}
+	maxDelay := cfg.MaxDelay
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if cfg.MaxRetries >= 0 && attempt > cfg.MaxRetries {
+			return fmt.Errorf("%w after %d attempts: %w", ErrMaxRetries, attempt, err)
+		}
+
+		wait := jitter(delay, cfg.Jitter)
+		if cfg.OnRetry != nil {
+			cfg.OnRetry(attempt, err, wait)
+		}
+		select {
+		case <-clk.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// jitter spreads d randomly by up to fraction of it in either direction
+func jitter(d time.Duration, fraction float64) time.Duration {
+	fraction = max(0, min(fraction, 1))
+	if fraction == 0 {
+		return d
+	}
+	spread := float64(d) * fraction
+	return time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectWithBackoff(t *testing.T) {
+	failure := errors.New("relay unavailable")
+	var delays []time.Duration
+	attempts := 0
+	cfg := BackoffConfig{
+		MaxRetries:   4,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     4 * time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			delays = append(delays, delay)
+		},
+	}
+
+	err := ReconnectWithBackoff(context.Background(), cfg, func() error {
+		attempts++
+		return failure
+	})
+	if !errors.Is(err, ErrMaxRetries) || !errors.Is(err, failure) {
+		t.Fatalf("expected ErrMaxRetries wrapping the last failure, got %v", err)
+	}
+	if attempts != 5 {
+		t.Errorf("expected 5 attempts, got %d", attempts)
+	}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond}
+	if len(delays) != len(want) {
+		t.Fatalf("expected delays %v, got %v", want, delays)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("expected delays %v, got %v", want, delays)
+			break
+		}
+	}
+
+	// A later success ends the retries
+	attempts = 0
+	err = ReconnectWithBackoff(context.Background(), cfg, func() error {
+		attempts++
+		if attempts < 3 {
+			return failure
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestReconnectWithBackoffCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := BackoffConfig{
+		MaxRetries:   -1,
+		InitialDelay: time.Hour,
+		OnRetry: func(int, error, time.Duration) {
+			cancel()
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ReconnectWithBackoff(ctx, cfg, func() error { return errors.New("relay unavailable") })
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backoff did not stop when the context was cancelled")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Errorf("expected no jitter, got %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second, 0.25)
+		if d < 750*time.Millisecond || d > 1250*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
@@ -2,21 +2,28 @@ package relay
 
 import (
 	"bufio"
+	"compress/flate"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
 	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+	"github.com/2gc-dev/cloudbridge-client/pkg/tunnel"
 )
 
 // Message types
@@ -26,6 +33,7 @@ const (
 	MessageTypeAuthResponse      = "auth_response"
 	MessageTypeTunnelInfo        = "tunnel_info"
 	MessageTypeTunnelResponse    = "tunnel_response"
+	MessageTypeCloseTunnel       = "close_tunnel"
 	MessageTypeHeartbeat         = "heartbeat"
 	MessageTypeHeartbeatResponse = "heartbeat_response"
 	MessageTypeError             = "error"
@@ -36,39 +44,150 @@ const (
 	HeartbeatInterval   = 30 * time.Second
 	HeartbeatTimeout    = 5 * time.Second
 	MaxMissedHeartbeats = 3
+	TunnelCreateTimeout = 15 * time.Second
+	HandshakeTimeout    = 10 * time.Second
+	// HelloTimeout bounds the wait for the server hello, so a peer that
+	// accepts connections but never speaks is given up on early
+	HelloTimeout = 5 * time.Second
+)
+
+var (
+	// ErrTunnelLimitReached is returned when creating a tunnel would
+	// exceed the configured maximum number of tunnels
+	ErrTunnelLimitReached = errors.New("tunnel limit reached")
+	// ErrTunnelNotFound is returned for tunnel IDs the client does not know
+	ErrTunnelNotFound = errors.New("tunnel not found")
+	// ErrServerTooOld is returned by the handshake when the relay reports
+	// a version below the configured minimum
+	ErrServerTooOld = errors.New("relay version too old")
+	// ErrNoServerHello is returned by the handshake when the server sends
+	// no hello within the hello timeout
+	ErrNoServerHello = errors.New("no hello from server")
+	// ErrNotAuthenticated is returned when creating a tunnel on a
+	// connection whose handshake has not completed
+	ErrNotAuthenticated = errors.New("not authenticated")
 )
 
 // Client represents a CloudBridge Relay client
 type Client struct {
+	// conn, reader, writer and compressor are those of the current
+	// connection, guarded by stateMu; MigrateTo swaps them
 	conn   net.Conn
-	reader *bufio.Reader
+	reader *lineReader
 	writer *bufio.Writer
-	useTLS bool
-	config *tls.Config
-	cfg    *config.Config
+	// writeMu serializes the messages written to the connection, so the
+	// lines of concurrent requests do not interleave
+	writeMu sync.Mutex
+	useTLS  bool
+	config  *tls.Config
+	cfg     *config.Config
 
 	missedHeartbeats int32
 	stopHeartbeat    chan struct{}
-	tunnels          map[string]*Tunnel
-	tunnelMutex      sync.RWMutex
+	heartbeatMu      sync.Mutex
+	heartbeatDone    chan struct{}
+	// heartbeatID is the request ID of the heartbeat in flight, guarded
+	// by pendingMu
+	heartbeatID       string
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	// heartbeatStats describes the heartbeats of the current connection,
+	// guarded by stateMu
+	heartbeatStats HeartbeatStats
+	tunnels        map[string]*Tunnel
+	tunnelMutex    sync.RWMutex
+	maxTunnels     int
+	metrics        *metrics.Metrics
+	// destinationPolicy checks remote hosts of new tunnels, guarded by
+	// tunnelMutex
+	destinationPolicy *DestinationPolicy
+	// transport carries the connections of tunnels to the relay, nil
+	// for data connections of its own, guarded by tunnelMutex
+	transport tunnel.TunnelTransport
+	// budget caps the copy buffers of forwarded connections, guarded by
+	// tunnelMutex
+	budget *tunnel.BufferBudget
+	// scheduler shares the uplink between tunnels, guarded by tunnelMutex
+	scheduler *tunnel.FairScheduler
 
 	// New fields for v2.0
 	protocolEngine *protocol.ProtocolEngine
 	tenantID       string
+	labels         map[string]string
+	minVersion     string
 	version        string
 	features       []string
+	pqProposal     *quantum.Proposal
+	// pqRequired fails handshakes with relays that do not negotiate
+	// post-quantum levels instead of falling back to classical crypto
+	pqRequired bool
+	// pqKyber and pqSigner are switched to the negotiated levels
+	pqKyber     *quantum.KyberKeyExchange
+	pqSigner    *quantum.DilithiumSigner
+	compression []string
+	compressor  *flate.Writer
+
+	// Connection state reported by ExportState
+	stateMu         sync.RWMutex
+	host            string
+	port            int
+	serverVersion   string
+	serverFeatures  []string
+	pqSelection     *quantum.Selection
+	compressionAlgo string
+	token           string
+	migration       *MigrationState
+	connState       connState
+	// clientInfo is set by SetClientInfo, helloExtras are the fields of
+	// the server hello the client does not interpret
+	clientInfo  map[string]interface{}
+	helloExtras map[string]interface{}
+
+	ready ReadySignal
+
+	// Request/response routing
+	requestSeq uint64
+	readToken  chan struct{}
+	pendingMu  sync.Mutex
+	pending    map[string]chan map[string]interface{}
+	closing    bool
+	drained    chan struct{}
+
+	// Malformed messages skipped in a row, and how many are tolerated
+	decodeErrors int32
+	decodeLimit  int32
+	// Panics recovered while dispatching messages in a row
+	dispatchPanics int32
+
+	// helloTimeout bounds the wait for the server hello
+	helloTimeout time.Duration
+
+	// timings of the last connection attempt, guarded by stateMu
+	timings HandshakeTimings
+	// handshakeLimiter bounds concurrent handshakes, guarded by stateMu
+	handshakeLimiter *HandshakeLimiter
+	// eventLog records connection events, guarded by stateMu
+	eventLog *ConnectionEventLog
 }
 
 // Tunnel represents a managed tunnel connection
 type Tunnel struct {
-	ID         string
-	LocalPort  int
-	RemoteHost string
-	RemotePort int
-	Protocol   string
-	Options    map[string]interface{}
-	stopChan   chan struct{}
-	proxyCmd   *exec.Cmd
+	ID string
+	// BindAddress is the local address listened on; empty listens on all
+	// interfaces
+	BindAddress string
+	LocalPort   int
+	RemoteHost  string
+	RemotePort  int
+	Protocol    string
+	Options     map[string]interface{}
+	// Weight is the share of the uplink the tunnel gets while others are
+	// sending too; zero is tunnel.DefaultTunnelWeight
+	Weight   int
+	stopChan chan struct{}
+	proxyCmd *exec.Cmd
+
+	forwarder *tunnelForwarder
 }
 
 // NewClient creates a new CloudBridge Relay client
@@ -77,6 +196,8 @@ func NewClient(useTLS bool, tlsConfig *tls.Config) *Client {
 		useTLS:         useTLS,
 		config:         tlsConfig,
 		stopHeartbeat:  make(chan struct{}),
+		readToken:      make(chan struct{}, 1),
+		decodeLimit:    DefaultMaxDecodeErrors,
 		tunnels:        make(map[string]*Tunnel),
 		protocolEngine: protocol.NewProtocolEngine(),
 		version:        protocol.ProtocolVersionV2,
@@ -93,6 +214,8 @@ func NewClientV1(useTLS bool, tlsConfig *tls.Config) *Client {
 		useTLS:         useTLS,
 		config:         tlsConfig,
 		stopHeartbeat:  make(chan struct{}),
+		readToken:      make(chan struct{}, 1),
+		decodeLimit:    DefaultMaxDecodeErrors,
 		tunnels:        make(map[string]*Tunnel),
 		protocolEngine: protocol.NewProtocolEngineV1(),
 		version:        protocol.ProtocolVersionV1,
@@ -108,7 +231,7 @@ func NewClientFromConfig(cfg *config.Config) (*Client, error) {
 	var err error
 
 	if cfg.TLS.Enabled {
-		tlsConfig, err = NewTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+		tlsConfig, err = TLSConfigFromConfig(cfg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create TLS config: %w", err)
 		}
@@ -132,13 +255,66 @@ func NewClientFromConfig(cfg *config.Config) (*Client, error) {
 		config:         tlsConfig,
 		cfg:            cfg,
 		stopHeartbeat:  make(chan struct{}),
+		readToken:      make(chan struct{}, 1),
+		decodeLimit:    DefaultMaxDecodeErrors,
 		tunnels:        make(map[string]*Tunnel),
 		protocolEngine: protocolEngine,
 		version:        version,
 		tenantID:       cfg.Tenant.ID,
+		labels:         cfg.Labels,
+		minVersion:     cfg.Server.MinVersion,
 		features:       protocolEngine.GetFeatures(),
 	}
 
+	if len(cfg.Protocol.Features) > 0 {
+		features, dropped := protocol.DropLegacyFeatures(cfg.Protocol.Features)
+		if len(dropped) > 0 {
+			log.Printf("Ignoring features %v of protocol.features: they are no longer supported", dropped)
+		}
+		if err := protocol.ValidateFeatures(features); err != nil {
+			return nil, fmt.Errorf("invalid protocol features: %w", err)
+		}
+		if len(features) > 0 {
+			client.features = features
+		}
+	}
+
+	client.SetMaxTunnels(cfg.Limits.MaxTunnels)
+	client.SetHandshakeLimiter(NewHandshakeLimiter(cfg.Limits.MaxConcurrentHandshakes))
+	client.SetBufferBudget(BufferBudgetFromConfig(cfg))
+
+	if len(cfg.Tunnel.AllowedDestinations) > 0 || len(cfg.Tunnel.DeniedDestinations) > 0 || cfg.Tunnel.ResolveDestinations {
+		policy, err := NewDestinationPolicy(cfg.Tunnel.AllowedDestinations, cfg.Tunnel.DeniedDestinations, cfg.Tunnel.ResolveDestinations)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel configuration: %w", err)
+		}
+		client.SetDestinationPolicy(policy)
+	}
+
+	if cfg.Quantum.Enabled {
+		proposal, err := quantum.NewProposal(cfg.Quantum.KyberSecurityLevel, cfg.Quantum.DilithiumSecurityLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid post-quantum configuration: %w", err)
+		}
+		client.pqProposal = proposal
+		client.pqRequired = cfg.Quantum.Require
+		client.pqKyber = quantum.NewKyberKeyExchange(&quantum.KyberConfig{
+			SecurityLevel: proposal.KyberLevels[len(proposal.KyberLevels)-1],
+			HybridMode:    cfg.Quantum.HybridMode,
+			KeySize:       32,
+		}, nil)
+		client.pqSigner = quantum.NewDilithiumSigner(&quantum.DilithiumConfig{
+			SecurityLevel: proposal.DilithiumLevels[len(proposal.DilithiumLevels)-1],
+			HybridMode:    cfg.Quantum.HybridMode,
+		}, nil)
+	}
+
+	if cfg.Protocol.Compression != "" && cfg.Protocol.Compression != "none" {
+		if err := client.SetCompression([]string{cfg.Protocol.Compression}); err != nil {
+			return nil, fmt.Errorf("invalid compression configuration: %w", err)
+		}
+	}
+
 	return client, nil
 }
 
@@ -152,6 +328,44 @@ func (c *Client) GetTenantID() string {
 	return c.tenantID
 }
 
+// SetPostQuantumProposal sets the post-quantum security levels offered to
+// the server during the handshake. A nil proposal disables negotiation.
+func (c *Client) SetPostQuantumProposal(proposal *quantum.Proposal) {
+	c.pqProposal = proposal
+}
+
+// SetPostQuantumRequired sets whether handshakes with relays that do not
+// negotiate post-quantum levels fail. Otherwise the client falls back to
+// classical crypto with them.
+func (c *Client) SetPostQuantumRequired(required bool) {
+	c.pqRequired = required
+}
+
+// SetPostQuantumCrypto sets the key exchange and signer switched to the
+// security levels negotiated during the handshake. Either may be nil.
+func (c *Client) SetPostQuantumCrypto(kyber *quantum.KyberKeyExchange, signer *quantum.DilithiumSigner) {
+	c.pqKyber = kyber
+	c.pqSigner = signer
+}
+
+// GetPostQuantumCrypto returns the key exchange and signer set with
+// SetPostQuantumCrypto or created from the config
+func (c *Client) GetPostQuantumCrypto() (*quantum.KyberKeyExchange, *quantum.DilithiumSigner) {
+	return c.pqKyber, c.pqSigner
+}
+
+// GetPostQuantumSelection returns the security levels negotiated with the
+// server, or nil if none were negotiated
+func (c *Client) GetPostQuantumSelection() *quantum.Selection {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	if c.pqSelection == nil {
+		return nil
+	}
+	selection := *c.pqSelection
+	return &selection
+}
+
 // GetVersion returns the protocol version
 func (c *Client) GetVersion() string {
 	return c.version
@@ -162,46 +376,179 @@ func (c *Client) GetFeatures() []string {
 	return c.features
 }
 
-// Connect establishes a connection to the relay server
+// UnixScheme prefixes a relay host that is the path of a Unix domain
+// socket, as in unix:///run/cloudbridge/relay.sock. The port is ignored for
+// such a host, and TLS is not used over the socket: it only reaches the
+// local host and is protected by its file permissions.
+const UnixScheme = "unix://"
+
+// Connect establishes a connection to the relay server. A host starting
+// with UnixScheme connects to a Unix domain socket.
 func (c *Client) Connect(host string, port int) error {
-	var err error
-	var conn net.Conn
-	dialer := &net.Dialer{Timeout: ConnectTimeout}
-	address := fmt.Sprintf("%s:%d", host, port)
+	c.stateMu.Lock()
+	c.timings = HandshakeTimings{}
+	c.stateMu.Unlock()
 
-	if c.useTLS {
-		conn, err = tls.DialWithDialer(dialer, "tcp", address, c.config)
-	} else {
-		conn, err = dialer.Dial("tcp", address)
+	c.recordEvent(ConnectionEvent{Type: ConnectionEventConnectAttempt}, host, port)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+	release, err := c.acquireHandshake(ctx)
+	cancel()
+	if err != nil {
+		err = fmt.Errorf("failed to connect to relay: %w", err)
+		c.recordEvent(ConnectionEvent{
+			Type: ConnectionEventConnectFailed, DurationMs: milliseconds(time.Since(start)), Error: err.Error(),
+		}, host, port)
+		return err
+	}
+	conn, timings, err := c.dialTimed(host, port)
+	release()
+	if timings.Connect > 0 {
+		c.recordPhase(PhaseConnect, timings.Connect)
+	}
+	if timings.TLSHandshake > 0 {
+		c.recordPhase(PhaseTLSHandshake, timings.TLSHandshake)
 	}
-
 	if err != nil {
-		return fmt.Errorf("failed to connect to relay: %w", err)
+		c.recordEvent(ConnectionEvent{
+			Type: ConnectionEventConnectFailed, DurationMs: milliseconds(time.Since(start)), Error: err.Error(),
+		}, host, port)
+		return err
 	}
 
+	c.ready.Set(false)
+
+	c.pendingMu.Lock()
+	c.closing = false
+	c.pendingMu.Unlock()
+
+	c.stateMu.Lock()
 	c.conn = conn
-	c.reader = bufio.NewReaderSize(conn, MaxMessageSize)
+	c.reader = newLineReader(conn, bufio.NewReaderSize(conn, MaxMessageSize))
 	c.writer = bufio.NewWriter(conn)
+	c.compressor = nil
+	c.host = host
+	c.port = port
+	c.serverVersion = ""
+	c.serverFeatures = nil
+	c.helloExtras = nil
+	c.pqSelection = nil
+	c.compressionAlgo = ""
+	c.connDoneLocked()
+	c.connState.since = time.Now()
+	c.stateMu.Unlock()
+
+	c.recordEvent(ConnectionEvent{
+		Type: ConnectionEventConnected, DurationMs: milliseconds(time.Since(start)),
+	}, host, port)
 	return nil
 }
 
-// Close closes the connection to the relay server
+// ConnectUnix connects to a relay listening on the Unix domain socket at
+// path
+func (c *Client) ConnectUnix(path string) error {
+	return c.Connect(UnixScheme+path, 0)
+}
+
+// dial opens a connection to the relay, using TLS if enabled
+func (c *Client) dial(host string, port int) (net.Conn, error) {
+	conn, _, err := c.dialTimed(host, port)
+	return conn, err
+}
+
+// dialTimed is dial, also reporting how long the TCP connect and the TLS
+// handshake took. Like tls.DialWithDialer, both together are bounded by
+// ConnectTimeout.
+func (c *Client) dialTimed(host string, port int) (net.Conn, HandshakeTimings, error) {
+	var timings HandshakeTimings
+	dialer := &net.Dialer{Timeout: ConnectTimeout}
+	network, address := "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+	socketPath, local := strings.CutPrefix(host, UnixScheme)
+	if local {
+		network, address = "unix", socketPath
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, timings, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	timings.Connect = time.Since(start)
+	if !c.useTLS || local {
+		return conn, timings, nil
+	}
+
+	config := c.config
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(ConnectTimeout))
+	defer cancel()
+	tlsStart := time.Now()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		err = classifyTLSError(err)
+		var tlsErr *TLSError
+		if m := c.clientMetrics(); m != nil && errors.As(err, &tlsErr) {
+			m.IncTLSErrors(string(tlsErr.Reason))
+		}
+		return nil, timings, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	timings.TLSHandshake = time.Since(tlsStart)
+	return tlsConn, timings, nil
+}
+
+// Close stops all tunnels and closes the connection to the relay server
 func (c *Client) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+	c.ready.Set(false)
+	c.connectionLost(nil)
+	c.stopHeartbeats()
+	c.stopTunnels()
+	// The connection may already be closed by Shutdown
+	if err := c.closeConn(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
 	}
 	return nil
 }
 
+// closeConn closes the current connection to the relay, if any. The
+// connection is read under stateMu, since MigrateTo swaps it.
+func (c *Client) closeConn() error {
+	c.stateMu.RLock()
+	conn := c.conn
+	c.stateMu.RUnlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
 // SendMessage отправляет JSON-сообщение с \n
 func (c *Client) SendMessage(msg interface{}) error {
-	if c.conn == nil {
+	return c.sendMessageUntil(msg, time.Now().Add(ReadWriteTimeout))
+}
+
+// sendMessageUntil sends one message with the given write deadline
+func (c *Client) sendMessageUntil(msg interface{}, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.sendMessageLocked(msg, deadline)
+}
+
+// sendMessageLocked implements sendMessageUntil. c.writeMu must be held.
+func (c *Client) sendMessageLocked(msg interface{}, deadline time.Time) error {
+	c.stateMu.RLock()
+	conn, writer, compressor := c.conn, c.writer, c.compressor
+	c.stateMu.RUnlock()
+	if conn == nil {
 		return fmt.Errorf("not connected to server")
 	}
 
-	if err := c.conn.SetWriteDeadline(time.Now().Add(ReadWriteTimeout)); err != nil {
-		return fmt.Errorf("failed to set write deadline: %w", err)
-	}
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -209,77 +556,231 @@ func (c *Client) SendMessage(msg interface{}) error {
 	if len(data) > MaxMessageSize {
 		return fmt.Errorf("message too large")
 	}
-	if _, err := c.writer.Write(append(data, '\n')); err != nil {
-		return err
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	_, err = writer.Write(append(data, '\n'))
+	if err == nil {
+		err = flush(writer, compressor)
+	}
+	if err != nil {
+		// Unlike a read, a write cut short by a timeout loses the
+		// connection too: part of the message may be on the wire, and
+		// the buffered writer fails every later write
+		c.connectionLost(err)
 	}
-	return c.writer.Flush()
+	return err
 }
 
 // ReadMessage читает строку, парсит JSON, ограничивает размер
 func (c *Client) ReadMessage() (map[string]interface{}, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(ReadWriteTimeout)); err != nil {
+	return c.readMessageUntil(time.Now().Add(ReadWriteTimeout))
+}
+
+// readMessageUntil reads one message with the given read deadline. Malformed
+// messages are skipped up to the decode error limit.
+func (c *Client) readMessageUntil(deadline time.Time) (map[string]interface{}, error) {
+	reader := c.connReader()
+	if reader == nil {
+		return nil, fmt.Errorf("not connected to server")
+	}
+	if err := reader.conn.SetReadDeadline(deadline); err != nil {
 		return nil, fmt.Errorf("failed to set read deadline: %w", err)
 	}
-	line, err := c.reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			c.checkConnError(err)
+			return nil, err
+		}
+		msg, err := c.decodeLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
 	}
+}
+
+// decodeLine parses one message line. It returns a nil message for a
+// malformed line that is skipped.
+func (c *Client) decodeLine(line string) (map[string]interface{}, error) {
 	if len(line) > MaxMessageSize {
 		return nil, fmt.Errorf("message too large")
 	}
-	line = strings.TrimSpace(line)
+	data := []byte(strings.TrimSpace(line))
 	var msg map[string]interface{}
-	if err := json.Unmarshal([]byte(line), &msg); err != nil {
-		return nil, err
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, c.handleDecodeError(data, err)
 	}
+	atomic.StoreInt32(&c.decodeErrors, 0)
 	return msg, nil
 }
 
+// SetMinVersion sets the oldest relay version the handshake accepts. An
+// empty version accepts any relay.
+func (c *Client) SetMinVersion(version string) error {
+	if version != "" {
+		if _, err := protocol.CompareVersions(version, version); err != nil {
+			return err
+		}
+	}
+	c.minVersion = version
+	return nil
+}
+
+// checkServerVersion rejects a relay whose hello reports a version below
+// the minimum. A relay reporting no valid version is rejected as well.
+func (c *Client) checkServerVersion(hello map[string]interface{}) error {
+	if c.minVersion == "" {
+		return nil
+	}
+	version, _ := hello["version"].(string)
+	cmp, err := protocol.CompareVersions(version, c.minVersion)
+	if err != nil {
+		return fmt.Errorf("%w: relay reports invalid version %q, need %s", ErrServerTooOld, version, c.minVersion)
+	}
+	if cmp < 0 {
+		return fmt.Errorf("%w: relay version %s is below %s", ErrServerTooOld, version, c.minVersion)
+	}
+	return nil
+}
+
+// SetHelloTimeout sets how long the handshake waits for the server hello.
+// A value of zero or less restores HelloTimeout.
+func (c *Client) SetHelloTimeout(timeout time.Duration) {
+	c.helloTimeout = timeout
+}
+
 // Handshake: ждет hello, отправляет auth, ждет auth_response
 func (c *Client) Handshake(token string) error {
+	return c.HandshakeContext(context.Background(), token)
+}
+
+// HandshakeContext performs the handshake like Handshake, but bounds the
+// whole hello, auth and auth_response exchange by the deadline of ctx instead
+// of giving every read and write its own ReadWriteTimeout
+func (c *Client) HandshakeContext(ctx context.Context, token string) error {
+	release, err := c.acquireHandshake(ctx)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = c.handshake(ctx, token)
+	release()
+	c.stateMu.RLock()
+	host, port := c.host, c.port
+	c.stateMu.RUnlock()
+	c.recordEvent(ConnectionEvent{
+		Type: ConnectionEventHandshake, DurationMs: milliseconds(time.Since(start)), Error: errorString(err),
+	}, host, port)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+		if deadlinePassed(ctx, err) {
+			return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+		}
+		return err
+	}
+
+	// Kept to authenticate with another relay when this one drains
+	c.stateMu.Lock()
+	c.token = token
+	c.stateMu.Unlock()
+	return nil
+}
+
+func (c *Client) handshake(ctx context.Context, token string) error {
 	// 0. Сначала отправляем hello
 	var helloMsg interface{}
 	if c.version == protocol.ProtocolVersionV2 {
-		helloMsg = protocol.NewHelloMessage()
+		hello := protocol.NewHelloMessage()
+		hello.Features = c.features
+		hello.PostQuantum = c.pqProposal
+		hello.Compression = c.compression
+		helloMsg = hello
 	} else {
-		helloMsg = protocol.NewHelloMessageV1()
+		hello := protocol.NewHelloMessageV1()
+		hello.Features = c.features
+		helloMsg = hello
 	}
-	if err := c.SendMessage(helloMsg); err != nil {
+	helloStart := time.Now()
+	if err := c.sendMessageContext(ctx, helloMsg); err != nil {
 		return fmt.Errorf("failed to send hello: %w", err)
 	}
 
 	// 1. Ждем hello-ответ от сервера
-	hello, err := c.ReadMessage()
+	helloTimeout := c.helloTimeout
+	if helloTimeout <= 0 {
+		helloTimeout = HelloTimeout
+	}
+	helloCtx, cancel := context.WithTimeout(ctx, helloTimeout)
+	hello, err := c.readMessageContext(helloCtx)
+	helloExpired := helloCtx.Err() == context.DeadlineExceeded || deadlinePassed(helloCtx, err)
+	cancel()
 	if err != nil {
+		// Expiry of ctx itself is reported by HandshakeContext
+		if helloExpired && ctx.Err() == nil && !deadlinePassed(ctx, err) {
+			return fmt.Errorf("%w within %v", ErrNoServerHello, helloTimeout)
+		}
 		return fmt.Errorf("failed to read hello: %w", err)
 	}
 
 	if hello["type"] != MessageTypeHello {
 		return fmt.Errorf("expected hello message, got: %s", hello["type"])
 	}
+	c.recordPhase(PhaseHelloExchange, time.Since(helloStart))
+	c.recordServerHello(hello)
+	if err := c.checkServerVersion(hello); err != nil {
+		return err
+	}
+
+	if c.pqProposal != nil {
+		if err := c.negotiatePostQuantum(hello); err != nil {
+			return err
+		}
+	}
+
+	if len(c.compression) > 0 {
+		if err := c.negotiateCompression(hello); err != nil {
+			return fmt.Errorf("compression negotiation failed: %w", err)
+		}
+	}
 
 	// 2. Отправляем auth based on version
-	var authMsg interface{}
+	var authMsg *protocol.AuthMessage
 	if c.version == protocol.ProtocolVersionV2 {
 		authMsg = protocol.NewAuthMessage(token, c.tenantID)
+		builtin := map[string]interface{}{}
+		if len(c.labels) > 0 {
+			builtin["labels"] = c.labels
+		}
+		authMsg.ClientInfo = c.authClientInfo(builtin)
 	} else {
 		// v1.0.0 backward compatibility
 		clientInfo := map[string]interface{}{
 			"os":   runtime.GOOS,
 			"arch": runtime.GOARCH,
 		}
-		authMsg = protocol.NewAuthMessageV1(token, clientInfo)
+		if len(c.labels) > 0 {
+			clientInfo["labels"] = c.labels
+		}
+		authMsg = protocol.NewAuthMessageV1(token, c.authClientInfo(clientInfo))
 	}
 
-	if err := c.SendMessage(authMsg); err != nil {
+	authStart := time.Now()
+	if err := c.sendMessageContext(ctx, authMsg); err != nil {
 		return fmt.Errorf("failed to send auth: %w", err)
 	}
 
 	// 3. Ждем auth_response
-	authResp, err := c.ReadMessage()
+	authResp, err := c.readMessageContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to read auth response: %w", err)
 	}
+	c.recordPhase(PhaseAuth, time.Since(authStart))
 
 	if authResp["type"] != MessageTypeAuthResponse {
 		return fmt.Errorf("expected auth_response message, got: %s", authResp["type"])
@@ -293,134 +794,369 @@ func (c *Client) Handshake(token string) error {
 		return fmt.Errorf("authentication failed: %s", errorMsg)
 	}
 
+	c.ready.Set(true)
+	return nil
+}
+
+// negotiatePostQuantum validates the post-quantum levels selected by the
+// server against the client's proposal and switches the key exchange and
+// signer to them. A relay without a post_quantum field predates post-quantum
+// negotiation; the client stays with classical crypto with it unless
+// post-quantum is required. A null field means no level is shared.
+func (c *Client) negotiatePostQuantum(hello map[string]interface{}) error {
+	raw, ok := hello["post_quantum"]
+	if ok && raw == nil {
+		return fmt.Errorf("post-quantum negotiation failed: %w: server did not select any level", quantum.ErrNoCommonLevel)
+	}
+	if !ok {
+		if c.pqRequired {
+			return fmt.Errorf("post-quantum negotiation failed: %w: server did not select any level", quantum.ErrNoCommonLevel)
+		}
+		log.Printf("Relay does not negotiate post-quantum levels, using classical crypto")
+		c.stateMu.Lock()
+		c.pqSelection = nil
+		c.stateMu.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("post-quantum negotiation failed: %w", err)
+	}
+	var selection quantum.Selection
+	if err := json.Unmarshal(data, &selection); err != nil {
+		return fmt.Errorf("post-quantum negotiation failed: invalid selection: %w", err)
+	}
+	if err := c.pqProposal.Validate(selection); err != nil {
+		return fmt.Errorf("post-quantum negotiation failed: %w", err)
+	}
+	if c.pqKyber != nil {
+		if err := c.pqKyber.SetSecurityLevel(selection.KyberLevel); err != nil {
+			return fmt.Errorf("post-quantum negotiation failed: kyber: %w", err)
+		}
+	}
+	if c.pqSigner != nil {
+		if err := c.pqSigner.SetSecurityLevel(selection.DilithiumLevel); err != nil {
+			return fmt.Errorf("post-quantum negotiation failed: dilithium: %w", err)
+		}
+	}
+
+	c.stateMu.Lock()
+	c.pqSelection = &selection
+	c.stateMu.Unlock()
 	return nil
 }
 
-// CreateTunnel creates a new tunnel
+// CreateTunnel creates a new tunnel, waiting at most TunnelCreateTimeout for
+// the relay
 func (c *Client) CreateTunnel(localPort int, remoteHost string, remotePort int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TunnelCreateTimeout)
+	defer cancel()
+	return c.CreateTunnelContext(ctx, localPort, remoteHost, remotePort)
+}
+
+// CreateTunnelContext creates a new tunnel. It listens on localPort and
+// forwards every accepted connection to the relay until the tunnel or the
+// client is closed. The tunnel is registered with a tunnel_info message and
+// named by the tunnel_id of the relay's tunnel_response. An error wrapping
+// ErrRequestTimeout is returned if the relay does not answer before ctx is
+// done. Creating a tunnel that already exists returns its ID.
+func (c *Client) CreateTunnelContext(ctx context.Context, localPort int, remoteHost string, remotePort int) (string, error) {
+	return c.CreateBoundTunnel(ctx, "", localPort, remoteHost, remotePort)
+}
+
+// CreateBoundTunnel is like CreateTunnelContext but listens on bindAddress
+// only, e.g. "127.0.0.1" to keep the tunnel off other interfaces. A
+// localPort of zero listens on a free port, which ListTunnels reports.
+func (c *Client) CreateBoundTunnel(ctx context.Context, bindAddress string, localPort int, remoteHost string, remotePort int) (string, error) {
 	// Validate ports
-	if localPort < 1 || localPort > 65535 {
-		return "", fmt.Errorf("invalid local port: %d (must be between 1 and 65535)", localPort)
+	if localPort < 0 || localPort > 65535 {
+		return "", fmt.Errorf("invalid local port: %d (must be between 1 and 65535, or 0 for a free port)", localPort)
 	}
 	if remotePort < 1 || remotePort > 65535 {
 		return "", fmt.Errorf("invalid remote port: %d (must be between 1 and 65535)", remotePort)
 	}
+	if err := c.checkDestination(ctx, remoteHost); err != nil {
+		return "", err
+	}
 
 	// Check if connected
 	if !c.IsConnected() {
 		return "", fmt.Errorf("not connected to server")
 	}
+	// The relay would not route tunnels of an unauthenticated connection.
+	// Shutdown also ends the authentication, but is reported as such.
+	if c.shuttingDown() {
+		return "", ErrShuttingDown
+	}
+	if !c.IsReady() {
+		return "", ErrNotAuthenticated
+	}
 
-	tunnelID := fmt.Sprintf("tunnel_%d_%s_%d", localPort, remoteHost, remotePort)
+	// Check the limit before asking the relay, so a flood of requests
+	// does not reach it
+	c.tunnelMutex.RLock()
+	existing := c.findTunnelLocked(bindAddress, localPort, remoteHost, remotePort)
+	err := c.checkTunnelLimit("")
+	c.tunnelMutex.RUnlock()
+	if existing != "" {
+		return existing, nil
+	}
+	if err != nil {
+		return "", err
+	}
 
 	tunnel := &Tunnel{
-		ID:         tunnelID,
-		LocalPort:  localPort,
-		RemoteHost: remoteHost,
-		RemotePort: remotePort,
-		Protocol:   "tcp",
-		Options:    make(map[string]interface{}),
-		stopChan:   make(chan struct{}),
+		BindAddress: bindAddress,
+		LocalPort:   localPort,
+		RemoteHost:  remoteHost,
+		RemotePort:  remotePort,
+		Protocol:    "tcp",
+		Options:     make(map[string]interface{}),
+		stopChan:    make(chan struct{}),
+	}
+	if err := c.listenTunnel(tunnel); err != nil {
+		return "", fmt.Errorf("failed to create tunnel: %w", err)
+	}
+
+	if err := c.registerTunnel(ctx, tunnel); err != nil {
+		tunnel.stop()
+		return "", fmt.Errorf("failed to create tunnel: %w", err)
 	}
 
+	// From here on the relay knows the tunnel and has to be told if it is
+	// dropped
 	c.tunnelMutex.Lock()
-	c.tunnels[tunnelID] = tunnel
+	if _, exists := c.tunnels[tunnel.ID]; exists {
+		c.tunnelMutex.Unlock()
+		c.dropRegisteredTunnel(tunnel)
+		return "", fmt.Errorf("failed to create tunnel: relay assigned tunnel ID %s twice", tunnel.ID)
+	}
+	// Concurrent creations may have used up the limit in the meantime
+	if err := c.checkTunnelLimit(tunnel.ID); err != nil {
+		c.tunnelMutex.Unlock()
+		c.dropRegisteredTunnel(tunnel)
+		return "", err
+	}
+	c.tunnels[tunnel.ID] = tunnel
+	count := len(c.tunnels)
+	c.scheduleTunnelLocked(c.scheduler, tunnel)
+	// Started under the lock, so a concurrent CloseTunnel waits for it
+	c.startForwarding(tunnel)
 	c.tunnelMutex.Unlock()
 
-	return tunnelID, nil
+	SetActiveTunnels(count)
+	return tunnel.ID, nil
 }
 
-// NewTLSConfig creates a new TLS configuration
-func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
-	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		// InsecureSkipVerify: false, // Always verify certificates in production
+// dropRegisteredTunnel stops a tunnel that could not be added after the
+// relay registered it, and unregisters it from the relay
+func (c *Client) dropRegisteredTunnel(t *Tunnel) {
+	t.stop()
+	if err := c.unregisterTunnel(t); err != nil {
+		log.Printf("Failed to unregister tunnel %s from the relay: %v", t.ID, err)
 	}
+}
 
-	// Load CA certificate if provided
-	if caFile != "" {
-		// Validate CA file path to prevent directory traversal
-		cleanCAFile := filepath.Clean(caFile)
-		if !filepath.IsAbs(cleanCAFile) || strings.Contains(cleanCAFile, "..") {
-			return nil, fmt.Errorf("invalid CA file path: %s", caFile)
-		}
+// unregisterTunnel tells the relay that t is closed. Nothing is sent once
+// the connection is no longer authenticated, since the relay drops the
+// tunnels of a lost connection itself.
+func (c *Client) unregisterTunnel(t *Tunnel) error {
+	if !c.IsReady() {
+		return nil
+	}
+	msg := map[string]interface{}{
+		"type":      MessageTypeCloseTunnel,
+		"tunnel_id": t.ID,
+	}
+	if c.tenantID != "" {
+		msg["tenant_id"] = c.tenantID
+	}
+	return c.SendMessage(msg)
+}
 
-		// Additional security check - ensure CA file is within allowed directories
-		allowedDirs := []string{"/etc/cloudbridge-client/certs", "/etc/ssl/certs", "/usr/local/share/ca-certificates"}
-		allowed := false
-		for _, dir := range allowedDirs {
-			if strings.HasPrefix(cleanCAFile, dir) {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return nil, fmt.Errorf("CA file path not in allowed directories: %s", caFile)
-		}
+// registerTunnel announces t to the relay with a tunnel_info message and
+// adopts the tunnel ID assigned in the tunnel_response. A tunnel that has an
+// ID asks for it and keeps it if the relay assigns none; a new tunnel then
+// gets an ID derived from its endpoints.
+func (c *Client) registerTunnel(ctx context.Context, t *Tunnel) error {
+	msg := map[string]interface{}{
+		"type":        MessageTypeTunnelInfo,
+		"local_port":  t.LocalPort,
+		"remote_host": t.RemoteHost,
+		"remote_port": t.RemotePort,
+		"protocol":    t.Protocol,
+	}
+	if t.ID != "" {
+		msg["tunnel_id"] = t.ID
+	}
+	if c.tenantID != "" {
+		msg["tenant_id"] = c.tenantID
+	}
 
-		caCert, err := os.ReadFile(cleanCAFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read CA cert: %w", err)
+	resp, err := c.roundTrip(ctx, msg)
+	if err != nil {
+		if errors.Is(err, ErrRequestTimeout) {
+			RecordTunnelCreateTimeout()
 		}
+		return err
+	}
 
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to append CA cert")
+	switch {
+	case resp["type"] == MessageTypeError:
+		return fmt.Errorf("relay rejected tunnel: %v", resp["message"])
+	case resp["type"] != MessageTypeTunnelResponse:
+		return fmt.Errorf("unexpected message type %v instead of tunnel_response", resp["type"])
+	case resp["status"] != nil && resp["status"] != "success":
+		if msg, ok := resp["message"].(string); ok {
+			return fmt.Errorf("relay rejected tunnel: %s", msg)
 		}
+		return fmt.Errorf("relay rejected tunnel: %v", resp["status"])
+	}
 
-		config.RootCAs = caCertPool
+	if id, ok := resp["tunnel_id"].(string); ok && id != "" {
+		t.ID = id
+	} else if t.ID == "" {
+		t.ID = tunnelKey(t.BindAddress, t.LocalPort, t.RemoteHost, t.RemotePort)
 	}
+	return nil
+}
 
-	// Load client certificate and key if provided
-	if certFile != "" && keyFile != "" {
-		// Validate certificate file paths to prevent directory traversal
-		cleanCertFile := filepath.Clean(certFile)
-		cleanKeyFile := filepath.Clean(keyFile)
+// tunnelKey names a tunnel by its endpoints. The bind address is left out
+// when empty, so tunnels listening on every interface keep their names.
+func tunnelKey(bindAddress string, localPort int, remoteHost string, remotePort int) string {
+	if bindAddress == "" {
+		return fmt.Sprintf("tunnel_%d_%s_%d", localPort, remoteHost, remotePort)
+	}
+	return fmt.Sprintf("tunnel_%s_%d_%s_%d", bindAddress, localPort, remoteHost, remotePort)
+}
 
-		if !filepath.IsAbs(cleanCertFile) || strings.Contains(cleanCertFile, "..") {
-			return nil, fmt.Errorf("invalid cert file path: %s", certFile)
-		}
-		if !filepath.IsAbs(cleanKeyFile) || strings.Contains(cleanKeyFile, "..") {
-			return nil, fmt.Errorf("invalid key file path: %s", keyFile)
+// findTunnelLocked returns the ID of the tunnel with the given endpoints, or
+// an empty string. The caller must hold tunnelMutex.
+func (c *Client) findTunnelLocked(bindAddress string, localPort int, remoteHost string, remotePort int) string {
+	for id, t := range c.tunnels {
+		if t.BindAddress == bindAddress && t.LocalPort == localPort && t.RemoteHost == remoteHost && t.RemotePort == remotePort {
+			return id
 		}
+	}
+	return ""
+}
 
-		// Additional security check - ensure certificate files are within allowed directories
-		allowedDirs := []string{"/etc/cloudbridge-client/certs", "/etc/ssl/private", "/usr/local/etc/ssl"}
-		certAllowed := false
-		keyAllowed := false
-		for _, dir := range allowedDirs {
-			if strings.HasPrefix(cleanCertFile, dir) {
-				certAllowed = true
-			}
-			if strings.HasPrefix(cleanKeyFile, dir) {
-				keyAllowed = true
-			}
-		}
-		if !certAllowed {
-			return nil, fmt.Errorf("cert file path not in allowed directories: %s", certFile)
-		}
-		if !keyAllowed {
-			return nil, fmt.Errorf("key file path not in allowed directories: %s", keyFile)
-		}
+// ListTunnels returns copies of the client's tunnels, sorted by ID
+func (c *Client) ListTunnels() []*Tunnel {
+	c.tunnelMutex.RLock()
+	defer c.tunnelMutex.RUnlock()
 
-		cert, err := tls.LoadX509KeyPair(cleanCertFile, cleanKeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load client cert: %w", err)
+	tunnels := make([]*Tunnel, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		options := make(map[string]interface{}, len(t.Options))
+		for k, v := range t.Options {
+			options[k] = v
 		}
+		tunnels = append(tunnels, &Tunnel{
+			ID:          t.ID,
+			BindAddress: t.BindAddress,
+			LocalPort:   t.LocalPort,
+			RemoteHost:  t.RemoteHost,
+			RemotePort:  t.RemotePort,
+			Weight:      t.Weight,
+			Protocol:    t.Protocol,
+			Options:     options,
+		})
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ID < tunnels[j].ID
+	})
+	return tunnels
+}
+
+// CloseTunnel stops a tunnel, releasing its local port, and removes it
+func (c *Client) CloseTunnel(tunnelID string) error {
+	c.tunnelMutex.Lock()
+	t, exists := c.tunnels[tunnelID]
+	if !exists {
+		c.tunnelMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelID)
+	}
+	delete(c.tunnels, tunnelID)
+	count := len(c.tunnels)
+	m := c.metrics
+	if c.scheduler != nil {
+		c.scheduler.RemoveTunnel(tunnelID)
+	}
+	c.tunnelMutex.Unlock()
+
+	t.stop()
+	if err := c.unregisterTunnel(t); err != nil {
+		log.Printf("Failed to unregister tunnel %s from the relay: %v", tunnelID, err)
+	}
+	if m != nil {
+		m.IncTunnelClosures()
+	}
+	SetActiveTunnels(count)
+	return nil
+}
+
+// stopTunnels closes every tunnel
+func (c *Client) stopTunnels() {
+	c.tunnelMutex.RLock()
+	ids := make([]string, 0, len(c.tunnels))
+	for id := range c.tunnels {
+		ids = append(ids, id)
+	}
+	c.tunnelMutex.RUnlock()
 
-		config.Certificates = []tls.Certificate{cert}
+	for _, id := range ids {
+		// A tunnel closed concurrently is already gone
+		_ = c.CloseTunnel(id)
 	}
+}
 
-	// For development/testing only - disable certificate verification
-	// TODO: Remove this in production
-	if os.Getenv("CLOUDBRIDGE_DEV_MODE") == "true" {
-		config.InsecureSkipVerify = true
+// SetMaxTunnels sets the maximum number of tunnels the client holds at once.
+// A value of zero or less disables the limit. Existing tunnels are kept.
+func (c *Client) SetMaxTunnels(max int) {
+	if max < 0 {
+		max = 0
 	}
+	c.tunnelMutex.Lock()
+	c.maxTunnels = max
+	c.tunnelMutex.Unlock()
+	SetMaxTunnels(max)
+}
+
+// checkTunnelLimit returns ErrTunnelLimitReached if adding tunnelID would
+// exceed the limit. Replacing a tunnel with the same ID is always allowed.
+// c.tunnelMutex must be held.
+func (c *Client) checkTunnelLimit(tunnelID string) error {
+	if c.maxTunnels <= 0 {
+		return nil
+	}
+	if _, exists := c.tunnels[tunnelID]; exists {
+		return nil
+	}
+	if len(c.tunnels) >= c.maxTunnels {
+		return fmt.Errorf("%w: %d tunnels", ErrTunnelLimitReached, c.maxTunnels)
+	}
+	return nil
+}
 
-	return config, nil
+// TLSConfigFromConfig creates the TLS configuration described by cfg,
+// including the ALPN protocols offered to the relay
+func TLSConfigFromConfig(cfg *config.Config) (*tls.Config, error) {
+	return NewTLSConfigWithOptions(TLSOptions{
+		CertFile:        cfg.TLS.CertFile,
+		KeyFile:         cfg.TLS.KeyFile,
+		CAFile:          cfg.TLS.CAFile,
+		AppendSystemCAs: cfg.TLS.AppendSystemCAs,
+		AllowedDirs:     cfg.TLS.AllowedDirs,
+		RequireOCSP:     cfg.TLS.RequireOCSP,
+		ALPN:            cfg.TLS.ALPN,
+	})
 }
 
 // IsConnected returns true if the client is connected
 func (c *Client) IsConnected() bool {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
 	return c.conn != nil
 }
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+)
+
+// supportedCompression lists the connection-level compression algorithms
+// this client implements
+var supportedCompression = []string{protocol.CompressionDeflate}
+
+// SetCompression sets the connection-level compression algorithms offered
+// to the server during the handshake. An empty list disables compression.
+func (c *Client) SetCompression(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if !containsString(supportedCompression, algorithm) {
+			return fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+		}
+	}
+	c.compression = append([]string(nil), algorithms...)
+	return nil
+}
+
+// GetCompression returns the compression algorithm negotiated with the
+// server, or an empty string if the connection is not compressed
+func (c *Client) GetCompression() string {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.compressionAlgo
+}
+
+// negotiateCompression reads the algorithm picked by the server from its
+// hello and, if there is one, switches the connection to compressed
+// framing. Both sides switch right after exchanging hello messages.
+func (c *Client) negotiateCompression(hello map[string]interface{}) error {
+	algorithm, _ := hello["compression"].(string)
+	if algorithm == "" || algorithm == "none" {
+		return nil
+	}
+	if !containsString(c.compression, algorithm) {
+		return fmt.Errorf("server selected compression %q that was not offered", algorithm)
+	}
+
+	compressor, err := flate.NewWriter(c.conn, flate.DefaultCompression)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+	// The inflated stream continues the existing buffered reader, so
+	// compressed bytes that arrived together with the server hello are not
+	// lost
+	inflated, err := inflate(c.conn, c.reader.r)
+	if err != nil {
+		return err
+	}
+	c.stateMu.Lock()
+	c.compressor = compressor
+	c.writer = bufio.NewWriter(compressor)
+	c.reader = newLineReader(inflated, bufio.NewReaderSize(inflated, MaxMessageSize))
+	c.compressionAlgo = algorithm
+	c.stateMu.Unlock()
+	return nil
+}
+
+// flush writes the data buffered in writer to the connection. With
+// compression each message is sync-flushed so the peer can decode it
+// without waiting for more data.
+func flush(writer *bufio.Writer, compressor *flate.Writer) error {
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Flush()
+	}
+	return nil
+}
+
+// inflate returns the decompressed stream of conn, whose compressed bytes
+// are read from r. compress/flate fails every read after the first error,
+// so a read timeout would end the stream for good: instead a goroutine
+// inflates without a read deadline, and hands the result over on a pipe
+// that read deadlines are set on and that survives a timeout. The pipe
+// ends when conn is closed or fails.
+func inflate(conn net.Conn, r io.Reader) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("failed to clear read deadline: %w", err)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		io.Copy(remote, flate.NewReader(r))
+	}()
+	return local, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
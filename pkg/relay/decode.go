@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// DefaultMaxDecodeErrors is the number of consecutive malformed messages
+// tolerated before the connection is considered corrupt
+const DefaultMaxDecodeErrors = 3
+
+// decodePreviewBytes bounds the part of a malformed message that is logged
+const decodePreviewBytes = 32
+
+// ErrConnectionCorrupt is returned when the relay sent more consecutive
+// malformed messages than tolerated, or handling more consecutive messages
+// panicked. The connection is closed.
+var ErrConnectionCorrupt = errors.New("relay connection corrupt")
+
+// SetMaxDecodeErrors sets how many consecutive malformed messages, and how
+// many consecutive panics handling messages, are skipped before the
+// connection is reset. Zero or less fails on the first.
+func (c *Client) SetMaxDecodeErrors(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&c.decodeLimit, int32(n))
+}
+
+// handleDecodeError records a message that could not be decoded. It returns
+// nil while the message can be skipped and an ErrConnectionCorrupt error
+// once the limit is exceeded, after closing the connection.
+func (c *Client) handleDecodeError(line []byte, err error) error {
+	messageDecodeErrors.Inc()
+	count := atomic.AddInt32(&c.decodeErrors, 1)
+	log.Printf("Failed to decode relay message (%d bytes, %s): %v", len(line), hexPreview(line), err)
+
+	if count <= atomic.LoadInt32(&c.decodeLimit) {
+		return nil
+	}
+
+	atomic.StoreInt32(&c.decodeErrors, 0)
+	c.ready.Set(false)
+	c.closeConn()
+	return fmt.Errorf("%w: %d consecutive malformed messages: %v", ErrConnectionCorrupt, count, err)
+}
+
+// handleDispatchPanic records a panic recovered while dispatching msg. Like
+// malformed messages, panics in a row are skipped up to the decode error
+// limit; beyond it the stream is taken to be corrupt, and an
+// ErrConnectionCorrupt error is returned after closing the connection.
+func (c *Client) handleDispatchPanic(msg map[string]interface{}, r interface{}) error {
+	messageHandlerPanics.Inc()
+	count := atomic.AddInt32(&c.dispatchPanics, 1)
+	log.Printf("Recovered from panic handling relay message of type %v: %v\n%s", msg["type"], r, debug.Stack())
+
+	if count <= atomic.LoadInt32(&c.decodeLimit) {
+		return nil
+	}
+
+	atomic.StoreInt32(&c.dispatchPanics, 0)
+	c.ready.Set(false)
+	c.closeConn()
+	return fmt.Errorf("%w: %d consecutive panics handling messages: %v", ErrConnectionCorrupt, count, r)
+}
+
+// hexPreview returns the hex encoding of the start of data
+func hexPreview(data []byte) string {
+	if len(data) <= decodePreviewBytes {
+		return hex.EncodeToString(data)
+	}
+	return hex.EncodeToString(data[:decodePreviewBytes]) + "..."
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadMessageSkipsMalformedMessages(t *testing.T) {
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		w.Write([]byte("not json\n{\"type\":\n"))
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeHeartbeat})
+		w.Write([]byte("garbage 1\ngarbage 2\ngarbage 3\n"))
+		r.ReadByte()
+	})
+
+	client := NewClient(false, nil)
+	client.SetMaxDecodeErrors(2)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	before := testutil.ToFloat64(messageDecodeErrors)
+
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected malformed messages to be skipped, got %v", err)
+	}
+	if msg["type"] != MessageTypeHeartbeat {
+		t.Errorf("expected heartbeat, got %v", msg["type"])
+	}
+
+	if _, err := client.ReadMessage(); !errors.Is(err, ErrConnectionCorrupt) {
+		t.Fatalf("expected corrupt connection error, got %v", err)
+	}
+	if got := testutil.ToFloat64(messageDecodeErrors) - before; got != 5 {
+		t.Errorf("expected 5 decode errors counted, got %v", got)
+	}
+	if err := client.SendMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err == nil {
+		t.Error("expected the corrupt connection to be closed")
+	}
+}
+
+func TestDispatchRecoversFromPanics(t *testing.T) {
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		r.ReadByte()
+	})
+
+	client := NewClient(false, nil)
+	client.SetMaxDecodeErrors(1)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	// Delivering to a closed response channel panics like a handler bug
+	closed := make(chan map[string]interface{})
+	close(closed)
+	client.pending = map[string]chan map[string]interface{}{"req_broken": closed}
+	broken := map[string]interface{}{"type": MessageTypeTunnelResponse, "request_id": "req_broken"}
+	before := testutil.ToFloat64(messageHandlerPanics)
+
+	if err := client.dispatchMessage(broken); err != nil {
+		t.Fatalf("expected the panic to be skipped, got %v", err)
+	}
+	// A message handled without panicking resets the count
+	if err := client.dispatchMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.dispatchMessage(broken); err != nil {
+		t.Fatalf("expected the panic to be skipped, got %v", err)
+	}
+	if err := client.dispatchMessage(broken); !errors.Is(err, ErrConnectionCorrupt) {
+		t.Fatalf("expected corrupt connection error, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(messageHandlerPanics) - before; got != 3 {
+		t.Errorf("expected 3 panics counted, got %v", got)
+	}
+	if err := client.SendMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestCorruptConnectionCloseDuringMigration(t *testing.T) {
+	client := NewClient(false, nil)
+	current, peer := net.Pipe()
+	defer peer.Close()
+	client.conn = current
+	client.SetMaxDecodeErrors(0)
+
+	// MigrateTo swaps the connection under stateMu meanwhile
+	next, nextPeer := net.Pipe()
+	defer nextPeer.Close()
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		client.stateMu.Lock()
+		client.conn = next
+		client.stateMu.Unlock()
+	}()
+
+	err := client.handleDecodeError([]byte("garbage"), errors.New("invalid character"))
+	if !errors.Is(err, ErrConnectionCorrupt) {
+		t.Errorf("expected ErrConnectionCorrupt, got %v", err)
+	}
+	<-swapped
+	client.closeConn()
+}
+
+func TestHexPreview(t *testing.T) {
+	if got := hexPreview([]byte("ab")); got != "6162" {
+		t.Errorf("unexpected preview %q", got)
+	}
+	long := make([]byte, 100)
+	if got := hexPreview(long); len(got) != 2*decodePreviewBytes+3 {
+		t.Errorf("expected truncated preview, got %d chars", len(got))
+	}
+}
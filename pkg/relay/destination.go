@@ -0,0 +1,230 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrDestinationDenied is returned when creating a tunnel to a remote host
+// the destination policy does not allow
+var ErrDestinationDenied = errors.New("tunnel destination not allowed")
+
+// DestinationPolicy decides which remote hosts tunnels may lead to. Rules
+// are host names, "*.example.com" wildcards matching every subdomain, IP
+// addresses or CIDR ranges. Denied rules win over allowed ones, and an empty
+// allow list allows every host that is not denied. Address rules apply to
+// the addresses host names resolve to, so a name cannot slip past a denied
+// range.
+type DestinationPolicy struct {
+	allowed []destinationRule
+	denied  []destinationRule
+	// resolve looks up every host name, so unknown hosts are rejected even
+	// where no address rule applies
+	resolve bool
+	// allowedAddresses and deniedAddresses are set if the allowed or
+	// denied rules include addresses or ranges
+	allowedAddresses bool
+	deniedAddresses  bool
+	lookup           func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// destinationRule is a parsed allow or deny rule
+type destinationRule struct {
+	host   string // exact host name
+	suffix string // ".example.com" of a wildcard
+	prefix *net.IPNet
+}
+
+// NewDestinationPolicy parses the allowed and denied rules. If resolve is
+// set, host names must resolve when a tunnel is created.
+func NewDestinationPolicy(allowed, denied []string, resolve bool) (*DestinationPolicy, error) {
+	p := &DestinationPolicy{resolve: resolve, lookup: net.DefaultResolver.LookupIPAddr}
+	var err error
+	if p.allowed, err = parseDestinationRules(allowed); err != nil {
+		return nil, fmt.Errorf("invalid allowed destination: %w", err)
+	}
+	if p.denied, err = parseDestinationRules(denied); err != nil {
+		return nil, fmt.Errorf("invalid denied destination: %w", err)
+	}
+	p.allowedAddresses = hasAddressRule(p.allowed)
+	p.deniedAddresses = hasAddressRule(p.denied)
+	return p, nil
+}
+
+func parseDestinationRules(rules []string) ([]destinationRule, error) {
+	parsed := make([]destinationRule, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case strings.Contains(rule, "/"):
+			_, prefix, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", rule, err)
+			}
+			parsed = append(parsed, destinationRule{prefix: prefix})
+		case net.ParseIP(rule) != nil:
+			ip := net.ParseIP(rule)
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			parsed = append(parsed, destinationRule{prefix: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+		case strings.HasPrefix(rule, "*."):
+			if err := ValidateRemoteHost(rule[2:]); err != nil {
+				return nil, fmt.Errorf("%q: %w", rule, err)
+			}
+			parsed = append(parsed, destinationRule{suffix: strings.TrimSuffix(rule[1:], ".")})
+		default:
+			if err := ValidateRemoteHost(rule); err != nil {
+				return nil, fmt.Errorf("%q: %w", rule, err)
+			}
+			parsed = append(parsed, destinationRule{host: strings.TrimSuffix(rule, ".")})
+		}
+	}
+	return parsed, nil
+}
+
+// hasAddressRule reports whether any of rules is an address or range
+func hasAddressRule(rules []destinationRule) bool {
+	for _, rule := range rules {
+		if rule.prefix != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesName reports whether the rule matches a lower-case host name
+func (r destinationRule) matchesName(host string) bool {
+	switch {
+	case r.host != "":
+		return host == r.host
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix)
+	}
+	return false
+}
+
+// matchesIP reports whether the rule matches an address
+func (r destinationRule) matchesIP(ip net.IP) bool {
+	return r.prefix != nil && r.prefix.Contains(ip)
+}
+
+// Check returns an error if tunnels must not lead to host: if the host is
+// not a valid IP address or host name, is denied or not allowed, or does
+// not resolve although resolving is required. A host name is resolved
+// whenever address rules could decide about it, and denied if it does not
+// resolve then. A nil policy only checks the syntax.
+func (p *DestinationPolicy) Check(ctx context.Context, host string) error {
+	if err := ValidateRemoteHost(host); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addrs, name = []net.IP{ip}, ""
+	}
+	for _, rule := range p.denied {
+		if rule.matchesName(name) {
+			return fmt.Errorf("%w: %s", ErrDestinationDenied, host)
+		}
+	}
+	allowedByName := len(p.allowed) == 0
+	for _, rule := range p.allowed {
+		if rule.matchesName(name) {
+			allowedByName = true
+			break
+		}
+	}
+
+	if name != "" && (p.resolve || p.deniedAddresses || (p.allowedAddresses && !allowedByName)) {
+		resolved, err := p.lookup(ctx, name)
+		if err != nil && p.resolve {
+			return fmt.Errorf("remote host %s does not resolve: %w", host, err)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s does not resolve to check its addresses: %v", ErrDestinationDenied, host, err)
+		}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.IP)
+		}
+	}
+
+	for _, rule := range p.denied {
+		for _, ip := range addrs {
+			if rule.matchesIP(ip) {
+				return fmt.Errorf("%w: %s (%s)", ErrDestinationDenied, host, ip)
+			}
+		}
+	}
+	if allowedByName {
+		return nil
+	}
+	// A name that is not allowed itself is allowed if all its addresses are
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w: %s", ErrDestinationDenied, host)
+	}
+	for _, ip := range addrs {
+		allowed := false
+		for _, rule := range p.allowed {
+			if rule.matchesIP(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s (%s)", ErrDestinationDenied, host, ip)
+		}
+	}
+	return nil
+}
+
+// ValidateRemoteHost checks that host is an IP address or a syntactically
+// valid host name
+func ValidateRemoteHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("remote host is empty")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	name := strings.TrimSuffix(host, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("invalid remote host %q", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid remote host %q", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("invalid remote host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+// SetDestinationPolicy sets the policy remote hosts of new tunnels are
+// checked against. A nil policy only checks that they are valid host names
+// or addresses. Existing tunnels are kept.
+func (c *Client) SetDestinationPolicy(p *DestinationPolicy) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+	c.destinationPolicy = p
+}
+
+// checkDestination checks remoteHost against the destination policy
+func (c *Client) checkDestination(ctx context.Context, remoteHost string) error {
+	c.tunnelMutex.RLock()
+	p := c.destinationPolicy
+	c.tunnelMutex.RUnlock()
+	return p.Check(ctx, remoteHost)
+}
@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestValidateRemoteHost(t *testing.T) {
+	for _, host := range []string{"10.0.0.1", "::1", "srv-42", "db.internal.example.com.", "_sip.example.com"} {
+		if err := ValidateRemoteHost(host); err != nil {
+			t.Errorf("expected %q to be valid: %v", host, err)
+		}
+	}
+	for _, host := range []string{"", "exa mple.com", "-bad.example.com", "a..b", "host:22", "[::1]"} {
+		if err := ValidateRemoteHost(host); err == nil {
+			t.Errorf("expected %q to be invalid", host)
+		}
+	}
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	policy, err := NewDestinationPolicy(
+		[]string{"*.corp.example.com", "10.0.0.0/8", "db.example.com"},
+		[]string{"secret.corp.example.com", "10.1.0.0/16"},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.1")}}, nil
+	}
+
+	ctx := context.Background()
+	for _, host := range []string{"rdp.corp.example.com", "DB.example.com", "10.0.0.1"} {
+		if err := policy.Check(ctx, host); err != nil {
+			t.Errorf("expected %s to be allowed: %v", host, err)
+		}
+	}
+	for _, host := range []string{"secret.corp.example.com", "10.1.2.3", "corp.example.com", "192.168.1.1", "other.example.com"} {
+		if err := policy.Check(ctx, host); !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("expected %s to be denied, got %v", host, err)
+		}
+	}
+
+	if _, err := NewDestinationPolicy([]string{"10.0.0.0/33"}, nil, false); err == nil {
+		t.Error("expected error for an invalid CIDR")
+	}
+}
+
+func TestDestinationPolicyResolves(t *testing.T) {
+	policy, err := NewDestinationPolicy([]string{"10.0.0.0/8"}, []string{"10.9.9.9"}, true)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "app.internal":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.5")}}, nil
+		case "mixed.internal":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.6")}, {IP: net.ParseIP("203.0.113.1")}}, nil
+		case "blocked.internal":
+			return []net.IPAddr{{IP: net.ParseIP("10.9.9.9")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ctx := context.Background()
+	if err := policy.Check(ctx, "app.internal"); err != nil {
+		t.Errorf("expected name resolving to an allowed address to be allowed: %v", err)
+	}
+	for _, host := range []string{"mixed.internal", "blocked.internal"} {
+		if err := policy.Check(ctx, host); !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("expected %s to be denied, got %v", host, err)
+		}
+	}
+	if err := policy.Check(ctx, "typo.internal"); err == nil || errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("expected resolution error for an unknown host, got %v", err)
+	}
+}
+
+func TestDestinationPolicyChecksAddressesOfNames(t *testing.T) {
+	// Denied ranges apply to names without resolve_destinations
+	policy, err := NewDestinationPolicy(nil, []string{"169.254.0.0/16"}, false)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "metadata.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("169.254.169.254")}}, nil
+		case "app.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("203.0.113.1")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ctx := context.Background()
+	if err := policy.Check(ctx, "app.example.com"); err != nil {
+		t.Errorf("expected app.example.com to be allowed: %v", err)
+	}
+	for _, host := range []string{"metadata.example.com", "unknown.example.com"} {
+		if err := policy.Check(ctx, host); !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("expected %s to be denied, got %v", host, err)
+		}
+	}
+
+	// Names are not looked up when only name rules decide
+	policy, err = NewDestinationPolicy([]string{"*.example.com", "10.0.0.0/8"}, []string{"secret.example.com"}, false)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		t.Errorf("unexpected lookup of %s", host)
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err := policy.Check(ctx, "app.example.com"); err != nil {
+		t.Errorf("expected app.example.com to be allowed: %v", err)
+	}
+	if err := policy.Check(ctx, "secret.example.com"); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("expected secret.example.com to be denied, got %v", err)
+	}
+}
+
+func TestCreateTunnelChecksDestination(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	policy, err := NewDestinationPolicy(nil, []string{"10.0.0.1"}, false)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	client.SetDestinationPolicy(policy)
+
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.1", 3389); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("expected ErrDestinationDenied, got %v", err)
+	}
+	if _, err := client.CreateTunnel(freePort(t), "bad host", 3389); err == nil {
+		t.Error("expected error for an invalid remote host")
+	}
+	if len(client.ListTunnels()) != 0 {
+		t.Error("rejected tunnels must not be registered")
+	}
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.2", 3389); err != nil {
+		t.Errorf("failed to create allowed tunnel: %v", err)
+	}
+}
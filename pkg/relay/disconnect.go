@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// connState tracks whether the current connection is still alive and who to
+// tell when it is lost. Guarded by Client.stateMu.
+type connState struct {
+	done         chan struct{}
+	lost         bool
+	onDisconnect func(err error)
+	// since is when the connection was established
+	since time.Time
+}
+
+// SetDisconnectHandler sets fn to be called when the connection to the
+// relay is lost: a read or write fails for a reason other than a timeout, or
+// the relay stops answering heartbeats. fn runs in a goroutine of its own,
+// at most once per connection, and is not called for Close or Shutdown.
+func (c *Client) SetDisconnectHandler(fn func(err error)) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.connState.onDisconnect = fn
+}
+
+// Done returns a channel that is closed when the current connection is lost
+// or closed. Call it again after Connect to watch the new connection.
+func (c *Client) Done() <-chan struct{} {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.connDoneLocked()
+}
+
+// connDoneLocked returns the done channel of the current connection,
+// creating it if needed. c.stateMu must be held.
+func (c *Client) connDoneLocked() chan struct{} {
+	if c.connState.done == nil || c.connState.lost {
+		c.connState.done = make(chan struct{})
+		c.connState.lost = false
+	}
+	return c.connState.done
+}
+
+// connectionDown reports whether the current connection was lost or closed
+func (c *Client) connectionDown() bool {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.conn == nil || c.connState.lost
+}
+
+// connectionLost marks the current connection as gone and calls the
+// disconnect handler. A nil err marks a deliberate close, which closes the
+// Done channel without calling the handler.
+func (c *Client) connectionLost(err error) {
+	c.stateMu.Lock()
+	if c.connState.done == nil || c.connState.lost {
+		c.stateMu.Unlock()
+		return
+	}
+	c.connState.lost = true
+	close(c.connState.done)
+	fn := c.connState.onDisconnect
+	host, port, since := c.host, c.port, c.connState.since
+	c.stateMu.Unlock()
+
+	event := ConnectionEvent{Type: ConnectionEventDisconnected, Reason: "closed", Error: errorString(err)}
+	if err != nil {
+		event.Reason = "lost"
+	}
+	if !since.IsZero() {
+		event.DurationMs = milliseconds(time.Since(since))
+	}
+	c.recordEvent(event, host, port)
+
+	c.ready.Set(false)
+	if fn != nil && err != nil {
+		go fn(err)
+	}
+}
+
+// checkConnError reports err as a lost connection unless it is a timeout,
+// which leaves the connection usable
+func (c *Client) checkConnError(err error) {
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return
+	}
+	c.connectionLost(err)
+}
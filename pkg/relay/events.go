@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionEventType identifies the kind of a connection event
+type ConnectionEventType string
+
+const (
+	ConnectionEventConnectAttempt ConnectionEventType = "connect_attempt"
+	ConnectionEventConnected      ConnectionEventType = "connected"
+	ConnectionEventConnectFailed  ConnectionEventType = "connect_failed"
+	ConnectionEventHandshake      ConnectionEventType = "handshake"
+	ConnectionEventDisconnected   ConnectionEventType = "disconnected"
+	ConnectionEventReconnect      ConnectionEventType = "reconnect"
+)
+
+// ConnectionEvent is one step in the life of a connection to the relay
+type ConnectionEvent struct {
+	Time  time.Time           `json:"time"`
+	Type  ConnectionEventType `json:"type"`
+	Relay string              `json:"relay,omitempty"`
+	// DurationMs is how long the step took; for a disconnect, how long
+	// the connection was up
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	// Attempt and DelayMs describe a reconnect: the attempt that failed
+	// and the wait before the next one
+	Attempt int     `json:"attempt,omitempty"`
+	DelayMs float64 `json:"delay_ms,omitempty"`
+	// Reason is "closed" for a deliberate disconnect and "lost" otherwise
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ConnectionEventLog appends connection events to a file as JSON lines, a
+// timeline of connection behavior that is easier to analyze than the logs.
+// A nil log discards events.
+type ConnectionEventLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// OpenConnectionEventLog opens the file at path for appending events,
+// creating it if needed
+func OpenConnectionEventLog(path string) (*ConnectionEventLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open connection event log: %w", err)
+	}
+	return &ConnectionEventLog{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Record appends an event, setting its time if unset
+func (l *ConnectionEventLog) Record(event ConnectionEvent) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.writer == nil {
+		return
+	}
+	l.writer.Write(data)
+	l.writer.WriteByte('\n')
+	l.writer.Flush()
+}
+
+// Close closes the file. Events recorded afterwards are discarded.
+func (l *ConnectionEventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.writer.Flush()
+	err := l.file.Close()
+	l.file, l.writer = nil, nil
+	return err
+}
+
+// SetEventLog sets the log connects, handshakes and disconnects of the
+// client are recorded in. A nil log stops recording.
+func (c *Client) SetEventLog(l *ConnectionEventLog) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.eventLog = l
+}
+
+// recordEvent records event for the relay at host and port
+func (c *Client) recordEvent(event ConnectionEvent, host string, port int) {
+	c.stateMu.RLock()
+	l := c.eventLog
+	c.stateMu.RUnlock()
+	if l == nil {
+		return
+	}
+	if host != "" {
+		event.Relay = relayAddress(host, port)
+	}
+	l.Record(event)
+}
+
+// relayAddress formats the relay endpoint for events
+func relayAddress(host string, port int) string {
+	if strings.HasPrefix(host, UnixScheme) {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// errorString returns the message of err, or "" if err is nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// milliseconds converts d for events
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
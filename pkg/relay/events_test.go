@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConnectionEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.jsonl")
+	events, err := OpenConnectionEventLog(path)
+	if err != nil {
+		t.Fatalf("failed to open event log: %v", err)
+	}
+
+	port := startFakeRelay(t, tunnelRelay(func(map[string]interface{}, net.Conn) {}))
+	client := NewClient(false, nil)
+	client.SetEventLog(events)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	client.Close()
+	if err := client.Connect("127.0.0.1", freePort(t)); err == nil {
+		t.Fatal("expected connecting to a closed port to fail")
+	}
+	if err := events.Close(); err != nil {
+		t.Fatalf("failed to close event log: %v", err)
+	}
+	// Events after Close are discarded
+	events.Record(ConnectionEvent{Type: ConnectionEventReconnect})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open event file: %v", err)
+	}
+	defer file.Close()
+	var got []ConnectionEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event ConnectionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, event)
+	}
+
+	want := []ConnectionEventType{
+		ConnectionEventConnectAttempt, ConnectionEventConnected, ConnectionEventHandshake,
+		ConnectionEventDisconnected, ConnectionEventConnectAttempt, ConnectionEventConnectFailed,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), got)
+	}
+	for i, event := range got {
+		if event.Type != want[i] {
+			t.Errorf("event %d: expected %s, got %s", i, want[i], event.Type)
+		}
+		if event.Time.IsZero() || event.Relay == "" {
+			t.Errorf("event %d lacks time or relay: %+v", i, event)
+		}
+	}
+	if got[2].Error != "" {
+		t.Errorf("expected a successful handshake, got %q", got[2].Error)
+	}
+	if got[3].Reason != "closed" {
+		t.Errorf("expected a deliberate disconnect, got %+v", got[3])
+	}
+	if got[5].Error == "" {
+		t.Error("expected the failed connect to carry its error")
+	}
+}
@@ -0,0 +1,72 @@
+package relay
+
+// serverHelloFields are the fields of the server hello the client itself
+// interprets; all others are returned by ServerHelloExtras
+var serverHelloFields = map[string]bool{
+	"type":         true,
+	"version":      true,
+	"features":     true,
+	"post_quantum": true,
+	"compression":  true,
+}
+
+// SetClientInfo sets custom fields sent in the client_info of the auth
+// message, for relay-specific handshake extensions such as region hints.
+// Fields the client sends itself, like labels, take precedence. It applies
+// to the next Handshake.
+func (c *Client) SetClientInfo(info map[string]interface{}) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.clientInfo = make(map[string]interface{}, len(info))
+	for key, value := range info {
+		c.clientInfo[key] = value
+	}
+}
+
+// authClientInfo returns the client_info of the auth message: the fields
+// set with SetClientInfo overlaid with builtin, or nil if both are empty
+func (c *Client) authClientInfo(builtin map[string]interface{}) map[string]interface{} {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	if len(c.clientInfo) == 0 && len(builtin) == 0 {
+		return nil
+	}
+	info := make(map[string]interface{}, len(c.clientInfo)+len(builtin))
+	for key, value := range c.clientInfo {
+		info[key] = value
+	}
+	for key, value := range builtin {
+		info[key] = value
+	}
+	return info
+}
+
+// ServerHelloExtras returns the fields of the last server hello that the
+// client does not interpret itself, or nil if there were none
+func (c *Client) ServerHelloExtras() map[string]interface{} {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	if len(c.helloExtras) == 0 {
+		return nil
+	}
+	extras := make(map[string]interface{}, len(c.helloExtras))
+	for key, value := range c.helloExtras {
+		extras[key] = value
+	}
+	return extras
+}
+
+// recordHelloExtrasLocked keeps the uninterpreted fields of hello. c.stateMu must
+// be held.
+func (c *Client) recordHelloExtrasLocked(hello map[string]interface{}) {
+	c.helloExtras = nil
+	for key, value := range hello {
+		if serverHelloFields[key] {
+			continue
+		}
+		if c.helloExtras == nil {
+			c.helloExtras = make(map[string]interface{})
+		}
+		c.helloExtras[key] = value
+	}
+}
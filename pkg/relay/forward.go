@@ -0,0 +1,446 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/2gc-dev/cloudbridge-client/pkg/tunnel"
+)
+
+// DataConnTimeout bounds opening a data connection to the relay for an
+// accepted local connection
+const DataConnTimeout = 15 * time.Second
+
+// tunnelForwarder is the forwarding state of a tunnel
+type tunnelForwarder struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// SetMetrics sets the metrics tunnel traffic is counted in
+func (c *Client) SetMetrics(m *metrics.Metrics) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+	c.metrics = m
+	c.observeBudgetLocked()
+}
+
+// SetBufferBudget sets the budget the copy buffers of forwarded connections
+// are reserved from. A nil budget is unlimited. One budget may be shared by
+// several clients.
+func (c *Client) SetBufferBudget(budget *tunnel.BufferBudget) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+	c.budget = budget
+	c.observeBudgetLocked()
+}
+
+// SetScheduler sets the scheduler that shares the uplink to the relay
+// between tunnels in proportion to their weights: writes of forwarded
+// connections wait for their turn. Existing and later tunnels are
+// registered with it. One scheduler may be shared by several clients; nil
+// writes without scheduling. Connections already being forwarded keep
+// their scheduler.
+func (c *Client) SetScheduler(scheduler *tunnel.FairScheduler) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+	for id, t := range c.tunnels {
+		if c.scheduler != nil {
+			c.scheduler.RemoveTunnel(id)
+		}
+		c.scheduleTunnelLocked(scheduler, t)
+	}
+	c.scheduler = scheduler
+}
+
+// scheduleTunnelLocked registers t with scheduler, if any. c.tunnelMutex
+// must be held.
+func (c *Client) scheduleTunnelLocked(scheduler *tunnel.FairScheduler, t *Tunnel) {
+	if scheduler == nil {
+		return
+	}
+	weight := t.Weight
+	if weight <= 0 {
+		weight = tunnel.DefaultTunnelWeight
+	}
+	if err := scheduler.AddTunnel(t.ID, weight); err != nil {
+		log.Printf("Tunnel %s is not scheduled: %v", t.ID, err)
+	}
+}
+
+// SetTunnelWeight changes the share of the uplink a tunnel gets
+func (c *Client) SetTunnelWeight(tunnelID string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight: %d", weight)
+	}
+
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	t, exists := c.tunnels[tunnelID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelID)
+	}
+	if c.scheduler != nil {
+		if err := c.scheduler.SetWeight(tunnelID, weight); err != nil {
+			return err
+		}
+	}
+	t.Weight = weight
+	return nil
+}
+
+// SchedulerStats returns per-tunnel scheduling statistics, or nil if no
+// scheduler is set
+func (c *Client) SchedulerStats() map[string]tunnel.SchedulerStats {
+	c.tunnelMutex.RLock()
+	scheduler := c.scheduler
+	c.tunnelMutex.RUnlock()
+
+	if scheduler == nil {
+		return nil
+	}
+	return scheduler.Stats()
+}
+
+// BufferBudgetFromConfig creates the budget of cfg.Tunnel.MaxBufferedBytes,
+// or returns nil if the limit is disabled
+func BufferBudgetFromConfig(cfg *config.Config) *tunnel.BufferBudget {
+	if cfg.Tunnel.MaxBufferedBytes < 0 {
+		return nil
+	}
+	return tunnel.NewBufferBudget(cfg.Tunnel.MaxBufferedBytes)
+}
+
+// bufferBudget returns the budget set with SetBufferBudget, or nil
+func (c *Client) bufferBudget() *tunnel.BufferBudget {
+	c.tunnelMutex.RLock()
+	defer c.tunnelMutex.RUnlock()
+	return c.budget
+}
+
+// observeBudgetLocked reports budget usage to the metrics. c.tunnelMutex
+// must be held.
+func (c *Client) observeBudgetLocked() {
+	if c.budget == nil || c.metrics == nil {
+		return
+	}
+	c.budget.SetObservers(c.metrics.SetTunnelBufferUsage, c.metrics.IncTunnelBufferWaits)
+}
+
+// clientMetrics returns the metrics set with SetMetrics, or nil
+func (c *Client) clientMetrics() *metrics.Metrics {
+	c.tunnelMutex.RLock()
+	defer c.tunnelMutex.RUnlock()
+	return c.metrics
+}
+
+// SetTransport sets the transport carrying the connections of tunnels to
+// the relay. Connections already being forwarded keep their transport. A
+// nil transport restores the default of a data connection per local
+// connection.
+func (c *Client) SetTransport(transport tunnel.TunnelTransport) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+	c.transport = transport
+}
+
+// tunnelTransport returns the transport set with SetTransport, or the
+// default relay transport
+func (c *Client) tunnelTransport() tunnel.TunnelTransport {
+	c.tunnelMutex.RLock()
+	defer c.tunnelMutex.RUnlock()
+	if c.transport == nil {
+		return relayTransport{client: c}
+	}
+	return c.transport
+}
+
+// relayTransport is the default transport: every local connection gets a
+// data connection of its own to the relay
+type relayTransport struct {
+	client *Client
+}
+
+// Name returns the transport name
+func (r relayTransport) Name() string {
+	return "relay"
+}
+
+// Open opens a data connection for the tunnel
+func (r relayTransport) Open(ctx context.Context, t *tunnel.Tunnel) (net.Conn, error) {
+	return r.client.openDataConn(ctx, t)
+}
+
+// listenTunnel binds the local address of t. Connections are accepted once
+// startForwarding is called.
+func (c *Client) listenTunnel(t *Tunnel) error {
+	addr := net.JoinHostPort(t.BindAddress, strconv.Itoa(t.LocalPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	// A tunnel asking for any free port is told which one it got
+	t.LocalPort = listener.Addr().(*net.TCPAddr).Port
+	t.forwarder = &tunnelForwarder{
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	return nil
+}
+
+// startForwarding forwards every connection accepted on the local port of t
+// to the relay over a channel of the client's transport. The tunnel must not
+// be modified afterwards.
+func (c *Client) startForwarding(t *Tunnel) {
+	t.forwarder.wg.Add(1)
+	go c.acceptConnections(t)
+}
+
+func (c *Client) acceptConnections(t *Tunnel) {
+	defer t.forwarder.wg.Done()
+
+	// Both copy buffers of tunnel.Pipe
+	reserved := int64(2 * tunnel.DefaultCopyConfig().BufferSize)
+	for {
+		// Reserve the buffers before accepting, so connections queue in
+		// the listen backlog while the buffer budget is exhausted
+		budget := c.bufferBudget()
+		if !budget.Acquire(reserved, t.stopChan) {
+			return
+		}
+
+		local, err := t.forwarder.listener.Accept()
+		if err != nil {
+			budget.Release(reserved)
+			select {
+			case <-t.stopChan:
+			default:
+				log.Printf("Tunnel %s stopped accepting connections: %v", t.ID, err)
+			}
+			return
+		}
+		if !t.track(local) {
+			budget.Release(reserved)
+			local.Close()
+			return
+		}
+
+		t.forwarder.wg.Add(1)
+		go func() {
+			defer budget.Release(reserved)
+			c.forward(t, local)
+		}()
+	}
+}
+
+// forward pumps data between a local connection and a new data connection
+// to the relay until either side is done
+func (c *Client) forward(t *Tunnel, local net.Conn) {
+	defer t.forwarder.wg.Done()
+	defer t.untrack(local)
+	defer local.Close()
+
+	transport := c.tunnelTransport()
+	ctx, cancel := context.WithTimeout(context.Background(), DataConnTimeout)
+	conn, err := transport.Open(ctx, &tunnel.Tunnel{
+		ID:         t.ID,
+		LocalPort:  t.LocalPort,
+		RemoteHost: t.RemoteHost,
+		RemotePort: t.RemotePort,
+	})
+	cancel()
+	if err != nil {
+		log.Printf("Tunnel %s failed to reach the relay over %s: %v", t.ID, transport.Name(), err)
+		return
+	}
+	c.tunnelMutex.RLock()
+	scheduler := c.scheduler
+	c.tunnelMutex.RUnlock()
+	if scheduler != nil {
+		conn = scheduler.Conn(t.ID, conn)
+	}
+	remote := &countedConn{Conn: conn, tunnelID: t.ID, metrics: c.clientMetrics()}
+	defer remote.Close()
+	if !t.track(remote) {
+		return
+	}
+	defer t.untrack(remote)
+
+	if _, _, err := tunnel.Pipe(local, remote, tunnel.DefaultCopyConfig()); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Tunnel %s connection ended: %v", t.ID, err)
+	}
+}
+
+// openDataConn opens a data connection for t. The connection completes the
+// same hello and auth handshake as the control connection, then names the
+// registered tunnel in a tunnel_info message; once the relay answers with a
+// tunnel_response, the connection carries raw tunnel bytes.
+func (c *Client) openDataConn(ctx context.Context, t *tunnel.Tunnel) (net.Conn, error) {
+	c.stateMu.RLock()
+	host, port, token := c.host, c.port, c.token
+	c.stateMu.RUnlock()
+
+	// Tunnel bytes are not JSON lines, so the session must not compress
+	session := c.newSession()
+	session.compression = nil
+	if err := session.Connect(host, port); err != nil {
+		return nil, err
+	}
+	conn := session.conn
+	if err := session.HandshakeContext(ctx, token); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("data connection handshake failed: %w", err)
+	}
+
+	msg := map[string]interface{}{
+		"type":        MessageTypeTunnelInfo,
+		"tunnel_id":   t.ID,
+		"local_port":  t.LocalPort,
+		"remote_host": t.RemoteHost,
+		"remote_port": t.RemotePort,
+	}
+	if c.tenantID != "" {
+		msg["tenant_id"] = c.tenantID
+	}
+	if err := session.sendMessageContext(ctx, msg); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send tunnel_info: %w", err)
+	}
+	resp, err := session.readMessageContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read tunnel_response: %w", err)
+	}
+	switch {
+	case resp["type"] == MessageTypeError:
+		conn.Close()
+		return nil, fmt.Errorf("relay rejected data connection: %v", resp["message"])
+	case resp["type"] != MessageTypeTunnelResponse:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected message type %v instead of tunnel_response", resp["type"])
+	case resp["status"] != nil && resp["status"] != "success":
+		conn.Close()
+		return nil, fmt.Errorf("relay rejected data connection: %v", resp["status"])
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dataConn{Conn: conn, reader: session.reader.r}, nil
+}
+
+// dataConn is a data connection to the relay. Bytes the handshake read
+// ahead are returned first.
+type dataConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (d *dataConn) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it
+func (d *dataConn) CloseWrite() error {
+	return closeWrite(d.Conn)
+}
+
+// countedConn counts the traffic of a tunnel connection to the relay
+type countedConn struct {
+	net.Conn
+	tunnelID string
+	metrics  *metrics.Metrics
+}
+
+func (d *countedConn) Read(p []byte) (int, error) {
+	n, err := d.Conn.Read(p)
+	if n > 0 && d.metrics != nil {
+		d.metrics.IncTunnelBytesFromServer(d.tunnelID, int64(n))
+	}
+	return n, err
+}
+
+func (d *countedConn) Write(p []byte) (int, error) {
+	n, err := d.Conn.Write(p)
+	if n > 0 && d.metrics != nil {
+		d.metrics.IncTunnelBytesToServer(d.tunnelID, int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it
+func (d *countedConn) CloseWrite() error {
+	return closeWrite(d.Conn)
+}
+
+// closeWrite half-closes conn if it supports it
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// track registers a connection to be closed when the tunnel stops. It
+// returns false if the tunnel is already stopping.
+func (t *Tunnel) track(conn net.Conn) bool {
+	t.forwarder.mu.Lock()
+	defer t.forwarder.mu.Unlock()
+	select {
+	case <-t.stopChan:
+		return false
+	default:
+	}
+	t.forwarder.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *Tunnel) untrack(conn net.Conn) {
+	t.forwarder.mu.Lock()
+	defer t.forwarder.mu.Unlock()
+	delete(t.forwarder.conns, conn)
+}
+
+// stop closes the listener, every forwarded connection and the proxy
+// command of the tunnel, and waits for the forwarding goroutines to finish
+func (t *Tunnel) stop() {
+	if t.forwarder == nil {
+		return
+	}
+	t.forwarder.stopOnce.Do(func() {
+		t.forwarder.mu.Lock()
+		close(t.stopChan)
+		conns := make([]net.Conn, 0, len(t.forwarder.conns))
+		for conn := range t.forwarder.conns {
+			conns = append(conns, conn)
+		}
+		t.forwarder.mu.Unlock()
+
+		if t.forwarder.listener != nil {
+			t.forwarder.listener.Close()
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if t.proxyCmd != nil && t.proxyCmd.Process != nil {
+			t.proxyCmd.Process.Kill()
+		}
+	})
+	t.forwarder.wg.Wait()
+}
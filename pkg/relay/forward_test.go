@@ -0,0 +1,354 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/2gc-dev/cloudbridge-client/pkg/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startForwardingRelay runs a relay whose first connection is the control
+// connection and whose later connections are data connections that
+// authenticate like it and then echo every byte back
+func startForwardingRelay(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				go func() {
+					defer conn.Close()
+					r := bufio.NewReader(conn)
+					if err := acceptHandshake(r, conn); err != nil {
+						return
+					}
+					answerTunnels(r, conn)
+				}()
+				continue
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := readJSONLine(r); err != nil {
+					return
+				}
+				writeJSONLine(conn, map[string]interface{}{"type": MessageTypeHello, "version": "2.0"})
+				auth, err := readJSONLine(r)
+				if err != nil {
+					return
+				}
+				if auth["type"] != MessageTypeAuth || auth["token"] != "token" {
+					writeJSONLine(conn, map[string]interface{}{"type": MessageTypeError, "message": "bad auth"})
+					return
+				}
+				writeJSONLine(conn, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+				msg, err := readJSONLine(r)
+				if err != nil {
+					return
+				}
+				if msg["type"] != MessageTypeTunnelInfo || !strings.HasPrefix(fmt.Sprint(msg["tunnel_id"]), "srv-") {
+					writeJSONLine(conn, map[string]interface{}{"type": MessageTypeError, "message": "bad data connection"})
+					return
+				}
+				writeJSONLine(conn, map[string]interface{}{"type": MessageTypeTunnelResponse, "status": "success"})
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTunnelForwardsTraffic(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	registry := prometheus.NewRegistry()
+	client.SetMetrics(metrics.NewMetrics(registry))
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateTunnel(localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := local.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected ping, got %q", buf)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	counted := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			if len(m.GetLabel()) > 0 && m.GetLabel()[0].GetValue() == tunnelID {
+				counted[family.GetName()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if counted["client_tunnel_bytes_to_server_total"] != 4 || counted["client_tunnel_bytes_from_server_total"] != 4 {
+		t.Errorf("unexpected byte counts: %v", counted)
+	}
+
+	// Closing the client tears down the listener and the forwarded connection
+	client.Close()
+	if _, err := local.Read(buf); err == nil {
+		t.Error("expected forwarded connection to be closed")
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort)); err == nil {
+		conn.Close()
+		t.Error("expected tunnel listener to be closed")
+	}
+}
+
+// echoTransport is a transport whose channels echo every byte back
+type echoTransport struct {
+	opened chan string
+}
+
+func (e *echoTransport) Name() string {
+	return "echo"
+}
+
+func (e *echoTransport) Open(ctx context.Context, t *tunnel.Tunnel) (net.Conn, error) {
+	e.opened <- fmt.Sprintf("%s %s:%d", t.ID, t.RemoteHost, t.RemotePort)
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		io.Copy(remote, remote)
+	}()
+	return local, nil
+}
+
+func TestTunnelForwardsOverTransport(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	transport := &echoTransport{opened: make(chan string, 1)}
+	client.SetTransport(transport)
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateTunnel(localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := local.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected ping, got %q", buf)
+	}
+	if opened := <-transport.opened; opened != tunnelID+" 10.0.0.1:3389" {
+		t.Errorf("unexpected channel opened: %s", opened)
+	}
+}
+
+func TestTunnelWaitsForBufferBudget(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	// Room for the buffers of one connection only
+	budget := tunnel.NewBufferBudget(int64(2 * tunnel.DefaultCopyConfig().BufferSize))
+	client.SetBufferBudget(budget)
+
+	localPort := freePort(t)
+	if _, err := client.CreateTunnel(localPort, "10.0.0.1", 3389); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	echo := func(conn net.Conn, timeout time.Duration) error {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	first, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel: %v", err)
+	}
+	if err := echo(first, 5*time.Second); err != nil {
+		t.Fatalf("first connection failed: %v", err)
+	}
+
+	second, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel: %v", err)
+	}
+	defer second.Close()
+	if err := echo(second, 300*time.Millisecond); err == nil {
+		t.Fatal("expected second connection to wait for the buffer budget")
+	}
+
+	first.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(second, make([]byte, 4)); err != nil {
+		t.Fatalf("second connection failed after the first closed: %v", err)
+	}
+	if used := budget.Used(); used != budget.Limit() {
+		t.Errorf("expected the budget to be held by the second connection, got %d", used)
+	}
+}
+
+func TestTunnelWritesAreScheduled(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	scheduler := tunnel.NewFairScheduler(nil, tunnel.DefaultSchedulerConfig())
+	scheduler.Start()
+	defer scheduler.Close()
+	client.SetScheduler(scheduler)
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateTunnel(localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if err := client.SetTunnelWeight(tunnelID, 3); err != nil {
+		t.Fatalf("failed to set weight: %v", err)
+	}
+
+	local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(local, make([]byte, 4)); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+
+	stats := client.SchedulerStats()[tunnelID]
+	if stats.BytesSent != 4 || stats.Weight != 3 {
+		t.Errorf("unexpected scheduler stats: %+v", stats)
+	}
+
+	if err := client.CloseTunnel(tunnelID); err != nil {
+		t.Fatalf("failed to close tunnel: %v", err)
+	}
+	if _, exists := scheduler.Stats()[tunnelID]; exists {
+		t.Error("expected closed tunnel to be removed from the scheduler")
+	}
+}
+
+func TestCloseTunnel(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateTunnel(localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	tunnels := client.ListTunnels()
+	if len(tunnels) != 1 || tunnels[0].ID != tunnelID || tunnels[0].LocalPort != localPort {
+		t.Fatalf("unexpected tunnels: %+v", tunnels)
+	}
+	// The list is a copy
+	tunnels[0].RemoteHost = "changed"
+	if client.ListTunnels()[0].RemoteHost != "10.0.0.1" {
+		t.Error("modifying the list must not modify the tunnel")
+	}
+
+	if err := client.CloseTunnel(tunnelID); err != nil {
+		t.Fatalf("failed to close tunnel: %v", err)
+	}
+	if len(client.ListTunnels()) != 0 {
+		t.Error("expected closed tunnel to be removed")
+	}
+	if err := client.CloseTunnel(tunnelID); !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("expected ErrTunnelNotFound, got %v", err)
+	}
+
+	// The local port is free again
+	if _, err := client.CreateTunnel(localPort, "10.0.0.1", 3389); err != nil {
+		t.Errorf("failed to recreate tunnel on the released port: %v", err)
+	}
+}
+
+func TestCreateBoundTunnel(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateBoundTunnel(context.Background(), "127.0.0.1", localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if tunnels := client.ListTunnels(); len(tunnels) != 1 || tunnels[0].ID != tunnelID || tunnels[0].BindAddress != "127.0.0.1" {
+		t.Fatalf("unexpected tunnels: %+v", tunnels)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to dial bound tunnel: %v", err)
+	}
+	conn.Close()
+
+	if _, err := client.CreateBoundTunnel(context.Background(), "203.0.113.1", freePort(t), "10.0.0.1", 22); err == nil {
+		t.Error("expected error for an address that is not local")
+	}
+
+	// Without a local port the tunnel listens on a free one
+	tunnelID, err = client.CreateBoundTunnel(context.Background(), "127.0.0.1", 0, "10.0.0.2", 22)
+	if err != nil {
+		t.Fatalf("failed to create tunnel on a free port: %v", err)
+	}
+	var picked int
+	for _, tunnel := range client.ListTunnels() {
+		if tunnel.ID == tunnelID {
+			picked = tunnel.LocalPort
+		}
+	}
+	if picked == 0 {
+		t.Fatalf("expected the picked port to be reported, got %+v", client.ListTunnels())
+	}
+	conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", picked))
+	if err != nil {
+		t.Fatalf("failed to dial tunnel on the picked port: %v", err)
+	}
+	conn.Close()
+}
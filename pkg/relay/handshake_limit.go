@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+)
+
+// DefaultMaxConcurrentHandshakes is the default limit on connects and
+// handshakes to the relay in progress at once
+const DefaultMaxConcurrentHandshakes = config.DefaultMaxConcurrentHandshakes
+
+// HandshakeLimiter caps the connects and handshakes to the relay in progress
+// at once, so tunnels reconnecting together after a network blip do not
+// flood the relay. Callers beyond the limit wait in turn. One limiter may be
+// shared by several clients; a nil limiter is unlimited.
+type HandshakeLimiter struct {
+	slots  chan struct{}
+	queued int64
+}
+
+// NewHandshakeLimiter creates a limiter allowing max handshakes at once. It
+// returns nil, which is unlimited, if max is zero or less.
+func NewHandshakeLimiter(max int) *HandshakeLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &HandshakeLimiter{slots: make(chan struct{}, max)}
+}
+
+// Acquire waits for a free slot. It returns an error if ctx is done first.
+// Every successful Acquire must be followed by a Release.
+func (l *HandshakeLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	atomic.AddInt64(&l.queued, 1)
+	handshakeQueueDepth.Inc()
+	defer func() {
+		atomic.AddInt64(&l.queued, -1)
+		handshakeQueueDepth.Dec()
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a handshake slot: %w", ctx.Err())
+	}
+}
+
+// Release frees the slot taken by Acquire
+func (l *HandshakeLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Queued returns the number of callers waiting for a slot
+func (l *HandshakeLimiter) Queued() int {
+	if l == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.queued))
+}
+
+// InProgress returns the number of slots taken
+func (l *HandshakeLimiter) InProgress() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// SetHandshakeLimiter sets the limiter that connects, authentication
+// handshakes and tunnel data connections of the client wait for. A nil
+// limiter removes the limit.
+func (c *Client) SetHandshakeLimiter(l *HandshakeLimiter) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.handshakeLimiter = l
+}
+
+// acquireHandshake takes a slot of the client's handshake limiter. The
+// returned function releases it.
+func (c *Client) acquireHandshake(ctx context.Context) (func(), error) {
+	c.stateMu.RLock()
+	l := c.handshakeLimiter
+	c.stateMu.RUnlock()
+	if err := l.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	return l.Release, nil
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	limiter := NewHandshakeLimiter(2)
+	for i := 0; i < 2; i++ {
+		if err := limiter.Acquire(context.Background()); err != nil {
+			t.Fatalf("failed to acquire slot %d: %v", i, err)
+		}
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.Acquire(context.Background()) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.Queued() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the third handshake to queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-acquired:
+		t.Fatal("third handshake must wait while both slots are taken")
+	default:
+	}
+
+	limiter.Release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("failed to acquire released slot: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued handshake did not get the released slot")
+	}
+	if limiter.Queued() != 0 || limiter.InProgress() != 2 {
+		t.Errorf("expected 0 queued and 2 in progress, got %d and %d", limiter.Queued(), limiter.InProgress())
+	}
+
+	// Waiting ends with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if limiter.Queued() != 0 {
+		t.Errorf("expected the cancelled handshake to leave the queue, got %d", limiter.Queued())
+	}
+
+	// No limit
+	unlimited := NewHandshakeLimiter(0)
+	if unlimited != nil {
+		t.Fatal("expected no limiter for a limit of zero")
+	}
+	for i := 0; i < 100; i++ {
+		if err := unlimited.Acquire(context.Background()); err != nil {
+			t.Fatalf("unlimited acquire failed: %v", err)
+		}
+	}
+	unlimited.Release()
+}
+
+func TestHandshakeWaitsForLimiter(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(nil))
+	limiter := NewHandshakeLimiter(1)
+	client := NewClient(false, nil)
+	client.SetHandshakeLimiter(limiter)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	// Another client holds the only slot
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("failed to acquire slot: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.HandshakeContext(ctx, "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the handshake to time out waiting for a slot, got %v", err)
+	}
+
+	limiter.Release()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if limiter.InProgress() != 0 {
+		t.Errorf("expected the handshake to release its slot, %d in progress", limiter.InProgress())
+	}
+}
@@ -0,0 +1,570 @@
+package relay
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+)
+
+// startFakeRelay accepts a single connection and passes it to handler
+func startFakeRelay(t *testing.T, handler func(r *bufio.Reader, w net.Conn)) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handler(bufio.NewReader(conn), conn)
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// acceptHandshake answers the hello and the auth of a client like a relay
+// without optional features that accepts any token
+func acceptHandshake(r *bufio.Reader, w net.Conn) error {
+	if _, err := readJSONLine(r); err != nil {
+		return err
+	}
+	writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": "2.0"})
+	if _, err := readJSONLine(r); err != nil {
+		return err
+	}
+	writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+	return nil
+}
+
+func readJSONLine(r *bufio.Reader) (map[string]interface{}, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var msg map[string]interface{}
+	err = json.Unmarshal(line, &msg)
+	return msg, err
+}
+
+func writeJSONLine(w net.Conn, msg interface{}) {
+	data, _ := json.Marshal(msg)
+	w.Write(append(data, '\n'))
+}
+
+// pqRelay answers the hello with a post-quantum selection picked from the
+// given supported levels and accepts any auth
+func pqRelay(kyber, dilithium []int) func(r *bufio.Reader, w net.Conn) {
+	return func(r *bufio.Reader, w net.Conn) {
+		hello, err := readJSONLine(r)
+		if err != nil {
+			return
+		}
+
+		response := map[string]interface{}{"type": MessageTypeHello, "version": "2.0"}
+		if raw, ok := hello["post_quantum"]; ok {
+			data, _ := json.Marshal(raw)
+			var proposal quantum.Proposal
+			json.Unmarshal(data, &proposal)
+			if selection, err := proposal.Select(kyber, dilithium); err == nil {
+				response["post_quantum"] = selection
+			} else {
+				response["post_quantum"] = nil
+			}
+		}
+		writeJSONLine(w, response)
+
+		if _, err := readJSONLine(r); err != nil {
+			return
+		}
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+	}
+}
+
+func newPQClient(t *testing.T, kyber, dilithium int) *Client {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Quantum.Enabled = true
+	cfg.Quantum.KyberSecurityLevel = kyber
+	cfg.Quantum.DilithiumSecurityLevel = dilithium
+
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestHandshakeNegotiatesPostQuantumLevels(t *testing.T) {
+	port := startFakeRelay(t, pqRelay([]int{512, 768}, []int{2, 3}))
+
+	client := newPQClient(t, 512, 2)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	selection := client.GetPostQuantumSelection()
+	if selection == nil || selection.KyberLevel != 768 || selection.DilithiumLevel != 3 {
+		t.Fatalf("unexpected selection: %+v", selection)
+	}
+	kyber, signer := client.GetPostQuantumCrypto()
+	if kyber.GetSecurityLevel() != 768 || signer.GetSecurityLevel() != 3 {
+		t.Errorf("negotiated levels not applied: kyber %d, dilithium %d", kyber.GetSecurityLevel(), signer.GetSecurityLevel())
+	}
+
+	state, _ := client.ExportState()
+	if state.Protocol.PostQuantum == nil || state.Protocol.PostQuantum.KyberLevel != 768 {
+		t.Errorf("negotiated level missing from state: %+v", state.Protocol)
+	}
+}
+
+func TestHandshakeRejectsNoCommonPostQuantumLevel(t *testing.T) {
+	port := startFakeRelay(t, pqRelay([]int{512}, []int{2}))
+
+	client := newPQClient(t, 1024, 5)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	err := client.Handshake("token")
+	if !errors.Is(err, quantum.ErrNoCommonLevel) {
+		t.Fatalf("expected ErrNoCommonLevel, got %v", err)
+	}
+	if client.GetPostQuantumSelection() != nil {
+		t.Error("expected no negotiated selection")
+	}
+}
+
+func TestHandshakeFallsBackWithoutPostQuantum(t *testing.T) {
+	// A relay that predates post-quantum negotiation ignores the proposal
+	legacy := func(r *bufio.Reader, w net.Conn) {
+		if err := acceptHandshake(r, w); err != nil {
+			return
+		}
+	}
+
+	client := newPQClient(t, 512, 2)
+	if err := client.Connect("127.0.0.1", startFakeRelay(t, legacy)); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("expected fallback to classical crypto, got %v", err)
+	}
+	if client.GetPostQuantumSelection() != nil {
+		t.Error("expected no negotiated selection")
+	}
+
+	required := newPQClient(t, 512, 2)
+	required.SetPostQuantumRequired(true)
+	if err := required.Connect("127.0.0.1", startFakeRelay(t, legacy)); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer required.Close()
+	if err := required.Handshake("token"); !errors.Is(err, quantum.ErrNoCommonLevel) {
+		t.Errorf("expected ErrNoCommonLevel when post-quantum is required, got %v", err)
+	}
+}
+
+// deflateRelay is a fake relay handler that negotiates deflate compression,
+// answers each heartbeat after replyDelay and accepts every tunnel
+func deflateRelay(replyDelay time.Duration) func(r *bufio.Reader, w net.Conn) {
+	return func(r *bufio.Reader, w net.Conn) {
+		hello, err := readJSONLine(r)
+		if err != nil {
+			return
+		}
+		if offered, _ := hello["compression"].([]interface{}); len(offered) != 1 || offered[0] != "deflate" {
+			return
+		}
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": "2.0", "compression": "deflate"})
+
+		// Everything after the hello exchange is compressed
+		cr := bufio.NewReader(flate.NewReader(r))
+		cw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		send := func(msg interface{}) {
+			data, _ := json.Marshal(msg)
+			cw.Write(append(data, '\n'))
+			cw.Flush()
+		}
+
+		if _, err := readJSONLine(cr); err != nil {
+			return
+		}
+		send(map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+
+		for {
+			msg, err := readJSONLine(cr)
+			if err != nil {
+				return
+			}
+			switch msg["type"] {
+			case MessageTypeHeartbeat:
+				time.Sleep(replyDelay)
+				send(map[string]interface{}{"type": MessageTypeHeartbeatResponse})
+			case MessageTypeTunnelInfo:
+				send(map[string]interface{}{
+					"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+				})
+			}
+		}
+	}
+}
+
+// connectDeflateClient connects and authenticates a client offering deflate
+// compression
+func connectDeflateClient(t *testing.T, port int) *Client {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Protocol.Compression = "deflate"
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if client.GetCompression() != "deflate" {
+		t.Fatalf("expected deflate compression, got %q", client.GetCompression())
+	}
+	return client
+}
+
+func TestHandshakeNegotiatesCompression(t *testing.T) {
+	port := startFakeRelay(t, deflateRelay(0))
+	client := connectDeflateClient(t, port)
+
+	// Several messages in a row must each be decodable on arrival
+	for i := 0; i < 3; i++ {
+		if err := client.SendMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err != nil {
+			t.Fatalf("failed to send heartbeat: %v", err)
+		}
+		msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read heartbeat response: %v", err)
+		}
+		if msg["type"] != MessageTypeHeartbeatResponse {
+			t.Errorf("unexpected message: %v", msg)
+		}
+	}
+
+	state, _ := client.ExportState()
+	if state.Protocol.Compression != "deflate" {
+		t.Errorf("compression missing from state: %+v", state.Protocol)
+	}
+}
+
+func TestCompressedReadSurvivesTimeout(t *testing.T) {
+	port := startFakeRelay(t, deflateRelay(200*time.Millisecond))
+	client := connectDeflateClient(t, port)
+
+	if err := client.SendMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	if _, err := client.readMessageUntil(time.Now().Add(50 * time.Millisecond)); err == nil {
+		t.Fatal("expected the first read to time out")
+	}
+
+	// The reply arriving after the timeout must still be readable
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read heartbeat response after a timeout: %v", err)
+	}
+	if msg["type"] != MessageTypeHeartbeatResponse {
+		t.Errorf("unexpected message: %v", msg)
+	}
+	if !client.IsConnected() {
+		t.Error("client should still be connected")
+	}
+}
+
+func TestHandshakeWithoutCompressionSupport(t *testing.T) {
+	port := startFakeRelay(t, pqRelay(nil, nil))
+
+	client := NewClient(false, nil)
+	if err := client.SetCompression([]string{"deflate"}); err != nil {
+		t.Fatalf("failed to set compression: %v", err)
+	}
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if client.GetCompression() != "" {
+		t.Errorf("expected uncompressed connection, got %q", client.GetCompression())
+	}
+	if err := client.SetCompression([]string{"zstd"}); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	port := startFakeRelay(t, pqRelay(nil, nil))
+
+	client := NewClient(false, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.WaitUntilReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded before connecting, got %v", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		waitErr <- client.WaitUntilReady(ctx)
+	}()
+
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if client.IsReady() {
+		t.Error("client must not be ready before the handshake")
+	}
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	if err := <-waitErr; err != nil {
+		t.Fatalf("expected client to become ready, got %v", err)
+	}
+	if !client.IsReady() {
+		t.Error("expected client to be ready")
+	}
+
+	client.Close()
+	if client.IsReady() {
+		t.Error("client must not be ready after close")
+	}
+}
+
+func TestHandshakeContextBoundsWholeExchange(t *testing.T) {
+	// Every step of this relay is well within ReadWriteTimeout, but together
+	// they take longer than the handshake deadline
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		if _, err := readJSONLine(r); err != nil {
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": "2.0"})
+		if _, err := readJSONLine(r); err != nil {
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+	})
+
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.HandshakeContext(ctx, "token")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handshake took %v despite a 200ms deadline", elapsed)
+	}
+	if client.IsReady() {
+		t.Error("client must not be ready after a failed handshake")
+	}
+}
+
+func TestHandshakeAdvertisesConfiguredFeatures(t *testing.T) {
+	advertised := make(chan interface{}, 1)
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		hello, err := readJSONLine(r)
+		if err != nil {
+			return
+		}
+		advertised <- hello["features"]
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": "2.0"})
+		if _, err := readJSONLine(r); err != nil {
+			return
+		}
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+	})
+
+	cfg := &config.Config{}
+	cfg.Protocol.Features = []string{protocol.FeatureTLS, protocol.FeatureHeartbeat}
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	features, _ := (<-advertised).([]interface{})
+	if len(features) != 2 || features[0] != protocol.FeatureTLS || features[1] != protocol.FeatureHeartbeat {
+		t.Errorf("expected only configured features to be advertised, got %v", features)
+	}
+
+	cfg.Protocol.Features = []string{protocol.FeatureTLS, "bogus"}
+	if _, err := NewClientFromConfig(cfg); err == nil {
+		t.Error("expected error for unknown feature")
+	}
+
+	// Features of older clients are dropped rather than rejected
+	cfg.Protocol.Features = []string{protocol.FeatureTLS, "p2p_mesh", "ai_monitoring"}
+	legacy, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("legacy features rejected: %v", err)
+	}
+	if len(legacy.features) != 1 || legacy.features[0] != protocol.FeatureTLS {
+		t.Errorf("expected legacy features to be dropped, got %v", legacy.features)
+	}
+}
+
+func TestHandshakeWithoutServerHello(t *testing.T) {
+	// The relay reads the hello but never answers
+	silent := func(r *bufio.Reader, w net.Conn) {
+		readJSONLine(r)
+		time.Sleep(time.Second)
+	}
+
+	client := NewClient(false, nil)
+	client.SetHelloTimeout(50 * time.Millisecond)
+	if err := client.Connect("127.0.0.1", startFakeRelay(t, silent)); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	err := client.HandshakeContext(context.Background(), "token")
+	if !errors.Is(err, ErrNoServerHello) {
+		t.Fatalf("expected ErrNoServerHello, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("handshake took %v, expected the hello timeout", elapsed)
+	}
+
+	// A shorter handshake deadline is reported as such
+	client = NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", startFakeRelay(t, silent)); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.HandshakeContext(ctx, "token")
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrNoServerHello) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestHandshakeRejectsOldServer(t *testing.T) {
+	relay := func(version string) func(r *bufio.Reader, w net.Conn) {
+		return func(r *bufio.Reader, w net.Conn) {
+			if _, err := readJSONLine(r); err != nil {
+				return
+			}
+			writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": version})
+			if _, err := readJSONLine(r); err != nil {
+				return
+			}
+			writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+		}
+	}
+
+	for version, wantErr := range map[string]bool{"1.0.0": true, "": true, "2.0": false, "2.1.3": false} {
+		client := NewClient(false, nil)
+		if err := client.SetMinVersion("2.0"); err != nil {
+			t.Fatalf("failed to set min version: %v", err)
+		}
+		if err := client.Connect("127.0.0.1", startFakeRelay(t, relay(version))); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+
+		err := client.Handshake("token")
+		if wantErr && !errors.Is(err, ErrServerTooOld) {
+			t.Errorf("version %q: expected ErrServerTooOld, got %v", version, err)
+		}
+		if !wantErr && err != nil {
+			t.Errorf("version %q: unexpected error: %v", version, err)
+		}
+		client.Close()
+	}
+
+	if err := NewClient(false, nil).SetMinVersion("latest"); err == nil {
+		t.Error("expected invalid min version to be rejected")
+	}
+}
+
+func TestHandshakeExtensions(t *testing.T) {
+	clientInfo := make(chan interface{}, 1)
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		if _, err := readJSONLine(r); err != nil {
+			return
+		}
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeHello, "version": "2.0", "region": "eu-west", "features": []string{}})
+		auth, err := readJSONLine(r)
+		if err != nil {
+			return
+		}
+		clientInfo <- auth["client_info"]
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeAuthResponse, "status": "success"})
+	})
+
+	cfg := &config.Config{Labels: map[string]string{"site": "lab"}}
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.SetClientInfo(map[string]interface{}{"region_hint": "eu", "labels": "overridden"})
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	info, _ := (<-clientInfo).(map[string]interface{})
+	labels, _ := info["labels"].(map[string]interface{})
+	if info["region_hint"] != "eu" || labels["site"] != "lab" {
+		t.Errorf("expected custom fields next to the labels, got %v", info)
+	}
+	extras := client.ServerHelloExtras()
+	if len(extras) != 1 || extras["region"] != "eu-west" {
+		t.Errorf("expected only the region as extra, got %v", extras)
+	}
+}
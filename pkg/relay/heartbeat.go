@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatStats summarizes the heartbeats of the current connection, as a
+// measure of its quality
+type HeartbeatStats struct {
+	// Answered is the number of heartbeats the relay answered
+	Answered int64 `json:"answered"`
+	// Missed is the number of heartbeats in a row that went unanswered
+	Missed int `json:"missed"`
+	// LastRTT and AverageRTT are the round trip times of the answered
+	// heartbeats
+	LastRTT    time.Duration `json:"last_rtt"`
+	AverageRTT time.Duration `json:"average_rtt"`
+}
+
+// HeartbeatStats returns the heartbeat statistics since StartHeartbeat
+func (c *Client) HeartbeatStats() HeartbeatStats {
+	c.stateMu.RLock()
+	stats := c.heartbeatStats
+	c.stateMu.RUnlock()
+	stats.Missed = int(atomic.LoadInt32(&c.missedHeartbeats))
+	return stats
+}
+
+// heartbeatAverageWindow caps the weight of earlier heartbeats in
+// AverageRTT, which keeps the average from overflowing and following the
+// link only slowly on connections that are up for months
+const heartbeatAverageWindow = 1 << 16
+
+// recordHeartbeatRTT adds an answered heartbeat to the statistics. The
+// average is cumulative for the first heartbeatAverageWindow heartbeats and
+// a moving average afterwards.
+func (c *Client) recordHeartbeatRTT(rtt time.Duration) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	stats := &c.heartbeatStats
+	weight := time.Duration(min(stats.Answered, heartbeatAverageWindow))
+	stats.AverageRTT = (stats.AverageRTT*weight + rtt) / (weight + 1)
+	stats.Answered++
+	stats.LastRTT = rtt
+}
+
+// StartHeartbeat sends a heartbeat every HeartbeatInterval and waits up to
+// HeartbeatTimeout for the heartbeat_response. Once more than
+// MaxMissedHeartbeats heartbeats in a row go unanswered, the connection is
+// closed. The heartbeats run until Close or Shutdown; starting them again
+// while they run has no effect.
+func (c *Client) StartHeartbeat() {
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+	if c.heartbeatDone != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.stopHeartbeat, c.heartbeatDone = stop, done
+	atomic.StoreInt32(&c.missedHeartbeats, 0)
+	c.stateMu.Lock()
+	c.heartbeatStats = HeartbeatStats{}
+	c.stateMu.Unlock()
+	go c.heartbeatLoop(stop, done)
+}
+
+// heartbeatRunning reports whether the heartbeats run
+func (c *Client) heartbeatRunning() bool {
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+	return c.heartbeatDone != nil
+}
+
+// stopHeartbeats signals the heartbeat goroutine to stop and waits for it
+func (c *Client) stopHeartbeats() {
+	c.heartbeatMu.Lock()
+	stop, done := c.stopHeartbeat, c.heartbeatDone
+	c.heartbeatDone = nil
+	c.heartbeatMu.Unlock()
+	if done == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+func (c *Client) heartbeatLoop(stop, done chan struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	interval := c.heartbeatInterval
+	if interval <= 0 {
+		interval = HeartbeatInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := c.sendHeartbeat(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			atomic.StoreInt32(&c.missedHeartbeats, 0)
+			continue
+		}
+
+		missed := atomic.AddInt32(&c.missedHeartbeats, 1)
+		RecordMissedHeartbeat()
+		if m := c.clientMetrics(); m != nil {
+			m.IncHeartbeatErrors()
+		}
+		log.Printf("Heartbeat failed (%d missed): %v", missed, err)
+		if missed > MaxMissedHeartbeats {
+			log.Printf("Relay missed %d heartbeats, closing connection", missed)
+			c.connectionLost(fmt.Errorf("relay missed %d heartbeats: %w", missed, err))
+			c.closeConn()
+			return
+		}
+	}
+}
+
+// sendHeartbeat sends one heartbeat and waits for its response
+func (c *Client) sendHeartbeat(ctx context.Context) error {
+	timeout := c.heartbeatTimeout
+	if timeout <= 0 {
+		timeout = HeartbeatTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Relays that do not echo the request ID still answer this heartbeat
+	id := c.nextRequestID()
+	c.pendingMu.Lock()
+	c.heartbeatID = id
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		c.heartbeatID = ""
+		c.pendingMu.Unlock()
+	}()
+
+	start := time.Now()
+	resp, err := c.roundTrip(ctx, map[string]interface{}{
+		"type":       MessageTypeHeartbeat,
+		"request_id": id,
+	})
+	if err != nil {
+		return err
+	}
+	if resp["type"] != MessageTypeHeartbeatResponse {
+		return fmt.Errorf("unexpected message type %v instead of heartbeat_response", resp["type"])
+	}
+
+	latency := time.Since(start)
+	c.recordHeartbeatRTT(latency)
+	RecordHeartbeat(latency.Seconds())
+	if m := c.clientMetrics(); m != nil {
+		m.ObserveHeartbeatLatency(latency)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var answer, beats int32 = 1, 0
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		if err := acceptHandshake(r, w); err != nil {
+			return
+		}
+
+		for {
+			msg, err := readJSONLine(r)
+			if err != nil {
+				return
+			}
+			if msg["type"] != MessageTypeHeartbeat {
+				continue
+			}
+			atomic.AddInt32(&beats, 1)
+			// The response carries no request ID, like older relays send it
+			if atomic.LoadInt32(&answer) == 1 {
+				writeJSONLine(w, map[string]interface{}{"type": MessageTypeHeartbeatResponse})
+			}
+		}
+	})
+
+	client := NewClient(false, nil)
+	client.heartbeatInterval = 20 * time.Millisecond
+	client.heartbeatTimeout = 20 * time.Millisecond
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	client.StartHeartbeat()
+	client.StartHeartbeat()
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&beats) == 0 {
+		t.Fatal("expected heartbeats to be sent")
+	}
+	if missed := atomic.LoadInt32(&client.missedHeartbeats); missed != 0 {
+		t.Errorf("expected answered heartbeats, got %d missed", missed)
+	}
+	if stats := client.HeartbeatStats(); stats.Answered == 0 || stats.LastRTT <= 0 || stats.AverageRTT <= 0 {
+		t.Errorf("expected answered heartbeats in the stats, got %+v", stats)
+	}
+
+	// Unanswered heartbeats close the connection
+	done := client.heartbeatDone
+	atomic.StoreInt32(&answer, 0)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected heartbeats to give up after missed heartbeats")
+	}
+	if client.ready.IsReady() {
+		t.Error("expected client to be not ready")
+	}
+	if _, err := client.ReadMessage(); err == nil {
+		t.Error("expected connection to be closed")
+	}
+	if missed := atomic.LoadInt32(&client.missedHeartbeats); missed <= MaxMissedHeartbeats {
+		t.Errorf("expected more than %d missed heartbeats, got %d", MaxMissedHeartbeats, missed)
+	}
+}
+
+func TestHeartbeatAlongsideTunnels(t *testing.T) {
+	plain := tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		switch msg["type"] {
+		case MessageTypeHeartbeat:
+			writeJSONLine(w, map[string]interface{}{"type": MessageTypeHeartbeatResponse, "request_id": msg["request_id"]})
+		case MessageTypeTunnelInfo:
+			writeJSONLine(w, map[string]interface{}{
+				"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+			})
+		}
+	})
+	tests := []struct {
+		name    string
+		relay   func(r *bufio.Reader, w net.Conn)
+		connect func(t *testing.T, port int) *Client
+	}{
+		{"plain", plain, connectTunnelClient},
+		{"deflate", deflateRelay(0), connectDeflateClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.connect(t, startFakeRelay(t, tt.relay))
+			client.heartbeatInterval = time.Millisecond
+			client.heartbeatTimeout = time.Second
+			client.StartHeartbeat()
+
+			// Heartbeats and tunnel requests share the connection
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := client.CreateTunnelContext(context.Background(), freePort(t), "10.0.0.1", 3389); err != nil {
+						errs <- err
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("failed to create tunnel: %v", err)
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			if stats := client.HeartbeatStats(); stats.Answered == 0 || stats.Missed != 0 {
+				t.Errorf("expected answered heartbeats only, got %+v", stats)
+			}
+			if !client.IsConnected() {
+				t.Error("client should still be connected")
+			}
+			if tunnels := client.ListTunnels(); len(tunnels) != 10 {
+				t.Errorf("expected 10 tunnels, got %d", len(tunnels))
+			}
+		})
+	}
+}
+
+func TestCloseStopsHeartbeat(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	client.heartbeatInterval = time.Hour
+	client.StartHeartbeat()
+
+	done := client.heartbeatDone
+	if err := client.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected heartbeat goroutine to exit on Close")
+	}
+}
+
+func TestDisconnectHandler(t *testing.T) {
+	port := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		if err := acceptHandshake(r, w); err != nil {
+			return
+		}
+		// The relay goes away right after the handshake
+	})
+
+	client := NewClient(false, nil)
+	lost := make(chan error, 2)
+	client.SetDisconnectHandler(func(err error) { lost <- err })
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	done := client.Done()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	if _, err := client.ReadMessage(); err == nil {
+		t.Fatal("expected read to fail")
+	}
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Error("expected the read error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect handler was not called")
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected Done channel to be closed")
+	}
+
+	// Further failures on the same connection are not reported again
+	client.ReadMessage()
+	client.Close()
+	select {
+	case err := <-lost:
+		t.Errorf("unexpected second disconnect: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCloseClosesDoneWithoutHandler(t *testing.T) {
+	client := connectTunnelClient(t, startForwardingRelay(t))
+	called := make(chan struct{}, 1)
+	client.SetDisconnectHandler(func(error) { called <- struct{}{} })
+
+	done := client.Done()
+	client.Close()
+	select {
+	case <-done:
+	default:
+		t.Fatal("expected Done channel to be closed")
+	}
+	select {
+	case <-called:
+		t.Error("deliberate close must not call the disconnect handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatAverageRTTLongRunning(t *testing.T) {
+	c := &Client{}
+	c.heartbeatStats = HeartbeatStats{Answered: math.MaxInt64 / 2, AverageRTT: 50 * time.Millisecond}
+
+	// Past the window a new round trip still moves the average, without
+	// overflowing
+	c.recordHeartbeatRTT(50*time.Millisecond + heartbeatAverageWindow*time.Microsecond)
+	if got := c.HeartbeatStats().AverageRTT; got <= 50*time.Millisecond || got > 50*time.Millisecond+time.Microsecond {
+		t.Errorf("unexpected average RTT %v", got)
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// lineReader reads the newline-delimited messages of one connection. Reads
+// are cut short by deadlines whenever a request gives up waiting, so a line
+// read only in part is kept for the next read rather than lost to whoever
+// reads next.
+type lineReader struct {
+	// conn is what read deadlines are set on
+	conn    net.Conn
+	r       *bufio.Reader
+	partial []byte
+}
+
+// newLineReader returns a lineReader reading r, with read deadlines set on
+// conn
+func newLineReader(conn net.Conn, r *bufio.Reader) *lineReader {
+	return &lineReader{conn: conn, r: r}
+}
+
+// readLine returns the next complete line, including the newline
+func (l *lineReader) readLine() (string, error) {
+	line, err := l.r.ReadString('\n')
+	if err != nil {
+		l.partial = append(l.partial, line...)
+		if len(l.partial) > MaxMessageSize {
+			l.partial = nil
+			return "", fmt.Errorf("message too large")
+		}
+		return "", err
+	}
+	if len(l.partial) > 0 {
+		line = string(l.partial) + line
+		l.partial = nil
+	}
+	return line, nil
+}
+
+// lineBuffered reports whether a complete line can be read without reading
+// from the connection
+func (l *lineReader) lineBuffered() bool {
+	buffered, _ := l.r.Peek(l.r.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// connReader returns the line reader of the current connection. MigrateTo
+// swaps it, so it is read under stateMu.
+func (c *Client) connReader() *lineReader {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.reader
+}
+
+// interruptOnDone sets the deadline of a connection to now once ctx is done,
+// cutting short a read or write in progress. The returned stop function
+// returns only once a deadline set this way has been set, so it cannot
+// override the deadline of the next read or write.
+func interruptOnDone(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	done := make(chan struct{})
+	stopFunc := context.AfterFunc(ctx, func() {
+		defer close(done)
+		setDeadline(time.Now())
+	})
+	return func() {
+		if !stopFunc() {
+			<-done
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package relay
 
 import (
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -30,6 +32,11 @@ var (
 		Help: "Number of active tunnels",
 	})
 
+	maxTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_max_tunnels",
+		Help: "Maximum number of tunnels the client may hold, 0 if unlimited",
+	})
+
 	// Heartbeat metrics
 	heartbeatLatency = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "relay_heartbeat_latency_seconds",
@@ -41,6 +48,41 @@ var (
 		Name: "relay_missed_heartbeats_total",
 		Help: "Total number of missed heartbeats",
 	})
+
+	tunnelCreateTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_tunnel_create_timeouts_total",
+		Help: "Total number of tunnel creations the relay did not answer in time",
+	})
+
+	drainsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_drains_total",
+		Help: "Total number of drain requests from the relay by migration result",
+	}, []string{"result"})
+
+	handshakeQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_handshake_queue_depth",
+		Help: "Number of connects and handshakes waiting for a free handshake slot",
+	})
+
+	poolConnectionUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_pool_connection_up",
+		Help: "Whether a connection of the relay client pool is up (1) or down (0)",
+	}, []string{"connection"})
+
+	poolConnectionTunnels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_pool_connection_tunnels",
+		Help: "Number of tunnels carried by a connection of the relay client pool",
+	}, []string{"connection"})
+
+	messageDecodeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "client_message_decode_errors_total",
+		Help: "Total number of relay messages that could not be decoded",
+	})
+
+	messageHandlerPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "client_message_handler_panics_total",
+		Help: "Total number of panics recovered while handling relay messages",
+	})
 )
 
 // RecordConnection records a new connection
@@ -59,6 +101,11 @@ func SetActiveTunnels(count int) {
 	activeTunnels.Set(float64(count))
 }
 
+// SetMaxTunnels sets the configured maximum number of tunnels
+func SetMaxTunnels(count int) {
+	maxTunnels.Set(float64(count))
+}
+
 // RecordHeartbeat records a heartbeat
 func RecordHeartbeat(latency float64) {
 	heartbeatLatency.Observe(latency)
@@ -67,4 +114,29 @@ func RecordHeartbeat(latency float64) {
 // RecordMissedHeartbeat records a missed heartbeat
 func RecordMissedHeartbeat() {
 	missedHeartbeats.Inc()
-} 
\ No newline at end of file
+}
+
+// RecordDrain records a drain request and whether the client migrated
+func RecordDrain(migrated bool) {
+	result := "migrated"
+	if !migrated {
+		result = "failed"
+	}
+	drainsTotal.WithLabelValues(result).Inc()
+}
+
+// RecordTunnelCreateTimeout records a tunnel creation that timed out
+func RecordTunnelCreateTimeout() {
+	tunnelCreateTimeouts.Inc()
+} 
+
+// SetPoolConnection records the state of a connection of a client pool
+func SetPoolConnection(index int, up bool, tunnels int) {
+	connection := strconv.Itoa(index)
+	value := 0.0
+	if up {
+		value = 1
+	}
+	poolConnectionUp.WithLabelValues(connection).Set(value)
+	poolConnectionTunnels.WithLabelValues(connection).Set(float64(tunnels))
+}
@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MessageTypeDrain is sent by a relay going into maintenance to ask clients
+// to move to another relay. It may carry a suggested "endpoint" (host:port)
+// and a "reason".
+const MessageTypeDrain = "drain"
+
+// MigrateTimeout bounds connecting and handshaking with the new relay when
+// the current one drains
+const MigrateTimeout = 30 * time.Second
+
+// MigrationState describes the last migration away from a draining relay
+type MigrationState struct {
+	From   string    `json:"from"`
+	To     string    `json:"to,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// HandleControlMessage handles unsolicited control messages from the relay.
+// It reports whether msg was one. A drain request starts a migration in the
+// background.
+func (c *Client) HandleControlMessage(msg map[string]interface{}) bool {
+	if msg["type"] != MessageTypeDrain {
+		return false
+	}
+
+	endpoint, _ := msg["endpoint"].(string)
+	reason, _ := msg["reason"].(string)
+	go c.drain(endpoint, reason)
+	return true
+}
+
+// drain migrates to the endpoint suggested by the relay, or else to the
+// first configured failover endpoint that accepts the connection
+func (c *Client) drain(suggested, reason string) {
+	c.stateMu.RLock()
+	from := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	c.stateMu.RUnlock()
+
+	var candidates []string
+	if suggested != "" {
+		candidates = append(candidates, suggested)
+	}
+	if c.cfg != nil {
+		candidates = append(candidates, c.cfg.Server.Failover...)
+	}
+
+	state := MigrationState{From: from, Reason: reason, At: time.Now()}
+	err := fmt.Errorf("no alternate relay endpoint available")
+	for _, endpoint := range candidates {
+		if endpoint == from {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), MigrateTimeout)
+		err = c.MigrateTo(ctx, endpoint)
+		cancel()
+		if err == nil {
+			state.To = endpoint
+			break
+		}
+		log.Printf("Failed to migrate from draining relay %s to %s: %v", from, endpoint, err)
+	}
+
+	if err != nil {
+		state.Error = err.Error()
+		RecordDrain(false)
+		log.Printf("Relay %s is draining and no migration succeeded: %v", from, err)
+	} else {
+		RecordDrain(true)
+		log.Printf("Migrated from draining relay %s to %s", from, state.To)
+	}
+
+	c.stateMu.Lock()
+	c.migration = &state
+	c.stateMu.Unlock()
+}
+
+// MigrateTo moves the client to the relay at endpoint (host:port) without
+// dropping the session in between: the new connection is established and
+// authenticated and the active tunnels are registered on it under their IDs
+// first, then it is swapped in, the heartbeats are restarted on it and the
+// old connection is closed.
+func (c *Client) MigrateTo(ctx context.Context, endpoint string) error {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid relay endpoint %q: %w", endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid relay endpoint %q: %w", endpoint, err)
+	}
+
+	c.stateMu.RLock()
+	token := c.token
+	c.stateMu.RUnlock()
+
+	next := c.newSession()
+	if err := next.Connect(host, port); err != nil {
+		return err
+	}
+	if err := next.HandshakeContext(ctx, token); err != nil {
+		next.Close()
+		return fmt.Errorf("handshake with %s failed: %w", endpoint, err)
+	}
+	if err := next.replayTunnels(ctx, c.ListTunnels()); err != nil {
+		next.Close()
+		return fmt.Errorf("failed to register tunnels with %s: %w", endpoint, err)
+	}
+
+	// The heartbeats of the old connection must not count against the new
+	// one
+	heartbeats := c.heartbeatRunning()
+	if heartbeats {
+		c.stopHeartbeats()
+	}
+
+	// Wait until no request is reading from the old connection
+	select {
+	case c.readToken <- struct{}{}:
+	case <-ctx.Done():
+		next.Close()
+		if heartbeats {
+			c.StartHeartbeat()
+		}
+		return ctx.Err()
+	}
+	c.stateMu.Lock()
+	old := c.conn
+	c.conn = next.conn
+	c.reader = next.reader
+	c.writer = next.writer
+	c.compressor = next.compressor
+	c.host = host
+	c.port = port
+	c.serverVersion = next.serverVersion
+	c.serverFeatures = next.serverFeatures
+	c.helloExtras = next.helloExtras
+	c.pqSelection = next.pqSelection
+	c.compressionAlgo = next.compressionAlgo
+	c.stateMu.Unlock()
+	<-c.readToken
+
+	c.ready.Set(true)
+	if heartbeats {
+		c.StartHeartbeat()
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// replayTunnels registers tunnels, which are active on another connection,
+// with the relay of c. The relay has to accept them under their IDs, which
+// the data connections and the callers of the client know them by.
+func (c *Client) replayTunnels(ctx context.Context, tunnels []*Tunnel) error {
+	for _, t := range tunnels {
+		replayed := &Tunnel{
+			ID:         t.ID,
+			LocalPort:  t.LocalPort,
+			RemoteHost: t.RemoteHost,
+			RemotePort: t.RemotePort,
+			Protocol:   t.Protocol,
+		}
+		if err := c.registerTunnel(ctx, replayed); err != nil {
+			return fmt.Errorf("tunnel %s: %w", t.ID, err)
+		}
+		if replayed.ID != t.ID {
+			return fmt.Errorf("tunnel %s: relay assigned tunnel ID %s", t.ID, replayed.ID)
+		}
+	}
+	return nil
+}
+
+// newSession returns an unconnected client for another connection to the
+// relay with the settings of c: the same TLS configuration, handshake
+// parameters, handshake limiter and metrics
+func (c *Client) newSession() *Client {
+	c.stateMu.RLock()
+	clientInfo, limiter := c.clientInfo, c.handshakeLimiter
+	c.stateMu.RUnlock()
+
+	return &Client{
+		useTLS:           c.useTLS,
+		config:           c.config,
+		cfg:              c.cfg,
+		readToken:        make(chan struct{}, 1),
+		decodeLimit:      atomic.LoadInt32(&c.decodeLimit),
+		metrics:          c.clientMetrics(),
+		protocolEngine:   c.protocolEngine,
+		tenantID:         c.tenantID,
+		labels:           c.labels,
+		minVersion:       c.minVersion,
+		version:          c.version,
+		features:         c.features,
+		pqProposal:       c.pqProposal,
+		pqRequired:       c.pqRequired,
+		pqKyber:          c.pqKyber,
+		pqSigner:         c.pqSigner,
+		compression:      c.compression,
+		clientInfo:       clientInfo,
+		helloTimeout:     c.helloTimeout,
+		handshakeLimiter: limiter,
+	}
+}
@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainMigratesToSuggestedRelay(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	nextPort := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		pqRelay(nil, nil)(r, w)
+		if msg, err := readJSONLine(r); err == nil {
+			received <- msg
+		}
+	})
+	drainingPort := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		pqRelay(nil, nil)(r, w)
+		writeJSONLine(w, map[string]interface{}{
+			"type":     MessageTypeDrain,
+			"endpoint": fmt.Sprintf("127.0.0.1:%d", nextPort),
+			"reason":   "maintenance",
+		})
+		r.ReadByte()
+	})
+
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", drainingPort); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read drain message: %v", err)
+	}
+	if !client.HandleControlMessage(msg) {
+		t.Fatal("expected drain to be handled as a control message")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	var state StateSnapshot
+	for {
+		state, _ = client.ExportState()
+		if state.Migration != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not migrate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if state.Migration.Error != "" || state.Migration.Reason != "maintenance" {
+		t.Errorf("unexpected migration state: %+v", state.Migration)
+	}
+	if state.Endpoint.Port != nextPort || !client.IsReady() {
+		t.Errorf("expected client to be ready on port %d, got %+v", nextPort, state.Endpoint)
+	}
+
+	if err := client.SendMessage(map[string]interface{}{"type": MessageTypeHeartbeat}); err != nil {
+		t.Fatalf("failed to send after migration: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg["type"] != MessageTypeHeartbeat {
+			t.Errorf("unexpected message at the new relay: %v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("new relay did not receive the message")
+	}
+}
+
+func TestDrainWithoutAlternateRelay(t *testing.T) {
+	client := NewClient(false, nil)
+	client.drain("", "maintenance")
+
+	state, _ := client.ExportState()
+	if state.Migration == nil || state.Migration.Error == "" {
+		t.Errorf("expected failed migration to be recorded, got %+v", state.Migration)
+	}
+}
+
+// replayRelay accepts the handshake, answers the replayed tunnel_info with
+// the tunnel ID assign returns for the requested one and then answers
+// heartbeats, passing on every message it reads
+func replayRelay(received chan<- map[string]interface{}, assign func(requested interface{}) interface{}) func(r *bufio.Reader, w net.Conn) {
+	return func(r *bufio.Reader, w net.Conn) {
+		pqRelay(nil, nil)(r, w)
+		for {
+			msg, err := readJSONLine(r)
+			if err != nil {
+				return
+			}
+			received <- msg
+			switch msg["type"] {
+			case MessageTypeTunnelInfo:
+				writeJSONLine(w, map[string]interface{}{
+					"type":       MessageTypeTunnelResponse,
+					"request_id": msg["request_id"],
+					"status":     "success",
+					"tunnel_id":  assign(msg["tunnel_id"]),
+				})
+			case MessageTypeHeartbeat:
+				writeJSONLine(w, map[string]interface{}{
+					"type":       MessageTypeHeartbeatResponse,
+					"request_id": msg["request_id"],
+				})
+			}
+		}
+	}
+}
+
+func TestMigrateToReplaysTunnelsAndRestartsHeartbeat(t *testing.T) {
+	received := make(chan map[string]interface{}, 16)
+	nextPort := startFakeRelay(t, replayRelay(received, func(requested interface{}) interface{} {
+		return requested
+	}))
+	oldPort := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		pqRelay(nil, nil)(r, w)
+		// The old relay stops answering, as a draining relay may
+		for {
+			if _, err := readJSONLine(r); err != nil {
+				return
+			}
+		}
+	})
+
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", oldPort); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	client.tunnels["tunnel-1"] = &Tunnel{ID: "tunnel-1", LocalPort: 8080, RemoteHost: "db", RemotePort: 5432, Protocol: "tcp"}
+	client.heartbeatInterval = 20 * time.Millisecond
+	client.StartHeartbeat()
+
+	if err := client.MigrateTo(context.Background(), fmt.Sprintf("127.0.0.1:%d", nextPort)); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	msg := <-received
+	if msg["type"] != MessageTypeTunnelInfo || msg["tunnel_id"] != "tunnel-1" || msg["remote_host"] != "db" {
+		t.Errorf("expected the tunnel to be replayed first, got %v", msg)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.HeartbeatStats().Answered == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("heartbeats were not answered on the new connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if missed := client.HeartbeatStats().Missed; missed != 0 {
+		t.Errorf("expected no missed heartbeats, got %d", missed)
+	}
+}
+
+func TestMigrateToRejectsRenamedTunnels(t *testing.T) {
+	received := make(chan map[string]interface{}, 16)
+	nextPort := startFakeRelay(t, replayRelay(received, func(interface{}) interface{} {
+		return "other"
+	}))
+	oldPort := startFakeRelay(t, func(r *bufio.Reader, w net.Conn) {
+		pqRelay(nil, nil)(r, w)
+		r.ReadByte()
+	})
+
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", oldPort); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	client.tunnels["tunnel-1"] = &Tunnel{ID: "tunnel-1", LocalPort: 8080, RemoteHost: "db", RemotePort: 5432, Protocol: "tcp"}
+
+	if err := client.MigrateTo(context.Background(), fmt.Sprintf("127.0.0.1:%d", nextPort)); err == nil {
+		t.Fatal("expected migration to fail when the relay renames a tunnel")
+	}
+	if state, _ := client.ExportState(); state.Endpoint.Port != oldPort {
+		t.Errorf("expected client to stay on port %d, got %+v", oldPort, state.Endpoint)
+	}
+}
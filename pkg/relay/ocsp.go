@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrCertificateRevoked is returned by the TLS handshake when the OCSP
+// response for the relay certificate reports it revoked
+var ErrCertificateRevoked = errors.New("relay certificate revoked")
+
+// ocspClockSkew is how far the clocks of the client and the OCSP responder
+// may disagree
+const ocspClockSkew = 5 * time.Minute
+
+// ocspCache keeps the OCSP status of certificates until their response
+// expires, so a relay that does not staple on every handshake is accepted
+// while its last response is valid
+type ocspCache struct {
+	mu      sync.Mutex
+	entries map[[32]byte]ocspEntry
+	now     func() time.Time
+}
+
+type ocspEntry struct {
+	status     int
+	nextUpdate time.Time
+}
+
+func newOCSPCache() *ocspCache {
+	return &ocspCache{entries: make(map[[32]byte]ocspEntry), now: time.Now}
+}
+
+// requireOCSP makes tlsConfig reject relay certificates without a valid
+// stapled OCSP response, and revoked ones
+func requireOCSP(tlsConfig *tls.Config) {
+	cache := newOCSPCache()
+	next := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := cache.verify(cs); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+}
+
+// verify checks the OCSP response stapled to the connection, or the cached
+// one if none was stapled
+func (c *ocspCache) verify(cs tls.ConnectionState) error {
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if len(chain) < 2 {
+		return fmt.Errorf("OCSP check needs the issuer of the relay certificate")
+	}
+	leaf, issuer := chain[0], chain[1]
+	key := sha256.Sum256(leaf.Raw)
+	now := c.now()
+
+	if len(cs.OCSPResponse) == 0 {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+		if !ok || !now.Before(entry.nextUpdate) {
+			return fmt.Errorf("relay did not staple an OCSP response")
+		}
+		return entryError(entry)
+	}
+
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("invalid stapled OCSP response: %w", err)
+	}
+	if resp.ThisUpdate.After(now.Add(ocspClockSkew)) {
+		return fmt.Errorf("stapled OCSP response is not valid yet")
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate.Add(ocspClockSkew)) {
+		return fmt.Errorf("stapled OCSP response expired at %s", resp.NextUpdate)
+	}
+
+	entry := ocspEntry{status: resp.Status, nextUpdate: resp.NextUpdate}
+	// Without a next update, the response is only good for this handshake
+	if !resp.NextUpdate.IsZero() {
+		c.mu.Lock()
+		for cached, old := range c.entries {
+			if now.After(old.nextUpdate) {
+				delete(c.entries, cached)
+			}
+		}
+		c.entries[key] = entry
+		c.mu.Unlock()
+	}
+	return entryError(entry)
+}
+
+func entryError(entry ocspEntry) error {
+	switch entry.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return ErrCertificateRevoked
+	default:
+		return fmt.Errorf("OCSP status of the relay certificate is unknown")
+	}
+}
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPCache(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cloudbridge-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "relay"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	now := time.Now()
+	staple := func(status int, thisUpdate, nextUpdate time.Time) []byte {
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+			RevokedAt:    thisUpdate,
+		}, caKey)
+		if err != nil {
+			t.Fatalf("failed to create OCSP response: %v", err)
+		}
+		return resp
+	}
+	state := func(resp []byte) tls.ConnectionState {
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}, OCSPResponse: resp}
+	}
+
+	cache := newOCSPCache()
+	if err := cache.verify(state(nil)); err == nil {
+		t.Error("expected a missing staple to be rejected")
+	}
+	if err := cache.verify(state(staple(ocsp.Revoked, now, now.Add(time.Hour)))); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("expected ErrCertificateRevoked, got %v", err)
+	}
+	if err := cache.verify(state(staple(ocsp.Good, now.Add(-2*time.Hour), now.Add(-time.Hour)))); err == nil {
+		t.Error("expected an expired response to be rejected")
+	}
+	if err := cache.verify(state([]byte("garbage"))); err == nil {
+		t.Error("expected an invalid response to be rejected")
+	}
+
+	// A good response is cached until its next update
+	if err := cache.verify(state(staple(ocsp.Good, now, now.Add(time.Hour)))); err != nil {
+		t.Fatalf("expected a good response to be accepted, got %v", err)
+	}
+	if err := cache.verify(state(nil)); err != nil {
+		t.Errorf("expected the cached response to be used, got %v", err)
+	}
+	cache.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if err := cache.verify(state(nil)); err == nil {
+		t.Error("expected the cached response to expire")
+	}
+}
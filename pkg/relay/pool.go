@@ -0,0 +1,576 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// poolVirtualNodes is the number of points each connection has on the hash
+// ring; more points spread tunnels more evenly
+const poolVirtualNodes = 64
+
+// ErrNoConnection is returned by a ClientPool when none of its connections
+// is up
+var ErrNoConnection = errors.New("no connection to the relay is up")
+
+// PoolConfig configures a ClientPool
+type PoolConfig struct {
+	// Size is the number of connections to the relay
+	Size  int
+	Host  string
+	Port  int
+	Token string
+	// NewClient creates the client of a connection. It is called again
+	// for every reconnect.
+	NewClient func() (*Client, error)
+	// Backoff paces reconnects of a lost connection; the zero value uses
+	// DefaultBackoffConfig. MaxRetries is ignored: a connection is retried
+	// until the pool is closed.
+	Backoff BackoffConfig
+	// OnConnLost, if set, is called when connection i is lost, before it
+	// is reconnected
+	OnConnLost func(i int, err error)
+}
+
+// PoolConnStats describes one connection of a pool
+type PoolConnStats struct {
+	Index      int    `json:"index"`
+	Connected  bool   `json:"connected"`
+	Tunnels    int    `json:"tunnels"`
+	Reconnects int    `json:"reconnects"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// ClientPool spreads tunnels across several connections to the relay, so a
+// single connection does not carry all of them. Tunnels are assigned by
+// consistent hashing of their ID: when a connection is lost, only its
+// tunnels move to the remaining ones, and they move back once it has
+// reconnected.
+type ClientPool struct {
+	config PoolConfig
+	ring   []ringPoint
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mu guards connections and tunnels. It is never held while talking
+	// to the relay: tunnels being created or moved are marked as moving
+	// instead.
+	mu      sync.Mutex
+	conns   []*poolConn
+	tunnels map[string]*poolTunnel
+	closed  bool
+	// rebalancing is set while a rebalance runs; rebalanceAgain asks it
+	// for another pass once done
+	rebalancing    bool
+	rebalanceAgain bool
+}
+
+// poolConn is a connection of a pool. A connection that is down has no
+// client.
+type poolConn struct {
+	client     *Client
+	reconnects int
+	lastErr    error
+}
+
+// poolTunnel is a tunnel of a pool and the connection carrying it
+type poolTunnel struct {
+	bindAddress string
+	localPort   int
+	remoteHost  string
+	remotePort  int
+	// conn is the index of the connection, -1 if no connection is up
+	conn int
+	// id is the ID of the tunnel on that connection
+	id string
+	// moving is set while the tunnel is created on a connection
+	moving bool
+}
+
+// poolMove moves a tunnel to the connection that owns it now
+type poolMove struct {
+	key string
+	t   *poolTunnel
+	// from is the client the tunnel is closed on, nil if it is not on a
+	// connection that is up
+	from   *Client
+	fromID string
+	// to is the index of the owner, -1 if no connection is up
+	to       int
+	toClient *Client
+}
+
+// ringPoint is a point of a connection on the hash ring
+type ringPoint struct {
+	hash uint32
+	conn int
+}
+
+// NewClientPool creates a pool of config.Size connections. Start connects
+// them.
+func NewClientPool(config PoolConfig) (*ClientPool, error) {
+	if config.Size < 1 {
+		return nil, fmt.Errorf("invalid pool size: %d", config.Size)
+	}
+	if config.NewClient == nil {
+		return nil, fmt.Errorf("pool needs a NewClient function")
+	}
+	if config.Backoff.InitialDelay <= 0 {
+		config.Backoff = DefaultBackoffConfig()
+	}
+	config.Backoff.MaxRetries = -1
+
+	p := &ClientPool{
+		config:  config,
+		conns:   make([]*poolConn, config.Size),
+		tunnels: make(map[string]*poolTunnel),
+	}
+	for i := range p.conns {
+		p.conns[i] = &poolConn{}
+		for v := 0; v < poolVirtualNodes; v++ {
+			p.ring = append(p.ring, ringPoint{hash: poolHash(strconv.Itoa(i) + "#" + strconv.Itoa(v)), conn: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p, nil
+}
+
+// Start connects and authenticates every connection. Connections that fail
+// are retried in the background; Start only fails if none could be
+// established. ctx bounds the reconnects as well as Start.
+func (p *ClientPool) Start(ctx context.Context) error {
+	p.mu.Lock()
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.mu.Unlock()
+
+	var lastErr error
+	up := 0
+	for i := range p.conns {
+		client, err := p.dialConn(i)
+		if err != nil {
+			lastErr = err
+			p.mu.Lock()
+			p.conns[i].lastErr = err
+			p.mu.Unlock()
+			p.reconnect(i)
+			continue
+		}
+		p.mu.Lock()
+		p.conns[i].client = client
+		p.reportLocked()
+		p.mu.Unlock()
+		p.adoptConn(i, client)
+		up++
+	}
+	if up == 0 {
+		p.Close()
+		return fmt.Errorf("failed to connect any pool connection: %w", lastErr)
+	}
+	return nil
+}
+
+// dialConn connects and authenticates a new client for connection i. The
+// caller stores the client and then calls adoptConn.
+func (p *ClientPool) dialConn(i int) (*Client, error) {
+	client, err := p.config.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	client.SetDisconnectHandler(func(err error) {
+		p.connLost(i, client, err)
+	})
+	if err := client.Connect(p.config.Host, p.config.Port); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, HandshakeTimeout)
+	defer cancel()
+	if err := client.HandshakeContext(ctx, p.config.Token); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	return client, nil
+}
+
+// adoptConn starts the heartbeats of the client just stored for connection
+// i. connLost ignores a client before it is stored, so a connection lost
+// in the meantime is taken down here.
+func (p *ClientPool) adoptConn(i int, client *Client) {
+	client.StartHeartbeat()
+	if client.connectionDown() {
+		p.connLost(i, client, fmt.Errorf("connection lost while being added to the pool"))
+	}
+}
+
+// connLost takes down connection i after its client lost the connection,
+// moves its tunnels to the remaining connections and starts reconnecting
+func (p *ClientPool) connLost(i int, client *Client, err error) {
+	p.mu.Lock()
+	if p.closed || p.conns[i].client != client {
+		p.mu.Unlock()
+		return
+	}
+	log.Printf("Pool connection %d lost: %v", i, err)
+	p.conns[i].client = nil
+	p.conns[i].lastErr = err
+	p.mu.Unlock()
+
+	client.Close()
+	if p.config.OnConnLost != nil {
+		p.config.OnConnLost(i, err)
+	}
+	p.rebalance()
+	p.reconnect(i)
+}
+
+// reconnect re-establishes connection i in the background and moves the
+// tunnels it owns back to it
+func (p *ClientPool) reconnect(i int) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := ReconnectWithBackoff(p.ctx, p.config.Backoff, func() error {
+			client, err := p.dialConn(i)
+			p.mu.Lock()
+			if err != nil {
+				p.conns[i].lastErr = err
+				p.mu.Unlock()
+				return err
+			}
+			if p.closed {
+				p.mu.Unlock()
+				client.Close()
+				return nil
+			}
+			p.conns[i].client = client
+			p.conns[i].reconnects++
+			p.conns[i].lastErr = nil
+			p.mu.Unlock()
+
+			p.adoptConn(i, client)
+			p.rebalance()
+			return nil
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Pool connection %d gave up reconnecting: %v", i, err)
+		}
+	}()
+}
+
+// ownerLocked returns the connection that should carry the tunnel with the
+// given ID: the first connection that is up clockwise of the ID's hash. It
+// returns -1 if no connection is up. p.mu must be held.
+func (p *ClientPool) ownerLocked(tunnelID string) int {
+	hash := poolHash(tunnelID)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+	for n := 0; n < len(p.ring); n++ {
+		point := p.ring[(start+n)%len(p.ring)]
+		if p.conns[point.conn].client != nil {
+			return point.conn
+		}
+	}
+	return -1
+}
+
+// rebalance moves every tunnel to the connection that owns it now. Only one
+// rebalance runs at a time; a rebalance asked for meanwhile is done as
+// another pass of the running one.
+func (p *ClientPool) rebalance() {
+	p.mu.Lock()
+	if p.rebalancing {
+		p.rebalanceAgain = true
+		p.mu.Unlock()
+		return
+	}
+	p.rebalancing = true
+	for {
+		p.rebalanceAgain = false
+		moves := p.planMovesLocked()
+		p.mu.Unlock()
+
+		for _, m := range moves {
+			p.move(m)
+		}
+
+		p.mu.Lock()
+		if !p.rebalanceAgain {
+			break
+		}
+	}
+	p.rebalancing = false
+	p.reportLocked()
+	p.mu.Unlock()
+}
+
+// planMovesLocked returns the tunnels that are not on the connection owning
+// them and marks them as moving. p.mu must be held.
+func (p *ClientPool) planMovesLocked() []poolMove {
+	var moves []poolMove
+	for key, t := range p.tunnels {
+		if t.moving {
+			continue
+		}
+		owner := p.ownerLocked(key)
+		if owner == t.conn {
+			continue
+		}
+		m := poolMove{key: key, t: t, to: owner}
+		if t.conn >= 0 {
+			m.from, m.fromID = p.conns[t.conn].client, t.id
+		}
+		if owner >= 0 {
+			m.toClient = p.conns[owner].client
+		}
+		t.conn, t.id = -1, ""
+		t.moving = true
+		moves = append(moves, m)
+	}
+	return moves
+}
+
+// move closes a tunnel on its old connection and creates it on the new one
+func (p *ClientPool) move(m poolMove) {
+	if m.from != nil {
+		if err := m.from.CloseTunnel(m.fromID); err != nil && !errors.Is(err, ErrTunnelNotFound) {
+			log.Printf("Failed to close tunnel %s on a pool connection: %v", m.key, err)
+		}
+	}
+	if m.toClient == nil {
+		p.mu.Lock()
+		m.t.moving = false
+		p.mu.Unlock()
+		return
+	}
+
+	id, err := p.createOn(m.toClient, m.t)
+	if err != nil {
+		log.Printf("Failed to move tunnel %s to pool connection %d: %v", m.key, m.to, err)
+	}
+	p.mu.Lock()
+	m.t.moving = false
+	if err == nil && !p.placeLocked(m.key, m.t, m.to, m.toClient, id) {
+		p.mu.Unlock()
+		// The tunnel was closed meanwhile
+		m.toClient.CloseTunnel(id)
+		return
+	}
+	p.mu.Unlock()
+}
+
+// placeLocked records that the tunnel was created on connection i with the
+// given client and ID. It returns false if the tunnel was closed while
+// being created. If the connection was lost meanwhile, the tunnel is left
+// without connection and another rebalance pass is asked for. p.mu must be
+// held.
+func (p *ClientPool) placeLocked(key string, t *poolTunnel, i int, client *Client, id string) bool {
+	if p.closed || p.tunnels[key] != t {
+		return false
+	}
+	if p.conns[i].client != client {
+		p.rebalanceAgain = true
+		return true
+	}
+	t.conn, t.id = i, id
+	return true
+}
+
+// createOn creates t with the client of a connection
+func (p *ClientPool) createOn(client *Client, t *poolTunnel) (string, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, TunnelCreateTimeout)
+	defer cancel()
+	return client.CreateBoundTunnel(ctx, t.bindAddress, t.localPort, t.remoteHost, t.remotePort)
+}
+
+// CreateTunnel creates a tunnel on the connection its ID hashes to, like
+// Client.CreateBoundTunnel. The returned ID names the tunnel in the pool;
+// it stays the same when the tunnel moves to another connection.
+func (p *ClientPool) CreateTunnel(bindAddress string, localPort int, remoteHost string, remotePort int) (string, error) {
+	key := tunnelKey(bindAddress, localPort, remoteHost, remotePort)
+
+	p.mu.Lock()
+	if p.closed || p.ctx == nil {
+		p.mu.Unlock()
+		return "", ErrNoConnection
+	}
+	if _, exists := p.tunnels[key]; exists {
+		p.mu.Unlock()
+		return key, nil
+	}
+	owner := p.ownerLocked(key)
+	if owner < 0 {
+		p.mu.Unlock()
+		return "", ErrNoConnection
+	}
+	client := p.conns[owner].client
+	t := &poolTunnel{
+		bindAddress: bindAddress,
+		localPort:   localPort,
+		remoteHost:  remoteHost,
+		remotePort:  remotePort,
+		conn:        -1,
+		moving:      true,
+	}
+	p.tunnels[key] = t
+	p.mu.Unlock()
+
+	id, err := p.createOn(client, t)
+
+	p.mu.Lock()
+	t.moving = false
+	if err != nil {
+		if p.tunnels[key] == t {
+			delete(p.tunnels, key)
+		}
+		p.mu.Unlock()
+		return "", err
+	}
+	if !p.placeLocked(key, t, owner, client, id) {
+		p.mu.Unlock()
+		client.CloseTunnel(id)
+		return "", fmt.Errorf("tunnel %s was closed while being created", key)
+	}
+	// A connection may have come up or gone down meanwhile
+	misplaced := p.ownerLocked(key) != t.conn
+	p.reportLocked()
+	p.mu.Unlock()
+
+	if misplaced {
+		p.rebalance()
+	}
+	return key, nil
+}
+
+// CloseTunnel closes a tunnel created with CreateTunnel
+func (p *ClientPool) CloseTunnel(tunnelID string) error {
+	p.mu.Lock()
+	t, exists := p.tunnels[tunnelID]
+	if !exists {
+		p.mu.Unlock()
+		return ErrTunnelNotFound
+	}
+	delete(p.tunnels, tunnelID)
+	var client *Client
+	if t.conn >= 0 {
+		client = p.conns[t.conn].client
+	}
+	p.reportLocked()
+	p.mu.Unlock()
+
+	// A tunnel being moved is closed by the move
+	if client != nil {
+		return client.CloseTunnel(t.id)
+	}
+	return nil
+}
+
+// Stats describes every connection of the pool
+func (p *ClientPool) Stats() []PoolConnStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.statsLocked()
+}
+
+func (p *ClientPool) statsLocked() []PoolConnStats {
+	stats := make([]PoolConnStats, len(p.conns))
+	for i, conn := range p.conns {
+		stats[i] = PoolConnStats{
+			Index:      i,
+			Connected:  conn.client != nil,
+			Reconnects: conn.reconnects,
+		}
+		if conn.lastErr != nil {
+			stats[i].LastError = conn.lastErr.Error()
+		}
+	}
+	for _, t := range p.tunnels {
+		if t.conn >= 0 {
+			stats[t.conn].Tunnels++
+		}
+	}
+	return stats
+}
+
+// reportLocked updates the pool metrics. p.mu must be held.
+func (p *ClientPool) reportLocked() {
+	for _, s := range p.statsLocked() {
+		SetPoolConnection(s.Index, s.Connected, s.Tunnels)
+	}
+}
+
+// Close closes every connection and stops reconnecting
+func (p *ClientPool) Close() error {
+	var firstErr error
+	for _, client := range p.stop() {
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.wg.Wait()
+	return firstErr
+}
+
+// Shutdown shuts every connection down gracefully like Client.Shutdown, all
+// within the deadline of ctx, and stops reconnecting
+func (p *ClientPool) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, client := range p.stop() {
+		if err := client.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.wg.Wait()
+	return firstErr
+}
+
+// stop marks the pool closed, stops reconnecting and returns the clients
+// of the connections that were up
+func (p *ClientPool) stop() []*Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	var clients []*Client
+	for _, conn := range p.conns {
+		if conn.client == nil {
+			continue
+		}
+		clients = append(clients, conn.client)
+		conn.client = nil
+	}
+	for _, t := range p.tunnels {
+		t.conn, t.id = -1, ""
+	}
+	p.reportLocked()
+	return clients
+}
+
+// Connected reports whether any connection of the pool is up
+func (p *ClientPool) Connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		if conn.client != nil && conn.client.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// poolHash hashes a tunnel ID or ring point
+func poolHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
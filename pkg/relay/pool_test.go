@@ -0,0 +1,324 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+)
+
+// startPoolRelay runs a relay completing the handshake on every connection
+// unless refuse is set
+func startPoolRelay(t *testing.T, refuse *atomic.Bool) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if refuse.Load() {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if err := acceptHandshake(r, conn); err != nil {
+					return
+				}
+				answerTunnels(r, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestClientPoolRebalances(t *testing.T) {
+	var refuse atomic.Bool
+	fake := clock.NewFake(time.Now())
+	pool, err := NewClientPool(PoolConfig{
+		Size:      3,
+		Host:      "127.0.0.1",
+		Port:      startPoolRelay(t, &refuse),
+		Token:     "token",
+		NewClient: func() (*Client, error) { return NewClient(false, nil), nil },
+		Backoff:   BackoffConfig{InitialDelay: time.Second, MaxDelay: time.Second, Clock: fake},
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Close()
+
+	ports := make(map[string]int)
+	for i := 0; i < 12; i++ {
+		port := freePort(t)
+		id, err := pool.CreateTunnel("127.0.0.1", port, "10.0.0.1", 3389)
+		if err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+		ports[id] = port
+	}
+
+	owners := func() map[string]int {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		owners := make(map[string]int)
+		for id, tunnel := range pool.tunnels {
+			owners[id] = tunnel.conn
+		}
+		return owners
+	}
+	before := owners()
+	used := 0
+	for _, s := range pool.Stats() {
+		if !s.Connected {
+			t.Fatalf("expected connection %d to be up", s.Index)
+		}
+		if s.Tunnels > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("expected tunnels spread across connections, got %+v", pool.Stats())
+	}
+
+	// Only the tunnels of a lost connection move. The relay refuses the
+	// reconnect until the backoff delay has passed.
+	refuse.Store(true)
+	pool.mu.Lock()
+	lost := pool.conns[0].client
+	pool.mu.Unlock()
+	pool.connLost(0, lost, errors.New("connection reset"))
+	during := owners()
+	for id, conn := range during {
+		if before[id] == 0 && (conn == 0 || conn < 0) {
+			t.Errorf("tunnel %s of the lost connection was not moved: %d", id, conn)
+		}
+		if before[id] != 0 && conn != before[id] {
+			t.Errorf("tunnel %s moved from %d to %d", id, before[id], conn)
+		}
+	}
+	for id, port := range ports {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Errorf("tunnel %s is not listening: %v", id, err)
+			continue
+		}
+		conn.Close()
+	}
+
+	// Once reconnected, the connection gets its tunnels back
+	refuse.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !pool.Stats()[0].Connected {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection did not reconnect: %+v", pool.Stats())
+		}
+		fake.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := pool.Stats()[0]; s.Reconnects != 1 {
+		t.Errorf("expected one reconnect, got %+v", s)
+	}
+	after := owners()
+	for id, conn := range after {
+		if conn != before[id] {
+			t.Errorf("tunnel %s ended on connection %d instead of %d", id, conn, before[id])
+		}
+	}
+
+	if err := pool.CloseTunnel("missing"); !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("expected ErrTunnelNotFound, got %v", err)
+	}
+	pool.Close()
+	if _, err := pool.CreateTunnel("127.0.0.1", freePort(t), "10.0.0.1", 22); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("expected ErrNoConnection after Close, got %v", err)
+	}
+}
+
+func TestClientPoolStartFails(t *testing.T) {
+	pool, err := NewClientPool(PoolConfig{
+		Size:      2,
+		Host:      "127.0.0.1",
+		Port:      freePort(t),
+		Backoff:   BackoffConfig{InitialDelay: time.Hour},
+		NewClient: func() (*Client, error) { return NewClient(false, nil), nil },
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	if err := pool.Start(context.Background()); err == nil {
+		t.Error("expected Start to fail without a relay")
+	}
+	if _, err := NewClientPool(PoolConfig{Size: 0}); err == nil {
+		t.Error("expected an error for an empty pool")
+	}
+}
+
+func TestClientPoolNotLockedWhileCreating(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	release := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if err := acceptHandshake(r, conn); err != nil {
+					return
+				}
+				// Tunnels are only answered once released
+				<-release
+				answerTunnels(r, conn)
+			}()
+		}
+	}()
+
+	pool, err := NewClientPool(PoolConfig{
+		Size:      2,
+		Host:      "127.0.0.1",
+		Port:      listener.Addr().(*net.TCPAddr).Port,
+		Token:     "token",
+		NewClient: func() (*Client, error) { return NewClient(false, nil), nil },
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Close()
+
+	port := freePort(t)
+	created := make(chan error, 1)
+	go func() {
+		_, err := pool.CreateTunnel("127.0.0.1", port, "10.0.0.1", 3389)
+		created <- err
+	}()
+
+	// The pool answers while the relay has not confirmed the tunnel yet
+	stats := make(chan []PoolConnStats, 1)
+	go func() { stats <- pool.Stats() }()
+	select {
+	case <-stats:
+	case <-time.After(time.Second):
+		t.Fatal("pool stayed locked while creating a tunnel")
+	}
+
+	close(release)
+	if err := <-created; err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+}
+
+func TestClientPoolKeysBindAddress(t *testing.T) {
+	var refuse atomic.Bool
+	pool, err := NewClientPool(PoolConfig{
+		Size:      1,
+		Host:      "127.0.0.1",
+		Port:      startPoolRelay(t, &refuse),
+		Token:     "token",
+		NewClient: func() (*Client, error) { return NewClient(false, nil), nil },
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Close()
+
+	// The same port on another address is another tunnel
+	port := freePort(t)
+	first, err := pool.CreateTunnel("127.0.0.1", port, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	second, err := pool.CreateTunnel("127.0.0.2", port, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if first == second {
+		t.Fatalf("tunnels on different bind addresses share ID %s", first)
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.tunnels) != 2 || pool.tunnels[first].id == pool.tunnels[second].id {
+		t.Errorf("expected two tunnels on the connection, got %d", len(pool.tunnels))
+	}
+}
+
+func TestClientPoolConnLostBeforeStored(t *testing.T) {
+	var refuse atomic.Bool
+	lost := make(chan int, 1)
+	pool, err := NewClientPool(PoolConfig{
+		Size:       1,
+		Host:       "127.0.0.1",
+		Port:       startPoolRelay(t, &refuse),
+		Token:      "token",
+		NewClient:  func() (*Client, error) { return NewClient(false, nil), nil },
+		OnConnLost: func(i int, err error) { lost <- i },
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start pool: %v", err)
+	}
+	defer pool.Close()
+
+	// The connection drops before the client is stored, so the disconnect
+	// handler finds another client on the connection and does nothing
+	client, err := pool.dialConn(0)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	client.connectionLost(errors.New("relay went away"))
+	time.Sleep(20 * time.Millisecond)
+
+	pool.mu.Lock()
+	previous := pool.conns[0].client
+	pool.conns[0].client = client
+	pool.mu.Unlock()
+	previous.Close()
+	pool.adoptConn(0, client)
+
+	select {
+	case i := <-lost:
+		if i != 0 {
+			t.Errorf("expected connection 0 to be lost, got %d", i)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection lost before it was stored stayed up")
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.conns[0].client == client {
+		t.Error("expected the lost client to be taken off the connection")
+	}
+}
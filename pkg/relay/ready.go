@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ReadySignal tracks whether a client is connected and lets callers wait for
+// it. The zero value is not ready.
+type ReadySignal struct {
+	mu    sync.Mutex
+	ready bool
+	ch    chan struct{}
+}
+
+// Set marks the client ready or not ready, waking waiters on ready
+func (r *ReadySignal) Set(ready bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ch == nil {
+		r.ch = make(chan struct{})
+	}
+	if ready && !r.ready {
+		close(r.ch)
+	} else if !ready && r.ready {
+		r.ch = make(chan struct{})
+	}
+	r.ready = ready
+}
+
+// IsReady returns true if the client is ready
+func (r *ReadySignal) IsReady() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// Wait blocks until the client is ready or ctx is done
+func (r *ReadySignal) Wait(ctx context.Context) error {
+	r.mu.Lock()
+	if r.ch == nil {
+		r.ch = make(chan struct{})
+	}
+	ch := r.ch
+	r.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("client not ready: %w", ctx.Err())
+	}
+}
+
+// WaitUntilReady blocks until the client is connected and the handshake has
+// completed, or until ctx is done
+func (c *Client) WaitUntilReady(ctx context.Context) error {
+	return c.ready.Wait(ctx)
+}
+
+// IsReady returns true if the client is connected and authenticated
+func (c *Client) IsReady() bool {
+	return c.ready.IsReady()
+}
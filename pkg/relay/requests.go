@@ -0,0 +1,202 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRequestTimeout is returned when the relay does not answer a request
+// before its context is done
+var ErrRequestTimeout = errors.New("relay request timed out")
+
+// roundTrip sends msg tagged with a new request ID and waits for the response
+// carrying the same ID. Responses to other pending requests that are read
+// meanwhile are handed to their waiters. The pending entry is removed when
+// roundTrip returns, so a late response is dropped.
+func (c *Client) roundTrip(ctx context.Context, msg map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := msg["request_id"].(string)
+	if id == "" {
+		id = c.nextRequestID()
+		msg["request_id"] = id
+	}
+
+	respCh := make(chan map[string]interface{}, 1)
+	c.pendingMu.Lock()
+	if c.closing {
+		c.pendingMu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]chan map[string]interface{})
+	}
+	c.pending[id] = respCh
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		c.requestDone(id)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.SendMessage(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case resp := <-respCh:
+			return resp, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %v", ErrRequestTimeout, id, ctx.Err())
+		case c.readToken <- struct{}{}:
+			// Only one waiter reads from the connection at a time. The
+			// response may have been delivered while waiting for the turn.
+			select {
+			case resp := <-respCh:
+				<-c.readToken
+				return resp, nil
+			default:
+			}
+			resp, err := c.readMessageContext(ctx)
+			if err != nil {
+				<-c.readToken
+				if ctx.Err() != nil || deadlinePassed(ctx, err) {
+					return nil, fmt.Errorf("%w: %s: %v", ErrRequestTimeout, id, err)
+				}
+				return nil, err
+			}
+			err = c.dispatchMessage(resp)
+			if err == nil {
+				err = c.dispatchBuffered()
+			}
+			<-c.readToken
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// nextRequestID returns a new request ID
+func (c *Client) nextRequestID() string {
+	return fmt.Sprintf("req_%d", atomic.AddUint64(&c.requestSeq, 1))
+}
+
+// dispatchMessage hands msg to the request waiting for it or handles it as
+// a control message. A panic while doing so is recovered, so a handler bug
+// does not take down the reader holding the read token; see
+// handleDispatchPanic.
+func (c *Client) dispatchMessage(msg map[string]interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = c.handleDispatchPanic(msg, r)
+		}
+	}()
+
+	if !c.dispatchResponse(msg) {
+		c.HandleControlMessage(msg)
+	}
+	atomic.StoreInt32(&c.dispatchPanics, 0)
+	return nil
+}
+
+// dispatchBuffered dispatches every complete message that is already
+// buffered, so a response does not sit behind another one until the next
+// read from the connection. The caller must hold the read token.
+func (c *Client) dispatchBuffered() error {
+	reader := c.connReader()
+	for {
+		if !reader.lineBuffered() {
+			return nil
+		}
+		line, err := reader.readLine()
+		if err != nil {
+			return err
+		}
+		msg, err := c.decodeLine(line)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			if err := c.dispatchMessage(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatchResponse hands a response to the request waiting for it. A
+// heartbeat_response without a request ID answers the pending heartbeat;
+// other messages without a pending request ID are dropped.
+func (c *Client) dispatchResponse(msg map[string]interface{}) bool {
+	id, _ := msg["request_id"].(string)
+
+	c.pendingMu.Lock()
+	if id == "" && msg["type"] == MessageTypeHeartbeatResponse {
+		id = c.heartbeatID
+	}
+	if id == "" {
+		c.pendingMu.Unlock()
+		return false
+	}
+	respCh, ok := c.pending[id]
+	c.pendingMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case respCh <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// readMessageContext reads one message, giving up when ctx is done
+func (c *Client) readMessageContext(ctx context.Context) (map[string]interface{}, error) {
+	if reader := c.connReader(); reader != nil {
+		defer interruptOnDone(ctx, reader.conn.SetReadDeadline)()
+	}
+	return c.readMessageUntil(contextDeadline(ctx))
+}
+
+// sendMessageContext sends one message, giving up when ctx is done
+func (c *Client) sendMessageContext(ctx context.Context, msg interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.stateMu.RLock()
+	conn := c.conn
+	c.stateMu.RUnlock()
+	if conn != nil {
+		defer interruptOnDone(ctx, conn.SetWriteDeadline)()
+	}
+	return c.sendMessageLocked(msg, contextDeadline(ctx))
+}
+
+// contextDeadline returns the deadline of ctx, capped at ReadWriteTimeout
+// from now
+func contextDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(ReadWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// deadlinePassed reports whether err is a read timeout caused by the
+// deadline of ctx rather than the default read timeout
+func deadlinePassed(ctx context.Context, err error) bool {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	d, ok := ctx.Deadline()
+	return ok && !time.Now().Before(d)
+}
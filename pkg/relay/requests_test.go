@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTripDispatchesBufferedResponses(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		// Both responses arrive in a single write
+		own, _ := json.Marshal(map[string]interface{}{"request_id": msg["request_id"], "status": "success"})
+		other, _ := json.Marshal(map[string]interface{}{"request_id": "req_other", "status": "success"})
+		w.Write(append(append(append(own, '\n'), other...), '\n'))
+	}))
+	client := connectTunnelClient(t, port)
+
+	otherCh := make(chan map[string]interface{}, 1)
+	client.pendingMu.Lock()
+	client.pending = map[string]chan map[string]interface{}{"req_other": otherCh}
+	client.pendingMu.Unlock()
+
+	if _, err := client.roundTrip(context.Background(), map[string]interface{}{"type": "ping"}); err != nil {
+		t.Fatalf("round trip failed: %v", err)
+	}
+
+	select {
+	case resp := <-otherCh:
+		if resp["request_id"] != "req_other" {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	default:
+		t.Error("buffered response was not dispatched")
+	}
+}
+
+func TestRoundTripConcurrentRequests(t *testing.T) {
+	// The relay stops answering once a line is not valid JSON, so lines of
+	// concurrent requests must not interleave
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		writeJSONLine(w, map[string]interface{}{"request_id": msg["request_id"], "status": "success"})
+	}))
+	client := connectTunnelClient(t, port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := client.roundTrip(ctx, map[string]interface{}{"type": "ping", "padding": strings.Repeat("x", 8192)})
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("round trip failed: %v", err)
+		}
+	}
+}
+
+func TestRoundTripKeepsPartialLine(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		if msg["type"] != "slow" {
+			writeJSONLine(w, map[string]interface{}{"request_id": msg["request_id"], "status": "success"})
+			return
+		}
+		// The response to another request arrives in two parts, the
+		// second after the slow request gave up reading
+		other, _ := json.Marshal(map[string]interface{}{"request_id": "req_other", "status": "success"})
+		other = append(other, '\n')
+		w.Write(other[:10])
+		time.Sleep(300 * time.Millisecond)
+		w.Write(other[10:])
+	}))
+	client := connectTunnelClient(t, port)
+
+	otherCh := make(chan map[string]interface{}, 1)
+	client.pendingMu.Lock()
+	client.pending = map[string]chan map[string]interface{}{"req_other": otherCh}
+	client.pendingMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.roundTrip(ctx, map[string]interface{}{"type": "slow"}); !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.roundTrip(ctx, map[string]interface{}{"type": "ping"}); err != nil {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	select {
+	case resp := <-otherCh:
+		if resp["request_id"] != "req_other" {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	default:
+		t.Error("response split across reads was lost")
+	}
+}
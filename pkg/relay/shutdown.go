@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrShuttingDown is returned for requests made while the client shuts down
+var ErrShuttingDown = errors.New("client is shutting down")
+
+// ShutdownError is returned by Shutdown when parts of the client did not
+// finish before the deadline and were closed forcibly
+type ShutdownError struct {
+	// Unfinished lists what was still running, e.g. "request req_3"
+	Unfinished []string
+	// Err is the error of the context that ended the grace period
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown incomplete, forced close of %s: %v", strings.Join(e.Unfinished, ", "), e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown stops the client gracefully. New requests are refused, requests
+// in flight may finish and then the connection is closed. Once ctx is done
+// the connection is closed regardless, failing the remaining requests, and
+// a *ShutdownError lists them.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.ready.Set(false)
+	c.stopHeartbeats()
+	c.connectionLost(nil)
+
+	drained := make(chan struct{})
+	c.pendingMu.Lock()
+	c.closing = true
+	if len(c.pending) == 0 {
+		close(drained)
+	} else {
+		c.drained = drained
+	}
+	c.pendingMu.Unlock()
+
+	var shutdownErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		c.pendingMu.Lock()
+		unfinished := make([]string, 0, len(c.pending))
+		for id := range c.pending {
+			unfinished = append(unfinished, "request "+id)
+		}
+		c.drained = nil
+		c.pendingMu.Unlock()
+		sort.Strings(unfinished)
+		shutdownErr = &ShutdownError{Unfinished: unfinished, Err: ctx.Err()}
+	}
+
+	c.stopTunnels()
+
+	c.stateMu.RLock()
+	conn := c.conn
+	c.stateMu.RUnlock()
+	if conn != nil {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) && shutdownErr == nil {
+			shutdownErr = fmt.Errorf("failed to close connection: %w", err)
+		}
+	}
+	return shutdownErr
+}
+
+// requestDone removes a finished request and wakes Shutdown once the last
+// one is gone. c.pendingMu must be held.
+func (c *Client) requestDone(id string) {
+	delete(c.pending, id)
+	if c.drained != nil && len(c.pending) == 0 {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// shuttingDown returns true once Shutdown has been called
+func (c *Client) shuttingDown() bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	return c.closing
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitForPending waits until a request is in flight
+func waitForPending(t *testing.T, client *Client) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.pendingMu.Lock()
+		n := len(client.pending)
+		client.pendingMu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request was not sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		time.Sleep(50 * time.Millisecond)
+		writeJSONLine(w, map[string]interface{}{
+			"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+		})
+	}))
+	client := connectTunnelClient(t, port)
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := client.CreateTunnelContext(context.Background(), 3389, "10.0.0.1", 3389)
+		created <- err
+	}()
+	waitForPending(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	if err := <-created; err != nil {
+		t.Errorf("request in flight should have finished: %v", err)
+	}
+
+	if _, err := client.CreateTunnelContext(context.Background(), 3390, "10.0.0.1", 3389); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestShutdownForcesCloseAfterDeadline(t *testing.T) {
+	// The relay never answers tunnel requests
+	port := startFakeRelay(t, tunnelRelay(func(map[string]interface{}, net.Conn) {}))
+	client := connectTunnelClient(t, port)
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := client.CreateTunnelContext(context.Background(), 3389, "10.0.0.1", 3389)
+		created <- err
+	}()
+	waitForPending(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Shutdown(ctx)
+
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) {
+		t.Fatalf("expected ShutdownError, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if len(shutdownErr.Unfinished) != 1 || shutdownErr.Unfinished[0] != "request req_1" {
+		t.Errorf("unexpected unfinished list: %v", shutdownErr.Unfinished)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+
+	select {
+	case err := <-created:
+		if err == nil {
+			t.Error("expected the request to fail after the forced close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not released by the forced close")
+	}
+}
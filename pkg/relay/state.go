@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"sort"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+)
+
+const redactedValue = "[REDACTED]"
+
+// StateSnapshot describes what a running client is actually doing. It is
+// meant to be serialized to JSON for support and to compare against the
+// config file on disk.
+type StateSnapshot struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Connected bool           `json:"connected"`
+	Endpoint  EndpointState  `json:"endpoint"`
+	Protocol  ProtocolState  `json:"protocol"`
+	TenantID  string         `json:"tenant_id,omitempty"`
+	Tunnels   []TunnelState  `json:"tunnels"`
+	Config    *config.Config `json:"config,omitempty"`
+
+	// MaxTunnels is the limit on len(Tunnels), 0 if unlimited
+	MaxTunnels int `json:"max_tunnels"`
+
+	// Migration describes the last move away from a draining relay
+	Migration *MigrationState `json:"migration,omitempty"`
+}
+
+// EndpointState describes the relay endpoint the client is connected to
+type EndpointState struct {
+	Host       string `json:"host,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	LocalAddr  string `json:"local_addr,omitempty"`
+	TLS        bool   `json:"tls"`
+}
+
+// ProtocolState describes the protocol version and features in use
+type ProtocolState struct {
+	Version        string   `json:"version"`
+	Features       []string `json:"features"`
+	ServerVersion  string   `json:"server_version,omitempty"`
+	ServerFeatures []string `json:"server_features,omitempty"`
+
+	// PostQuantum holds the negotiated post-quantum security levels
+	PostQuantum *quantum.Selection `json:"post_quantum,omitempty"`
+	// Compression is the negotiated connection-level compression
+	Compression string `json:"compression,omitempty"`
+}
+
+// TunnelState describes a registered tunnel
+type TunnelState struct {
+	ID         string `json:"id"`
+	LocalPort  int    `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int    `json:"remote_port"`
+	Protocol   string `json:"protocol"`
+}
+
+// ExportState returns a snapshot of the client's effective configuration
+// and runtime state. Secrets in the configuration are redacted.
+func (c *Client) ExportState() (StateSnapshot, error) {
+	snapshot := StateSnapshot{
+		Timestamp: time.Now(),
+		TenantID:  c.tenantID,
+		Protocol: ProtocolState{
+			Version:  c.version,
+			Features: append([]string(nil), c.features...),
+		},
+		Tunnels: []TunnelState{},
+	}
+
+	c.stateMu.RLock()
+	snapshot.Endpoint = EndpointState{
+		Host: c.host,
+		Port: c.port,
+		TLS:  c.useTLS,
+	}
+	snapshot.Protocol.ServerVersion = c.serverVersion
+	snapshot.Protocol.ServerFeatures = append([]string(nil), c.serverFeatures...)
+	if c.pqSelection != nil {
+		selection := *c.pqSelection
+		snapshot.Protocol.PostQuantum = &selection
+	}
+	snapshot.Protocol.Compression = c.compressionAlgo
+	if c.migration != nil {
+		migration := *c.migration
+		snapshot.Migration = &migration
+	}
+	conn := c.conn
+	c.stateMu.RUnlock()
+
+	snapshot.Connected = conn != nil
+	if conn != nil {
+		snapshot.Endpoint.RemoteAddr = conn.RemoteAddr().String()
+		snapshot.Endpoint.LocalAddr = conn.LocalAddr().String()
+	}
+
+	c.tunnelMutex.RLock()
+	snapshot.MaxTunnels = c.maxTunnels
+	for _, tunnel := range c.tunnels {
+		snapshot.Tunnels = append(snapshot.Tunnels, TunnelState{
+			ID:         tunnel.ID,
+			LocalPort:  tunnel.LocalPort,
+			RemoteHost: tunnel.RemoteHost,
+			RemotePort: tunnel.RemotePort,
+			Protocol:   tunnel.Protocol,
+		})
+	}
+	c.tunnelMutex.RUnlock()
+	sort.Slice(snapshot.Tunnels, func(i, j int) bool {
+		return snapshot.Tunnels[i].ID < snapshot.Tunnels[j].ID
+	})
+
+	if c.cfg != nil {
+		snapshot.Config = redactConfig(c.cfg)
+	}
+
+	return snapshot, nil
+}
+
+// recordServerHello stores the version and features announced by the
+// relay, and the fields the client does not interpret
+func (c *Client) recordServerHello(hello map[string]interface{}) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.recordHelloExtrasLocked(hello)
+
+	c.serverVersion, _ = hello["version"].(string)
+	c.serverFeatures = nil
+	if features, ok := hello["features"].([]interface{}); ok {
+		for _, f := range features {
+			if name, ok := f.(string); ok {
+				c.serverFeatures = append(c.serverFeatures, name)
+			}
+		}
+	}
+}
+
+// redactConfig returns a copy of cfg with secrets replaced
+func redactConfig(cfg *config.Config) *config.Config {
+	redacted := *cfg
+	if redacted.Server.JWTToken != "" {
+		redacted.Server.JWTToken = redactedValue
+	}
+	if redacted.Auth.Secret != "" {
+		redacted.Auth.Secret = redactedValue
+	}
+	if redacted.Webhooks.Secret != "" {
+		redacted.Webhooks.Secret = redactedValue
+	}
+	return &redacted
+}
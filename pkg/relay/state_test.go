@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+)
+
+func TestExportState(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			answerTunnels(bufio.NewReader(conn), conn)
+		}
+	}()
+
+	cfg := &config.Config{}
+	cfg.Server.JWTToken = "secret-token"
+	cfg.Tenant.ID = "tenant-1"
+
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if err := client.Connect("127.0.0.1", addr.Port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	client.recordServerHello(map[string]interface{}{
+		"type":     MessageTypeHello,
+		"version":  "2.0",
+		"features": []interface{}{"tls", "heartbeat"},
+	})
+	// The fake relay does not authenticate
+	client.ready.Set(true)
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.1", 3389); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	state, err := client.ExportState()
+	if err != nil {
+		t.Fatalf("failed to export state: %v", err)
+	}
+
+	if !state.Connected {
+		t.Error("expected connected state")
+	}
+	if state.Endpoint.Port != addr.Port || state.Endpoint.RemoteAddr == "" {
+		t.Errorf("unexpected endpoint: %+v", state.Endpoint)
+	}
+	if state.Protocol.ServerVersion != "2.0" || len(state.Protocol.ServerFeatures) != 2 {
+		t.Errorf("unexpected protocol state: %+v", state.Protocol)
+	}
+	if state.TenantID != "tenant-1" {
+		t.Errorf("expected tenant-1, got %s", state.TenantID)
+	}
+	if len(state.Tunnels) != 1 || state.Tunnels[0].RemoteHost != "10.0.0.1" {
+		t.Errorf("unexpected tunnels: %+v", state.Tunnels)
+	}
+	if state.Config == nil || state.Config.Server.JWTToken != redactedValue {
+		t.Error("expected token to be redacted in exported config")
+	}
+	if cfg.Server.JWTToken != "secret-token" {
+		t.Error("redaction must not modify the live config")
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("failed to marshal state: %v", err)
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Error("serialized state leaks the token")
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"time"
+)
+
+// Phases of establishing a relay connection, as labelled in the
+// client_handshake_phase_duration_seconds histogram
+const (
+	PhaseConnect       = "connect"
+	PhaseTLSHandshake  = "tls_handshake"
+	PhaseHelloExchange = "hello_exchange"
+	PhaseAuth          = "auth"
+)
+
+// HandshakeTimings is how long each phase of the last connection attempt
+// took. A phase that did not run or did not complete is zero.
+type HandshakeTimings struct {
+	Connect       time.Duration `json:"connect"`
+	TLSHandshake  time.Duration `json:"tls_handshake"`
+	HelloExchange time.Duration `json:"hello_exchange"`
+	Auth          time.Duration `json:"auth"`
+}
+
+// Total returns the time spent in all phases
+func (t HandshakeTimings) Total() time.Duration {
+	return t.Connect + t.TLSHandshake + t.HelloExchange + t.Auth
+}
+
+// Phases returns the phase names and durations in the order they run
+func (t HandshakeTimings) Phases() []PhaseTiming {
+	return []PhaseTiming{
+		{PhaseConnect, t.Connect},
+		{PhaseTLSHandshake, t.TLSHandshake},
+		{PhaseHelloExchange, t.HelloExchange},
+		{PhaseAuth, t.Auth},
+	}
+}
+
+// PhaseTiming is the duration of one phase
+type PhaseTiming struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// HandshakeTimings returns the phase durations of the last connection
+// attempt
+func (c *Client) HandshakeTimings() HandshakeTimings {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.timings
+}
+
+// recordPhase stores the duration of a phase of the current connection
+// attempt and observes it in the client metrics. The auth phase is observed
+// as the authentication duration as well.
+func (c *Client) recordPhase(phase string, d time.Duration) {
+	c.stateMu.Lock()
+	switch phase {
+	case PhaseConnect:
+		c.timings.Connect = d
+	case PhaseTLSHandshake:
+		c.timings.TLSHandshake = d
+	case PhaseHelloExchange:
+		c.timings.HelloExchange = d
+	case PhaseAuth:
+		c.timings.Auth = d
+	}
+	c.stateMu.Unlock()
+
+	if m := c.clientMetrics(); m != nil {
+		m.ObserveHandshakePhase(phase, d)
+		if phase == PhaseAuth {
+			m.ObserveAuthDuration(d)
+		}
+	}
+}
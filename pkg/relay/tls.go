@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// defaultCADirs are the directories CA files may be loaded from
+	defaultCADirs = []string{"/etc/cloudbridge-client/certs", "/etc/ssl/certs", "/usr/local/share/ca-certificates"}
+	// defaultCertDirs are the directories client certificates and keys may
+	// be loaded from
+	defaultCertDirs = []string{"/etc/cloudbridge-client/certs", "/etc/ssl/private", "/usr/local/etc/ssl"}
+)
+
+// TLSOptions describes the TLS configuration created by
+// NewTLSConfigWithOptions
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is the CA the relay certificate must be issued by. Without it
+	// the system CA pool is used.
+	CAFile string
+	// AppendSystemCAs trusts the system CA pool in addition to CAFile. A
+	// certificate any public CA issues for the relay name is then accepted,
+	// so a private CA no longer pins the relay.
+	AppendSystemCAs bool
+	// AllowedDirs are directories the files may be loaded from besides the
+	// default system directories. Whoever can write to one of them can make
+	// the client trust another relay, so they must only be writable by
+	// trusted users.
+	AllowedDirs []string
+	// RequireOCSP rejects relay certificates that are revoked or come
+	// without a valid stapled OCSP response
+	RequireOCSP bool
+	// ALPN lists the protocols offered during the TLS handshake, in order
+	// of preference
+	ALPN []string
+}
+
+// NewTLSConfig creates a new TLS configuration
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	return NewTLSConfigWithOptions(TLSOptions{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+}
+
+// NewTLSConfigWithOptions creates the TLS configuration described by opts
+func NewTLSConfigWithOptions(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// InsecureSkipVerify: false, // Always verify certificates in production
+	}
+
+	// Load CA certificate if provided
+	if opts.CAFile != "" {
+		cleanCAFile, err := allowedPath("CA file", opts.CAFile, defaultCADirs, opts.AllowedDirs)
+		if err != nil {
+			return nil, err
+		}
+
+		caCert, err := os.ReadFile(cleanCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA cert: %w", err)
+		}
+
+		caCertPool := x509.NewCertPool()
+		if opts.AppendSystemCAs {
+			if caCertPool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("failed to load system CA pool: %w", err)
+			}
+		}
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append CA cert")
+		}
+
+		config.RootCAs = caCertPool
+	}
+
+	// Load client certificate and key if provided
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cleanCertFile, err := allowedPath("cert file", opts.CertFile, defaultCertDirs, opts.AllowedDirs)
+		if err != nil {
+			return nil, err
+		}
+		cleanKeyFile, err := allowedPath("key file", opts.KeyFile, defaultCertDirs, opts.AllowedDirs)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.LoadX509KeyPair(cleanCertFile, cleanKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.ALPN) > 0 {
+		config.NextProtos = append([]string(nil), opts.ALPN...)
+	}
+
+	if opts.RequireOCSP {
+		requireOCSP(config)
+	}
+
+	// For development/testing only - disable certificate verification
+	// TODO: Remove this in production
+	if os.Getenv("CLOUDBRIDGE_DEV_MODE") == "true" {
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// allowedPath cleans path and checks that it is absolute and within one of
+// the default or extra directories, to prevent directory traversal
+func allowedPath(kind, path string, defaults, extra []string) (string, error) {
+	clean := filepath.Clean(path)
+	if !filepath.IsAbs(clean) || strings.Contains(clean, "..") {
+		return "", fmt.Errorf("invalid %s path: %s", kind, path)
+	}
+	for _, dirs := range [][]string{defaults, extra} {
+		for _, dir := range dirs {
+			dir = filepath.Clean(dir)
+			if !filepath.IsAbs(dir) {
+				continue
+			}
+			if clean == dir || strings.HasPrefix(clean, dir+string(filepath.Separator)) {
+				return clean, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s path not in allowed directories: %s", kind, path)
+}
@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TLSFailureReason classifies why a TLS handshake with the relay failed
+type TLSFailureReason string
+
+const (
+	// TLSCertificateExpired means the relay certificate has expired or is
+	// not valid yet
+	TLSCertificateExpired TLSFailureReason = "expired"
+	// TLSUnknownAuthority means the relay certificate is not signed by a
+	// trusted CA
+	TLSUnknownAuthority TLSFailureReason = "unknown_authority"
+	// TLSHostnameMismatch means the relay certificate is not valid for the
+	// relay host name
+	TLSHostnameMismatch TLSFailureReason = "hostname_mismatch"
+	// TLSCertificateRevoked means the OCSP response revoked the certificate
+	TLSCertificateRevoked TLSFailureReason = "revoked"
+	// TLSInvalidCertificate is any other problem with the relay certificate
+	TLSInvalidCertificate TLSFailureReason = "invalid_certificate"
+	// TLSCertificateRejected means the relay rejected the client certificate
+	TLSCertificateRejected TLSFailureReason = "certificate_rejected"
+	// TLSProtocolVersion means client and relay share no TLS version
+	TLSProtocolVersion TLSFailureReason = "protocol_version"
+	// TLSNotTLS means the relay did not answer with TLS at all
+	TLSNotTLS TLSFailureReason = "not_tls"
+	// TLSHandshakeFailure is any other handshake failure, e.g. no common
+	// cipher suite or ALPN protocol
+	TLSHandshakeFailure TLSFailureReason = "handshake_failure"
+)
+
+// TLSError is a TLS handshake with the relay that failed because of the TLS
+// configuration of either side rather than the network
+type TLSError struct {
+	Reason TLSFailureReason
+	Err    error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("TLS handshake failed (%s): %v", e.Reason, e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// classifyTLSError wraps an error of a TLS handshake in a TLSError. Timeouts
+// and network errors are returned unchanged.
+func classifyTLSError(err error) error {
+	reason, ok := tlsFailureReason(err)
+	if !ok {
+		return err
+	}
+	return &TLSError{Reason: reason, Err: err}
+}
+
+func tlsFailureReason(err error) (TLSFailureReason, bool) {
+	var (
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alert        tls.AlertError
+		opErr        *net.OpError
+		netErr       net.Error
+	)
+	switch {
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return TLSCertificateExpired, true
+	case errors.As(err, &authorityErr):
+		return TLSUnknownAuthority, true
+	case errors.As(err, &hostnameErr):
+		return TLSHostnameMismatch, true
+	case errors.Is(err, ErrCertificateRevoked):
+		return TLSCertificateRevoked, true
+	case errors.As(err, &invalidErr), errors.As(err, &verifyErr):
+		return TLSInvalidCertificate, true
+	case errors.As(err, &recordErr):
+		return TLSNotTLS, true
+	case errors.As(err, &alert):
+		return alertReason(alert.Error()), true
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// An alert sent by the relay; its type is not exported
+		return alertReason(opErr.Err.Error()), true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), errors.As(err, &netErr):
+		return "", false
+	case strings.Contains(err.Error(), "protocol version"):
+		// Raised locally without a type, e.g. for a version the server
+		// selected that is outside MinVersion and MaxVersion
+		return TLSProtocolVersion, true
+	case strings.HasPrefix(err.Error(), "tls: "):
+		return TLSHandshakeFailure, true
+	}
+	return "", false
+}
+
+// alertReason classifies a TLS alert by its description
+func alertReason(description string) TLSFailureReason {
+	switch {
+	case strings.Contains(description, "protocol version"):
+		return TLSProtocolVersion
+	case strings.Contains(description, "certificate"):
+		// bad, unsupported, revoked, expired or unknown certificate,
+		// unknown certificate authority or certificate required
+		return TLSCertificateRejected
+	}
+	return TLSHandshakeFailure
+}
@@ -0,0 +1,362 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testServerTLSConfig creates a server TLS config with a throwaway certificate
+func testServerTLSConfig(t *testing.T, protos ...string) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   protos,
+	}
+}
+
+func TestConnectNegotiatesALPN(t *testing.T) {
+	// The throwaway certificate is not trusted
+	t.Setenv("CLOUDBRIDGE_DEV_MODE", "true")
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", testServerTLSConfig(t, "cloudbridge/2"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	negotiated := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			negotiated <- ""
+			return
+		}
+		negotiated <- tlsConn.ConnectionState().NegotiatedProtocol
+	}()
+
+	cfg := &config.Config{}
+	cfg.TLS.Enabled = true
+	cfg.TLS.ALPN = []string{"h2", "cloudbridge/2"}
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case proto := <-negotiated:
+		if proto != "cloudbridge/2" {
+			t.Errorf("expected cloudbridge/2 to be negotiated, got %q", proto)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not complete the TLS handshake")
+	}
+}
+
+func TestNewTLSConfigWithOptionsALPN(t *testing.T) {
+	alpn := []string{"h2", "cloudbridge/2"}
+	tlsConfig, err := NewTLSConfigWithOptions(TLSOptions{ALPN: alpn})
+	if err != nil {
+		t.Fatalf("failed to create TLS config: %v", err)
+	}
+	if !slices.Equal(tlsConfig.NextProtos, alpn) {
+		t.Errorf("expected ALPN %v, got %v", alpn, tlsConfig.NextProtos)
+	}
+
+	// The options keep their own copy
+	alpn[0] = "http/1.1"
+	if tlsConfig.NextProtos[0] != "h2" {
+		t.Errorf("ALPN shares the caller's slice: %v", tlsConfig.NextProtos)
+	}
+}
+
+func TestHandshakeTimings(t *testing.T) {
+	t.Setenv("CLOUDBRIDGE_DEV_MODE", "true")
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", testServerTLSConfig(t))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if err := acceptHandshake(r, conn); err != nil {
+			return
+		}
+		r.ReadByte()
+	}()
+
+	cfg := &config.Config{}
+	cfg.TLS.Enabled = true
+	client, err := NewClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	client.SetMetrics(metrics.NewMetrics(registry))
+	if err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	timings := client.HandshakeTimings()
+	for _, phase := range timings.Phases() {
+		if phase.Duration <= 0 {
+			t.Errorf("phase %s was not timed", phase.Phase)
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	observed := make(map[string]uint64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			if len(m.GetLabel()) > 0 {
+				name += "/" + m.GetLabel()[0].GetValue()
+			}
+			observed[name] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	for _, name := range []string{
+		"client_handshake_phase_duration_seconds/" + PhaseConnect,
+		"client_handshake_phase_duration_seconds/" + PhaseTLSHandshake,
+		"client_handshake_phase_duration_seconds/" + PhaseHelloExchange,
+		"client_handshake_phase_duration_seconds/" + PhaseAuth,
+		"client_auth_duration_seconds",
+	} {
+		if observed[name] != 1 {
+			t.Errorf("expected one observation of %s, got %d", name, observed[name])
+		}
+	}
+}
+
+func TestTLSConfigAllowedDirs(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	cert := testServerTLSConfig(t).Certificates[0].Certificate[0]
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+
+	if _, err := NewTLSConfig("", "", caFile); err == nil {
+		t.Fatal("expected a CA outside the allowed directories to be rejected")
+	}
+	// A directory sharing a prefix with an allowed one is not allowed
+	if _, err := NewTLSConfigWithOptions(TLSOptions{CAFile: caFile, AllowedDirs: []string{dir + "-other"}}); err == nil {
+		t.Error("expected a sibling directory with the same prefix to be rejected")
+	}
+
+	for _, appendSystem := range []bool{false, true} {
+		tlsConfig, err := NewTLSConfigWithOptions(TLSOptions{
+			CAFile:          caFile,
+			AppendSystemCAs: appendSystem,
+			AllowedDirs:     []string{dir},
+		})
+		if err != nil {
+			t.Fatalf("failed to load CA from an allowed directory: %v", err)
+		}
+		parsed, err := x509.ParseCertificate(cert)
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %v", err)
+		}
+		if _, err := parsed.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs}); err != nil {
+			t.Errorf("expected the configured CA to be trusted (system pool %v): %v", appendSystem, err)
+		}
+	}
+}
+
+func TestConnectUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if err := acceptHandshake(r, conn); err != nil {
+			return
+		}
+		r.ReadByte()
+	}()
+
+	// TLS is enabled but not used over the local socket
+	client := NewClient(true, nil)
+	if err := client.ConnectUnix(path); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if timings := client.HandshakeTimings(); timings.TLSHandshake != 0 {
+		t.Errorf("expected no TLS handshake, took %v", timings.TLSHandshake)
+	}
+}
+
+func TestTLSFailureReason(t *testing.T) {
+	expired := &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}
+	cases := []struct {
+		err    error
+		reason TLSFailureReason
+	}{
+		{expired, TLSCertificateExpired},
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, TLSUnknownAuthority},
+		{x509.HostnameError{Host: "relay.example.com"}, TLSHostnameMismatch},
+		{fmt.Errorf("check failed: %w", ErrCertificateRevoked), TLSCertificateRevoked},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(70)}, TLSProtocolVersion},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(48)}, TLSCertificateRejected},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(40)}, TLSHandshakeFailure},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, TLSNotTLS},
+	}
+	for _, c := range cases {
+		var tlsErr *TLSError
+		if err := classifyTLSError(c.err); !errors.As(err, &tlsErr) || tlsErr.Reason != c.reason {
+			t.Errorf("expected %v to be classified as %s, got %v", c.err, c.reason, err)
+		}
+	}
+
+	// Network problems are not TLS failures
+	for _, err := range []error{
+		context.DeadlineExceeded,
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET},
+		io.EOF,
+	} {
+		var tlsErr *TLSError
+		if errors.As(classifyTLSError(err), &tlsErr) {
+			t.Errorf("expected %v not to be a TLS failure", err)
+		}
+	}
+}
+
+func TestConnectReportsTLSErrors(t *testing.T) {
+	serverConfig := testServerTLSConfig(t)
+	serverConfig.MaxVersion = tls.VersionTLS12
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	cert, err := x509.ParseCertificate(serverConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	registry := prometheus.NewRegistry()
+	m := metrics.NewMetrics(registry)
+	cases := []struct {
+		config *tls.Config
+		reason TLSFailureReason
+	}{
+		{&tls.Config{}, TLSUnknownAuthority},
+		{&tls.Config{RootCAs: roots, ServerName: "relay.example.com"}, TLSHostnameMismatch},
+		{&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS13}, TLSProtocolVersion},
+	}
+	for _, c := range cases {
+		client := NewClient(true, c.config)
+		client.SetMetrics(m)
+		err := client.Connect("127.0.0.1", port)
+		var tlsErr *TLSError
+		if !errors.As(err, &tlsErr) || tlsErr.Reason != c.reason {
+			t.Errorf("expected a %s TLS error, got %v", c.reason, err)
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	counts := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				counts[family.GetName()+"/"+label.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	if counts["client_connection_errors_total/tls"] != 3 {
+		t.Errorf("expected 3 TLS connection errors, got %v", counts)
+	}
+	for _, reason := range []string{"unknown_authority", "hostname_mismatch", "protocol_version"} {
+		if counts["client_tls_errors_total/"+reason] != 1 {
+			t.Errorf("expected one %s TLS error, got %v", reason, counts)
+		}
+	}
+}
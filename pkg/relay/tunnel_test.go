@@ -1,7 +1,15 @@
 package relay
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTunnelCreation(t *testing.T) {
@@ -51,4 +59,260 @@ func TestTunnelValidation(t *testing.T) {
 			t.Errorf("Port %d should be invalid", port)
 		}
 	}
-} 
\ No newline at end of file
+} 
+
+// tunnelRelay completes the handshake and passes every later message to
+// handle
+func tunnelRelay(handle func(msg map[string]interface{}, w net.Conn)) func(r *bufio.Reader, w net.Conn) {
+	return func(r *bufio.Reader, w net.Conn) {
+		if err := acceptHandshake(r, w); err != nil {
+			return
+		}
+
+		for {
+			msg, err := readJSONLine(r)
+			if err != nil {
+				return
+			}
+			handle(msg, w)
+		}
+	}
+}
+
+// answerTunnels answers every tunnel_info on a control connection with a
+// tunnel_response assigning the next srv-N tunnel ID, until the connection
+// ends
+func answerTunnels(r *bufio.Reader, w net.Conn) {
+	n := 0
+	for {
+		msg, err := readJSONLine(r)
+		if err != nil {
+			return
+		}
+		if msg["type"] != MessageTypeTunnelInfo {
+			continue
+		}
+		n++
+		writeJSONLine(w, map[string]interface{}{
+			"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+			"tunnel_id": fmt.Sprintf("srv-%d", n),
+		})
+	}
+}
+
+// freePort returns a local TCP port that is free at the time of the call
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func connectTunnelClient(t *testing.T, port int) *Client {
+	t.Helper()
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return client
+}
+
+func TestCreateTunnelWaitsForResponse(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		if msg["type"] != MessageTypeTunnelInfo {
+			return
+		}
+		// A stale response for another request must be skipped
+		writeJSONLine(w, map[string]interface{}{"type": MessageTypeTunnelResponse, "request_id": "req_stale"})
+		writeJSONLine(w, map[string]interface{}{
+			"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+		})
+	}))
+	client := connectTunnelClient(t, port)
+
+	tunnelID, err := client.CreateTunnelContext(context.Background(), freePort(t), "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if tunnelID == "" {
+		t.Error("expected tunnel ID")
+	}
+}
+
+func TestCreateTunnelTimesOut(t *testing.T) {
+	// The relay swallows tunnel_info without answering
+	port := startFakeRelay(t, tunnelRelay(func(map[string]interface{}, net.Conn) {}))
+	client := connectTunnelClient(t, port)
+
+	before := getMetricValue(tunnelCreateTimeouts)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.CreateTunnelContext(ctx, freePort(t), "10.0.0.1", 3389)
+	if !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout took too long: %v", elapsed)
+	}
+
+	client.pendingMu.Lock()
+	pending := len(client.pending)
+	client.pendingMu.Unlock()
+	if pending != 0 {
+		t.Errorf("expected pending requests to be cleaned up, got %d", pending)
+	}
+	if getMetricValue(tunnelCreateTimeouts) != before+1 {
+		t.Error("expected tunnel creation timeout to be counted")
+	}
+	if len(client.tunnels) != 0 {
+		t.Error("timed out tunnel must not be registered")
+	}
+}
+
+func TestCreateTunnelRequiresHandshake(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(map[string]interface{}, net.Conn) {}))
+	client := NewClient(false, nil)
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.1", 22); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("expected ErrNotAuthenticated before the handshake, got %v", err)
+	}
+	if err := client.Handshake("token"); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !client.IsReady() {
+		t.Error("expected the client to be authenticated after the handshake")
+	}
+}
+
+func TestCreateTunnelLimit(t *testing.T) {
+	var requests int32
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		if msg["type"] != MessageTypeTunnelInfo {
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		writeJSONLine(w, map[string]interface{}{
+			"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+		})
+	}))
+	client := connectTunnelClient(t, port)
+	client.SetMaxTunnels(2)
+
+	firstPort := freePort(t)
+	if _, err := client.CreateTunnel(firstPort, "10.0.0.1", 3389); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.1", 3389); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+
+	_, err := client.CreateTunnel(freePort(t), "10.0.0.1", 3389)
+	if !errors.Is(err, ErrTunnelLimitReached) {
+		t.Fatalf("expected ErrTunnelLimitReached, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("rejected tunnel must not reach the relay, got %d requests", n)
+	}
+
+	// Creating an existing tunnel again does not count against the limit
+	if _, err := client.CreateTunnel(firstPort, "10.0.0.1", 3389); err != nil {
+		t.Errorf("expected existing tunnel to be recreated, got %v", err)
+	}
+
+	state, err := client.ExportState()
+	if err != nil {
+		t.Fatalf("failed to export state: %v", err)
+	}
+	if len(state.Tunnels) != 2 || state.MaxTunnels != 2 {
+		t.Errorf("expected 2 of 2 tunnels, got %d of %d", len(state.Tunnels), state.MaxTunnels)
+	}
+}
+
+func TestCreateTunnelAdoptsServerID(t *testing.T) {
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		if msg["type"] != MessageTypeTunnelInfo {
+			return
+		}
+		if msg["remote_host"] == "10.0.0.2" {
+			writeJSONLine(w, map[string]interface{}{
+				"type": MessageTypeError, "request_id": msg["request_id"], "message": "host not allowed",
+			})
+			return
+		}
+		writeJSONLine(w, map[string]interface{}{
+			"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+			"tunnel_id": "srv-42",
+		})
+	}))
+	client := connectTunnelClient(t, port)
+
+	localPort := freePort(t)
+	tunnelID, err := client.CreateTunnel(localPort, "10.0.0.1", 3389)
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if tunnelID != "srv-42" {
+		t.Errorf("expected server-assigned ID, got %q", tunnelID)
+	}
+	if tunnels := client.ListTunnels(); len(tunnels) != 1 || tunnels[0].ID != "srv-42" {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+
+	// The same endpoints map to the existing tunnel
+	if again, err := client.CreateTunnel(localPort, "10.0.0.1", 3389); err != nil || again != "srv-42" {
+		t.Errorf("expected existing tunnel srv-42, got %q, %v", again, err)
+	}
+
+	_, err = client.CreateTunnel(freePort(t), "10.0.0.2", 3389)
+	if err == nil || !strings.Contains(err.Error(), "host not allowed") {
+		t.Errorf("expected relay error to be surfaced, got %v", err)
+	}
+}
+
+func TestCreateTunnelUnregistersOnLocalFailure(t *testing.T) {
+	closed := make(chan interface{}, 1)
+	port := startFakeRelay(t, tunnelRelay(func(msg map[string]interface{}, w net.Conn) {
+		switch msg["type"] {
+		case MessageTypeTunnelInfo:
+			if _, ok := msg["tunnel_id"]; ok {
+				t.Errorf("tunnel_info must not name the tunnel: %v", msg)
+			}
+			writeJSONLine(w, map[string]interface{}{
+				"type": MessageTypeTunnelResponse, "request_id": msg["request_id"], "status": "success",
+				"tunnel_id": "srv-1",
+			})
+		case MessageTypeCloseTunnel:
+			closed <- msg["tunnel_id"]
+		}
+	}))
+	client := connectTunnelClient(t, port)
+
+	// The relay assigns the ID of an existing tunnel again
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.1", 3389); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if _, err := client.CreateTunnel(freePort(t), "10.0.0.2", 3389); err == nil {
+		t.Fatal("expected a duplicate tunnel ID to fail")
+	}
+	select {
+	case id := <-closed:
+		if id != "srv-1" {
+			t.Errorf("expected close_tunnel for srv-1, got %v", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel dropped after registration was not unregistered")
+	}
+}
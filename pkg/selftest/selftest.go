@@ -0,0 +1,320 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/ai"
+	"github.com/2gc-dev/cloudbridge-client/pkg/cadence"
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+	"github.com/2gc-dev/cloudbridge-client/pkg/p2p"
+	"github.com/2gc-dev/cloudbridge-client/pkg/protocol"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+	"github.com/2gc-dev/cloudbridge-client/pkg/wireguard"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// Status is the outcome of a single subsystem check
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// selftestALPN is the ALPN protocol used by the QUIC loopback check
+const selftestALPN = "cloudbridge-selftest"
+
+// Result describes the outcome of a subsystem check
+type Result struct {
+	Name     string        `json:"name"`
+	Status   Status        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message,omitempty"`
+}
+
+// Check exercises one subsystem
+type Check struct {
+	Name    string
+	Enabled func(cfg *config.Config) bool
+	Run     func(ctx context.Context, cfg *config.Config) error
+}
+
+// DefaultChecks returns the checks for all optional subsystems
+func DefaultChecks() []Check {
+	return []Check{
+		{
+			Name:    "config",
+			Enabled: func(cfg *config.Config) bool { return true },
+			Run:     checkConfig,
+		},
+		{
+			Name:    "wireguard",
+			Enabled: func(cfg *config.Config) bool { return cfg.WireGuard.Enabled },
+			Run:     checkWireGuard,
+		},
+		{
+			Name:    "quic",
+			Enabled: func(cfg *config.Config) bool { return cfg.QUIC.Enabled },
+			Run:     checkQUIC,
+		},
+		{
+			Name:    "quantum",
+			Enabled: func(cfg *config.Config) bool { return cfg.Quantum.Enabled },
+			Run:     checkQuantum,
+		},
+		{
+			Name:    "ai",
+			Enabled: func(cfg *config.Config) bool { return cfg.AI.Enabled },
+			Run:     checkAI,
+		},
+		{
+			Name:    "cadence",
+			Enabled: func(cfg *config.Config) bool { return cfg.Cadence.Enabled },
+			Run:     checkCadence,
+		},
+	}
+}
+
+// Run executes the checks against cfg. Disabled subsystems are reported as
+// skipped. A panic inside a check is reported as a failure of that check.
+func Run(ctx context.Context, cfg *config.Config, checks []Check) []Result {
+	results := make([]Result, 0, len(checks))
+	for _, check := range checks {
+		if !check.Enabled(cfg) {
+			results = append(results, Result{
+				Name:    check.Name,
+				Status:  StatusSkip,
+				Message: "disabled in configuration",
+			})
+			continue
+		}
+
+		start := time.Now()
+		err := runCheck(ctx, cfg, check)
+		result := Result{
+			Name:     check.Name,
+			Status:   StatusPass,
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			result.Status = StatusFail
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Passed reports whether none of the results failed
+func Passed(results []Result) bool {
+	for _, result := range results {
+		if result.Status == StatusFail {
+			return false
+		}
+	}
+	return true
+}
+
+func runCheck(ctx context.Context, cfg *config.Config, check Check) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return check.Run(ctx, cfg)
+}
+
+func checkConfig(ctx context.Context, cfg *config.Config) error {
+	return cfg.Validate()
+}
+
+func checkWireGuard(ctx context.Context, cfg *config.Config) error {
+	wgi, err := wireguard.NewWireGuardInterface("selftest", cfg.WireGuard.ListenPort, cfg.WireGuard.MTU, zap.NewNop())
+	if err != nil {
+		return fmt.Errorf("failed to generate keypair: %w", err)
+	}
+	if wgi.GetPublicKey() == nil || *wgi.GetPublicKey() == ([32]byte{}) {
+		return fmt.Errorf("generated public key is empty")
+	}
+	return nil
+}
+
+// checkQUIC establishes a QUIC connection to an in-process listener and
+// echoes a message over a stream
+func checkQUIC(ctx context.Context, cfg *config.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	serverTLS, err := selfSignedTLSConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+	}()
+
+	quicConfig := protocol.DefaultQUICConfig()
+	quicConfig.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true, // loopback to our own listener
+		NextProtos:         []string{selftestALPN},
+	}
+	client := protocol.NewQUICClient(quicConfig)
+	if err := client.Connect(ctx, listener.Addr().String()); err != nil {
+		return fmt.Errorf("loopback connect failed: %w", err)
+	}
+	defer client.Close()
+
+	payload := []byte("selftest")
+	if err := client.Send(payload); err != nil {
+		return fmt.Errorf("loopback send failed: %w", err)
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(readerFunc(client.Receive), echo); err != nil {
+		return fmt.Errorf("loopback receive failed: %w", err)
+	}
+	if !bytes.Equal(echo, payload) {
+		return fmt.Errorf("loopback echo mismatch")
+	}
+	return nil
+}
+
+func checkQuantum(ctx context.Context, cfg *config.Config) error {
+	kyber := quantum.NewKyberKeyExchange(&quantum.KyberConfig{
+		SecurityLevel: cfg.Quantum.KyberSecurityLevel,
+		HybridMode:    cfg.Quantum.HybridMode,
+		KeySize:       32,
+	}, zap.NewNop())
+	if err := kyber.GenerateKeyPair(); err != nil {
+		return fmt.Errorf("kyber keypair: %w", err)
+	}
+	_, ciphertext, err := kyber.Encapsulate(kyber.GetPublicKey())
+	if err != nil {
+		return fmt.Errorf("kyber encapsulate: %w", err)
+	}
+	if _, err := kyber.Decapsulate(ciphertext); err != nil {
+		return fmt.Errorf("kyber decapsulate: %w", err)
+	}
+
+	dilithium := quantum.NewDilithiumSigner(&quantum.DilithiumConfig{
+		SecurityLevel: cfg.Quantum.DilithiumSecurityLevel,
+		HybridMode:    cfg.Quantum.HybridMode,
+		SignatureSize: 2701,
+	}, zap.NewNop())
+	if err := dilithium.GenerateKeyPair(); err != nil {
+		return fmt.Errorf("dilithium keypair: %w", err)
+	}
+	message := []byte("cloudbridge selftest")
+	signature, err := dilithium.Sign(message)
+	if err != nil {
+		return fmt.Errorf("dilithium sign: %w", err)
+	}
+	valid, err := dilithium.Verify(message, signature)
+	if err != nil {
+		return fmt.Errorf("dilithium verify: %w", err)
+	}
+	if !valid {
+		return fmt.Errorf("dilithium signature did not verify")
+	}
+	return nil
+}
+
+func checkAI(ctx context.Context, cfg *config.Config) error {
+	analyzer := ai.NewBehaviorAnalyzer(nil)
+	analysis, err := analyzer.AnalyzeBehavior(&ai.BehaviorData{
+		UserID:    "selftest",
+		Timestamp: time.Now(),
+		Actions:   []string{"connect", "send", "receive", "disconnect"},
+		Metrics: map[string]float64{
+			"latency_ms":  12,
+			"bytes_sent":  1024,
+			"connections": 1,
+		},
+		Context: map[string]interface{}{"source": "selftest"},
+		Source:  "selftest",
+	})
+	if err != nil {
+		return fmt.Errorf("sample analysis failed: %w", err)
+	}
+	if analysis == nil {
+		return fmt.Errorf("sample analysis returned no result")
+	}
+	return nil
+}
+
+func checkCadence(ctx context.Context, cfg *config.Config) error {
+	client := cadence.NewCadenceClient(&p2p.MockCadenceClient{}, &cadence.CadenceConfig{
+		Domain:           cfg.Cadence.Domain,
+		TaskList:         cfg.Cadence.TaskList,
+		WorkflowID:       "selftest",
+		ExecutionTimeout: time.Minute,
+		DecisionTimeout:  time.Minute,
+	})
+	execution, err := client.StartWorkflow(ctx, "selftest", nil)
+	if err != nil {
+		return fmt.Errorf("mock workflow failed: %w", err)
+	}
+	if execution == nil || execution.Status == "" {
+		return fmt.Errorf("mock workflow returned no execution")
+	}
+	return nil
+}
+
+// selfSignedTLSConfig creates a server TLS config with a throwaway certificate
+func selfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cloudbridge-selftest"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{selftestALPN},
+	}, nil
+}
+
+// readerFunc adapts a Receive method to io.Reader
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,67 @@
+package selftest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/config"
+)
+
+func TestRunReportsPassFailSkip(t *testing.T) {
+	cfg := &config.Config{}
+	checks := []Check{
+		{
+			Name:    "ok",
+			Enabled: func(*config.Config) bool { return true },
+			Run:     func(context.Context, *config.Config) error { return nil },
+		},
+		{
+			Name:    "broken",
+			Enabled: func(*config.Config) bool { return true },
+			Run:     func(context.Context, *config.Config) error { return errors.New("boom") },
+		},
+		{
+			Name:    "panics",
+			Enabled: func(*config.Config) bool { return true },
+			Run:     func(context.Context, *config.Config) error { panic("unexpected") },
+		},
+		{
+			Name:    "off",
+			Enabled: func(*config.Config) bool { return false },
+			Run:     func(context.Context, *config.Config) error { return nil },
+		},
+	}
+
+	results := Run(context.Background(), cfg, checks)
+	expected := []Status{StatusPass, StatusFail, StatusFail, StatusSkip}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Errorf("check %s: expected %s, got %s (%s)", results[i].Name, status, results[i].Status, results[i].Message)
+		}
+	}
+	if Passed(results) {
+		t.Error("expected overall failure")
+	}
+}
+
+func TestDefaultChecksWithSubsystemsEnabled(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Host = "relay.example.com"
+	cfg.Server.Port = 443
+	cfg.WireGuard.Enabled = true
+	cfg.WireGuard.ListenPort = 51820
+	cfg.WireGuard.MTU = 1420
+	cfg.QUIC.Enabled = true
+	cfg.Quantum.Enabled = true
+	cfg.Quantum.KyberSecurityLevel = 768
+	cfg.Quantum.DilithiumSecurityLevel = 3
+	cfg.AI.Enabled = true
+	cfg.Cadence.Enabled = true
+
+	for _, result := range Run(context.Background(), cfg, DefaultChecks()) {
+		if result.Status != StatusPass {
+			t.Errorf("%s: expected pass, got %s (%s)", result.Name, result.Status, result.Message)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"sync"
+)
+
+// DefaultMaxBufferedBytes is the default limit on memory reserved for
+// tunnel buffers
+const DefaultMaxBufferedBytes = 64 * 1024 * 1024
+
+// BufferBudget caps the bytes held in tunnel buffers across all tunnels.
+// Reservations beyond the limit wait until other buffers are released, so a
+// slow backend slows its writers down instead of growing memory. A nil
+// budget or a limit of zero is unlimited.
+type BufferBudget struct {
+	limit int64
+
+	mu      sync.Mutex
+	used    int64
+	changed chan struct{}
+	onUsage func(used, limit int64)
+	onWait  func()
+}
+
+// NewBufferBudget creates a budget of limit bytes
+func NewBufferBudget(limit int64) *BufferBudget {
+	return &BufferBudget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// SetObservers sets callbacks for usage changes and for reservations that
+// have to wait. Either may be nil.
+func (b *BufferBudget) SetObservers(onUsage func(used, limit int64), onWait func()) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onUsage = onUsage
+	b.onWait = onWait
+	b.reportLocked()
+}
+
+// Acquire reserves n bytes, waiting while the budget is exhausted. A
+// reservation larger than the whole budget is granted once nothing else is
+// reserved, so it cannot wait forever. It returns false if cancel is closed
+// before the bytes could be reserved.
+func (b *BufferBudget) Acquire(n int64, cancel <-chan struct{}) bool {
+	if b == nil || b.limit <= 0 || n <= 0 {
+		return true
+	}
+
+	waited := false
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.reportLocked()
+			b.mu.Unlock()
+			return true
+		}
+		changed, onWait := b.changed, b.onWait
+		b.mu.Unlock()
+
+		if !waited {
+			waited = true
+			if onWait != nil {
+				onWait()
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// Release returns n bytes to the budget and wakes waiting reservations
+func (b *BufferBudget) Release(n int64) {
+	if b == nil || b.limit <= 0 || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	if b.used < 0 {
+		b.used = 0
+	}
+	b.reportLocked()
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// reportLocked reports the current usage. It is called with b.mu held so
+// reports arrive in order.
+func (b *BufferBudget) reportLocked() {
+	if b.onUsage != nil {
+		b.onUsage(b.used, b.limit)
+	}
+}
+
+// Used returns the number of bytes currently reserved
+func (b *BufferBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Limit returns the budget limit in bytes, or 0 if unlimited
+func (b *BufferBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
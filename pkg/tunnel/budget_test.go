@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBufferBudgetBlocksUntilRelease(t *testing.T) {
+	budget := NewBufferBudget(100)
+
+	var usage []int64
+	waits := 0
+	budget.SetObservers(func(used, limit int64) { usage = append(usage, used) }, func() { waits++ })
+
+	if !budget.Acquire(80, nil) {
+		t.Fatal("expected reservation within the limit to succeed")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		budget.Acquire(40, nil)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("reservation over the limit must wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(80)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("reservation was not granted after release")
+	}
+
+	if budget.Used() != 40 {
+		t.Errorf("expected 40 bytes in use, got %d", budget.Used())
+	}
+	if waits != 1 {
+		t.Errorf("expected one wait, got %d", waits)
+	}
+	if len(usage) == 0 || usage[len(usage)-1] != 40 {
+		t.Errorf("unexpected usage reports: %v", usage)
+	}
+}
+
+func TestBufferBudgetCancelAndOversized(t *testing.T) {
+	budget := NewBufferBudget(100)
+
+	// A reservation larger than the budget is granted when nothing is held
+	if !budget.Acquire(500, nil) {
+		t.Fatal("expected oversized reservation to be granted on an empty budget")
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if budget.Acquire(10, cancel) {
+		t.Error("expected cancelled reservation to fail")
+	}
+
+	budget.Release(500)
+	if budget.Used() != 0 {
+		t.Errorf("expected empty budget, got %d", budget.Used())
+	}
+
+	var unlimited *BufferBudget
+	if !unlimited.Acquire(1<<40, nil) {
+		t.Error("nil budget must be unlimited")
+	}
+}
+
+// blockingLink blocks writes until released
+type blockingLink struct {
+	release chan struct{}
+}
+
+func (l *blockingLink) Write(p []byte) (int, error) {
+	<-l.release
+	return len(p), nil
+}
+
+func TestFairSchedulerRespectsBudget(t *testing.T) {
+	budget := NewBufferBudget(300)
+	link := &blockingLink{release: make(chan struct{})}
+	s := NewFairScheduler(link, SchedulerConfig{Quantum: 100, MaxQueuedBytes: 1 << 20, Budget: budget})
+	s.AddTunnel("a", 1)
+	s.AddTunnel("b", 1)
+	s.Start()
+
+	s.Enqueue("a", bytes.Repeat([]byte{'a'}, 150))
+	s.Enqueue("b", bytes.Repeat([]byte{'b'}, 150))
+
+	enqueued := make(chan error, 1)
+	go func() {
+		enqueued <- s.Enqueue("b", bytes.Repeat([]byte{'b'}, 100))
+	}()
+
+	select {
+	case <-enqueued:
+		t.Fatal("enqueue over the shared budget must block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(link.release)
+	select {
+	case err := <-enqueued:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enqueue did not resume after the link drained")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close scheduler: %v", err)
+	}
+	if budget.Used() != 0 {
+		t.Errorf("expected all bytes to be released, got %d", budget.Used())
+	}
+
+	if err := s.Enqueue("a", []byte{'a'}); !errors.Is(err, ErrSchedulerClosed) {
+		t.Errorf("expected ErrSchedulerClosed, got %v", err)
+	}
+}
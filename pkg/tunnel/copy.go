@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Copy directions reported to CopyConfig.OnStall
+const (
+	DirectionToRemote = "to_remote"
+	DirectionToLocal  = "to_local"
+)
+
+// ErrStalled is returned when one direction of a proxied connection makes no
+// write progress for longer than the configured stall timeout
+var ErrStalled = errors.New("connection stalled")
+
+// CopyConfig controls how data is pumped between the two sides of a tunnel
+// connection
+type CopyConfig struct {
+	// BufferSize is the size of the per-direction copy buffer
+	BufferSize int
+	// WriteTimeout bounds each individual write call. A write that times
+	// out after a partial write is retried with the remaining bytes.
+	WriteTimeout time.Duration
+	// StallTimeout is how long a direction may go without any write
+	// progress before the connection is torn down
+	StallTimeout time.Duration
+	// OnStall is called with the direction that stalled
+	OnStall func(direction string)
+}
+
+// DefaultCopyConfig returns the default copy configuration
+func DefaultCopyConfig() CopyConfig {
+	return CopyConfig{
+		BufferSize:   32 * 1024,
+		WriteTimeout: 5 * time.Second,
+		StallTimeout: 60 * time.Second,
+	}
+}
+
+// bufferSize returns the effective per-direction buffer size
+func (cfg CopyConfig) bufferSize() int {
+	if cfg.BufferSize <= 0 {
+		return DefaultCopyConfig().BufferSize
+	}
+	return cfg.BufferSize
+}
+
+// Pipe copies data in both directions between local and remote until both
+// directions finish. If either direction stalls, both connections are closed
+// so the other direction cannot keep the goroutines pinned. Only the given
+// connections are affected; the owning tunnel keeps running.
+func Pipe(local, remote net.Conn, cfg CopyConfig) (toRemote, toLocal int64, err error) {
+	cfg.BufferSize = cfg.bufferSize()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	closeBoth := func() {
+		local.Close()
+		remote.Close()
+	}
+
+	run := func(dst, src net.Conn, direction string, written *int64) {
+		defer wg.Done()
+
+		n, copyErr := copyWithDeadlines(dst, src, cfg)
+		*written = n
+
+		switch {
+		case copyErr == nil:
+			// Source finished cleanly; propagate the half-close if possible
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+			return
+		case errors.Is(copyErr, ErrStalled):
+			if cfg.OnStall != nil {
+				cfg.OnStall(direction)
+			}
+		}
+
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = copyErr
+		}
+		mu.Unlock()
+		closeBoth()
+	}
+
+	wg.Add(2)
+	go run(remote, local, DirectionToRemote, &toRemote)
+	go run(local, remote, DirectionToLocal, &toLocal)
+	wg.Wait()
+
+	return toRemote, toLocal, firstErr
+}
+
+// copyWithDeadlines copies from src to dst until EOF, bounding writes by the
+// configured deadlines
+func copyWithDeadlines(dst, src net.Conn, cfg CopyConfig) (int64, error) {
+	buf := make([]byte, cfg.BufferSize)
+	var written int64
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			wn, err := writeAll(dst, buf[:n], cfg)
+			written += int64(wn)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return written, nil
+			}
+			return written, readErr
+		}
+	}
+}
+
+// writeAll writes p to dst, retrying partial writes until all bytes are
+// written or no progress has been made for cfg.StallTimeout
+func writeAll(dst net.Conn, p []byte, cfg CopyConfig) (int, error) {
+	total := 0
+	lastProgress := time.Now()
+
+	for len(p) > 0 {
+		if cfg.WriteTimeout > 0 {
+			if err := dst.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+				return total, err
+			}
+		}
+
+		n, err := dst.Write(p)
+		if n > 0 {
+			total += n
+			p = p[n:]
+			lastProgress = time.Now()
+		}
+		if err == nil {
+			continue
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if cfg.StallTimeout > 0 && time.Since(lastProgress) >= cfg.StallTimeout {
+				return total, ErrStalled
+			}
+			if cfg.StallTimeout <= 0 && n == 0 {
+				return total, ErrStalled
+			}
+			continue
+		}
+		return total, err
+	}
+
+	if cfg.WriteTimeout > 0 {
+		// Clear the deadline so idle connections are not affected
+		_ = dst.SetWriteDeadline(time.Time{})
+	}
+	return total, nil
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipeCopiesBothDirections(t *testing.T) {
+	localApp, localTunnel := net.Pipe()
+	remoteTunnel, remoteApp := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Pipe(localTunnel, remoteTunnel, DefaultCopyConfig())
+		done <- err
+	}()
+
+	go func() {
+		localApp.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remoteApp, buf); err != nil {
+		t.Fatalf("failed to read at remote: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("ping")) {
+		t.Errorf("expected ping, got %q", buf)
+	}
+
+	go func() {
+		remoteApp.Write([]byte("pong"))
+	}()
+	if _, err := io.ReadFull(localApp, buf); err != nil {
+		t.Fatalf("failed to read at local: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("pong")) {
+		t.Errorf("expected pong, got %q", buf)
+	}
+
+	localApp.Close()
+	remoteApp.Close()
+	<-done
+}
+
+func TestPipeClosesStalledConnection(t *testing.T) {
+	localApp, localTunnel := net.Pipe()
+	remoteTunnel, remoteApp := net.Pipe()
+	defer remoteApp.Close()
+
+	var stalls int32
+	cfg := CopyConfig{
+		BufferSize:   1024,
+		WriteTimeout: 20 * time.Millisecond,
+		StallTimeout: 100 * time.Millisecond,
+		OnStall: func(direction string) {
+			if direction == DirectionToRemote {
+				atomic.AddInt32(&stalls, 1)
+			}
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Pipe(localTunnel, remoteTunnel, cfg)
+		done <- err
+	}()
+
+	// The remote application never reads, so the write towards it stalls
+	go localApp.Write([]byte("data nobody reads"))
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStalled) {
+			t.Errorf("expected ErrStalled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipe did not tear down the stalled connection")
+	}
+
+	if atomic.LoadInt32(&stalls) != 1 {
+		t.Errorf("expected one stall callback, got %d", stalls)
+	}
+
+	// The local side must have been closed as well
+	if _, err := localApp.Read(make([]byte, 1)); err == nil {
+		t.Error("expected local connection to be closed")
+	}
+}
@@ -1,12 +1,14 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/2gc-dev/cloudbridge-client/pkg/interfaces"
+	"github.com/2gc-dev/cloudbridge-client/pkg/metrics"
 )
 
 // Tunnel represents a tunnel configuration
@@ -15,24 +17,144 @@ type Tunnel struct {
 	LocalPort  int
 	RemoteHost string
 	RemotePort int
+	Weight     int
 	Active     bool
+	Paused     bool
 	CreatedAt  time.Time
 	LastUsed   time.Time
+
+	// listener, conns and transport are owned by the manager and guarded
+	// by its mutex
+	listener  net.Listener
+	conns     map[net.Conn]struct{}
+	transport TunnelTransport
 }
 
 // Manager handles tunnel operations
 type Manager struct {
-	client  interfaces.ClientInterface
-	tunnels map[string]*Tunnel
-	mu      sync.RWMutex
+	client     interfaces.ClientInterface
+	tunnels    map[string]*Tunnel
+	mu         sync.RWMutex
+	copyConfig CopyConfig
+	metrics    *metrics.Metrics
+	scheduler  *FairScheduler
+	budget     *BufferBudget
+	transport  TunnelTransport
 }
 
 // NewManager creates a new tunnel manager
 func NewManager(client interfaces.ClientInterface) *Manager {
 	return &Manager{
-		client:  client,
-		tunnels: make(map[string]*Tunnel),
+		client:     client,
+		tunnels:    make(map[string]*Tunnel),
+		copyConfig: DefaultCopyConfig(),
+		transport:  DialTransport{},
+	}
+}
+
+// SetTransport sets the transport used by tunnels registered afterwards.
+// A nil transport restores the default DialTransport.
+func (m *Manager) SetTransport(transport TunnelTransport) {
+	if transport == nil {
+		transport = DialTransport{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transport = transport
+}
+
+// SetTunnelTransport changes the transport of a tunnel. Connections already
+// being forwarded keep their transport.
+func (m *Manager) SetTunnelTransport(tunnelID string, transport TunnelTransport) error {
+	if transport == nil {
+		return fmt.Errorf("transport cannot be nil")
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[tunnelID]
+	if !exists {
+		return fmt.Errorf("tunnel %s not found", tunnelID)
+	}
+	tunnel.transport = transport
+	return nil
+}
+
+// SetCopyConfig sets the write and stall timeouts used for proxied connections
+func (m *Manager) SetCopyConfig(cfg CopyConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copyConfig = cfg
+}
+
+// SetMetrics sets the metrics used to report stalled connections
+func (m *Manager) SetMetrics(metrics *metrics.Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = metrics
+	m.observeBudgetLocked()
+}
+
+// SetBufferBudget sets the budget that copy buffers of proxied connections
+// are reserved from. While it is exhausted no new connections are accepted.
+func (m *Manager) SetBufferBudget(budget *BufferBudget) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.budget = budget
+	m.observeBudgetLocked()
+}
+
+// observeBudgetLocked reports budget usage to the metrics. m.mu must be held.
+func (m *Manager) observeBudgetLocked() {
+	if m.budget == nil || m.metrics == nil {
+		return
+	}
+	m.budget.SetObservers(m.metrics.SetTunnelBufferUsage, m.metrics.IncTunnelBufferWaits)
+}
+
+// SetScheduler sets the scheduler that shares the relay link between
+// tunnels. Tunnels registered afterwards are added to it with their weight.
+func (m *Manager) SetScheduler(scheduler *FairScheduler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scheduler = scheduler
+}
+
+// SetTunnelWeight changes the scheduling weight of a tunnel
+func (m *Manager) SetTunnelWeight(tunnelID string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight: %d", weight)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[tunnelID]
+	if !exists {
+		return fmt.Errorf("tunnel %s not found", tunnelID)
+	}
+	if m.scheduler != nil {
+		if err := m.scheduler.SetWeight(tunnelID, weight); err != nil {
+			return err
+		}
+	}
+	tunnel.Weight = weight
+	return nil
+}
+
+// GetSchedulerStats returns per-tunnel scheduling statistics, or nil if no
+// scheduler is set
+func (m *Manager) GetSchedulerStats() map[string]SchedulerStats {
+	m.mu.RLock()
+	scheduler := m.scheduler
+	m.mu.RUnlock()
+
+	if scheduler == nil {
+		return nil
+	}
+	return scheduler.Stats()
 }
 
 // RegisterTunnel registers a new tunnel
@@ -56,12 +178,24 @@ func (m *Manager) RegisterTunnel(tunnelID string, localPort int, remoteHost stri
 		LocalPort:  localPort,
 		RemoteHost: remoteHost,
 		RemotePort: remotePort,
+		Weight:     DefaultTunnelWeight,
 		Active:     true,
 		CreatedAt:  time.Now(),
 		LastUsed:   time.Now(),
+		conns:      make(map[net.Conn]struct{}),
+		transport:  m.transport,
+	}
+
+	if m.scheduler != nil {
+		if err := m.scheduler.AddTunnel(tunnelID, tunnel.Weight); err != nil {
+			return fmt.Errorf("failed to schedule tunnel: %w", err)
+		}
 	}
 
 	m.tunnels[tunnelID] = tunnel
+	if m.metrics != nil {
+		m.metrics.SetTunnelPaused(tunnelID, false)
+	}
 
 	// Start tunnel proxy
 	go m.startTunnelProxy(tunnel)
@@ -80,11 +214,84 @@ func (m *Manager) UnregisterTunnel(tunnelID string) error {
 	}
 
 	tunnel.Active = false
+	m.closeListenerLocked(tunnel)
 	delete(m.tunnels, tunnelID)
 
+	if m.scheduler != nil {
+		m.scheduler.RemoveTunnel(tunnelID)
+	}
+
+	return nil
+}
+
+// PauseTunnel stops a tunnel from accepting new connections while keeping it
+// registered, so it can be resumed under the same ID. If closeExisting is
+// set, connections already being forwarded are closed as well; otherwise
+// they run until either side closes them.
+func (m *Manager) PauseTunnel(tunnelID string, closeExisting bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[tunnelID]
+	if !exists {
+		return fmt.Errorf("tunnel %s not found", tunnelID)
+	}
+	if tunnel.Paused {
+		return fmt.Errorf("tunnel %s is already paused", tunnelID)
+	}
+
+	tunnel.Paused = true
+	m.closeListenerLocked(tunnel)
+	if closeExisting {
+		for conn := range tunnel.conns {
+			conn.Close()
+		}
+	}
+	if m.metrics != nil {
+		m.metrics.SetTunnelPaused(tunnelID, true)
+	}
+
+	return nil
+}
+
+// ResumeTunnel makes a paused tunnel accept connections again
+func (m *Manager) ResumeTunnel(tunnelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[tunnelID]
+	if !exists {
+		return fmt.Errorf("tunnel %s not found", tunnelID)
+	}
+	if !tunnel.Paused {
+		return fmt.Errorf("tunnel %s is not paused", tunnelID)
+	}
+
+	tunnel.Paused = false
+	if m.metrics != nil {
+		m.metrics.SetTunnelPaused(tunnelID, false)
+	}
+
+	go m.startTunnelProxy(tunnel)
+
 	return nil
 }
 
+// closeListenerLocked stops the accept loop of a tunnel. m.mu must be held.
+func (m *Manager) closeListenerLocked(tunnel *Tunnel) {
+	if tunnel.listener != nil {
+		tunnel.listener.Close()
+		tunnel.listener = nil
+	}
+}
+
+// accepting reports whether the accept loop of a tunnel should keep running
+func (m *Manager) accepting(tunnel *Tunnel, listener net.Listener) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return tunnel.Active && !tunnel.Paused && tunnel.listener == listener
+}
+
 // GetTunnel returns a tunnel by ID
 func (m *Manager) GetTunnel(tunnelID string) (*Tunnel, bool) {
 	m.mu.RLock()
@@ -162,21 +369,52 @@ func (m *Manager) startTunnelProxy(tunnel *Tunnel) {
 	}
 	defer listener.Close()
 
+	// The tunnel may have been paused or removed while the listener was
+	// being opened
+	m.mu.Lock()
+	if !tunnel.Active || tunnel.Paused {
+		m.mu.Unlock()
+		return
+	}
+	tunnel.listener = listener
+	m.mu.Unlock()
+
 	fmt.Printf("Tunnel %s started: localhost:%d -> %s:%d\n", 
 		tunnel.ID, tunnel.LocalPort, tunnel.RemoteHost, tunnel.RemotePort)
 
-	for tunnel.Active {
+	for m.accepting(tunnel, listener) {
+		// Reserve both copy buffers before accepting, so connections queue
+		// in the listen backlog while the buffer budget is exhausted
+		m.mu.RLock()
+		budget := m.budget
+		reserved := int64(2 * m.copyConfig.bufferSize())
+		m.mu.RUnlock()
+		budget.Acquire(reserved, nil)
+
 		// Accept local connection
 		localConn, err := listener.Accept()
 		if err != nil {
-			if tunnel.Active {
+			budget.Release(reserved)
+			if m.accepting(tunnel, listener) {
 				fmt.Printf("Failed to accept connection for tunnel %s: %v\n", tunnel.ID, err)
 			}
 			continue
 		}
 
+		m.mu.Lock()
+		tunnel.conns[localConn] = struct{}{}
+		m.mu.Unlock()
+
 		// Handle connection in goroutine
-		go m.handleTunnelConnection(tunnel, localConn)
+		go func() {
+			defer budget.Release(reserved)
+			defer func() {
+				m.mu.Lock()
+				delete(tunnel.conns, localConn)
+				m.mu.Unlock()
+			}()
+			m.handleTunnelConnection(tunnel, localConn)
+		}()
 	}
 }
 
@@ -187,56 +425,31 @@ func (m *Manager) handleTunnelConnection(tunnel *Tunnel, localConn net.Conn) {
 	// Update last used time
 	tunnel.LastUsed = time.Now()
 
-	// Connect to remote host
-	remoteConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", tunnel.RemoteHost, tunnel.RemotePort))
+	m.mu.RLock()
+	copyConfig := m.copyConfig
+	tunnelMetrics := m.metrics
+	transport := tunnel.transport
+	m.mu.RUnlock()
+
+	// Open a channel to the remote end
+	remoteConn, err := transport.Open(context.Background(), tunnel)
 	if err != nil {
-		fmt.Printf("Failed to connect to remote host for tunnel %s: %v\n", tunnel.ID, err)
+		fmt.Printf("Failed to open %s channel for tunnel %s: %v\n", transport.Name(), tunnel.ID, err)
 		return
 	}
 	defer remoteConn.Close()
 
-	// Start bidirectional data transfer
-	done := make(chan bool, 2)
-
-	// Local to remote
-	go func() {
-		buffer := make([]byte, 4096)
-		for {
-			n, err := localConn.Read(buffer)
-			if err != nil {
-				break
-			}
-			if n > 0 {
-				_, err = remoteConn.Write(buffer[:n])
-				if err != nil {
-					break
-				}
-			}
+	copyConfig.OnStall = func(direction string) {
+		fmt.Printf("Connection on tunnel %s stalled (%s), closing it\n", tunnel.ID, direction)
+		if tunnelMetrics != nil {
+			tunnelMetrics.IncTunnelStalls(tunnel.ID, direction)
 		}
-		done <- true
-	}()
-
-	// Remote to local
-	go func() {
-		buffer := make([]byte, 4096)
-		for {
-			n, err := remoteConn.Read(buffer)
-			if err != nil {
-				break
-			}
-			if n > 0 {
-				_, err = localConn.Write(buffer[:n])
-				if err != nil {
-					break
-				}
-			}
-		}
-		done <- true
-	}()
+	}
 
-	// Wait for both directions to complete
-	<-done
-	<-done
+	// Start bidirectional data transfer
+	if _, _, err := Pipe(localConn, remoteConn, copyConfig); err != nil {
+		fmt.Printf("Tunnel %s connection closed: %v\n", tunnel.ID, err)
+	}
 }
 
 // GetTunnelStats returns statistics for all tunnels
@@ -248,12 +461,17 @@ func (m *Manager) GetTunnelStats() map[string]interface{} {
 	stats["total_tunnels"] = len(m.tunnels)
 	
 	activeCount := 0
+	pausedCount := 0
 	for _, tunnel := range m.tunnels {
 		if tunnel.Active {
 			activeCount++
 		}
+		if tunnel.Paused {
+			pausedCount++
+		}
 	}
 	stats["active_tunnels"] = activeCount
+	stats["paused_tunnels"] = pausedCount
 
 	return stats
 } 
\ No newline at end of file
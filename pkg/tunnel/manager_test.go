@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a TCP server echoing everything it reads
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// dialTunnel waits until the tunnel accepts connections and returns one
+func dialTunnel(t *testing.T, port int) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel did not accept connections: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func echo(t *testing.T, conn net.Conn) error {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	return err
+}
+
+func TestPauseAndResumeTunnel(t *testing.T) {
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	m := NewManager(nil)
+	if err := m.RegisterTunnel("t1", localPort, "127.0.0.1", remotePort); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	defer m.UnregisterTunnel("t1")
+
+	existing := dialTunnel(t, localPort)
+	defer existing.Close()
+	if err := echo(t, existing); err != nil {
+		t.Fatalf("tunnel does not forward: %v", err)
+	}
+
+	if err := m.PauseTunnel("t1", false); err != nil {
+		t.Fatalf("failed to pause tunnel: %v", err)
+	}
+	if err := m.PauseTunnel("t1", false); err == nil {
+		t.Error("expected error pausing a paused tunnel")
+	}
+
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort)); err == nil {
+		conn.Close()
+		t.Error("paused tunnel accepted a new connection")
+	}
+	if err := echo(t, existing); err != nil {
+		t.Errorf("existing connection should survive a pause: %v", err)
+	}
+
+	tunnels := m.ListTunnels()
+	if len(tunnels) != 1 || !tunnels[0].Paused {
+		t.Fatalf("expected one paused tunnel, got %+v", tunnels)
+	}
+	if stats := m.GetTunnelStats(); stats["paused_tunnels"] != 1 {
+		t.Errorf("expected 1 paused tunnel in stats, got %v", stats["paused_tunnels"])
+	}
+
+	if err := m.ResumeTunnel("t1"); err != nil {
+		t.Fatalf("failed to resume tunnel: %v", err)
+	}
+	resumed := dialTunnel(t, localPort)
+	defer resumed.Close()
+	if err := echo(t, resumed); err != nil {
+		t.Errorf("resumed tunnel does not forward: %v", err)
+	}
+	if tunnel, _ := m.GetTunnel("t1"); tunnel.Paused {
+		t.Error("expected tunnel to be resumed")
+	}
+}
+
+func TestPauseTunnelClosesExisting(t *testing.T) {
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	m := NewManager(nil)
+	if err := m.RegisterTunnel("t1", localPort, "127.0.0.1", remotePort); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	defer m.UnregisterTunnel("t1")
+
+	conn := dialTunnel(t, localPort)
+	defer conn.Close()
+	if err := echo(t, conn); err != nil {
+		t.Fatalf("tunnel does not forward: %v", err)
+	}
+
+	if err := m.PauseTunnel("t1", true); err != nil {
+		t.Fatalf("failed to pause tunnel: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected existing connection to be closed")
+	}
+}
+
+// pipeTransport serves every channel with an in-memory echo peer
+type pipeTransport struct {
+	opened chan string
+}
+
+func (t *pipeTransport) Name() string { return "pipe" }
+
+func (t *pipeTransport) Open(ctx context.Context, tunnel *Tunnel) (net.Conn, error) {
+	local, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		io.Copy(peer, peer)
+	}()
+	t.opened <- tunnel.ID
+	return local, nil
+}
+
+func TestTunnelUsesCustomTransport(t *testing.T) {
+	localPort := freePort(t)
+	transport := &pipeTransport{opened: make(chan string, 1)}
+
+	m := NewManager(nil)
+	m.SetTransport(transport)
+	// The remote host is only meaningful to the transport
+	if err := m.RegisterTunnel("t1", localPort, "peer-1", 1); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	defer m.UnregisterTunnel("t1")
+
+	conn := dialTunnel(t, localPort)
+	defer conn.Close()
+	if err := echo(t, conn); err != nil {
+		t.Fatalf("tunnel does not forward over the transport: %v", err)
+	}
+	if id := <-transport.opened; id != "t1" {
+		t.Errorf("expected channel for t1, got %s", id)
+	}
+
+	if err := m.SetTunnelTransport("t1", nil); err == nil {
+		t.Error("expected error for nil transport")
+	}
+	if err := m.SetTunnelTransport("missing", transport); err == nil {
+		t.Error("expected error for unknown tunnel")
+	}
+}
@@ -0,0 +1,596 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTunnelWeight is the scheduling weight of a tunnel without an
+// explicit weight
+const DefaultTunnelWeight = 1
+
+var (
+	// ErrSchedulerClosed is returned when writing to a closed scheduler
+	ErrSchedulerClosed = errors.New("scheduler closed")
+	// ErrUnknownTunnel is returned for tunnels not registered with the scheduler
+	ErrUnknownTunnel = errors.New("tunnel not registered with scheduler")
+)
+
+// SchedulerConfig controls the fair scheduler
+type SchedulerConfig struct {
+	// Quantum is the number of bytes a tunnel of weight 1 may send per round
+	Quantum int
+	// MaxQueuedBytes bounds the bytes queued per tunnel; writers block
+	// until the scheduler has drained the queue below this limit
+	MaxQueuedBytes int
+	// Budget, if set, bounds the bytes queued across all tunnels together
+	// with other tunnel buffers sharing the budget
+	Budget *BufferBudget
+	// MaxInFlightBytes bounds the bytes granted by Acquire and not yet
+	// released
+	MaxInFlightBytes int
+}
+
+// DefaultSchedulerConfig returns the default scheduler configuration
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{
+		Quantum:          16 * 1024,
+		MaxQueuedBytes:   256 * 1024,
+		MaxInFlightBytes: 256 * 1024,
+	}
+}
+
+// SchedulerStats describes the scheduling of a single tunnel. BytesSent and
+// FramesSent only ever grow; rates are the differences between two calls of
+// Stats. AvgQueueDelay favors recent frames, see maxDelaySamples.
+type SchedulerStats struct {
+	Weight        int           `json:"weight"`
+	BytesSent     int64         `json:"bytes_sent"`
+	FramesSent    int64         `json:"frames_sent"`
+	QueuedFrames  int           `json:"queued_frames"`
+	QueuedBytes   int           `json:"queued_bytes"`
+	AvgQueueDelay time.Duration `json:"avg_queue_delay"`
+}
+
+// FairScheduler interleaves frames from many tunnels onto one shared link.
+// It uses deficit round robin, so over time every backlogged tunnel gets a
+// share of the link proportional to its weight and a bulk transfer cannot
+// starve an interactive tunnel. Frames are written to the link whole and in
+// the order they were queued for each tunnel.
+//
+// Tunnels whose connections each lead somewhere of their own share the link
+// through grants instead: Acquire waits for the turn of the tunnel, the
+// caller writes to its connection and then calls Release.
+type FairScheduler struct {
+	link   io.Writer
+	config SchedulerConfig
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[string]*tunnelQueue
+	active  []*tunnelQueue
+	closed  bool
+	err     error
+	started bool
+	doneCh  chan struct{}
+	// inFlight is the number of bytes granted and not yet released
+	inFlight int
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+type tunnelQueue struct {
+	id      string
+	weight  int
+	deficit int
+	frames  []queuedFrame
+	active  bool
+	stats   SchedulerStats
+	// totalDelay is the queue delay of the last delayFrames frames
+	totalDelay  time.Duration
+	delayFrames int64
+}
+
+// maxDelaySamples is the number of frames past which the queue delay
+// average of a tunnel is renormalized: totalDelay and delayFrames are
+// halved, which keeps the average, keeps totalDelay from overflowing and
+// lets the average follow the link on tunnels that are up for months
+const maxDelaySamples = 1 << 20
+
+type queuedFrame struct {
+	data     []byte
+	grant    *frameGrant
+	enqueued time.Time
+}
+
+// frameGrant is a frame of size bytes that the caller of Acquire writes
+// itself once granted. Its fields are guarded by the scheduler mutex.
+type frameGrant struct {
+	size      int
+	ready     chan struct{}
+	err       error
+	granted   bool
+	cancelled bool
+}
+
+// size returns the number of bytes the frame takes on the link
+func (f queuedFrame) size() int {
+	if f.grant != nil {
+		return f.grant.size
+	}
+	return len(f.data)
+}
+
+// NewFairScheduler creates a scheduler writing to link
+func NewFairScheduler(link io.Writer, config SchedulerConfig) *FairScheduler {
+	defaults := DefaultSchedulerConfig()
+	if config.Quantum <= 0 {
+		config.Quantum = defaults.Quantum
+	}
+	if config.MaxQueuedBytes <= 0 {
+		config.MaxQueuedBytes = defaults.MaxQueuedBytes
+	}
+	if config.MaxInFlightBytes <= 0 {
+		config.MaxInFlightBytes = defaults.MaxInFlightBytes
+	}
+
+	s := &FairScheduler{
+		link:    link,
+		config:  config,
+		queues:  make(map[string]*tunnelQueue),
+		doneCh:  make(chan struct{}),
+		closeCh: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Start begins writing queued frames to the link in a background goroutine
+func (s *FairScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.loop()
+}
+
+// Close stops accepting frames, writes what is already queued and waits for
+// the scheduler to finish
+func (s *FairScheduler) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	started := s.started
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.closeOnce.Do(func() { close(s.closeCh) })
+
+	if started {
+		<-s.doneCh
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// AddTunnel registers a tunnel with the given weight
+func (s *FairScheduler) AddTunnel(id string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight %d for tunnel %s", weight, id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.queues[id]; exists {
+		return fmt.Errorf("tunnel %s already registered with scheduler", id)
+	}
+	s.queues[id] = &tunnelQueue{
+		id:     id,
+		weight: weight,
+		stats:  SchedulerStats{Weight: weight},
+	}
+	return nil
+}
+
+// SetWeight changes the weight of a registered tunnel
+func (s *FairScheduler) SetWeight(id string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight %d for tunnel %s", weight, id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, exists := s.queues[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUnknownTunnel, id)
+	}
+	q.weight = weight
+	q.stats.Weight = weight
+	return nil
+}
+
+// RemoveTunnel unregisters a tunnel and drops its queued frames
+func (s *FairScheduler) RemoveTunnel(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, exists := s.queues[id]
+	if !exists {
+		return
+	}
+	delete(s.queues, id)
+	for i, aq := range s.active {
+		if aq == q {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+	s.dropFramesLocked(q, fmt.Errorf("%w: %s", ErrUnknownTunnel, id))
+	s.cond.Broadcast()
+}
+
+// dropFramesLocked drops the queued frames of q, failing pending grants
+// with err. s.mu must be held.
+func (s *FairScheduler) dropFramesLocked(q *tunnelQueue, err error) {
+	for _, frame := range q.frames {
+		if frame.grant == nil {
+			s.config.Budget.Release(int64(len(frame.data)))
+		} else if !frame.grant.cancelled {
+			frame.grant.err = err
+			close(frame.grant.ready)
+		}
+	}
+	q.frames = nil
+	q.stats.QueuedBytes = 0
+	q.stats.QueuedFrames = 0
+}
+
+// Enqueue queues a frame for the tunnel. It blocks while the tunnel's queue
+// is full or the shared buffer budget is exhausted. The frame is copied, so
+// the caller may reuse data.
+func (s *FairScheduler) Enqueue(id string, data []byte) error {
+	size := int64(len(data))
+	if !s.config.Budget.Acquire(size, s.closeCh) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err != nil {
+			return s.err
+		}
+		return ErrSchedulerClosed
+	}
+
+	frame := queuedFrame{data: append([]byte(nil), data...)}
+	if err := s.enqueue(id, frame); err != nil {
+		s.config.Budget.Release(size)
+		return err
+	}
+	return nil
+}
+
+// enqueue queues a frame for the tunnel, waiting while the queue is full.
+// Grants do not buffer data and are never held back by the queue limit.
+func (s *FairScheduler) enqueue(id string, frame queuedFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			if s.err != nil {
+				return s.err
+			}
+			return ErrSchedulerClosed
+		}
+		q, exists := s.queues[id]
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrUnknownTunnel, id)
+		}
+
+		// An empty queue always accepts a frame so oversized frames still
+		// make progress
+		if frame.grant != nil || q.stats.QueuedBytes == 0 || q.stats.QueuedBytes+frame.size() <= s.config.MaxQueuedBytes {
+			frame.enqueued = time.Now()
+			q.frames = append(q.frames, frame)
+			q.stats.QueuedBytes += frame.size()
+			q.stats.QueuedFrames++
+			if !q.active {
+				q.active = true
+				s.active = append(s.active, q)
+			}
+			s.cond.Broadcast()
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// Acquire waits until the scheduler grants the tunnel n bytes of the link,
+// in the same weighted round-robin order as queued frames. At most
+// MaxInFlightBytes are granted and not yet released at once. Every
+// successful Acquire must be followed by a Release of n once the bytes are
+// written. It returns an error if ctx is done first.
+func (s *FairScheduler) Acquire(ctx context.Context, id string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	g := &frameGrant{size: n, ready: make(chan struct{})}
+	if err := s.enqueue(id, queuedFrame{grant: g}); err != nil {
+		return err
+	}
+
+	select {
+	case <-g.ready:
+		return g.err
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g.granted {
+		// Granted while giving up
+		s.releaseLocked(n)
+	} else if g.err == nil {
+		// The loop skips the frame, or stops waiting for room for it
+		g.cancelled = true
+		s.cond.Broadcast()
+	}
+	return fmt.Errorf("waiting for a scheduler grant: %w", ctx.Err())
+}
+
+// Release returns n bytes granted by Acquire
+func (s *FairScheduler) Release(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(n)
+}
+
+func (s *FairScheduler) releaseLocked(n int) {
+	s.inFlight -= n
+	if s.inFlight < 0 {
+		s.inFlight = 0
+	}
+	s.cond.Broadcast()
+}
+
+// Conn wraps conn, a connection of the tunnel, so every write first waits
+// for a grant of the scheduler. Write deadlines of the returned connection
+// bound the wait as well, and Close ends it.
+func (s *FairScheduler) Conn(id string, conn net.Conn) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scheduledConn{Conn: conn, scheduler: s, id: id, ctx: ctx, cancel: cancel}
+}
+
+type scheduledConn struct {
+	net.Conn
+	scheduler *FairScheduler
+	id        string
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *scheduledConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	if err := c.scheduler.Acquire(ctx, c.id, len(p)); err != nil {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return 0, os.ErrDeadlineExceeded
+		case errors.Is(err, context.Canceled):
+			return 0, net.ErrClosed
+		}
+		return 0, err
+	}
+	defer c.scheduler.Release(len(p))
+	return c.Conn.Write(p)
+}
+
+func (c *scheduledConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *scheduledConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it
+func (c *scheduledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *scheduledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// Writer returns an io.Writer that queues each write as a frame of the tunnel
+func (s *FairScheduler) Writer(id string) io.Writer {
+	return tunnelWriter{scheduler: s, id: id}
+}
+
+type tunnelWriter struct {
+	scheduler *FairScheduler
+	id        string
+}
+
+func (w tunnelWriter) Write(p []byte) (int, error) {
+	if err := w.scheduler.Enqueue(w.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stats returns the scheduling statistics of all registered tunnels
+func (s *FairScheduler) Stats() map[string]SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]SchedulerStats, len(s.queues))
+	for id, q := range s.queues {
+		st := q.stats
+		if q.delayFrames > 0 {
+			st.AvgQueueDelay = q.totalDelay / time.Duration(q.delayFrames)
+		}
+		stats[id] = st
+	}
+	return stats
+}
+
+func (s *FairScheduler) loop() {
+	defer close(s.doneCh)
+
+	for {
+		q, batch, ok := s.nextBatch()
+		if !ok {
+			return
+		}
+
+		for i, frame := range batch {
+			if frame.grant != nil {
+				s.grant(q, frame)
+				continue
+			}
+			if _, err := s.link.Write(frame.data); err != nil {
+				for _, unsent := range batch[i:] {
+					if unsent.grant == nil {
+						s.config.Budget.Release(int64(len(unsent.data)))
+					} else {
+						s.mu.Lock()
+						if !unsent.grant.cancelled {
+							unsent.grant.err = ErrSchedulerClosed
+							close(unsent.grant.ready)
+						}
+						s.mu.Unlock()
+					}
+				}
+				s.fail(fmt.Errorf("failed to write to link: %w", err))
+				return
+			}
+			s.recordSent(q, batch[i])
+		}
+	}
+}
+
+// nextBatch picks the next tunnel in round-robin order, credits it one
+// quantum per unit of weight and takes as many frames as its deficit allows
+func (s *FairScheduler) nextBatch() (*tunnelQueue, []queuedFrame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.active) == 0 {
+		if s.closed {
+			return nil, nil, false
+		}
+		s.cond.Wait()
+	}
+
+	q := s.active[0]
+	s.active = s.active[1:]
+	q.deficit += s.config.Quantum * q.weight
+
+	var batch []queuedFrame
+	for len(q.frames) > 0 && q.frames[0].size() <= q.deficit {
+		frame := q.frames[0]
+		q.frames = q.frames[1:]
+		q.deficit -= frame.size()
+		q.stats.QueuedBytes -= frame.size()
+		q.stats.QueuedFrames--
+		batch = append(batch, frame)
+	}
+
+	if len(q.frames) == 0 {
+		// Idle tunnels do not accumulate credit
+		q.deficit = 0
+		q.active = false
+	} else {
+		s.active = append(s.active, q)
+	}
+
+	s.cond.Broadcast()
+	return q, batch, true
+}
+
+func (s *FairScheduler) recordSent(q *tunnelQueue, frame queuedFrame) {
+	s.config.Budget.Release(int64(len(frame.data)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordSentLocked(q, frame)
+}
+
+func (s *FairScheduler) recordSentLocked(q *tunnelQueue, frame queuedFrame) {
+	q.stats.BytesSent += int64(frame.size())
+	q.stats.FramesSent++
+	q.totalDelay += time.Since(frame.enqueued)
+	q.delayFrames++
+	if q.delayFrames > maxDelaySamples {
+		q.totalDelay /= 2
+		q.delayFrames /= 2
+	}
+}
+
+// grant grants a frame queued by Acquire once the bytes in flight leave
+// room for it. Grants given up in the meantime are skipped.
+func (s *FairScheduler) grant(q *tunnelQueue, frame queuedFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := frame.grant
+	for !g.cancelled && s.inFlight > 0 && s.inFlight+g.size > s.config.MaxInFlightBytes {
+		s.cond.Wait()
+	}
+	if g.cancelled {
+		return
+	}
+	s.inFlight += g.size
+	g.granted = true
+	close(g.ready)
+	s.recordSentLocked(q, frame)
+}
+
+// fail closes the scheduler after a link error and releases blocked writers
+func (s *FairScheduler) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.closed = true
+	s.closeOnce.Do(func() { close(s.closeCh) })
+	s.active = nil
+	for _, q := range s.queues {
+		s.dropFramesLocked(q, err)
+		q.active = false
+	}
+	s.cond.Broadcast()
+}
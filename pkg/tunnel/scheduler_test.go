@@ -0,0 +1,193 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLink records which tunnel each written frame belongs to. Frames
+// are tagged with the tunnel ID in their first byte.
+type recordingLink struct {
+	mu    sync.Mutex
+	order []byte
+	bytes map[byte]int
+}
+
+func (l *recordingLink) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order = append(l.order, p[0])
+	l.bytes[p[0]] += len(p)
+	return len(p), nil
+}
+
+func TestFairSchedulerHonorsWeights(t *testing.T) {
+	link := &recordingLink{bytes: make(map[byte]int)}
+	s := NewFairScheduler(link, SchedulerConfig{Quantum: 100, MaxQueuedBytes: 1 << 20})
+
+	if err := s.AddTunnel("a", 1); err != nil {
+		t.Fatalf("failed to add tunnel: %v", err)
+	}
+	if err := s.AddTunnel("b", 3); err != nil {
+		t.Fatalf("failed to add tunnel: %v", err)
+	}
+
+	// Backlog both tunnels before the scheduler starts
+	for i := 0; i < 40; i++ {
+		s.Enqueue("a", bytes.Repeat([]byte{'a'}, 100))
+		s.Enqueue("b", bytes.Repeat([]byte{'b'}, 100))
+	}
+
+	s.Start()
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close scheduler: %v", err)
+	}
+
+	// While both tunnels are backlogged, b gets three frames per frame of a
+	var a, b int
+	for _, tag := range link.order[:40] {
+		if tag == 'a' {
+			a++
+		} else {
+			b++
+		}
+	}
+	if a != 10 || b != 30 {
+		t.Errorf("expected 10:30 split in first 40 frames, got %d:%d", a, b)
+	}
+
+	stats := s.Stats()
+	if stats["a"].BytesSent != 4000 || stats["b"].BytesSent != 4000 {
+		t.Errorf("expected all bytes sent, got %+v", stats)
+	}
+	if stats["b"].Weight != 3 || stats["a"].QueuedFrames != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFairSchedulerPreventsStarvation(t *testing.T) {
+	link := &recordingLink{bytes: make(map[byte]int)}
+	s := NewFairScheduler(link, SchedulerConfig{Quantum: 1000, MaxQueuedBytes: 1 << 20})
+	s.AddTunnel("bulk", 1)
+	s.AddTunnel("interactive", 1)
+
+	for i := 0; i < 100; i++ {
+		s.Enqueue("bulk", bytes.Repeat([]byte{'b'}, 1000))
+	}
+	s.Enqueue("interactive", []byte{'i'})
+
+	s.Start()
+	defer s.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats()["interactive"].FramesSent == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("interactive frame was never sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	for i, tag := range link.order {
+		if tag == 'i' {
+			if i > 1 {
+				t.Errorf("interactive frame sent at position %d behind bulk data", i)
+			}
+			break
+		}
+	}
+}
+
+func TestFairSchedulerUnknownTunnel(t *testing.T) {
+	s := NewFairScheduler(&bytes.Buffer{}, DefaultSchedulerConfig())
+	if err := s.Enqueue("missing", []byte("x")); err == nil {
+		t.Error("expected error for unknown tunnel")
+	}
+	if err := s.AddTunnel("a", 0); err == nil {
+		t.Error("expected error for zero weight")
+	}
+	s.Close()
+	s.AddTunnel("b", 1)
+	if err := s.Enqueue("b", []byte("x")); err != ErrSchedulerClosed {
+		t.Errorf("expected ErrSchedulerClosed, got %v", err)
+	}
+}
+
+func TestFairSchedulerGrants(t *testing.T) {
+	s := NewFairScheduler(nil, SchedulerConfig{Quantum: 100, MaxInFlightBytes: 100})
+	s.AddTunnel("a", 1)
+	s.AddTunnel("b", 1)
+	s.Start()
+	defer s.Close()
+
+	if err := s.Acquire(context.Background(), "a", 100); err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	// The window is full, so b waits until a releases its bytes
+	granted := make(chan error, 1)
+	go func() { granted <- s.Acquire(context.Background(), "b", 100) }()
+	select {
+	case err := <-granted:
+		t.Fatalf("expected b to wait for the window, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A grant given up does not hold up the ones queued behind it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, "a", 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+
+	s.Release(100)
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("b was never granted")
+	}
+	s.Release(100)
+
+	if err := s.Acquire(context.Background(), "a", 50); err != nil {
+		t.Fatalf("failed to acquire after the cancelled grant: %v", err)
+	}
+	s.Release(50)
+
+	stats := s.Stats()
+	if stats["a"].BytesSent != 150 || stats["b"].BytesSent != 100 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFairSchedulerRenormalizesQueueDelay(t *testing.T) {
+	s := NewFairScheduler(&recordingLink{bytes: make(map[byte]int)}, SchedulerConfig{Quantum: 100, MaxQueuedBytes: 1 << 20})
+	if err := s.AddTunnel("a", 1); err != nil {
+		t.Fatalf("failed to add tunnel: %v", err)
+	}
+
+	// A tunnel that has been up for long: its earlier frames waited a
+	// second each
+	s.mu.Lock()
+	q := s.queues["a"]
+	q.stats.FramesSent = maxDelaySamples
+	q.delayFrames = maxDelaySamples
+	q.totalDelay = maxDelaySamples * time.Second
+	s.recordSentLocked(q, queuedFrame{data: []byte("a"), enqueued: time.Now()})
+	s.mu.Unlock()
+
+	stats := s.Stats()["a"]
+	if stats.FramesSent != maxDelaySamples+1 || stats.BytesSent != 1 {
+		t.Errorf("expected the counters to keep growing, got %+v", stats)
+	}
+	if q.delayFrames > maxDelaySamples || stats.AvgQueueDelay < 999*time.Millisecond || stats.AvgQueueDelay > time.Second {
+		t.Errorf("expected the average to be kept over fewer frames, got %v over %d frames", stats.AvgQueueDelay, q.delayFrames)
+	}
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TunnelTransport carries the connections of a tunnel to its remote end.
+// It lets tunnel data travel over transports the client does not implement
+// itself, such as WebRTC data channels.
+type TunnelTransport interface {
+	// Name identifies the transport in logs
+	Name() string
+	// Open opens a logical channel to the remote end of the tunnel for one
+	// local connection. Reads, writes and Close on the returned connection
+	// act on that channel only. Write deadlines must be honoured, as they
+	// are used to detect stalled connections.
+	Open(ctx context.Context, tunnel *Tunnel) (net.Conn, error)
+}
+
+// DialTransport is the default transport. It connects to the remote host of
+// the tunnel over TCP.
+type DialTransport struct {
+	// Timeout bounds connection establishment; zero means no timeout
+	Timeout time.Duration
+}
+
+// Name returns the transport name
+func (t DialTransport) Name() string {
+	return "tcp"
+}
+
+// Open dials the remote host and port of the tunnel
+func (t DialTransport) Open(ctx context.Context, tunnel *Tunnel) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: t.Timeout}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(tunnel.RemoteHost, strconv.Itoa(tunnel.RemotePort)))
+}
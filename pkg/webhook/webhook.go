@@ -0,0 +1,317 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle events a webhook can subscribe to
+const (
+	EventConnected        = "connected"
+	EventDisconnected     = "disconnected"
+	EventTunnelCreated    = "tunnel_created"
+	EventTunnelClosed     = "tunnel_closed"
+	EventProtocolSwitched = "protocol_switched"
+	EventHealthDegraded   = "health_degraded"
+)
+
+// Headers set on every delivery
+const (
+	// EventHeader carries the event type
+	EventHeader = "X-CloudBridge-Event"
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// body keyed with the shared secret
+	SignatureHeader = "X-CloudBridge-Signature"
+)
+
+var knownEvents = map[string]bool{
+	EventConnected:        true,
+	EventDisconnected:     true,
+	EventTunnelCreated:    true,
+	EventTunnelClosed:     true,
+	EventProtocolSwitched: true,
+	EventHealthDegraded:   true,
+}
+
+// Config holds webhook configuration
+type Config struct {
+	URL    string
+	Secret string
+	// Events lists the subscribed events; empty subscribes to all
+	Events []string
+	// QueueSize bounds the events waiting for delivery. Events emitted
+	// while the queue is full are dropped.
+	QueueSize int
+	// MaxRetries is how often a failed delivery is retried
+	MaxRetries int
+	// Backoff is the delay before the first retry; it doubles per retry
+	Backoff time.Duration
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration
+}
+
+// DefaultConfig returns the default webhook configuration without an endpoint
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:  100,
+		MaxRetries: 3,
+		Backoff:    time.Second,
+		Timeout:    5 * time.Second,
+	}
+}
+
+// Event is the JSON payload posted to the webhook endpoint
+type Event struct {
+	// ID is unique per event and stays the same across retries, so
+	// receivers can drop duplicates
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Stats describes the deliveries of an emitter
+type Stats struct {
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// Emitter posts lifecycle events to a webhook endpoint. Events are queued
+// and delivered one at a time by a background goroutine, so emitting never
+// blocks the caller. All methods are safe to call on a nil Emitter.
+type Emitter struct {
+	config Config
+	client *http.Client
+	events map[string]bool
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	delivered int64
+	failed    int64
+	dropped   int64
+}
+
+// NewEmitter creates an emitter and starts delivering events
+func NewEmitter(config Config) (*Emitter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	if config.Secret == "" {
+		return nil, fmt.Errorf("webhook secret is required")
+	}
+
+	var events map[string]bool
+	if len(config.Events) > 0 {
+		events = make(map[string]bool, len(config.Events))
+		for _, event := range config.Events {
+			if !knownEvents[event] {
+				return nil, fmt.Errorf("unknown webhook event: %s", event)
+			}
+			events[event] = true
+		}
+	}
+
+	defaults := DefaultConfig()
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaults.Backoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Emitter{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		events: events,
+		queue:  make(chan Event, config.QueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go e.run()
+	return e, nil
+}
+
+// Subscribed reports whether eventType is delivered by the emitter
+func (e *Emitter) Subscribed(eventType string) bool {
+	if e == nil {
+		return false
+	}
+	return e.events == nil || e.events[eventType]
+}
+
+// Emit queues an event for delivery. It returns false if the event is not
+// subscribed, the emitter is closed or the queue is full.
+func (e *Emitter) Emit(eventType string, data map[string]interface{}) bool {
+	if !e.Subscribed(eventType) {
+		return false
+	}
+
+	event := Event{
+		ID:        newEventID(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return false
+	}
+	select {
+	case e.queue <- event:
+		return true
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+		return false
+	}
+}
+
+// Close stops accepting events and waits for queued events to be delivered.
+// If ctx is done first, outstanding deliveries are abandoned.
+func (e *Emitter) Close(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		e.cancel()
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-e.done
+		return ctx.Err()
+	}
+}
+
+// Stats returns the delivery statistics
+func (e *Emitter) Stats() Stats {
+	if e == nil {
+		return Stats{}
+	}
+	return Stats{
+		Delivered: atomic.LoadInt64(&e.delivered),
+		Failed:    atomic.LoadInt64(&e.failed),
+		Dropped:   atomic.LoadInt64(&e.dropped),
+	}
+}
+
+func (e *Emitter) run() {
+	defer close(e.done)
+	for event := range e.queue {
+		if err := e.deliver(event); err != nil {
+			atomic.AddInt64(&e.failed, 1)
+			continue
+		}
+		atomic.AddInt64(&e.delivered, 1)
+	}
+}
+
+// deliver posts event, retrying with exponential backoff while the failure
+// is worth retrying
+func (e *Emitter) deliver(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+
+	backoff := e.config.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(event.Type, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= e.config.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-e.ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying
+func (e *Emitter) post(eventType string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(SignatureHeader, Sign(e.config.Secret, body))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return e.ctx.Err() == nil, fmt.Errorf("failed to post webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook endpoint returned status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook endpoint returned status %d", resp.StatusCode)
+	}
+}
+
+// Sign returns the signature header value of body for secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid signature of body for secret
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+func newEventID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
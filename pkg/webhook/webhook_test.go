@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEmitterDeliversSignedEvents(t *testing.T) {
+	var attempts int32
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", body, r.Header.Get(SignatureHeader)) {
+			t.Error("invalid signature")
+		}
+		// The first attempt fails and must be retried
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	emitter, err := NewEmitter(Config{
+		URL:        server.URL,
+		Secret:     "secret",
+		Events:     []string{EventConnected},
+		MaxRetries: 2,
+		Backoff:    10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create emitter: %v", err)
+	}
+
+	if emitter.Emit(EventTunnelCreated, nil) {
+		t.Error("unsubscribed event must not be queued")
+	}
+	if !emitter.Emit(EventConnected, map[string]interface{}{"host": "relay"}) {
+		t.Fatal("expected event to be queued")
+	}
+
+	select {
+	case event := <-received:
+		if event.Type != EventConnected || event.Data["host"] != "relay" || event.ID == "" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	if err := emitter.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close emitter: %v", err)
+	}
+	if stats := emitter.Stats(); stats.Delivered != 1 || stats.Failed != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if emitter.Emit(EventConnected, nil) {
+		t.Error("closed emitter must not queue events")
+	}
+}
+
+func TestEmitterDropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	emitter, err := NewEmitter(Config{URL: server.URL, Secret: "secret", QueueSize: 1})
+	if err != nil {
+		t.Fatalf("failed to create emitter: %v", err)
+	}
+
+	// One event is in flight and one waits in the queue; the rest are dropped
+	for i := 0; i < 5; i++ {
+		emitter.Emit(EventConnected, nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := emitter.Stats().Dropped; dropped != 3 {
+		t.Errorf("expected 3 dropped events, got %d", dropped)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := emitter.Close(ctx); err == nil {
+		t.Error("expected close to give up on the blocked delivery")
+	}
+}
+
+func TestNewEmitterRejectsUnknownEvent(t *testing.T) {
+	_, err := NewEmitter(Config{URL: "http://localhost", Secret: "secret", Events: []string{"rebooted"}})
+	if err == nil {
+		t.Error("expected unknown event to be rejected")
+	}
+}
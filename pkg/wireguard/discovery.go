@@ -1,13 +1,21 @@
 package wireguard
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
 	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
 )
 
 // PeerDiscovery represents a peer discovery service
@@ -21,6 +29,59 @@ type PeerDiscovery struct {
 	logger       *zap.Logger
 	metrics      *DiscoveryMetrics
 	config       *DiscoveryConfig
+	clock        clock.Clock
+
+	// announceNow asks announcePresence to announce right away
+	announceNow chan struct{}
+
+	socketMu     sync.Mutex
+	socketStatus DiscoverySocketStatus
+
+	// signer signs and verifies announcements if set; signerMu serializes
+	// its use. signingKeys are the signing keys of the known peers, guarded
+	// by peersMutex.
+	signer      *quantum.DilithiumSigner
+	signerMu    sync.Mutex
+	signingKeys map[string]string
+
+	// collidingPeers are the peers announcing the node ID of a known peer
+	// with a different public key, by public key, guarded by peersMutex.
+	// They are handed to the discovery channel once, for the topology to
+	// reject or rename them.
+	collidingPeers map[[32]byte]*Peer
+
+	// listen binds the discovery socket and interfaceAddrs describes the
+	// local addresses; both are replaced in tests, like the delays
+	listen                 func(addr *net.UDPAddr) (*net.UDPConn, error)
+	interfaceAddrs         func() string
+	listenRetryDelay       time.Duration
+	listenRetryMaxDelay    time.Duration
+	interfaceCheckInterval time.Duration
+}
+
+const (
+	// listenRetryDelay is the first delay before binding the discovery
+	// socket again; it doubles up to listenRetryMaxDelay
+	listenRetryDelay    = time.Second
+	listenRetryMaxDelay = time.Minute
+	// interfaceCheckInterval is how often the local addresses are checked
+	// for changes that call for binding the socket again
+	interfaceCheckInterval = 10 * time.Second
+)
+
+// errInterfacesChanged ends reading from a socket bound before the local
+// addresses changed
+var errInterfacesChanged = errors.New("local interface addresses changed")
+
+// DiscoverySocketStatus reports whether discovery is listening for
+// announcements
+type DiscoverySocketStatus struct {
+	Listening bool
+	// Errors counts failed binds and socket errors
+	Errors    int64
+	LastError string
+	// Since is when Listening last changed
+	Since time.Time
 }
 
 // MeshNode represents a node in the mesh network
@@ -53,8 +114,18 @@ type GeoLocation struct {
 	Region    string  `json:"region"`
 }
 
+// AnnouncementFormatVersion is the announcement format sent by this client.
+// Version 1 carries the public key as 64 hex characters. Announcements
+// without a format version predate versioning and use the same encoding.
+const AnnouncementFormatVersion = 1
+
+// ErrUnsupportedAnnouncementFormat is returned for announcements in a
+// format version this client does not understand
+var ErrUnsupportedAnnouncementFormat = errors.New("unsupported announcement format")
+
 // Announcement represents a peer announcement message
 type Announcement struct {
+	FormatVersion int        `json:"format_version"`
 	NodeID      string       `json:"node_id"`
 	PublicKey   string       `json:"public_key"`
 	Endpoint    string       `json:"endpoint"`
@@ -62,6 +133,11 @@ type Announcement struct {
 	Capabilities []string    `json:"capabilities"`
 	Version     string       `json:"version"`
 	Timestamp   time.Time    `json:"timestamp"`
+
+	// SigningKey is the hex encoded Dilithium public key Signature, the
+	// hex encoded signature of the announcement, verifies with
+	SigningKey string `json:"signing_key,omitempty"`
+	Signature  string `json:"signature,omitempty"`
 }
 
 // DiscoveryMetrics represents metrics for peer discovery
@@ -70,6 +146,14 @@ type DiscoveryMetrics struct {
 	ActivePeers        int64
 	DiscoveryLatency   time.Duration
 	LastDiscovery      time.Time
+	// FilteredPeers counts announcements dropped for their capabilities
+	FilteredPeers int64
+	// InvalidSignatures counts announcements dropped as unsigned or for
+	// a signature that does not verify
+	InvalidSignatures int64
+	// NodeIDCollisions counts peers announcing the node ID of a known
+	// peer with a different public key
+	NodeIDCollisions int64
 }
 
 // DiscoveryConfig represents configuration for peer discovery
@@ -79,8 +163,30 @@ type DiscoveryConfig struct {
 	AnnouncementTimeout time.Duration
 	MaxPeers            int
 	EnableGeoDiscovery  bool
+
+	// RequiredCapabilities lists capabilities a peer must announce to be
+	// added; ExcludedCapabilities lists capabilities that rule a peer out
+	RequiredCapabilities []string
+	ExcludedCapabilities []string
+
+	// MulticastGroup is the IPv4 group announcements are sent to and
+	// received on; empty disables multicast. MulticastTTL is how many
+	// routers announcements may cross, DefaultMulticastTTL if zero.
+	MulticastGroup string
+	MulticastTTL   int
+	// SeedPeers are addresses announcements are also sent to, for networks
+	// without multicast. The discovery port is used if one has none.
+	SeedPeers []string
 }
 
+const (
+	// DefaultMulticastGroup is the organization-local group used by the
+	// default discovery configuration
+	DefaultMulticastGroup = "239.255.51.21"
+	// DefaultMulticastTTL lets announcements cross a few routers
+	DefaultMulticastTTL = 4
+)
+
 // NewPeerDiscovery creates a new peer discovery service
 func NewPeerDiscovery(localNode *MeshNode, config *DiscoveryConfig, logger *zap.Logger) *PeerDiscovery {
 	if config == nil {
@@ -90,21 +196,38 @@ func NewPeerDiscovery(localNode *MeshNode, config *DiscoveryConfig, logger *zap.
 			AnnouncementTimeout: 5 * time.Minute,
 			MaxPeers:           100,
 			EnableGeoDiscovery: true,
+			MulticastGroup:     DefaultMulticastGroup,
 		}
 	}
 
 	return &PeerDiscovery{
 		localNode:   localNode,
 		knownPeers:  make(map[string]*Peer),
+		signingKeys: make(map[string]string),
+		collidingPeers: make(map[[32]byte]*Peer),
 		discoveryCh: make(chan *Peer, 100),
 		announceCh:  make(chan *Announcement, 100),
 		stopCh:      make(chan struct{}),
 		logger:      logger,
 		metrics:     &DiscoveryMetrics{},
 		config:      config,
+		clock:       clock.Real{},
+		announceNow: make(chan struct{}, 1),
+
+		listen:                 listenDiscovery,
+		interfaceAddrs:         localInterfaceAddrs,
+		listenRetryDelay:       listenRetryDelay,
+		listenRetryMaxDelay:    listenRetryMaxDelay,
+		interfaceCheckInterval: interfaceCheckInterval,
 	}
 }
 
+// SetClock sets the clock used for announcement ages and stale peer
+// cleanup. It must be called before Start.
+func (pd *PeerDiscovery) SetClock(c clock.Clock) {
+	pd.clock = c
+}
+
 // Start starts the peer discovery service
 func (pd *PeerDiscovery) Start() error {
 	pd.logger.Info("Starting peer discovery service",
@@ -134,40 +257,178 @@ func (pd *PeerDiscovery) Stop() error {
 	return nil
 }
 
-// listenForAnnouncements listens for peer announcements on UDP
+// listenForAnnouncements listens for peer announcements on UDP. A socket
+// that cannot be bound is retried with backoff, and a socket that fails or
+// was bound before the local addresses changed is bound again. Each new
+// socket is followed by an announcement, as peers may have dropped this node
+// while it was not listening.
 func (pd *PeerDiscovery) listenForAnnouncements() {
 	addr := &net.UDPAddr{Port: pd.config.DiscoveryPort}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		pd.logger.Error("Failed to listen for announcements", zap.Error(err))
-		return
+	if group := pd.multicastGroup(); group != nil {
+		addr.IP = group
 	}
-	defer conn.Close()
+	delay := pd.listenRetryDelay
+	for {
+		conn, err := pd.listen(addr)
+		if err != nil {
+			pd.setSocketDown(err)
+			pd.logger.Warn("Failed to listen for announcements",
+				zap.Error(err),
+				zap.Duration("retry_in", delay))
+			select {
+			case <-pd.stopCh:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, pd.listenRetryMaxDelay)
+			continue
+		}
+		delay = pd.listenRetryDelay
 
-	pd.logger.Info("Listening for peer announcements", zap.String("address", addr.String()))
+		pd.setSocketUp()
+		pd.logger.Info("Listening for peer announcements", zap.String("address", conn.LocalAddr().String()))
+		select {
+		case pd.announceNow <- struct{}{}:
+		default:
+		}
+
+		err = pd.readAnnouncements(conn)
+		conn.Close()
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, errInterfacesChanged):
+			pd.setSocketDown(nil)
+			pd.logger.Info("Local addresses changed, binding the discovery socket again")
+		default:
+			pd.setSocketDown(err)
+			pd.logger.Warn("Discovery socket failed, binding it again", zap.Error(err))
+		}
+	}
+}
+
+// readAnnouncements handles the announcements received on conn until the
+// service stops, which returns nil, or the socket has to be bound again
+func (pd *PeerDiscovery) readAnnouncements(conn *net.UDPConn) error {
+	addrs := pd.interfaceAddrs()
+	lastCheck := time.Now()
 
 	buffer := make([]byte, 2048)
 	for {
 		select {
 		case <-pd.stopCh:
-			return
+			return nil
 		default:
-			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, remoteAddr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				pd.logger.Error("Error reading from UDP", zap.Error(err))
+		}
+		if time.Since(lastCheck) >= pd.interfaceCheckInterval {
+			lastCheck = time.Now()
+			if pd.interfaceAddrs() != addrs {
+				return errInterfacesChanged
+			}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
+			return err
+		}
+
+		// Process announcement; the buffer is reused for the next one
+		go pd.handleAnnouncement(append([]byte(nil), buffer[:n]...), remoteAddr)
+	}
+}
+
+// listenDiscovery binds the discovery socket. A multicast address joins
+// the group on the default interface; seed peers reach the socket too, as
+// it is bound to all addresses either way.
+func listenDiscovery(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", nil, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// multicastGroup returns the configured multicast group, or nil
+func (pd *PeerDiscovery) multicastGroup() net.IP {
+	if pd.config.MulticastGroup == "" {
+		return nil
+	}
+	group := net.ParseIP(pd.config.MulticastGroup).To4()
+	if group == nil || !group.IsMulticast() {
+		pd.logger.Warn("Ignoring invalid multicast group", zap.String("group", pd.config.MulticastGroup))
+		return nil
+	}
+	return group
+}
 
-			// Process announcement
-			go pd.handleAnnouncement(buffer[:n], remoteAddr)
+// announcementTargets returns the multicast group and the seed peers
+func (pd *PeerDiscovery) announcementTargets() []*net.UDPAddr {
+	var targets []*net.UDPAddr
+	if group := pd.multicastGroup(); group != nil {
+		targets = append(targets, &net.UDPAddr{IP: group, Port: pd.config.DiscoveryPort})
+	}
+	for _, seed := range pd.config.SeedPeers {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			seed = net.JoinHostPort(seed, strconv.Itoa(pd.config.DiscoveryPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", seed)
+		if err != nil {
+			pd.logger.Warn("Failed to resolve seed peer", zap.String("seed", seed), zap.Error(err))
+			continue
 		}
+		targets = append(targets, addr)
+	}
+	return targets
+}
+
+// localInterfaceAddrs describes the addresses of the local interfaces, to
+// notice when they change
+func localInterfaceAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	described := make([]string, len(addrs))
+	for i, addr := range addrs {
+		described[i] = addr.String()
+	}
+	sort.Strings(described)
+	return strings.Join(described, ",")
+}
+
+// setSocketUp records that the discovery socket is listening
+func (pd *PeerDiscovery) setSocketUp() {
+	pd.socketMu.Lock()
+	defer pd.socketMu.Unlock()
+	pd.socketStatus.Listening = true
+	pd.socketStatus.Since = pd.clock.Now()
+}
+
+// setSocketDown records that the discovery socket is not listening, because
+// of err if not nil
+func (pd *PeerDiscovery) setSocketDown(err error) {
+	pd.socketMu.Lock()
+	defer pd.socketMu.Unlock()
+	if pd.socketStatus.Listening {
+		pd.socketStatus.Listening = false
+		pd.socketStatus.Since = pd.clock.Now()
+	}
+	if err != nil {
+		pd.socketStatus.Errors++
+		pd.socketStatus.LastError = err.Error()
 	}
 }
 
+// SocketStatus reports whether discovery is listening for announcements
+func (pd *PeerDiscovery) SocketStatus() DiscoverySocketStatus {
+	pd.socketMu.Lock()
+	defer pd.socketMu.Unlock()
+	return pd.socketStatus
+}
+
 // handleAnnouncement processes an incoming announcement
 func (pd *PeerDiscovery) handleAnnouncement(data []byte, remoteAddr *net.UDPAddr) {
 	var announcement Announcement
@@ -181,11 +442,30 @@ func (pd *PeerDiscovery) handleAnnouncement(data []byte, remoteAddr *net.UDPAddr
 		return
 	}
 
+	// Peers running a newer client may use an encoding we cannot parse
+	if announcement.FormatVersion > AnnouncementFormatVersion {
+		pd.logger.Warn("Ignoring announcement in unsupported format",
+			zap.String("node_id", announcement.NodeID),
+			zap.Int("format_version", announcement.FormatVersion),
+			zap.Int("supported_version", AnnouncementFormatVersion))
+		return
+	}
+
 	// Validate announcement
 	if err := pd.validateAnnouncement(&announcement); err != nil {
 		pd.logger.Error("Invalid announcement", zap.Error(err))
 		return
 	}
+	if err := pd.verifyAnnouncement(&announcement); err != nil {
+		pd.peersMutex.Lock()
+		pd.metrics.InvalidSignatures++
+		pd.peersMutex.Unlock()
+		pd.logger.Warn("Dropping announcement",
+			zap.String("node_id", announcement.NodeID),
+			zap.String("remote_addr", remoteAddr.String()),
+			zap.Error(err))
+		return
+	}
 
 	// Send to processing channel
 	select {
@@ -195,18 +475,41 @@ func (pd *PeerDiscovery) handleAnnouncement(data []byte, remoteAddr *net.UDPAddr
 	}
 }
 
+// DecodePublicKey decodes the public key according to the format version
+// of the announcement
+func (a *Announcement) DecodePublicKey() (*[32]byte, error) {
+	switch a.FormatVersion {
+	case 0, 1:
+		if a.PublicKey == "" {
+			return nil, fmt.Errorf("empty public key")
+		}
+		raw, err := hex.DecodeString(a.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key encoding: %w", err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("invalid public key length: %d", len(raw))
+		}
+		publicKey := new([32]byte)
+		copy(publicKey[:], raw)
+		return publicKey, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedAnnouncementFormat, a.FormatVersion)
+	}
+}
+
 // validateAnnouncement validates an announcement message
 func (pd *PeerDiscovery) validateAnnouncement(announcement *Announcement) error {
 	if announcement.NodeID == "" {
 		return fmt.Errorf("empty node ID")
 	}
-	if announcement.PublicKey == "" {
-		return fmt.Errorf("empty public key")
+	if _, err := announcement.DecodePublicKey(); err != nil {
+		return err
 	}
 	if announcement.Endpoint == "" {
 		return fmt.Errorf("empty endpoint")
 	}
-	if time.Since(announcement.Timestamp) > pd.config.AnnouncementTimeout {
+	if pd.clock.Since(announcement.Timestamp) > pd.config.AnnouncementTimeout {
 		return fmt.Errorf("announcement too old")
 	}
 	return nil
@@ -221,6 +524,10 @@ func (pd *PeerDiscovery) announcePresence() {
 		select {
 		case <-pd.stopCh:
 			return
+		case <-pd.announceNow:
+			if err := pd.sendAnnouncement(); err != nil {
+				pd.logger.Error("Failed to send announcement", zap.Error(err))
+			}
 		case <-ticker.C:
 			if err := pd.sendAnnouncement(); err != nil {
 				pd.logger.Error("Failed to send announcement", zap.Error(err))
@@ -229,37 +536,70 @@ func (pd *PeerDiscovery) announcePresence() {
 	}
 }
 
-// sendAnnouncement sends an announcement to the network
-func (pd *PeerDiscovery) sendAnnouncement() error {
+// marshalAnnouncement encodes the announcement of the local node
+func (pd *PeerDiscovery) marshalAnnouncement() ([]byte, error) {
 	announcement := &Announcement{
+		FormatVersion: AnnouncementFormatVersion,
 		NodeID:      pd.localNode.ID,
-		PublicKey:   fmt.Sprintf("%x", pd.localNode.PublicKey[:]),
+		PublicKey:   hex.EncodeToString(pd.localNode.PublicKey[:]),
 		Endpoint:    pd.localNode.Endpoint.String(),
 		Location:    pd.localNode.Location,
 		Capabilities: pd.localNode.Capabilities,
 		Version:     pd.localNode.Version,
-		Timestamp:   time.Now(),
+		Timestamp:   pd.clock.Now(),
+	}
+	if pd.signer != nil {
+		if err := pd.signAnnouncement(announcement); err != nil {
+			return nil, err
+		}
 	}
 
 	data, err := json.Marshal(announcement)
 	if err != nil {
-		return fmt.Errorf("failed to marshal announcement: %w", err)
+		return nil, fmt.Errorf("failed to marshal announcement: %w", err)
 	}
+	return data, nil
+}
 
-	// Send to broadcast address
-	broadcastAddr := &net.UDPAddr{
-		IP:   net.IPv4(255, 255, 255, 255),
-		Port: pd.config.DiscoveryPort,
+// sendAnnouncement sends an announcement to the multicast group and the
+// seed peers. It fails only if the announcement reached none of them.
+func (pd *PeerDiscovery) sendAnnouncement() error {
+	data, err := pd.marshalAnnouncement()
+	if err != nil {
+		return err
+	}
+	targets := pd.announcementTargets()
+	if len(targets) == 0 {
+		return fmt.Errorf("no multicast group or seed peers to announce to")
 	}
 
-	conn, err := net.DialUDP("udp", nil, broadcastAddr)
+	conn, err := net.ListenUDP("udp4", nil)
 	if err != nil {
 		return fmt.Errorf("failed to create UDP connection: %w", err)
 	}
 	defer conn.Close()
+	ttl := pd.config.MulticastTTL
+	if ttl == 0 {
+		ttl = DefaultMulticastTTL
+	}
+	if err := ipv4.NewPacketConn(conn).SetMulticastTTL(ttl); err != nil {
+		pd.logger.Warn("Failed to set multicast TTL", zap.Error(err))
+	}
 
-	if _, err := conn.Write(data); err != nil {
-		return fmt.Errorf("failed to send announcement: %w", err)
+	var sent int
+	var lastErr error
+	for _, target := range targets {
+		if _, err := conn.WriteToUDP(data, target); err != nil {
+			lastErr = err
+			pd.logger.Debug("Failed to send announcement",
+				zap.String("target", target.String()),
+				zap.Error(err))
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("failed to send announcement: %w", lastErr)
 	}
 
 	pd.metrics.TotalAnnouncements++
@@ -279,56 +619,138 @@ func (pd *PeerDiscovery) processAnnouncements() {
 	}
 }
 
-// handleProcessedAnnouncement handles a processed announcement
+// handleProcessedAnnouncement handles a processed announcement. Only the
+// peer map is updated under peersMutex: the endpoint is resolved before,
+// and a new peer is handed to the discovery channel after.
 func (pd *PeerDiscovery) handleProcessedAnnouncement(announcement *Announcement) {
+	endpoint, endpointErr := ParseEndpoint(announcement.Endpoint)
+
 	pd.peersMutex.Lock()
-	defer pd.peersMutex.Unlock()
+	added := pd.applyAnnouncementLocked(announcement, endpoint, endpointErr)
+	pd.peersMutex.Unlock()
+
+	if added == nil {
+		return
+	}
+	select {
+	case pd.discoveryCh <- added:
+	default:
+		pd.logger.Warn("Discovery channel full, dropping peer")
+	}
+}
 
-	// Check if we already know this peer
-	if _, exists := pd.knownPeers[announcement.NodeID]; exists {
-		// Update existing peer
-		pd.updateExistingPeer(announcement)
-	} else {
-		// Add new peer
-		pd.addNewPeer(announcement)
+// applyAnnouncementLocked adds or updates the peer of announcement and
+// returns it if it is new. peersMutex must be held.
+func (pd *PeerDiscovery) applyAnnouncementLocked(announcement *Announcement, endpoint *net.UDPAddr, endpointErr error) *Peer {
+	if err := pd.checkCapabilities(announcement); err != nil {
+		pd.metrics.FilteredPeers++
+		// A known peer may have changed its feature set
+		if _, exists := pd.knownPeers[announcement.NodeID]; exists {
+			delete(pd.knownPeers, announcement.NodeID)
+			delete(pd.signingKeys, announcement.NodeID)
+			pd.metrics.ActivePeers--
+		}
+		pd.logger.Debug("Ignoring incompatible peer",
+			zap.String("node_id", announcement.NodeID),
+			zap.Error(err))
+		return nil
+	}
+
+	pd.metrics.LastDiscovery = pd.clock.Now()
+	// Check if we already know this peer. Another node announcing its ID
+	// must not take over the peer's endpoint.
+	if peer, exists := pd.knownPeers[announcement.NodeID]; exists {
+		publicKey, err := announcement.DecodePublicKey()
+		if err == nil && keysDiffer(peer.PublicKey, publicKey) {
+			return pd.collidingPeer(announcement, publicKey, endpoint, endpointErr)
+		}
+		pd.updateExistingPeer(announcement, endpoint, endpointErr)
+		return nil
+	}
+	return pd.addNewPeer(announcement, endpoint, endpointErr)
+}
+
+// collidingPeer records the peer of announcement, which announces the node
+// ID of a known peer with publicKey, and returns it the first time it is
+// seen. peersMutex must be held.
+func (pd *PeerDiscovery) collidingPeer(announcement *Announcement, publicKey *[32]byte, endpoint *net.UDPAddr, endpointErr error) *Peer {
+	if peer, ok := pd.collidingPeers[*publicKey]; ok {
+		peer.LastSeen = announcement.Timestamp
+		if endpointErr == nil {
+			peer.Endpoint = endpoint
+		}
+		return nil
+	}
+	if endpointErr != nil || len(pd.collidingPeers) >= pd.config.MaxPeers {
+		return nil
 	}
 
-	pd.metrics.LastDiscovery = time.Now()
+	pd.metrics.NodeIDCollisions++
+	pd.logger.Warn("Peer announces the node ID of a known peer with a different public key",
+		zap.String("node_id", announcement.NodeID),
+		zap.String("endpoint", announcement.Endpoint))
+	peer := &Peer{
+		NodeID:    announcement.NodeID,
+		PublicKey: publicKey,
+		Endpoint:  endpoint,
+		Status:    PeerStatusOffline,
+		LastSeen:  announcement.Timestamp,
+	}
+	pd.collidingPeers[*publicKey] = peer
+	return peer
 }
 
-// addNewPeer adds a new peer from announcement
-func (pd *PeerDiscovery) addNewPeer(announcement *Announcement) {
+// checkCapabilities checks the announced capabilities against the required
+// and excluded capabilities of the configuration
+func (pd *PeerDiscovery) checkCapabilities(announcement *Announcement) error {
+	announced := make(map[string]bool, len(announcement.Capabilities))
+	for _, capability := range announcement.Capabilities {
+		announced[capability] = true
+	}
+	for _, capability := range pd.config.RequiredCapabilities {
+		if !announced[capability] {
+			return fmt.Errorf("missing required capability %s", capability)
+		}
+	}
+	for _, capability := range pd.config.ExcludedCapabilities {
+		if announced[capability] {
+			return fmt.Errorf("announces excluded capability %s", capability)
+		}
+	}
+	return nil
+}
+
+// addNewPeer adds a new peer from announcement, whose endpoint resolved to
+// endpoint or failed with endpointErr, and returns it. peersMutex must be
+// held.
+func (pd *PeerDiscovery) addNewPeer(announcement *Announcement, endpoint *net.UDPAddr, endpointErr error) *Peer {
 	// Check if we've reached the maximum number of peers
 	if len(pd.knownPeers) >= pd.config.MaxPeers {
 		pd.logger.Warn("Maximum number of peers reached, dropping new peer",
 			zap.String("node_id", announcement.NodeID))
-		return
+		return nil
 	}
 
 	// Parse public key
-	publicKeyBytes := []byte(announcement.PublicKey)
-	if len(publicKeyBytes) != 32 {
-		pd.logger.Error("Invalid public key length", 
+	publicKey, err := announcement.DecodePublicKey()
+	if err != nil {
+		pd.logger.Error("Invalid public key",
 			zap.String("node_id", announcement.NodeID),
-			zap.Int("length", len(publicKeyBytes)))
-		return
+			zap.Error(err))
+		return nil
 	}
 
-	publicKey := new([32]byte)
-	copy(publicKey[:], publicKeyBytes)
-
-	// Parse endpoint
-	endpoint, err := net.ResolveUDPAddr("udp", announcement.Endpoint)
-	if err != nil {
+	if endpointErr != nil {
 		pd.logger.Error("Failed to resolve endpoint",
 			zap.String("node_id", announcement.NodeID),
 			zap.String("endpoint", announcement.Endpoint),
-			zap.Error(err))
-		return
+			zap.Error(endpointErr))
+		return nil
 	}
 
 	// Create peer
 	peer := &Peer{
+		NodeID:    announcement.NodeID,
 		PublicKey: publicKey,
 		Endpoint:  endpoint,
 		Status:    PeerStatusOffline,
@@ -336,28 +758,26 @@ func (pd *PeerDiscovery) addNewPeer(announcement *Announcement) {
 	}
 
 	pd.knownPeers[announcement.NodeID] = peer
+	delete(pd.collidingPeers, *publicKey)
+	if announcement.SigningKey != "" {
+		pd.signingKeys[announcement.NodeID] = announcement.SigningKey
+	}
 	pd.metrics.ActivePeers++
 
 	pd.logger.Info("Added new peer",
 		zap.String("node_id", announcement.NodeID),
 		zap.String("endpoint", announcement.Endpoint))
-
-	// Send to discovery channel
-	select {
-	case pd.discoveryCh <- peer:
-	default:
-		pd.logger.Warn("Discovery channel full, dropping peer")
-	}
+	return peer
 }
 
-// updateExistingPeer updates an existing peer
-func (pd *PeerDiscovery) updateExistingPeer(announcement *Announcement) {
+// updateExistingPeer updates an existing peer. peersMutex must be held.
+func (pd *PeerDiscovery) updateExistingPeer(announcement *Announcement, endpoint *net.UDPAddr, endpointErr error) {
 	peer := pd.knownPeers[announcement.NodeID]
 	peer.LastSeen = announcement.Timestamp
 
 	// Update endpoint if changed
-	if announcement.Endpoint != peer.Endpoint.String() {
-		if endpoint, err := net.ResolveUDPAddr("udp", announcement.Endpoint); err == nil {
+	if endpointErr == nil {
+		if !sameEndpoint(endpoint, peer.Endpoint) {
 			peer.Endpoint = endpoint
 			pd.logger.Debug("Updated peer endpoint",
 				zap.String("node_id", announcement.NodeID),
@@ -368,31 +788,62 @@ func (pd *PeerDiscovery) updateExistingPeer(announcement *Announcement) {
 
 // cleanupStalePeers removes peers that haven't been seen recently
 func (pd *PeerDiscovery) cleanupStalePeers() {
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := pd.clock.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-pd.stopCh:
 			return
-		case <-ticker.C:
-			pd.peersMutex.Lock()
-			
-			now := time.Now()
-			for nodeID, peer := range pd.knownPeers {
-				if now.Sub(peer.LastSeen) > pd.config.AnnouncementTimeout {
-					delete(pd.knownPeers, nodeID)
-					pd.metrics.ActivePeers--
-					
-					pd.logger.Info("Removed stale peer",
-						zap.String("node_id", nodeID),
-						zap.Duration("last_seen", now.Sub(peer.LastSeen)))
-				}
-			}
-			
-			pd.peersMutex.Unlock()
+		case <-ticker.C():
+			pd.removeStalePeers()
+		}
+	}
+}
+
+// removeStalePeers removes peers not seen within the announcement timeout.
+// The stale peers are collected under the read lock, so announcements are
+// only held up while they are deleted.
+func (pd *PeerDiscovery) removeStalePeers() {
+	now := pd.clock.Now()
+	var stale []string
+	pd.peersMutex.RLock()
+	for nodeID, peer := range pd.knownPeers {
+		if now.Sub(peer.LastSeen) > pd.config.AnnouncementTimeout {
+			stale = append(stale, nodeID)
 		}
 	}
+	colliding := len(pd.collidingPeers)
+	pd.peersMutex.RUnlock()
+	if len(stale) == 0 && colliding == 0 {
+		return
+	}
+
+	removed := make(map[string]time.Duration, len(stale))
+	pd.peersMutex.Lock()
+	for _, nodeID := range stale {
+		// The peer may have announced itself again in between
+		peer, ok := pd.knownPeers[nodeID]
+		if !ok || now.Sub(peer.LastSeen) <= pd.config.AnnouncementTimeout {
+			continue
+		}
+		delete(pd.knownPeers, nodeID)
+		delete(pd.signingKeys, nodeID)
+		pd.metrics.ActivePeers--
+		removed[nodeID] = now.Sub(peer.LastSeen)
+	}
+	for publicKey, peer := range pd.collidingPeers {
+		if now.Sub(peer.LastSeen) > pd.config.AnnouncementTimeout {
+			delete(pd.collidingPeers, publicKey)
+		}
+	}
+	pd.peersMutex.Unlock()
+
+	for nodeID, age := range removed {
+		pd.logger.Info("Removed stale peer",
+			zap.String("node_id", nodeID),
+			zap.Duration("last_seen", age))
+	}
 }
 
 // GetDiscoveredPeers returns all discovered peers
@@ -0,0 +1,379 @@
+package wireguard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+	"go.uber.org/zap"
+)
+
+func newTestDiscovery() *PeerDiscovery {
+	local := &MeshNode{ID: "local", PublicKey: new([32]byte)}
+	return NewPeerDiscovery(local, nil, zap.NewNop())
+}
+
+func testAnnouncement(formatVersion int) []byte {
+	key := [32]byte{1, 2, 3}
+	data, _ := json.Marshal(&Announcement{
+		FormatVersion: formatVersion,
+		NodeID:        "peer-1",
+		PublicKey:     hex.EncodeToString(key[:]),
+		Endpoint:      "192.0.2.10:51820",
+		Timestamp:     time.Now(),
+	})
+	return data
+}
+
+func TestHandleAnnouncementAddsPeer(t *testing.T) {
+	pd := newTestDiscovery()
+	pd.handleAnnouncement(testAnnouncement(AnnouncementFormatVersion), &net.UDPAddr{})
+
+	select {
+	case announcement := <-pd.announceCh:
+		pd.handleProcessedAnnouncement(announcement)
+	default:
+		t.Fatal("valid announcement was dropped")
+	}
+
+	peers := pd.GetDiscoveredPeers()
+	if len(peers) != 1 || peers[0].PublicKey[0] != 1 || peers[0].PublicKey[2] != 3 {
+		t.Fatalf("expected peer with decoded key, got %+v", peers)
+	}
+}
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	key := [32]byte{0xde, 0xad, 0xbe, 0xef}
+	sender := NewPeerDiscovery(&MeshNode{
+		ID:        "sender",
+		PublicKey: &key,
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 51820},
+	}, nil, zap.NewNop())
+	data, err := sender.marshalAnnouncement()
+	if err != nil {
+		t.Fatalf("failed to marshal announcement: %v", err)
+	}
+
+	receiver := newTestDiscovery()
+	receiver.handleAnnouncement(data, &net.UDPAddr{})
+	select {
+	case announcement := <-receiver.announceCh:
+		receiver.handleProcessedAnnouncement(announcement)
+	default:
+		t.Fatal("announcement was dropped")
+	}
+	peers := receiver.GetDiscoveredPeers()
+	if len(peers) != 1 || *peers[0].PublicKey != key || peers[0].Endpoint.String() != "192.0.2.20:51820" {
+		t.Fatalf("expected the sender with its key, got %+v", peers)
+	}
+}
+
+func TestSendAnnouncementToGroupAndSeeds(t *testing.T) {
+	seed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer seed.Close()
+
+	pd := NewPeerDiscovery(&MeshNode{ID: "local", PublicKey: new([32]byte)}, &DiscoveryConfig{
+		DiscoveryPort:  51821,
+		MulticastGroup: DefaultMulticastGroup,
+		SeedPeers:      []string{seed.LocalAddr().String(), "127.0.0.2"},
+	}, zap.NewNop())
+	targets := pd.announcementTargets()
+	if len(targets) != 3 || targets[0].String() != DefaultMulticastGroup+":51821" || targets[2].String() != "127.0.0.2:51821" {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+
+	if err := pd.sendAnnouncement(); err != nil {
+		t.Fatalf("failed to send announcement: %v", err)
+	}
+	seed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := seed.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("seed peer got no announcement: %v", err)
+	}
+	var announcement Announcement
+	if err := json.Unmarshal(buf[:n], &announcement); err != nil || announcement.NodeID != "local" {
+		t.Errorf("unexpected announcement %q: %v", buf[:n], err)
+	}
+
+	// An invalid group is ignored rather than announced to
+	pd.config.MulticastGroup = "192.0.2.1"
+	if targets := pd.announcementTargets(); len(targets) != 2 {
+		t.Errorf("expected only the seeds for a unicast group, got %v", targets)
+	}
+}
+
+func TestHandleAnnouncementRejectsUnknownFormat(t *testing.T) {
+	pd := newTestDiscovery()
+	pd.handleAnnouncement(testAnnouncement(AnnouncementFormatVersion+1), &net.UDPAddr{})
+
+	select {
+	case <-pd.announceCh:
+		t.Fatal("announcement in unknown format was accepted")
+	default:
+	}
+}
+
+func TestDecodePublicKey(t *testing.T) {
+	legacy := &Announcement{PublicKey: hex.EncodeToString(make([]byte, 32))}
+	if _, err := legacy.DecodePublicKey(); err != nil {
+		t.Errorf("unversioned announcement rejected: %v", err)
+	}
+
+	raw := &Announcement{FormatVersion: 1, PublicKey: string(make([]byte, 32))}
+	if _, err := raw.DecodePublicKey(); err == nil {
+		t.Error("expected error for raw key bytes")
+	}
+
+	unknown := &Announcement{FormatVersion: 2, PublicKey: legacy.PublicKey}
+	if _, err := unknown.DecodePublicKey(); !errors.Is(err, ErrUnsupportedAnnouncementFormat) {
+		t.Errorf("expected ErrUnsupportedAnnouncementFormat, got %v", err)
+	}
+}
+
+func TestHandleAnnouncementFiltersByCapability(t *testing.T) {
+	local := &MeshNode{ID: "local", PublicKey: new([32]byte)}
+	pd := NewPeerDiscovery(local, &DiscoveryConfig{
+		AnnouncementTimeout:  time.Minute,
+		MaxPeers:             10,
+		RequiredCapabilities: []string{"relay"},
+		ExcludedCapabilities: []string{"legacy"},
+	}, zap.NewNop())
+
+	announce := func(nodeID string, capabilities ...string) {
+		key := [32]byte{byte(len(nodeID))}
+		pd.handleProcessedAnnouncement(&Announcement{
+			NodeID:       nodeID,
+			PublicKey:    hex.EncodeToString(key[:]),
+			Endpoint:     "192.0.2.10:51820",
+			Capabilities: capabilities,
+			Timestamp:    time.Now(),
+		})
+	}
+
+	announce("compatible", "relay", "quic")
+	announce("missing")
+	announce("excluded", "relay", "legacy")
+
+	if peers := pd.GetDiscoveredPeers(); len(peers) != 1 {
+		t.Fatalf("expected only the compatible peer, got %d peers", len(peers))
+	}
+	if filtered := pd.GetMetrics().FilteredPeers; filtered != 2 {
+		t.Errorf("expected 2 filtered peers, got %d", filtered)
+	}
+
+	// A known peer that drops a required capability is removed
+	announce("compatible", "quic")
+	if peers := pd.GetDiscoveredPeers(); len(peers) != 0 {
+		t.Errorf("expected peer to be removed, got %d peers", len(peers))
+	}
+	if active := pd.GetMetrics().ActivePeers; active != 0 {
+		t.Errorf("expected no active peers, got %d", active)
+	}
+}
+
+func TestHandleAnnouncementDetectsNodeIDCollision(t *testing.T) {
+	pd := newTestDiscovery()
+	announce := func(key byte, endpoint string) {
+		publicKey := [32]byte{key}
+		pd.handleProcessedAnnouncement(&Announcement{
+			NodeID:    "peer-1",
+			PublicKey: hex.EncodeToString(publicKey[:]),
+			Endpoint:  endpoint,
+			Timestamp: time.Now(),
+		})
+	}
+
+	announce(1, "192.0.2.10:51820")
+	first := <-pd.GetDiscoveryChannel()
+	if first.NodeID != "peer-1" {
+		t.Fatalf("expected peer with its node ID, got %q", first.NodeID)
+	}
+
+	// Another key announcing the ID is handed on once and does not take
+	// over the known peer
+	announce(2, "192.0.2.20:51820")
+	announce(2, "192.0.2.20:51820")
+	select {
+	case colliding := <-pd.GetDiscoveryChannel():
+		if colliding.NodeID != "peer-1" || colliding.PublicKey[0] != 2 {
+			t.Errorf("unexpected colliding peer %+v", colliding)
+		}
+	default:
+		t.Fatal("colliding peer was not handed to the discovery channel")
+	}
+	select {
+	case peer := <-pd.GetDiscoveryChannel():
+		t.Errorf("colliding peer handed on again: %+v", peer)
+	default:
+	}
+
+	peers := pd.GetDiscoveredPeers()
+	if len(peers) != 1 || peers[0].PublicKey[0] != 1 || peers[0].Endpoint.String() != "192.0.2.10:51820" {
+		t.Errorf("known peer was overwritten: %+v", peers)
+	}
+	if collisions := pd.GetMetrics().NodeIDCollisions; collisions != 1 {
+		t.Errorf("expected 1 collision, got %d", collisions)
+	}
+}
+
+func TestRemoveStalePeers(t *testing.T) {
+	pd := newTestDiscovery()
+	fake := clock.NewFake(time.Now())
+	pd.SetClock(fake)
+
+	pd.handleAnnouncement(testAnnouncement(AnnouncementFormatVersion), &net.UDPAddr{})
+	pd.handleProcessedAnnouncement(<-pd.announceCh)
+
+	fake.Advance(pd.config.AnnouncementTimeout - time.Second)
+	pd.removeStalePeers()
+	if len(pd.GetDiscoveredPeers()) != 1 {
+		t.Fatal("peer removed before the announcement timeout")
+	}
+
+	fake.Advance(2 * time.Second)
+	pd.removeStalePeers()
+	if len(pd.GetDiscoveredPeers()) != 0 {
+		t.Error("stale peer was not removed")
+	}
+}
+
+func TestConcurrentAnnouncementsAndCleanup(t *testing.T) {
+	local := &MeshNode{ID: "local", PublicKey: new([32]byte)}
+	pd := NewPeerDiscovery(local, &DiscoveryConfig{
+		AnnouncementTimeout: time.Minute,
+		MaxPeers:            1000,
+	}, zap.NewNop())
+	key := hex.EncodeToString(make([]byte, 32))
+
+	// Nobody reads the discovery channel, so it fills up
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				// Every other peer was last seen too long ago
+				timestamp := time.Now()
+				if i%2 == 1 {
+					timestamp = timestamp.Add(-2 * time.Minute)
+				}
+				pd.handleProcessedAnnouncement(&Announcement{
+					NodeID:    fmt.Sprintf("peer-%d-%d", worker, i%100),
+					PublicKey: key,
+					Endpoint:  "192.0.2.10:51820",
+					Timestamp: timestamp,
+				})
+			}
+		}(worker)
+	}
+	for cleaner := 0; cleaner < 2; cleaner++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pd.removeStalePeers()
+				pd.GetDiscoveredPeers()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("announcements and cleanup did not finish")
+	}
+
+	pd.removeStalePeers()
+	peers := pd.GetDiscoveredPeers()
+	if len(peers) != 8*50 {
+		t.Errorf("expected the %d fresh peers, got %d", 8*50, len(peers))
+	}
+	if pd.metrics.ActivePeers != int64(len(peers)) {
+		t.Errorf("active peers %d does not match %d known peers", pd.metrics.ActivePeers, len(peers))
+	}
+}
+
+func TestDiscoverySocketRecovers(t *testing.T) {
+	pd := newTestDiscovery()
+	pd.listenRetryDelay = time.Millisecond
+	pd.interfaceCheckInterval = 10 * time.Millisecond
+	addrs := make(chan string, 1)
+	addrs <- "192.0.2.1/24"
+	current := "192.0.2.1/24"
+	pd.interfaceAddrs = func() string {
+		select {
+		case current = <-addrs:
+		default:
+		}
+		return current
+	}
+	binds := make(chan *net.UDPConn, 10)
+	failures := 2
+	pd.listen = func(*net.UDPAddr) (*net.UDPConn, error) {
+		if failures > 0 {
+			failures--
+			return nil, errors.New("network is down")
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err == nil {
+			binds <- conn
+		}
+		return conn, err
+	}
+
+	go pd.listenForAnnouncements()
+	defer pd.Stop()
+
+	// The listener is bound once the network is back
+	var conn *net.UDPConn
+	select {
+	case conn = <-binds:
+	case <-time.After(2 * time.Second):
+		t.Fatal("discovery socket was not bound after bind failures")
+	}
+	status := pd.SocketStatus()
+	if !status.Listening || status.Errors != 2 || status.LastError != "network is down" {
+		t.Errorf("unexpected socket status: %+v", status)
+	}
+	select {
+	case <-pd.announceNow:
+	default:
+		t.Error("expected an announcement after binding")
+	}
+
+	// Announcements arrive on the recovered socket
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial discovery socket: %v", err)
+	}
+	defer sender.Close()
+	sender.Write(testAnnouncement(AnnouncementFormatVersion))
+	select {
+	case <-pd.announceCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("announcement was not received")
+	}
+
+	// A change of the local addresses binds the socket again
+	addrs <- "192.0.2.2/24"
+	select {
+	case <-binds:
+	case <-time.After(2 * time.Second):
+		t.Fatal("discovery socket was not bound again after an address change")
+	}
+}
@@ -0,0 +1,63 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ParseEndpoint parses a peer endpoint of the form host:port. IPv6 link-local
+// addresses may carry a zone identifier, either bracketed ("[fe80::1%eth0]:51820")
+// or unbracketed ("fe80::1%eth0:51820"); the zone is preserved in the returned
+// address so the peer stays reachable over the right interface.
+func ParseEndpoint(endpoint string) (*net.UDPAddr, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("empty endpoint")
+	}
+
+	// Literal addresses are parsed directly so the zone never goes through
+	// the resolver
+	if addrPort, err := netip.ParseAddrPort(normalizeEndpoint(endpoint)); err == nil {
+		return net.UDPAddrFromAddrPort(addrPort), nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve endpoint %s: %w", endpoint, err)
+	}
+	return addr, nil
+}
+
+// normalizeEndpoint adds the brackets around an unbracketed IPv6 host
+func normalizeEndpoint(endpoint string) string {
+	if strings.HasPrefix(endpoint, "[") {
+		return endpoint
+	}
+	i := strings.LastIndex(endpoint, ":")
+	if i < 0 || !strings.Contains(endpoint[:i], ":") {
+		return endpoint
+	}
+	return "[" + endpoint[:i] + "]" + endpoint[i:]
+}
+
+// sameEndpoint reports whether two endpoints refer to the same address,
+// including the IPv6 zone
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+// cloneEndpoint returns a copy of addr that does not share the IP slice
+func cloneEndpoint(addr *net.UDPAddr) *net.UDPAddr {
+	if addr == nil {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), addr.IP...),
+		Port: addr.Port,
+		Zone: addr.Zone,
+	}
+}
@@ -0,0 +1,86 @@
+package wireguard
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseEndpointZoned(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		ip       string
+		zone     string
+		port     int
+	}{
+		{"[fe80::1%eth0]:51820", "fe80::1", "eth0", 51820},
+		{"fe80::1%eth0:51820", "fe80::1", "eth0", 51820},
+		{"[fe80::abcd%2]:51821", "fe80::abcd", "2", 51821},
+		{"[2001:db8::1]:51820", "2001:db8::1", "", 51820},
+		{"192.168.1.10:51820", "192.168.1.10", "", 51820},
+	}
+
+	for _, tt := range tests {
+		addr, err := ParseEndpoint(tt.endpoint)
+		if err != nil {
+			t.Errorf("ParseEndpoint(%q) failed: %v", tt.endpoint, err)
+			continue
+		}
+		if !addr.IP.Equal(net.ParseIP(tt.ip)) || addr.Zone != tt.zone || addr.Port != tt.port {
+			t.Errorf("ParseEndpoint(%q) = %v, want ip=%s zone=%s port=%d",
+				tt.endpoint, addr, tt.ip, tt.zone, tt.port)
+		}
+	}
+
+	if _, err := ParseEndpoint(""); err == nil {
+		t.Error("expected error for empty endpoint")
+	}
+}
+
+func TestDiscoveryPreservesEndpointZone(t *testing.T) {
+	localNode := &MeshNode{ID: "local"}
+	pd := NewPeerDiscovery(localNode, nil, zap.NewNop())
+
+	announcement := &Announcement{
+		NodeID:    "peer-1",
+		PublicKey: strings.Repeat("6b", 32), // hex of 32 "k" bytes
+		Endpoint:  "[fe80::1%eth0]:51820",
+		Timestamp: time.Now(),
+	}
+	pd.handleProcessedAnnouncement(announcement)
+
+	peers := pd.GetDiscoveredPeers()
+	if len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(peers))
+	}
+	peer := peers[0]
+	if peer.Endpoint.Zone != "eth0" {
+		t.Errorf("expected zone eth0, got %q", peer.Endpoint.Zone)
+	}
+	if peer.Endpoint.String() != "[fe80::1%eth0]:51820" {
+		t.Errorf("unexpected endpoint string %s", peer.Endpoint)
+	}
+
+	// Pushing the peer to the interface keeps the zone
+	wgi, err := NewWireGuardInterface("wg-test", 51820, 1420, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create interface: %v", err)
+	}
+	if err := wgi.AddPeer(peer.PublicKey, nil, peer.Endpoint); err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+	added, ok := wgi.GetPeer(peer.PublicKey)
+	if !ok || added.Endpoint.Zone != "eth0" {
+		t.Errorf("expected zone to be preserved on the interface, got %+v", added)
+	}
+
+	// A re-announcement on another interface updates the zone
+	announcement.Endpoint = "fe80::1%eth1:51820"
+	pd.handleProcessedAnnouncement(announcement)
+	if peer.Endpoint.Zone != "eth1" {
+		t.Errorf("expected zone eth1 after update, got %q", peer.Endpoint.Zone)
+	}
+}
@@ -0,0 +1,211 @@
+package wireguard
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MeshEventType identifies the kind of a mesh event
+type MeshEventType string
+
+const (
+	MeshEventNodeAdded       MeshEventType = "node_added"
+	MeshEventNodeRemoved     MeshEventType = "node_removed"
+	MeshEventConnectionUp    MeshEventType = "connection_up"
+	MeshEventConnectionDown  MeshEventType = "connection_down"
+	MeshEventOptimization    MeshEventType = "optimization"
+	MeshEventRouteCalculated MeshEventType = "route_calculated"
+)
+
+// DefaultEventLogSize is the number of events kept in memory by default
+const DefaultEventLogSize = 1024
+
+// MeshEvent records a single topology or routing decision
+type MeshEvent struct {
+	Seq          uint64        `json:"seq"`
+	Time         time.Time     `json:"time"`
+	Type         MeshEventType `json:"type"`
+	NodeID       string        `json:"node_id,omitempty"`
+	ConnectionID string        `json:"connection_id,omitempty"`
+	Source       string        `json:"source,omitempty"`
+	Destination  string        `json:"destination,omitempty"`
+	Path         []string      `json:"path,omitempty"`
+	PreviousPath []string      `json:"previous_path,omitempty"`
+	CostBefore   float64       `json:"cost_before,omitempty"`
+	CostAfter    float64       `json:"cost_after,omitempty"`
+	Details      string        `json:"details,omitempty"`
+}
+
+// EventLog is a fixed-size ring buffer of mesh events. When a file is
+// attached, every event is also appended to it as a JSON line so the history
+// survives restarts and can be replayed with ReadEventFile.
+type EventLog struct {
+	mu     sync.RWMutex
+	events []MeshEvent
+	next   int
+	full   bool
+	seq    uint64
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewEventLog creates an event log keeping the last size events
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = DefaultEventLogSize
+	}
+	return &EventLog{
+		events: make([]MeshEvent, size),
+	}
+}
+
+// AttachFile appends all subsequent events to the file at path
+func (el *EventLog) AttachFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log file: %w", err)
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.closeFileLocked()
+	el.file = file
+	el.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// Record stores an event, assigning its sequence number and timestamp
+func (el *EventLog) Record(event MeshEvent) {
+	if el == nil {
+		return
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.seq++
+	event.Seq = el.seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	el.events[el.next] = event
+	el.next = (el.next + 1) % len(el.events)
+	if el.next == 0 {
+		el.full = true
+	}
+
+	if el.writer != nil {
+		if data, err := json.Marshal(event); err == nil {
+			el.writer.Write(data)
+			el.writer.WriteByte('\n')
+			el.writer.Flush()
+		}
+	}
+}
+
+// Events returns the buffered events with a sequence number greater than
+// since, oldest first
+func (el *EventLog) Events(since uint64) []MeshEvent {
+	el.mu.RLock()
+	defer el.mu.RUnlock()
+
+	var ordered []MeshEvent
+	if el.full {
+		ordered = append(ordered, el.events[el.next:]...)
+	}
+	ordered = append(ordered, el.events[:el.next]...)
+
+	result := make([]MeshEvent, 0, len(ordered))
+	for _, event := range ordered {
+		if event.Seq > since {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// Replay calls fn for every buffered event, oldest first
+func (el *EventLog) Replay(fn func(MeshEvent)) {
+	for _, event := range el.Events(0) {
+		fn(event)
+	}
+}
+
+// ServeHTTP returns the buffered events as JSON. The optional "since" query
+// parameter skips events up to that sequence number and "type" filters by
+// event type.
+func (el *EventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	events := el.Events(since)
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filtered := events[:0]
+		for _, event := range events {
+			if string(event.Type) == eventType {
+				filtered = append(filtered, event)
+			}
+		}
+		events = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Close flushes and closes the attached file, if any
+func (el *EventLog) Close() error {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	return el.closeFileLocked()
+}
+
+func (el *EventLog) closeFileLocked() error {
+	if el.file == nil {
+		return nil
+	}
+	el.writer.Flush()
+	err := el.file.Close()
+	el.file = nil
+	el.writer = nil
+	return err
+}
+
+// ReadEventFile reads events previously written by an attached event log
+func ReadEventFile(path string) ([]MeshEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log file: %w", err)
+	}
+	defer file.Close()
+
+	var events []MeshEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event MeshEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return events, fmt.Errorf("failed to decode event: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return events, fmt.Errorf("failed to read event log file: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,95 @@
+package wireguard
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestEventLogRingBuffer(t *testing.T) {
+	log := NewEventLog(3)
+	for i := 0; i < 5; i++ {
+		log.Record(MeshEvent{Type: MeshEventNodeAdded})
+	}
+
+	events := log.Events(0)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	for i, event := range events {
+		if event.Seq != uint64(i+3) {
+			t.Errorf("expected seq %d at %d, got %d", i+3, i, event.Seq)
+		}
+	}
+
+	if events := log.Events(4); len(events) != 1 || events[0].Seq != 5 {
+		t.Errorf("expected only event 5 after since=4, got %+v", events)
+	}
+}
+
+func TestEventLogFileReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mesh-events.jsonl")
+
+	log := NewEventLog(10)
+	if err := log.AttachFile(path); err != nil {
+		t.Fatalf("failed to attach file: %v", err)
+	}
+	log.Record(MeshEvent{Type: MeshEventNodeAdded, NodeID: "a"})
+	log.Record(MeshEvent{Type: MeshEventConnectionDown, ConnectionID: "a-b"})
+	if err := log.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	events, err := ReadEventFile(path)
+	if err != nil {
+		t.Fatalf("failed to read events: %v", err)
+	}
+	if len(events) != 2 || events[0].NodeID != "a" || events[1].ConnectionID != "a-b" {
+		t.Errorf("unexpected replayed events: %+v", events)
+	}
+}
+
+func TestTopologyRecordsEvents(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	topology.AddNode(&MeshNode{ID: "a"})
+	topology.AddNode(&MeshNode{ID: "b"})
+	topology.AddNode(&MeshNode{ID: "c"})
+
+	manager := NewMeshTopologyManager(topology, nil, logger)
+	if err := manager.BuildOptimalTopology(); err != nil {
+		t.Fatalf("failed to build topology: %v", err)
+	}
+	if _, err := manager.GetRouter().FindRoute("a", "c"); err != nil {
+		t.Fatalf("failed to find route: %v", err)
+	}
+
+	counts := make(map[MeshEventType]int)
+	topology.Events().Replay(func(event MeshEvent) {
+		counts[event.Type]++
+	})
+	if counts[MeshEventNodeAdded] != 3 {
+		t.Errorf("expected 3 node_added events, got %d", counts[MeshEventNodeAdded])
+	}
+	if counts[MeshEventOptimization] != 1 {
+		t.Errorf("expected 1 optimization event, got %d", counts[MeshEventOptimization])
+	}
+	if counts[MeshEventRouteCalculated] != 1 {
+		t.Errorf("expected 1 route_calculated event, got %d", counts[MeshEventRouteCalculated])
+	}
+
+	req := httptest.NewRequest("GET", "/?type=optimization", nil)
+	rec := httptest.NewRecorder()
+	topology.Events().ServeHTTP(rec, req)
+
+	var served []MeshEvent
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(served) != 1 || served[0].CostAfter <= 0 {
+		t.Errorf("unexpected served events: %+v", served)
+	}
+}
@@ -3,12 +3,16 @@ package wireguard
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // WireGuardInterface represents a WireGuard network interface
@@ -25,6 +29,25 @@ type WireGuardInterface struct {
 	logger      *zap.Logger
 	metrics     *WireGuardMetrics
 	status      InterfaceStatus
+
+	// device configures the kernel device while the interface is started;
+	// it is guarded by peersMutex
+	device deviceController
+	// createLink, deleteLink and openDevice reach the kernel; they are
+	// replaced in tests
+	createLink func(name string, mtu int) error
+	deleteLink func(name string) error
+	openDevice func() (deviceController, error)
+}
+
+// ErrWireGuardUnsupported is returned by Start on platforms where the
+// client cannot create WireGuard devices
+var ErrWireGuardUnsupported = errors.New("WireGuard devices are not supported on this platform")
+
+// deviceController configures WireGuard devices, as wgctrl.Client does
+type deviceController interface {
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
 }
 
 // InterfaceStatus represents the status of a WireGuard interface
@@ -38,6 +61,8 @@ const (
 
 // Peer represents a WireGuard peer
 type Peer struct {
+	// NodeID is the mesh node ID announced by a discovered peer
+	NodeID              string
 	PublicKey           *[32]byte
 	AllowedIPs          []net.IPNet
 	Endpoint            *net.UDPAddr
@@ -76,20 +101,31 @@ type WireGuardMetrics struct {
 	InterfaceUpTime  time.Duration
 }
 
-// NewWireGuardInterface creates a new WireGuard interface
-func NewWireGuardInterface(name string, listenPort int, mtu int, logger *zap.Logger) (*WireGuardInterface, error) {
-	// Generate private key
+// generateKeyPair generates a WireGuard key pair: a random Curve25519
+// private key, clamped as the WireGuard spec requires, and its X25519
+// public key
+func generateKeyPair() (*[32]byte, *[32]byte, error) {
 	privateKey := new([32]byte)
 	if _, err := rand.Read(privateKey[:]); err != nil {
-		return nil, fmt.Errorf("failed to generate private key: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
 
-	// Generate public key from private key
+	public, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive public key: %w", err)
+	}
 	publicKey := new([32]byte)
-	// In a real implementation, you would use WireGuard's key generation
-	// For now, we'll use a simple XOR operation as placeholder
-	for i := 0; i < 32; i++ {
-		publicKey[i] = privateKey[i] ^ 0x42
+	copy(publicKey[:], public)
+	return privateKey, publicKey, nil
+}
+
+// NewWireGuardInterface creates a new WireGuard interface
+func NewWireGuardInterface(name string, listenPort int, mtu int, logger *zap.Logger) (*WireGuardInterface, error) {
+	privateKey, publicKey, err := generateKeyPair()
+	if err != nil {
+		return nil, err
 	}
 
 	return &WireGuardInterface{
@@ -101,23 +137,60 @@ func NewWireGuardInterface(name string, listenPort int, mtu int, logger *zap.Log
 		peers:      make(map[string]*Peer),
 		routes:     make(map[string]*Route),
 		logger:     logger,
+		createLink: createLink,
+		deleteLink: deleteLink,
+		openDevice: func() (deviceController, error) {
+			return wgctrl.New()
+		},
 		metrics:    &WireGuardMetrics{},
 		status:     InterfaceStatusDown,
 	}, nil
 }
 
-// Start initializes and starts the WireGuard interface
+// Start creates the kernel WireGuard device and configures it with the
+// private key, the listen port and the peers added so far. On platforms
+// without WireGuard support it returns an error wrapping
+// ErrWireGuardUnsupported.
 func (wgi *WireGuardInterface) Start() error {
 	wgi.logger.Info("Starting WireGuard interface", 
 		zap.String("name", wgi.name),
 		zap.Int("port", wgi.listenPort))
 
-	// In a real implementation, you would:
-	// 1. Create the WireGuard interface using wgctrl
-	// 2. Configure the interface with private key and listen port
-	// 3. Set up the interface in the kernel
-	// 4. Start listening for incoming connections
+	wgi.peersMutex.Lock()
+	defer wgi.peersMutex.Unlock()
+	if wgi.device != nil {
+		return nil
+	}
+
+	if err := wgi.createLink(wgi.name, wgi.mtu); err != nil {
+		wgi.status = InterfaceStatusError
+		return fmt.Errorf("failed to create WireGuard device %s: %w", wgi.name, err)
+	}
+	device, err := wgi.openDevice()
+	if err != nil {
+		wgi.status = InterfaceStatusError
+		wgi.removeLink()
+		return fmt.Errorf("failed to open WireGuard control interface: %w", err)
+	}
 
+	privateKey := wgtypes.Key(*wgi.privateKey)
+	listenPort := wgi.listenPort
+	config := wgtypes.Config{
+		PrivateKey:   &privateKey,
+		ListenPort:   &listenPort,
+		ReplacePeers: true,
+	}
+	for _, peer := range wgi.peers {
+		config.Peers = append(config.Peers, peerConfig(peer))
+	}
+	if err := device.ConfigureDevice(wgi.name, config); err != nil {
+		wgi.status = InterfaceStatusError
+		device.Close()
+		wgi.removeLink()
+		return fmt.Errorf("failed to configure WireGuard device %s: %w", wgi.name, err)
+	}
+
+	wgi.device = device
 	wgi.status = InterfaceStatusUp
 	wgi.metrics.InterfaceUpTime = time.Since(time.Now())
 
@@ -125,22 +198,47 @@ func (wgi *WireGuardInterface) Start() error {
 	return nil
 }
 
-// Stop stops the WireGuard interface
+// Stop removes the kernel WireGuard device
 func (wgi *WireGuardInterface) Stop() error {
 	wgi.logger.Info("Stopping WireGuard interface", zap.String("name", wgi.name))
 
-	// In a real implementation, you would:
-	// 1. Stop listening for connections
-	// 2. Remove all peers
-	// 3. Bring down the interface
-	// 4. Clean up kernel resources
-
+	wgi.peersMutex.Lock()
+	defer wgi.peersMutex.Unlock()
 	wgi.status = InterfaceStatusDown
+	if wgi.device == nil {
+		return nil
+	}
+	wgi.device.Close()
+	wgi.device = nil
+	if err := wgi.deleteLink(wgi.name); err != nil {
+		return fmt.Errorf("failed to remove WireGuard device %s: %w", wgi.name, err)
+	}
+
 	wgi.logger.Info("WireGuard interface stopped")
 	return nil
 }
 
-// AddPeer adds a new peer to the WireGuard interface
+// removeLink deletes the device after a failed Start
+func (wgi *WireGuardInterface) removeLink() {
+	if err := wgi.deleteLink(wgi.name); err != nil {
+		wgi.logger.Warn("Failed to remove WireGuard device", zap.String("name", wgi.name), zap.Error(err))
+	}
+}
+
+// peerConfig is the device configuration of peer
+func peerConfig(peer *Peer) wgtypes.PeerConfig {
+	keepalive := peer.PersistentKeepalive
+	return wgtypes.PeerConfig{
+		PublicKey:                   wgtypes.Key(*peer.PublicKey),
+		Endpoint:                    peer.Endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  peer.AllowedIPs,
+	}
+}
+
+// AddPeer adds a new peer to the WireGuard interface. While the interface
+// is started the peer is configured on the device as well.
 func (wgi *WireGuardInterface) AddPeer(publicKey *[32]byte, allowedIPs []net.IPNet, endpoint *net.UDPAddr) error {
 	wgi.peersMutex.Lock()
 	defer wgi.peersMutex.Unlock()
@@ -150,14 +248,23 @@ func (wgi *WireGuardInterface) AddPeer(publicKey *[32]byte, allowedIPs []net.IPN
 	peer := &Peer{
 		PublicKey:           publicKey,
 		AllowedIPs:          allowedIPs,
-		Endpoint:            endpoint,
+		Endpoint:            cloneEndpoint(endpoint),
 		PersistentKeepalive: 25 * time.Second,
 		Status:              PeerStatusOffline,
 		LastSeen:            time.Now(),
 	}
 
+	if wgi.device != nil {
+		config := wgtypes.Config{Peers: []wgtypes.PeerConfig{peerConfig(peer)}}
+		if err := wgi.device.ConfigureDevice(wgi.name, config); err != nil {
+			return fmt.Errorf("failed to add peer %s to WireGuard device: %w", peerKey, err)
+		}
+	}
+
+	if _, exists := wgi.peers[peerKey]; !exists {
+		wgi.metrics.TotalPeers++
+	}
 	wgi.peers[peerKey] = peer
-	wgi.metrics.TotalPeers++
 
 	wgi.logger.Info("Added peer to WireGuard interface",
 		zap.String("peer", peerKey),
@@ -166,7 +273,8 @@ func (wgi *WireGuardInterface) AddPeer(publicKey *[32]byte, allowedIPs []net.IPN
 	return nil
 }
 
-// RemovePeer removes a peer from the WireGuard interface
+// RemovePeer removes a peer from the WireGuard interface and, while the
+// interface is started, from the device
 func (wgi *WireGuardInterface) RemovePeer(publicKey *[32]byte) error {
 	wgi.peersMutex.Lock()
 	defer wgi.peersMutex.Unlock()
@@ -174,6 +282,12 @@ func (wgi *WireGuardInterface) RemovePeer(publicKey *[32]byte) error {
 	peerKey := base64.StdEncoding.EncodeToString(publicKey[:])
 	
 	if peer, exists := wgi.peers[peerKey]; exists {
+		if wgi.device != nil {
+			config := wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: wgtypes.Key(*publicKey), Remove: true}}}
+			if err := wgi.device.ConfigureDevice(wgi.name, config); err != nil {
+				return fmt.Errorf("failed to remove peer %s from WireGuard device: %w", peerKey, err)
+			}
+		}
 		if peer.Status == PeerStatusOnline {
 			wgi.metrics.OnlinePeers--
 		}
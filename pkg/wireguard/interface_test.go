@@ -0,0 +1,108 @@
+package wireguard
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestInterfaceKeyPair(t *testing.T) {
+	a, err := NewWireGuardInterface("wg-a", 51820, 1420, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create interface: %v", err)
+	}
+	b, err := NewWireGuardInterface("wg-b", 51821, 1420, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create interface: %v", err)
+	}
+
+	private := a.GetPrivateKey()
+	if private[0]&7 != 0 || private[31]&128 != 0 || private[31]&64 == 0 {
+		t.Errorf("private key is not clamped: %x", private)
+	}
+
+	// Both sides derive the same shared secret from their private key and
+	// the other's public key
+	ab, err := curve25519.X25519(a.GetPrivateKey()[:], b.GetPublicKey()[:])
+	if err != nil {
+		t.Fatalf("failed to derive shared secret: %v", err)
+	}
+	ba, err := curve25519.X25519(b.GetPrivateKey()[:], a.GetPublicKey()[:])
+	if err != nil {
+		t.Fatalf("failed to derive shared secret: %v", err)
+	}
+	if !bytes.Equal(ab, ba) {
+		t.Error("public keys do not match the private keys")
+	}
+}
+
+// fakeDevice records the configurations pushed to the device
+type fakeDevice struct {
+	configs []wgtypes.Config
+	closed  bool
+}
+
+func (d *fakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	d.configs = append(d.configs, cfg)
+	return nil
+}
+
+func (d *fakeDevice) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestInterfaceConfiguresDevice(t *testing.T) {
+	wgi, err := NewWireGuardInterface("wg-test", 51820, 1420, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create interface: %v", err)
+	}
+	device := &fakeDevice{}
+	links := make(map[string]int)
+	wgi.createLink = func(name string, mtu int) error {
+		links[name] = mtu
+		return nil
+	}
+	wgi.deleteLink = func(name string) error {
+		delete(links, name)
+		return nil
+	}
+	wgi.openDevice = func() (deviceController, error) { return device, nil }
+
+	first := [32]byte{1}
+	if err := wgi.AddPeer(&first, nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}); err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+	if err := wgi.Start(); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if links["wg-test"] != 1420 || len(device.configs) != 1 {
+		t.Fatalf("expected the device to be created and configured, got links %v and %d configs", links, len(device.configs))
+	}
+	config := device.configs[0]
+	if *config.PrivateKey != wgtypes.Key(*wgi.GetPrivateKey()) || *config.ListenPort != 51820 || !config.ReplacePeers {
+		t.Errorf("unexpected device configuration: %+v", config)
+	}
+	if len(config.Peers) != 1 || config.Peers[0].PublicKey != wgtypes.Key(first) {
+		t.Errorf("expected the peer added before Start, got %+v", config.Peers)
+	}
+
+	// Peer changes are pushed to the started device
+	second := [32]byte{2}
+	wgi.AddPeer(&second, nil, nil)
+	wgi.RemovePeer(&first)
+	if len(device.configs) != 3 || device.configs[1].Peers[0].PublicKey != wgtypes.Key(second) || !device.configs[2].Peers[0].Remove {
+		t.Errorf("unexpected peer updates: %+v", device.configs[1:])
+	}
+
+	if err := wgi.Stop(); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if !device.closed || len(links) != 0 || wgi.GetStatus() != InterfaceStatusDown {
+		t.Error("expected the device to be removed")
+	}
+}
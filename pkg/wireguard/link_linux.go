@@ -0,0 +1,38 @@
+package wireguard
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// createLink creates the kernel WireGuard device name and brings it up
+func createLink(name string, mtu int) error {
+	if err := ip("link", "add", "dev", name, "type", "wireguard"); err != nil {
+		return fmt.Errorf("%w (is the wireguard kernel module available?)", err)
+	}
+	args := []string{"link", "set", "dev", name}
+	if mtu > 0 {
+		args = append(args, "mtu", strconv.Itoa(mtu))
+	}
+	if err := ip(append(args, "up")...); err != nil {
+		ip("link", "delete", "dev", name)
+		return err
+	}
+	return nil
+}
+
+// deleteLink removes the device name
+func deleteLink(name string) error {
+	return ip("link", "delete", "dev", name)
+}
+
+// ip runs the ip command with args
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package wireguard
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func createLink(name string, mtu int) error {
+	return fmt.Errorf("%w (%s)", ErrWireGuardUnsupported, runtime.GOOS)
+}
+
+func deleteLink(name string) error {
+	return nil
+}
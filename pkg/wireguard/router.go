@@ -2,22 +2,33 @@ package wireguard
 
 import (
 	"container/heap"
+	"errors"
 	"fmt"
 	"math"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
 	"go.uber.org/zap"
 )
 
+// ErrRouteHopLimit is returned when the destination can only be reached
+// over more hops than RouterConfig.MaxRouteHops allows
+var ErrRouteHopLimit = errors.New("route exceeds the hop limit")
+
 // MeshRouter represents a router for the mesh network
 type MeshRouter struct {
 	topology    *MeshTopology
 	logger      *zap.Logger
 	metrics     *RouterMetrics
 	routesCache map[string]*CachedRoute
+	lastRoutes  map[string]*MeshRoute
+	// balanced holds the equal-cost routes FindBalancedRoute picks from
+	balanced map[string]*balancedRoutes
 	cacheMutex  sync.RWMutex
 	config      *RouterConfig
+	clock       clock.Clock
 }
 
 // RouterMetrics represents metrics for the mesh router
@@ -28,6 +39,11 @@ type RouterMetrics struct {
 	AverageRouteLatency   time.Duration
 	RoutingErrors         int64
 	LastRouteCalculation  time.Time
+	// BalancedSelections counts routes picked by FindBalancedRoute, and
+	// RouteSelections how often each path was picked, keyed by the node
+	// IDs of the path joined with commas
+	BalancedSelections int64
+	RouteSelections    map[string]int64
 }
 
 // CachedRoute represents a cached route
@@ -45,6 +61,19 @@ type RouterConfig struct {
 	EnableFailover        bool
 	MaxRouteHops          int
 	RouteCalculationTimeout time.Duration
+	// LoadBalanceTolerance is how much more than the cheapest route, as a
+	// fraction of its cost, a route may cost to share the traffic
+	LoadBalanceTolerance float64
+	// MaxBalancedRoutes caps the routes traffic is spread across
+	MaxBalancedRoutes int
+}
+
+// balancedRoutes are the near-equal-cost routes between two nodes, used in
+// turn
+type balancedRoutes struct {
+	routes    []*MeshRoute
+	next      int
+	expiresAt time.Time
 }
 
 // NewMeshRouter creates a new mesh router
@@ -52,8 +81,10 @@ func NewMeshRouter(topology *MeshTopology, logger *zap.Logger) *MeshRouter {
 	return &MeshRouter{
 		topology:    topology,
 		logger:      logger,
-		metrics:     &RouterMetrics{},
+		metrics:     &RouterMetrics{RouteSelections: make(map[string]int64)},
 		routesCache: make(map[string]*CachedRoute),
+		lastRoutes:  make(map[string]*MeshRoute),
+		balanced:    make(map[string]*balancedRoutes),
 		config: &RouterConfig{
 			CacheTTL:                5 * time.Minute,
 			MaxCacheSize:           1000,
@@ -61,111 +92,168 @@ func NewMeshRouter(topology *MeshTopology, logger *zap.Logger) *MeshRouter {
 			EnableFailover:         true,
 			MaxRouteHops:           10,
 			RouteCalculationTimeout: 10 * time.Second,
+			LoadBalanceTolerance:    0.1,
+			MaxBalancedRoutes:       4,
 		},
+		clock: clock.Real{},
 	}
 }
 
+// SetClock sets the clock used for route cache expiry. It must be called
+// before the router is used.
+func (mr *MeshRouter) SetClock(c clock.Clock) {
+	mr.clock = c
+}
+
 // FindRoute finds the best route between two nodes
 func (mr *MeshRouter) FindRoute(source, destination string) (*MeshRoute, error) {
 	// Check cache first
 	if route := mr.getCachedRoute(source, destination); route != nil {
-		mr.metrics.CacheHits++
 		return route, nil
 	}
 
-	mr.metrics.CacheMisses++
-
 	// Calculate new route
 	route, err := mr.calculateRoute(source, destination)
 	if err != nil {
+		mr.cacheMutex.Lock()
 		mr.metrics.RoutingErrors++
+		mr.cacheMutex.Unlock()
 		return nil, fmt.Errorf("failed to calculate route: %w", err)
 	}
 
 	// Cache the route
 	mr.cacheRoute(source, destination, route)
-
-	mr.metrics.TotalRoutesCalculated++
-	mr.metrics.LastRouteCalculation = time.Now()
+	mr.recordRouteCalculated(route)
 
 	return route, nil
 }
 
 // calculateRoute calculates the optimal route between two nodes
 func (mr *MeshRouter) calculateRoute(source, destination string) (*MeshRoute, error) {
-	// Use Dijkstra's algorithm to find shortest path
-	distances := make(map[string]float64)
-	previous := make(map[string]string)
-	visited := make(map[string]bool)
+	return mr.calculateRouteExcluding(source, destination, nil)
+}
+
+// calculateRouteExcluding calculates the optimal route between two nodes
+// that avoids the connections whose IDs are in excluded. The topology is
+// not modified.
+func (mr *MeshRouter) calculateRouteExcluding(source, destination string, excluded map[string]bool) (*MeshRoute, error) {
+	maxHops := mr.config.MaxRouteHops
+	path, cost, found := mr.shortestPath(source, destination, excluded, maxHops)
+	if !found {
+		if maxHops > 0 {
+			if _, _, reachable := mr.shortestPath(source, destination, excluded, 0); reachable {
+				return nil, fmt.Errorf("%w: no route from %s to %s within %d hops", ErrRouteHopLimit, source, destination, maxHops)
+			}
+		}
+		return nil, fmt.Errorf("no route found from %s to %s", source, destination)
+	}
+
+	// Calculate route metrics
+	latency, bandwidth, reliability := mr.calculateRouteMetrics(path)
+
+	route := &MeshRoute{
+		ID:          fmt.Sprintf("%s-%s", source, destination),
+		Source:      source,
+		Destination: destination,
+		Path:        path,
+		Latency:     latency,
+		Bandwidth:   bandwidth,
+		Reliability: reliability,
+		Cost:        cost,
+		LastUpdated: mr.clock.Now(),
+	}
+
+	return route, nil
+}
 
-	// Initialize distances
-	nodes := mr.topology.GetAllNodes()
-	for _, node := range nodes {
-		distances[node.ID] = math.Inf(1)
+// shortestPath finds the cheapest path of at most maxHops connections, or
+// of any length if maxHops is zero, that avoids the excluded connections
+func (mr *MeshRouter) shortestPath(source, destination string, excluded map[string]bool, maxHops int) ([]string, float64, bool) {
+	// Use Dijkstra's algorithm to find the shortest path. With a hop
+	// limit, a node reached over fewer hops is a different state than the
+	// same node reached over more, as only the former may still be
+	// extended to the destination.
+	distances := make(map[hopState]float64)
+	previous := make(map[hopState]hopState)
+	// fewestHops is the hop count of the cheapest visited state of a node;
+	// a later state with at least as many hops cannot do better
+	fewestHops := make(map[string]int)
+
+	known := make(map[string]bool)
+	for _, node := range mr.topology.GetAllNodes() {
+		known[node.ID] = true
 	}
-	distances[source] = 0
 
-	// Priority queue for unvisited nodes
+	start := hopState{id: source}
+	distances[start] = 0
+
+	// Priority queue for unvisited states
 	pq := &NodePriorityQueue{}
 	heap.Init(pq)
 	heap.Push(pq, &NodeDistance{ID: source, Distance: 0})
 
+	found := false
+	var end hopState
 	for pq.Len() > 0 {
 		current := heap.Pop(pq).(*NodeDistance)
-		
-		if visited[current.ID] {
+		state := hopState{id: current.ID, hops: current.Hops}
+		if current.Distance > distances[state] {
+			continue
+		}
+		if hops, visited := fewestHops[current.ID]; visited && hops <= current.Hops {
 			continue
 		}
-		visited[current.ID] = true
+		fewestHops[current.ID] = current.Hops
 
 		if current.ID == destination {
+			found, end = true, state
 			break
 		}
 
 		// Check all connections from current node
 		connections := mr.getNodeConnections(current.ID)
 		for _, conn := range connections {
+			if excluded[conn.ID] {
+				continue
+			}
 			neighbor := conn.TargetNode
 			if conn.TargetNode == current.ID {
 				neighbor = conn.SourceNode
 			}
-
-			if visited[neighbor] {
+			if !known[neighbor] {
+				continue
+			}
+			if _, visited := fewestHops[neighbor]; visited && maxHops <= 0 {
 				continue
 			}
 
-			newDistance := distances[current.ID] + conn.Cost
-			if newDistance < distances[neighbor] {
-				distances[neighbor] = newDistance
-				previous[neighbor] = current.ID
-				heap.Push(pq, &NodeDistance{ID: neighbor, Distance: newDistance})
+			next := hopState{id: neighbor}
+			if maxHops > 0 {
+				if current.Hops >= maxHops {
+					continue
+				}
+				next.hops = current.Hops + 1
+			}
+
+			newDistance := distances[state] + conn.Cost
+			if distance, ok := distances[next]; !ok || newDistance < distance {
+				distances[next] = newDistance
+				previous[next] = state
+				heap.Push(pq, &NodeDistance{ID: neighbor, Distance: newDistance, Hops: next.hops})
 			}
 		}
 	}
 
-	// Reconstruct path
-	if distances[destination] == math.Inf(1) {
-		return nil, fmt.Errorf("no route found from %s to %s", source, destination)
+	if !found {
+		return nil, 0, false
 	}
 
-	path := mr.reconstructPath(previous, source, destination)
-	
-	// Calculate route metrics
-	latency, bandwidth, reliability := mr.calculateRouteMetrics(path)
-
-	route := &MeshRoute{
-		ID:          fmt.Sprintf("%s-%s", source, destination),
-		Source:      source,
-		Destination: destination,
-		Path:        path,
-		Latency:     latency,
-		Bandwidth:   bandwidth,
-		Reliability: reliability,
-		Cost:        distances[destination],
-		LastUpdated: time.Now(),
+	path := []string{destination}
+	for state := end; state != start; {
+		state = previous[state]
+		path = append([]string{state.id}, path...)
 	}
-
-	return route, nil
+	return path, distances[end], true
 }
 
 // getNodeConnections returns all connections for a given node
@@ -182,20 +270,6 @@ func (mr *MeshRouter) getNodeConnections(nodeID string) []*MeshConnection {
 	return nodeConnections
 }
 
-// reconstructPath reconstructs the path from the previous map
-func (mr *MeshRouter) reconstructPath(previous map[string]string, source, destination string) []string {
-	var path []string
-	current := destination
-
-	for current != source {
-		path = append([]string{current}, path...)
-		current = previous[current]
-	}
-	path = append([]string{source}, path...)
-
-	return path
-}
-
 // calculateRouteMetrics calculates metrics for a route
 func (mr *MeshRouter) calculateRouteMetrics(path []string) (time.Duration, int64, float64) {
 	if len(path) < 2 {
@@ -245,15 +319,17 @@ func (mr *MeshRouter) calculateRouteMetrics(path []string) (time.Duration, int64
 	return totalLatency, minBandwidth, averageReliability
 }
 
-// getCachedRoute retrieves a cached route
+// getCachedRoute retrieves a cached route and counts the cache hit or miss.
+// It updates the cache, so it takes the write lock.
 func (mr *MeshRouter) getCachedRoute(source, destination string) *MeshRoute {
-	mr.cacheMutex.RLock()
-	defer mr.cacheMutex.RUnlock()
+	mr.cacheMutex.Lock()
+	defer mr.cacheMutex.Unlock()
 
 	cacheKey := fmt.Sprintf("%s-%s", source, destination)
 	if cached, exists := mr.routesCache[cacheKey]; exists {
-		if time.Now().Before(cached.ExpiresAt) {
+		if mr.clock.Now().Before(cached.ExpiresAt) {
 			cached.AccessCount++
+			mr.metrics.CacheHits++
 			return cached.Route
 		} else {
 			// Remove expired cache entry
@@ -261,6 +337,7 @@ func (mr *MeshRouter) getCachedRoute(source, destination string) *MeshRoute {
 		}
 	}
 
+	mr.metrics.CacheMisses++
 	return nil
 }
 
@@ -277,11 +354,35 @@ func (mr *MeshRouter) cacheRoute(source, destination string, route *MeshRoute) {
 	cacheKey := fmt.Sprintf("%s-%s", source, destination)
 	mr.routesCache[cacheKey] = &CachedRoute{
 		Route:      route,
-		ExpiresAt:  time.Now().Add(mr.config.CacheTTL),
+		ExpiresAt:  mr.clock.Now().Add(mr.config.CacheTTL),
 		AccessCount: 1,
 	}
 }
 
+// recordRouteCalculated records a route calculation together with the
+// previously calculated route between the same nodes
+func (mr *MeshRouter) recordRouteCalculated(route *MeshRoute) {
+	mr.cacheMutex.Lock()
+	previous := mr.lastRoutes[route.ID]
+	mr.lastRoutes[route.ID] = route
+	mr.metrics.TotalRoutesCalculated++
+	mr.metrics.LastRouteCalculation = mr.clock.Now()
+	mr.cacheMutex.Unlock()
+
+	event := MeshEvent{
+		Type:        MeshEventRouteCalculated,
+		Source:      route.Source,
+		Destination: route.Destination,
+		Path:        route.Path,
+		CostAfter:   route.Cost,
+	}
+	if previous != nil {
+		event.PreviousPath = previous.Path
+		event.CostBefore = previous.Cost
+	}
+	mr.topology.events.Record(event)
+}
+
 // evictOldestCacheEntry removes the oldest cache entry
 func (mr *MeshRouter) evictOldestCacheEntry() {
 	var oldestKey string
@@ -310,35 +411,106 @@ func (mr *MeshRouter) FindAlternativeRoutes(source, destination string, count in
 	}
 	routes = append(routes, primaryRoute)
 
-	// Find alternative routes by temporarily removing edges
+	// Find alternative routes by excluding one edge at a time. The live
+	// topology is never modified, as other goroutines route against it.
 	connections := mr.topology.GetAllConnections()
 	for i := 0; i < len(connections) && len(routes) < count; i++ {
-		conn := connections[i]
-		
-		// Temporarily remove connection
-		mr.topology.RemoveConnection(conn.ID)
-		
-		// Try to find alternative route
-		if altRoute, err := mr.calculateRoute(source, destination); err == nil {
-			// Check if this is a different route
-			if !mr.isSameRoute(primaryRoute, altRoute) {
-				routes = append(routes, altRoute)
+		excluded := map[string]bool{connections[i].ID: true}
+		altRoute, err := mr.calculateRouteExcluding(source, destination, excluded)
+		if err != nil {
+			continue
+		}
+		known := false
+		for _, route := range routes {
+			if mr.isSameRoute(route, altRoute) {
+				known = true
+				break
 			}
 		}
-		
-		// Restore connection
-		mr.topology.AddConnection(
-			conn.SourceNode,
-			conn.TargetNode,
-			conn.Latency,
-			conn.Bandwidth,
-			conn.Reliability,
-		)
+		if !known {
+			routes = append(routes, altRoute)
+		}
 	}
 
 	return routes, nil
 }
 
+// FindBalancedRoute finds a route between two nodes like FindRoute, but
+// spreads traffic across routes whose cost is within LoadBalanceTolerance of
+// the cheapest one by returning them in turn. The routes are cached for
+// CacheTTL. Without EnableLoadBalancing it is FindRoute.
+func (mr *MeshRouter) FindBalancedRoute(source, destination string) (*MeshRoute, error) {
+	if !mr.config.EnableLoadBalancing {
+		return mr.FindRoute(source, destination)
+	}
+
+	cacheKey := fmt.Sprintf("%s-%s", source, destination)
+	mr.cacheMutex.Lock()
+	if set, exists := mr.balanced[cacheKey]; exists {
+		if mr.clock.Now().Before(set.expiresAt) {
+			route := mr.pickBalancedLocked(set)
+			mr.cacheMutex.Unlock()
+			return route, nil
+		}
+		delete(mr.balanced, cacheKey)
+	}
+	mr.cacheMutex.Unlock()
+
+	routes, err := mr.FindAlternativeRoutes(source, destination, mr.config.MaxBalancedRoutes)
+	if err != nil {
+		return nil, err
+	}
+	cheapest := routes[0].Cost
+	for _, route := range routes {
+		cheapest = math.Min(cheapest, route.Cost)
+	}
+	set := &balancedRoutes{expiresAt: mr.clock.Now().Add(mr.config.CacheTTL)}
+	for _, route := range routes {
+		if route.Cost <= cheapest*(1+mr.config.LoadBalanceTolerance) {
+			set.routes = append(set.routes, route)
+		}
+	}
+
+	mr.cacheMutex.Lock()
+	defer mr.cacheMutex.Unlock()
+	// Another caller may have stored the routes meanwhile
+	if existing, exists := mr.balanced[cacheKey]; exists && mr.clock.Now().Before(existing.expiresAt) {
+		set = existing
+	} else {
+		if len(mr.balanced) >= mr.config.MaxCacheSize {
+			mr.evictOldestBalancedLocked()
+		}
+		mr.balanced[cacheKey] = set
+	}
+	return mr.pickBalancedLocked(set), nil
+}
+
+// pickBalancedLocked returns the next route of set and counts the
+// selection. mr.cacheMutex must be held.
+func (mr *MeshRouter) pickBalancedLocked(set *balancedRoutes) *MeshRoute {
+	route := set.routes[set.next%len(set.routes)]
+	set.next++
+	mr.metrics.BalancedSelections++
+	mr.metrics.RouteSelections[strings.Join(route.Path, ",")]++
+	return route
+}
+
+// evictOldestBalancedLocked removes the balanced routes that expire first.
+// mr.cacheMutex must be held.
+func (mr *MeshRouter) evictOldestBalancedLocked() {
+	var oldestKey string
+	var oldestTime time.Time
+	for key, set := range mr.balanced {
+		if oldestKey == "" || set.expiresAt.Before(oldestTime) {
+			oldestKey = key
+			oldestTime = set.expiresAt
+		}
+	}
+	if oldestKey != "" {
+		delete(mr.balanced, oldestKey)
+	}
+}
+
 // isSameRoute checks if two routes are the same
 func (mr *MeshRouter) isSameRoute(route1, route2 *MeshRoute) bool {
 	if len(route1.Path) != len(route2.Path) {
@@ -362,7 +534,7 @@ func (mr *MeshRouter) UpdateRoute(route *MeshRoute) {
 	cacheKey := fmt.Sprintf("%s-%s", route.Source, route.Destination)
 	if cached, exists := mr.routesCache[cacheKey]; exists {
 		cached.Route = route
-		cached.ExpiresAt = time.Now().Add(mr.config.CacheTTL)
+		cached.ExpiresAt = mr.clock.Now().Add(mr.config.CacheTTL)
 	}
 }
 
@@ -372,18 +544,43 @@ func (mr *MeshRouter) ClearCache() {
 	defer mr.cacheMutex.Unlock()
 
 	mr.routesCache = make(map[string]*CachedRoute)
+	mr.balanced = make(map[string]*balancedRoutes)
 	mr.logger.Info("Route cache cleared")
 }
 
-// GetMetrics returns router metrics
+// RouteCount returns the number of routes currently cached
+func (mr *MeshRouter) RouteCount() int {
+	mr.cacheMutex.RLock()
+	defer mr.cacheMutex.RUnlock()
+	return len(mr.routesCache)
+}
+
+// GetMetrics returns a snapshot of the router metrics
 func (mr *MeshRouter) GetMetrics() *RouterMetrics {
-	return mr.metrics
+	mr.cacheMutex.RLock()
+	defer mr.cacheMutex.RUnlock()
+
+	metrics := *mr.metrics
+	metrics.RouteSelections = make(map[string]int64, len(mr.metrics.RouteSelections))
+	for path, count := range mr.metrics.RouteSelections {
+		metrics.RouteSelections[path] = count
+	}
+	return &metrics
 }
 
 // NodeDistance represents a node with its distance for priority queue
 type NodeDistance struct {
 	ID       string
 	Distance float64
+	// Hops is the number of connections from the source, counted only
+	// while routes are limited to a number of hops
+	Hops int
+}
+
+// hopState is a node reached over a number of hops
+type hopState struct {
+	id   string
+	hops int
 }
 
 // NodePriorityQueue implements heap.Interface for node distances
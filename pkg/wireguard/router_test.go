@@ -0,0 +1,202 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/clock"
+	"go.uber.org/zap"
+)
+
+func TestRouteCacheExpires(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	topology.AddNode(&MeshNode{ID: "a"})
+	topology.AddNode(&MeshNode{ID: "b"})
+	topology.AddConnection("a", "b", 10*time.Millisecond, 1000, 0.99)
+
+	router := NewMeshRouter(topology, logger)
+	fake := clock.NewFake(time.Now())
+	router.SetClock(fake)
+
+	for i := 0; i < 2; i++ {
+		if _, err := router.FindRoute("a", "b"); err != nil {
+			t.Fatalf("failed to find route: %v", err)
+		}
+	}
+	if router.metrics.CacheHits != 1 || router.metrics.CacheMisses != 1 {
+		t.Fatalf("expected one hit and one miss, got %+v", router.metrics)
+	}
+
+	fake.Advance(router.config.CacheTTL + time.Second)
+	if _, err := router.FindRoute("a", "b"); err != nil {
+		t.Fatalf("failed to find route: %v", err)
+	}
+	if router.metrics.CacheMisses != 2 {
+		t.Errorf("expected expired route to miss the cache, got %+v", router.metrics)
+	}
+}
+
+func TestGetMetricsDuringFindRoute(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	topology.AddNode(&MeshNode{ID: "a"})
+	topology.AddNode(&MeshNode{ID: "b"})
+	topology.AddConnection("a", "b", 10*time.Millisecond, 1000, 0.99)
+	router := NewMeshRouter(topology, logger)
+
+	// Run with -race: the counters are updated and read concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				router.FindRoute("a", "b")
+				router.FindRoute("a", "missing")
+				router.GetMetrics()
+			}
+		}()
+	}
+	wg.Wait()
+
+	metrics := router.GetMetrics()
+	if metrics.CacheHits+metrics.CacheMisses != 800 || metrics.RoutingErrors != 400 {
+		t.Errorf("expected every lookup to be counted, got %+v", metrics)
+	}
+}
+
+func TestFindAlternativeRoutesKeepsTopology(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		topology.AddNode(&MeshNode{ID: id})
+	}
+	topology.AddConnection("a", "b", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("b", "d", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("a", "c", 50*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("c", "d", 50*time.Millisecond, 1000, 0.99)
+
+	before := make(map[string]*MeshConnection)
+	for _, conn := range topology.GetAllConnections() {
+		before[conn.ID] = conn
+	}
+	router := NewMeshRouter(topology, logger)
+	// The primary route is recorded as an event of its own
+	if _, err := router.FindRoute("a", "d"); err != nil {
+		t.Fatalf("failed to find route: %v", err)
+	}
+	events := len(topology.Events().Events(0))
+
+	routes, err := router.FindAlternativeRoutes("a", "d", 3)
+	if err != nil {
+		t.Fatalf("failed to find routes: %v", err)
+	}
+	if len(routes) != 2 || routes[0].Path[1] != "b" || routes[1].Path[1] != "c" {
+		t.Fatalf("expected the route over b and the one over c, got %d routes", len(routes))
+	}
+
+	after := topology.GetAllConnections()
+	if len(after) != len(before) {
+		t.Fatalf("expected %d connections, got %d", len(before), len(after))
+	}
+	for _, conn := range after {
+		if before[conn.ID] != conn {
+			t.Errorf("connection %s was replaced", conn.ID)
+		}
+	}
+	if got := len(topology.Events().Events(0)); got != events {
+		t.Errorf("expected no topology events, got %d new", got-events)
+	}
+}
+
+func TestRouteHopLimit(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	// A chain n0-n1-...-n5 of five hops, and a detour n0-x-n5 of two
+	// expensive hops
+	for i := 0; i <= 5; i++ {
+		topology.AddNode(&MeshNode{ID: fmt.Sprintf("n%d", i)})
+		if i > 0 {
+			topology.AddConnection(fmt.Sprintf("n%d", i-1), fmt.Sprintf("n%d", i), time.Millisecond, 100*1024*1024, 0.99)
+		}
+	}
+	topology.AddNode(&MeshNode{ID: "x"})
+	topology.AddConnection("n0", "x", 100*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("x", "n5", 100*time.Millisecond, 1000, 0.99)
+
+	router := NewMeshRouter(topology, logger)
+	route, err := router.calculateRoute("n0", "n5")
+	if err != nil || len(route.Path) != 6 {
+		t.Fatalf("expected the cheap chain without a binding limit, got %v, %v", route, err)
+	}
+
+	router.config.MaxRouteHops = 4
+	route, err = router.calculateRoute("n0", "n5")
+	if err != nil {
+		t.Fatalf("failed to find a route within 4 hops: %v", err)
+	}
+	if want := []string{"n0", "x", "n5"}; fmt.Sprint(route.Path) != fmt.Sprint(want) {
+		t.Errorf("expected the detour %v, got %v", want, route.Path)
+	}
+
+	topology.RemoveConnection("x-n5")
+	if _, err := router.calculateRoute("n0", "n5"); !errors.Is(err, ErrRouteHopLimit) {
+		t.Errorf("expected ErrRouteHopLimit for the long chain, got %v", err)
+	}
+	router.config.MaxRouteHops = 5
+	if route, err := router.calculateRoute("n0", "n5"); err != nil || len(route.Path) != 6 {
+		t.Errorf("expected the chain to fit 5 hops, got %v, %v", route, err)
+	}
+
+	// An unreachable node is not a hop limit problem
+	topology.AddNode(&MeshNode{ID: "island"})
+	router.config.MaxRouteHops = 2
+	if _, err := router.calculateRoute("n0", "island"); err == nil || errors.Is(err, ErrRouteHopLimit) {
+		t.Errorf("expected a plain no-route error, got %v", err)
+	}
+}
+
+func TestFindBalancedRoute(t *testing.T) {
+	logger := zap.NewNop()
+	topology := NewMeshTopology(nil, logger)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		topology.AddNode(&MeshNode{ID: id})
+	}
+	// Two equal routes over b and c, and an expensive one over e
+	topology.AddConnection("a", "b", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("b", "d", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("a", "c", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("c", "d", 10*time.Millisecond, 1000, 0.99)
+	topology.AddConnection("a", "e", time.Second, 1000, 0.5)
+	topology.AddConnection("e", "d", time.Second, 1000, 0.5)
+
+	router := NewMeshRouter(topology, logger)
+	via := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		route, err := router.FindBalancedRoute("a", "d")
+		if err != nil {
+			t.Fatalf("failed to find route: %v", err)
+		}
+		via[route.Path[1]]++
+	}
+	if via["b"] != 3 || via["c"] != 3 {
+		t.Errorf("expected traffic split evenly over b and c, got %v", via)
+	}
+
+	metrics := router.GetMetrics()
+	if metrics.BalancedSelections != 6 || metrics.RouteSelections["a,b,d"] != 3 || metrics.RouteSelections["a,c,d"] != 3 {
+		t.Errorf("unexpected selection counts: %d, %v", metrics.BalancedSelections, metrics.RouteSelections)
+	}
+
+	router.config.EnableLoadBalancing = false
+	first, _ := router.FindBalancedRoute("a", "d")
+	for i := 0; i < 3; i++ {
+		if route, _ := router.FindBalancedRoute("a", "d"); !router.isSameRoute(first, route) {
+			t.Fatal("expected one route without load balancing")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package wireguard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+)
+
+// ErrInvalidAnnouncementSignature is returned for announcements whose
+// signature does not verify, or that are not signed where signatures are
+// required
+var ErrInvalidAnnouncementSignature = errors.New("invalid announcement signature")
+
+// SetSigner makes discovery sign its announcements with the key pair of
+// signer, and drop announcements of other nodes that are unsigned or whose
+// signature does not verify. The signing key a node first announced with
+// is kept while the node is known, so another key cannot take its place.
+// It must be called before Start.
+func (pd *PeerDiscovery) SetSigner(signer *quantum.DilithiumSigner) {
+	pd.signer = signer
+}
+
+// signedBytes returns the canonical serialization the signature covers:
+// the JSON encoding of the announcement without its signature
+func (a *Announcement) signedBytes() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+// signAnnouncement adds the signing key and the signature of the local
+// node to announcement
+func (pd *PeerDiscovery) signAnnouncement(announcement *Announcement) error {
+	pd.signerMu.Lock()
+	defer pd.signerMu.Unlock()
+
+	publicKey, err := pd.signer.ExportPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to sign announcement: %w", err)
+	}
+	announcement.SigningKey = hex.EncodeToString(publicKey)
+	message, err := announcement.signedBytes()
+	if err != nil {
+		return fmt.Errorf("failed to sign announcement: %w", err)
+	}
+	signature, err := pd.signer.Sign(message)
+	if err != nil {
+		return fmt.Errorf("failed to sign announcement: %w", err)
+	}
+	announcement.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// verifyAnnouncement checks the signature of announcement against the
+// signing key it carries, and that a known node still uses the same key.
+// Without a signer, signatures are not checked.
+func (pd *PeerDiscovery) verifyAnnouncement(announcement *Announcement) error {
+	if pd.signer == nil {
+		return nil
+	}
+	if announcement.Signature == "" || announcement.SigningKey == "" {
+		return fmt.Errorf("%w: announcement is not signed", ErrInvalidAnnouncementSignature)
+	}
+	keyBytes, err := hex.DecodeString(announcement.SigningKey)
+	if err != nil {
+		return fmt.Errorf("%w: invalid signing key encoding: %v", ErrInvalidAnnouncementSignature, err)
+	}
+	signature, err := hex.DecodeString(announcement.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: invalid signature encoding: %v", ErrInvalidAnnouncementSignature, err)
+	}
+	message, err := announcement.signedBytes()
+	if err != nil {
+		return err
+	}
+
+	pd.peersMutex.RLock()
+	pinned, known := pd.signingKeys[announcement.NodeID]
+	pd.peersMutex.RUnlock()
+	if known && pinned != announcement.SigningKey {
+		return fmt.Errorf("%w: node %s announced a different signing key", ErrInvalidAnnouncementSignature, announcement.NodeID)
+	}
+
+	pd.signerMu.Lock()
+	defer pd.signerMu.Unlock()
+	publicKey, err := pd.signer.ImportPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnnouncementSignature, err)
+	}
+	valid, err := pd.signer.VerifyWithPublicKey(message, signature, publicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnnouncementSignature, err)
+	}
+	if !valid {
+		return ErrInvalidAnnouncementSignature
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package wireguard
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/2gc-dev/cloudbridge-client/pkg/quantum"
+	"go.uber.org/zap"
+)
+
+func newTestSigner(t *testing.T) *quantum.DilithiumSigner {
+	t.Helper()
+	signer := quantum.NewDilithiumSigner(nil, zap.NewNop())
+	if err := signer.GenerateKeyPair(); err != nil {
+		t.Fatalf("failed to generate key pair: %v", err)
+	}
+	return signer
+}
+
+// signedAnnouncement returns an announcement of id signed by signer
+func signedAnnouncement(t *testing.T, id string, signer *quantum.DilithiumSigner) *Announcement {
+	t.Helper()
+	sender := NewPeerDiscovery(&MeshNode{
+		ID:        id,
+		PublicKey: &[32]byte{1},
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.30"), Port: 51820},
+	}, nil, zap.NewNop())
+	if signer != nil {
+		sender.SetSigner(signer)
+	}
+	data, err := sender.marshalAnnouncement()
+	if err != nil {
+		t.Fatalf("failed to marshal announcement: %v", err)
+	}
+	var announcement Announcement
+	if err := json.Unmarshal(data, &announcement); err != nil {
+		t.Fatalf("failed to unmarshal announcement: %v", err)
+	}
+	return &announcement
+}
+
+func TestVerifyAnnouncement(t *testing.T) {
+	receiver := newTestDiscovery()
+	receiver.SetSigner(newTestSigner(t))
+
+	signed := signedAnnouncement(t, "peer-1", newTestSigner(t))
+	if signed.SigningKey == "" || signed.Signature == "" {
+		t.Fatalf("expected a signed announcement, got %+v", signed)
+	}
+	if err := receiver.verifyAnnouncement(signed); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+
+	unsigned := signedAnnouncement(t, "peer-1", nil)
+	if err := receiver.verifyAnnouncement(unsigned); !errors.Is(err, ErrInvalidAnnouncementSignature) {
+		t.Errorf("expected unsigned announcement to be rejected, got %v", err)
+	}
+
+	truncated := *signed
+	truncated.Signature = truncated.Signature[:64]
+	if err := receiver.verifyAnnouncement(&truncated); !errors.Is(err, ErrInvalidAnnouncementSignature) {
+		t.Errorf("expected a bad signature to be rejected, got %v", err)
+	}
+
+	// The signature covers the announced endpoint
+	moved := *signed
+	moved.Endpoint = "198.51.100.1:51820"
+	if err := receiver.verifyAnnouncement(&moved); !errors.Is(err, ErrInvalidAnnouncementSignature) {
+		t.Errorf("expected a modified announcement to be rejected, got %v", err)
+	}
+
+	// Without a signer, signatures are not checked
+	if err := newTestDiscovery().verifyAnnouncement(unsigned); err != nil {
+		t.Errorf("expected unsigned announcement to pass without a signer, got %v", err)
+	}
+}
+
+func TestSigningKeyIsKeptWhileKnown(t *testing.T) {
+	receiver := newTestDiscovery()
+	receiver.SetSigner(newTestSigner(t))
+
+	first := signedAnnouncement(t, "peer-1", newTestSigner(t))
+	if err := receiver.verifyAnnouncement(first); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	receiver.handleProcessedAnnouncement(first)
+
+	// Another key cannot announce as the same node
+	impostor := signedAnnouncement(t, "peer-1", newTestSigner(t))
+	if err := receiver.verifyAnnouncement(impostor); !errors.Is(err, ErrInvalidAnnouncementSignature) {
+		t.Errorf("expected a different signing key to be rejected, got %v", err)
+	}
+	receiver.handleAnnouncement(mustMarshal(t, impostor), &net.UDPAddr{})
+	if receiver.metrics.InvalidSignatures != 1 {
+		t.Errorf("expected 1 invalid signature, got %d", receiver.metrics.InvalidSignatures)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	return data
+}
@@ -2,8 +2,11 @@ package wireguard
 
 import (
 	"container/heap"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,8 +24,27 @@ type MeshTopology struct {
 	discovery   *PeerDiscovery
 	logger      *zap.Logger
 	metrics     *TopologyMetrics
+	events      *EventLog
+
+	// duplicatePolicy decides what happens to a node whose ID is taken
+	duplicatePolicy DuplicateIDPolicy
 }
 
+// DuplicateIDPolicy decides how AddNode handles a node whose ID is already
+// used by a node with a different public key
+type DuplicateIDPolicy string
+
+const (
+	// DuplicateIDReject refuses the newcomer and keeps the existing node
+	DuplicateIDReject DuplicateIDPolicy = "reject"
+	// DuplicateIDRename adds the newcomer under an ID derived from its key
+	DuplicateIDRename DuplicateIDPolicy = "rename"
+)
+
+// ErrDuplicateNodeID is returned by AddNode when a node ID is already used
+// by a node with a different public key and the policy rejects it
+var ErrDuplicateNodeID = errors.New("duplicate node ID")
+
 // MeshConnection represents a connection between two nodes
 type MeshConnection struct {
 	ID           string
@@ -67,6 +89,9 @@ type TopologyMetrics struct {
 	AverageBandwidth int64
 	NetworkDiameter  int
 	LastOptimization time.Time
+	// NodeIDCollisions counts nodes that reused the ID of a node with a
+	// different public key
+	NodeIDCollisions int64
 }
 
 // MeshTopologyManager manages the mesh topology
@@ -81,10 +106,18 @@ type MeshTopologyManager struct {
 // TopologyConfig represents configuration for topology management
 type TopologyConfig struct {
 	OptimizationInterval time.Duration
+	// MaxConnections bounds the connections of each node that redundant
+	// connections are added for
 	MaxConnections       int
+	// MinReliability and MaxLatency rule out connections as redundant ones
 	MinReliability       float64
 	MaxLatency           time.Duration
+	// MinDegree is how many connections redundant ones are added to give
+	// each node, DefaultMinDegree if zero
+	MinDegree            int
 	EnableAutoOptimization bool
+	// EventLogPath, if set, persists mesh events as JSON lines
+	EventLogPath string
 }
 
 // NewMeshTopology creates a new mesh topology
@@ -96,9 +129,32 @@ func NewMeshTopology(discovery *PeerDiscovery, logger *zap.Logger) *MeshTopology
 		discovery:   discovery,
 		logger:      logger,
 		metrics:     &TopologyMetrics{},
+		events:      NewEventLog(DefaultEventLogSize),
+
+		duplicatePolicy: DuplicateIDReject,
+	}
+}
+
+// SetDuplicateIDPolicy sets how ID collisions are handled. The default is
+// DuplicateIDReject.
+func (mt *MeshTopology) SetDuplicateIDPolicy(policy DuplicateIDPolicy) error {
+	switch policy {
+	case DuplicateIDReject, DuplicateIDRename:
+	default:
+		return fmt.Errorf("unknown duplicate ID policy %q", policy)
 	}
+
+	mt.nodesMutex.Lock()
+	defer mt.nodesMutex.Unlock()
+	mt.duplicatePolicy = policy
+	return nil
 }
 
+// DefaultMinDegree gives every node a second connection. A degree of two
+// alone does not keep the mesh together when a connection fails, which is
+// why addRedundantConnections also covers the bridges.
+const DefaultMinDegree = 2
+
 // NewMeshTopologyManager creates a new topology manager
 func NewMeshTopologyManager(topology *MeshTopology, config *TopologyConfig, logger *zap.Logger) *MeshTopologyManager {
 	if config == nil {
@@ -111,6 +167,12 @@ func NewMeshTopologyManager(topology *MeshTopology, config *TopologyConfig, logg
 		}
 	}
 
+	if config.EventLogPath != "" {
+		if err := topology.events.AttachFile(config.EventLogPath); err != nil {
+			logger.Warn("Failed to attach mesh event log file", zap.Error(err))
+		}
+	}
+
 	router := NewMeshRouter(topology, logger)
 	return &MeshTopologyManager{
 		topology: topology,
@@ -121,17 +183,74 @@ func NewMeshTopologyManager(topology *MeshTopology, config *TopologyConfig, logg
 	}
 }
 
-// AddNode adds a node to the topology
-func (mt *MeshTopology) AddNode(node *MeshNode) {
+// AddNode adds a node to the topology and returns the ID it was added under.
+// A node with the ID and public key of a known node replaces it. If the ID
+// belongs to a node with a different public key, the duplicate ID policy
+// either rejects the node with ErrDuplicateNodeID or renames it, in which
+// case node.ID is updated.
+func (mt *MeshTopology) AddNode(node *MeshNode) (string, error) {
 	mt.nodesMutex.Lock()
 	defer mt.nodesMutex.Unlock()
 
+	existing, exists := mt.nodes[node.ID]
+	if exists && keysDiffer(existing.PublicKey, node.PublicKey) {
+		mt.metrics.NodeIDCollisions++
+		if mt.duplicatePolicy != DuplicateIDRename {
+			mt.logger.Warn("Rejected node with duplicate ID",
+				zap.String("node_id", node.ID),
+				zap.String("endpoint", node.Endpoint.String()))
+			return "", fmt.Errorf("%w: %s", ErrDuplicateNodeID, node.ID)
+		}
+
+		renamed := mt.uniqueNodeID(node)
+		mt.logger.Warn("Renamed node with duplicate ID",
+			zap.String("node_id", node.ID),
+			zap.String("renamed_to", renamed),
+			zap.String("endpoint", node.Endpoint.String()))
+		node.ID = renamed
+		// The node may have been renamed to this ID before
+		_, exists = mt.nodes[renamed]
+	}
+
 	mt.nodes[node.ID] = node
-	mt.metrics.TotalNodes++
+	if !exists {
+		mt.metrics.TotalNodes++
+	}
+	mt.events.Record(MeshEvent{Type: MeshEventNodeAdded, NodeID: node.ID})
 
 	mt.logger.Info("Added node to topology",
 		zap.String("node_id", node.ID),
 		zap.String("endpoint", node.Endpoint.String()))
+	return node.ID, nil
+}
+
+// keysDiffer reports whether two public keys are known and differ. A node
+// without a key cannot be told apart from the one it replaces.
+func keysDiffer(a, b *[32]byte) bool {
+	return a != nil && b != nil && *a != *b
+}
+
+// uniqueNodeID derives an ID for node from its ID and public key that is
+// unused or already belongs to a node with the same key, so a node added
+// again is given the ID it was renamed to before. The suffixes are always
+// derived from the base ID. mt.nodesMutex must be held.
+func (mt *MeshTopology) uniqueNodeID(node *MeshNode) string {
+	base := fmt.Sprintf("%s-%s", node.ID, hex.EncodeToString(node.PublicKey[:4]))
+	id := base
+	for i := 2; ; i++ {
+		existing, taken := mt.nodes[id]
+		if !taken || (existing.PublicKey != nil && *existing.PublicKey == *node.PublicKey) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// NodeIDCollisions returns the number of node ID collisions detected
+func (mt *MeshTopology) NodeIDCollisions() int64 {
+	mt.nodesMutex.RLock()
+	defer mt.nodesMutex.RUnlock()
+	return mt.metrics.NodeIDCollisions
 }
 
 // RemoveNode removes a node from the topology
@@ -163,12 +282,25 @@ func (mt *MeshTopology) RemoveNode(nodeID string) {
 		}
 		mt.routesMutex.Unlock()
 
+		mt.events.Record(MeshEvent{Type: MeshEventNodeRemoved, NodeID: nodeID})
 		mt.logger.Info("Removed node from topology", zap.String("node_id", nodeID))
 	}
 }
 
 // AddConnection adds a connection between two nodes
 func (mt *MeshTopology) AddConnection(sourceNode, targetNode string, latency time.Duration, bandwidth int64, reliability float64) {
+	connection := mt.addConnection(sourceNode, targetNode, latency, bandwidth, reliability)
+	mt.events.Record(MeshEvent{
+		Type:         MeshEventConnectionUp,
+		ConnectionID: connection.ID,
+		Source:       sourceNode,
+		Destination:  targetNode,
+		CostAfter:    connection.Cost,
+	})
+}
+
+// addConnection adds a connection without recording an event
+func (mt *MeshTopology) addConnection(sourceNode, targetNode string, latency time.Duration, bandwidth int64, reliability float64) *MeshConnection {
 	mt.connMutex.Lock()
 	defer mt.connMutex.Unlock()
 
@@ -194,6 +326,8 @@ func (mt *MeshTopology) AddConnection(sourceNode, targetNode string, latency tim
 		zap.String("source", sourceNode),
 		zap.String("target", targetNode),
 		zap.Duration("latency", latency))
+
+	return connection
 }
 
 // RemoveConnection removes a connection
@@ -201,10 +335,18 @@ func (mt *MeshTopology) RemoveConnection(connID string) {
 	mt.connMutex.Lock()
 	defer mt.connMutex.Unlock()
 
-	if _, exists := mt.connections[connID]; exists {
+	if conn, exists := mt.connections[connID]; exists {
 		delete(mt.connections, connID)
 		mt.metrics.TotalConnections--
 
+		mt.events.Record(MeshEvent{
+			Type:         MeshEventConnectionDown,
+			ConnectionID: connID,
+			Source:       conn.SourceNode,
+			Destination:  conn.TargetNode,
+			CostBefore:   conn.Cost,
+		})
+
 		mt.logger.Info("Removed connection from topology", zap.String("connection_id", connID))
 	}
 }
@@ -279,7 +421,7 @@ func (mtm *MeshTopologyManager) BuildOptimalTopology() error {
 	mst := mtm.buildMinimumSpanningTree(nodes)
 	
 	// Add redundant connections for fault tolerance
-	redundant := mtm.addRedundantConnections(mst)
+	redundant := mtm.addRedundantConnections(nodes, mst)
 	
 	// Optimize routes
 	optimized := mtm.optimizeRoutes(redundant)
@@ -288,9 +430,8 @@ func (mtm *MeshTopologyManager) BuildOptimalTopology() error {
 	return mtm.applyTopology(optimized)
 }
 
-// buildMinimumSpanningTree builds a minimum spanning tree using Kruskal's algorithm
-func (mtm *MeshTopologyManager) buildMinimumSpanningTree(nodes []*MeshNode) []*MeshConnection {
-	// Create all possible connections
+// possibleConnections returns a connection between every pair of nodes
+func (mtm *MeshTopologyManager) possibleConnections(nodes []*MeshNode) []*MeshConnection {
 	var edges []*MeshConnection
 	for i := 0; i < len(nodes); i++ {
 		for j := i + 1; j < len(nodes); j++ {
@@ -309,9 +450,16 @@ func (mtm *MeshTopologyManager) buildMinimumSpanningTree(nodes []*MeshNode) []*M
 			edges = append(edges, conn)
 		}
 	}
+	return edges
+}
+
+// buildMinimumSpanningTree builds a minimum spanning tree using Kruskal's algorithm
+func (mtm *MeshTopologyManager) buildMinimumSpanningTree(nodes []*MeshNode) []*MeshConnection {
+	edges := mtm.possibleConnections(nodes)
 
-	// Sort edges by cost
-	heap.Init(&EdgeHeap{edges})
+	// Order edges by cost; popping shrinks the heap
+	edgeHeap := &EdgeHeap{edges}
+	heap.Init(edgeHeap)
 
 	// Union-Find data structure for cycle detection
 	uf := NewUnionFind(len(nodes))
@@ -321,8 +469,8 @@ func (mtm *MeshTopologyManager) buildMinimumSpanningTree(nodes []*MeshNode) []*M
 	}
 
 	var mst []*MeshConnection
-	for len(edges) > 0 && len(mst) < len(nodes)-1 {
-		edge := heap.Pop(&EdgeHeap{edges}).(*MeshConnection)
+	for edgeHeap.Len() > 0 && len(mst) < len(nodes)-1 {
+		edge := heap.Pop(edgeHeap).(*MeshConnection)
 		
 		sourceIdx := nodeMap[edge.SourceNode]
 		targetIdx := nodeMap[edge.TargetNode]
@@ -336,23 +484,179 @@ func (mtm *MeshTopologyManager) buildMinimumSpanningTree(nodes []*MeshNode) []*M
 	return mst
 }
 
-// addRedundantConnections adds redundant connections for fault tolerance
-func (mtm *MeshTopologyManager) addRedundantConnections(mst []*MeshConnection) []*MeshConnection {
-	// For now, we'll add a few additional connections based on cost
-	// In a real implementation, you might use more sophisticated algorithms
-	
+// addRedundantConnections adds the cheapest connections outside the tree mst
+// of nodes until every node has MinDegree connections, then covers every
+// bridge, a connection whose loss splits the mesh, with the cheapest
+// connection across it, so the mesh survives losing any one connection. A
+// connection is not added if it is slower than MaxLatency, less reliable
+// than MinReliability, or would give a node more than MaxConnections.
+func (mtm *MeshTopologyManager) addRedundantConnections(nodes []*MeshNode, mst []*MeshConnection) []*MeshConnection {
 	connections := make([]*MeshConnection, len(mst))
 	copy(connections, mst)
-	
-	// Add some redundant connections (up to MaxConnections)
-	if len(connections) < mtm.config.MaxConnections {
-		// This is a simplified approach - in reality you'd want more sophisticated logic
-		mtm.logger.Debug("Adding redundant connections for fault tolerance")
+
+	minDegree := mtm.config.MinDegree
+	if minDegree == 0 {
+		minDegree = DefaultMinDegree
 	}
-	
+	degree := make(map[string]int, len(nodes))
+	present := make(map[[2]string]bool, len(mst))
+	for _, conn := range mst {
+		degree[conn.SourceNode]++
+		degree[conn.TargetNode]++
+		present[[2]string{conn.SourceNode, conn.TargetNode}] = true
+	}
+	usable := func(conn *MeshConnection) bool {
+		source, target := conn.SourceNode, conn.TargetNode
+		switch {
+		case present[[2]string{source, target}]:
+			return false
+		case mtm.config.MaxConnections > 0 &&
+			(degree[source] >= mtm.config.MaxConnections || degree[target] >= mtm.config.MaxConnections):
+			return false
+		case mtm.config.MaxLatency > 0 && conn.Latency > mtm.config.MaxLatency:
+			return false
+		case conn.Reliability < mtm.config.MinReliability:
+			return false
+		}
+		return true
+	}
+	add := func(conn *MeshConnection) {
+		connections = append(connections, conn)
+		present[[2]string{conn.SourceNode, conn.TargetNode}] = true
+		degree[conn.SourceNode]++
+		degree[conn.TargetNode]++
+	}
+	lacking := 0
+	for _, node := range nodes {
+		if degree[node.ID] < minDegree {
+			lacking++
+		}
+	}
+
+	candidates := mtm.possibleConnections(nodes)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Cost < candidates[j].Cost
+	})
+	for _, conn := range candidates {
+		if lacking == 0 {
+			break
+		}
+		source, target := conn.SourceNode, conn.TargetNode
+		if (degree[source] >= minDegree && degree[target] >= minDegree) || !usable(conn) {
+			continue
+		}
+
+		add(conn)
+		for _, id := range []string{source, target} {
+			if degree[id] == minDegree {
+				lacking--
+			}
+		}
+	}
+
+	// Each connection across a bridge puts it on a cycle, so this ends
+	// once no bridge is left or none can be covered
+	uncovered := 0
+	for {
+		bridges := findBridges(nodes, connections)
+		uncovered = len(bridges)
+		covered := false
+		for _, bridge := range bridges {
+			side := reachableWithout(bridge.SourceNode, connections, bridge)
+			for _, conn := range candidates {
+				if side[conn.SourceNode] != side[conn.TargetNode] && usable(conn) {
+					add(conn)
+					covered = true
+					break
+				}
+			}
+			if covered {
+				break
+			}
+		}
+		if !covered {
+			break
+		}
+	}
+
+	mtm.logger.Debug("Added redundant connections",
+		zap.Int("tree", len(mst)),
+		zap.Int("redundant", len(connections)-len(mst)),
+		zap.Int("nodes_below_min_degree", lacking),
+		zap.Int("uncovered_bridges", uncovered))
 	return connections
 }
 
+// findBridges returns the connections whose loss would split the mesh of
+// nodes, found with Tarjan's low-link depth-first search
+func findBridges(nodes []*MeshNode, connections []*MeshConnection) []*MeshConnection {
+	adjacent := make(map[string][]*MeshConnection, len(nodes))
+	for _, conn := range connections {
+		adjacent[conn.SourceNode] = append(adjacent[conn.SourceNode], conn)
+		adjacent[conn.TargetNode] = append(adjacent[conn.TargetNode], conn)
+	}
+
+	order := make(map[string]int, len(nodes))
+	low := make(map[string]int, len(nodes))
+	var bridges []*MeshConnection
+	var visit func(id string, via *MeshConnection)
+	visit = func(id string, via *MeshConnection) {
+		order[id] = len(order) + 1
+		low[id] = order[id]
+		for _, conn := range adjacent[id] {
+			if conn == via {
+				continue
+			}
+			next := conn.TargetNode
+			if next == id {
+				next = conn.SourceNode
+			}
+			if order[next] == 0 {
+				visit(next, conn)
+				low[id] = min(low[id], low[next])
+				if low[next] > order[id] {
+					bridges = append(bridges, conn)
+				}
+			} else {
+				low[id] = min(low[id], order[next])
+			}
+		}
+	}
+	for _, node := range nodes {
+		if order[node.ID] == 0 {
+			visit(node.ID, nil)
+		}
+	}
+	return bridges
+}
+
+// reachableWithout returns the nodes reachable from start over connections
+// other than skip
+func reachableWithout(start string, connections []*MeshConnection, skip *MeshConnection) map[string]bool {
+	adjacent := make(map[string][]string)
+	for _, conn := range connections {
+		if conn == skip {
+			continue
+		}
+		adjacent[conn.SourceNode] = append(adjacent[conn.SourceNode], conn.TargetNode)
+		adjacent[conn.TargetNode] = append(adjacent[conn.TargetNode], conn.SourceNode)
+	}
+
+	reached := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range adjacent[id] {
+			if !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return reached
+}
+
 // optimizeRoutes optimizes routes in the topology
 func (mtm *MeshTopologyManager) optimizeRoutes(connections []*MeshConnection) []*MeshConnection {
 	// For now, we'll just return the connections as-is
@@ -368,7 +672,10 @@ func (mtm *MeshTopologyManager) optimizeRoutes(connections []*MeshConnection) []
 // applyTopology applies the topology to the network
 func (mtm *MeshTopologyManager) applyTopology(connections []*MeshConnection) error {
 	mtm.logger.Info("Applying topology", zap.Int("connections", len(connections)))
-	
+
+	costBefore := mtm.topology.totalConnectionCost()
+	connectionsBefore := len(mtm.topology.GetAllConnections())
+
 	// Clear existing connections
 	mtm.topology.connMutex.Lock()
 	mtm.topology.connections = make(map[string]*MeshConnection)
@@ -377,7 +684,7 @@ func (mtm *MeshTopologyManager) applyTopology(connections []*MeshConnection) err
 	
 	// Add new connections
 	for _, conn := range connections {
-		mtm.topology.AddConnection(
+		mtm.topology.addConnection(
 			conn.SourceNode,
 			conn.TargetNode,
 			conn.Latency,
@@ -388,6 +695,13 @@ func (mtm *MeshTopologyManager) applyTopology(connections []*MeshConnection) err
 	
 	// Update metrics
 	mtm.topology.metrics.LastOptimization = time.Now()
+
+	mtm.topology.events.Record(MeshEvent{
+		Type:       MeshEventOptimization,
+		CostBefore: costBefore,
+		CostAfter:  mtm.topology.totalConnectionCost(),
+		Details:    fmt.Sprintf("connections %d -> %d", connectionsBefore, len(connections)),
+	})
 	
 	mtm.logger.Info("Topology applied successfully")
 	return nil
@@ -451,6 +765,23 @@ func (mt *MeshTopology) GetMetrics() *TopologyMetrics {
 	return mt.metrics
 }
 
+// Events returns the topology's event log
+func (mt *MeshTopology) Events() *EventLog {
+	return mt.events
+}
+
+// totalConnectionCost returns the sum of the costs of all connections
+func (mt *MeshTopology) totalConnectionCost() float64 {
+	mt.connMutex.RLock()
+	defer mt.connMutex.RUnlock()
+
+	var total float64
+	for _, conn := range mt.connections {
+		total += conn.Cost
+	}
+	return total
+}
+
 // GetRouter returns the mesh router
 func (mtm *MeshTopologyManager) GetRouter() *MeshRouter {
 	return mtm.router
@@ -0,0 +1,268 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAddNodeDuplicateID(t *testing.T) {
+	keyA, keyB := &[32]byte{1}, &[32]byte{2}
+
+	topology := NewMeshTopology(nil, zap.NewNop())
+	if _, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyA}); err != nil {
+		t.Fatalf("failed to add node: %v", err)
+	}
+
+	// The same node announcing itself again replaces the entry
+	if _, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyA}); err != nil {
+		t.Fatalf("expected same key to be accepted, got %v", err)
+	}
+
+	_, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyB})
+	if !errors.Is(err, ErrDuplicateNodeID) {
+		t.Fatalf("expected ErrDuplicateNodeID, got %v", err)
+	}
+	if node, _ := topology.GetNode("node"); node.PublicKey != keyA {
+		t.Error("rejected node must not replace the existing one")
+	}
+
+	if err := topology.SetDuplicateIDPolicy(DuplicateIDRename); err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+	id, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyB})
+	if err != nil {
+		t.Fatalf("expected rename, got %v", err)
+	}
+	if id == "node" || !strings.HasPrefix(id, "node-") {
+		t.Errorf("unexpected renamed ID %q", id)
+	}
+	if node, ok := topology.GetNode(id); !ok || node.PublicKey != keyB {
+		t.Error("renamed node not found under its new ID")
+	}
+
+	if topology.NodeIDCollisions() != 2 {
+		t.Errorf("expected 2 collisions, got %d", topology.NodeIDCollisions())
+	}
+	if topology.GetMetrics().TotalNodes != 2 {
+		t.Errorf("expected 2 nodes, got %d", topology.GetMetrics().TotalNodes)
+	}
+
+	if err := topology.SetDuplicateIDPolicy("ignore"); err == nil {
+		t.Error("expected unknown policy to be rejected")
+	}
+}
+
+func TestAddNodeRenameIsStable(t *testing.T) {
+	keyA, keyB, keyC := &[32]byte{1}, &[32]byte{2}, &[32]byte{2, 0, 0, 0, 1}
+
+	topology := NewMeshTopology(nil, zap.NewNop())
+	if err := topology.SetDuplicateIDPolicy(DuplicateIDRename); err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+	if _, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyA}); err != nil {
+		t.Fatalf("failed to add node: %v", err)
+	}
+
+	// The renamed node announcing itself again keeps its ID
+	first, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyB})
+	if err != nil {
+		t.Fatalf("expected rename, got %v", err)
+	}
+	again, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyB})
+	if err != nil {
+		t.Fatalf("expected rename, got %v", err)
+	}
+	if again != first {
+		t.Errorf("expected node to be renamed to %q again, got %q", first, again)
+	}
+
+	// A third key sharing the prefix of the second is numbered from the
+	// base ID
+	third, err := topology.AddNode(&MeshNode{ID: "node", PublicKey: keyC})
+	if err != nil {
+		t.Fatalf("expected rename, got %v", err)
+	}
+	if third != first+"-2" {
+		t.Errorf("expected %q, got %q", first+"-2", third)
+	}
+
+	if topology.GetMetrics().TotalNodes != 3 {
+		t.Errorf("expected 3 nodes, got %d", topology.GetMetrics().TotalNodes)
+	}
+}
+
+// equatorNodes returns nodes along the equator, so the cost of connecting
+// two grows with their distance
+func equatorNodes() []*MeshNode {
+	var nodes []*MeshNode
+	for i, longitude := range []float64{0, 10, 20, 40, 45} {
+		nodes = append(nodes, &MeshNode{
+			ID:       fmt.Sprintf("node-%d", i),
+			Location: &GeoLocation{Longitude: longitude},
+		})
+	}
+	return nodes
+}
+
+// connected reports whether connections join all nodes
+func connected(nodes []*MeshNode, connections []*MeshConnection) bool {
+	index := make(map[string]int)
+	for i, node := range nodes {
+		index[node.ID] = i
+	}
+	uf := NewUnionFind(len(nodes))
+	for _, conn := range connections {
+		uf.Union(index[conn.SourceNode], index[conn.TargetNode])
+	}
+	for i := range nodes {
+		if uf.Find(i) != uf.Find(0) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildMinimumSpanningTree(t *testing.T) {
+	nodes := equatorNodes()
+	topology := NewMeshTopology(nil, zap.NewNop())
+	manager := NewMeshTopologyManager(topology, nil, zap.NewNop())
+
+	mst := manager.buildMinimumSpanningTree(nodes)
+	if len(mst) != len(nodes)-1 {
+		t.Fatalf("expected %d edges, got %d", len(nodes)-1, len(mst))
+	}
+	var total float64
+	for _, edge := range mst {
+		total += edge.Cost
+	}
+
+	// Compare with the cheapest of all spanning trees
+	var edges []*MeshConnection
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			latency := manager.calculateLatency(nodes[i], nodes[j])
+			edges = append(edges, &MeshConnection{
+				SourceNode: nodes[i].ID,
+				TargetNode: nodes[j].ID,
+				Cost: topology.calculateConnectionCost(latency,
+					manager.calculateBandwidth(nodes[i], nodes[j]),
+					manager.calculateReliability(nodes[i], nodes[j])),
+			})
+		}
+	}
+	index := make(map[string]int)
+	for i, node := range nodes {
+		index[node.ID] = i
+	}
+	cheapest := math.Inf(1)
+	for set := 0; set < 1<<len(edges); set++ {
+		if bits.OnesCount(uint(set)) != len(nodes)-1 {
+			continue
+		}
+		uf := NewUnionFind(len(nodes))
+		cost, spanning := 0.0, true
+		for i, edge := range edges {
+			if set&(1<<i) == 0 {
+				continue
+			}
+			a, b := index[edge.SourceNode], index[edge.TargetNode]
+			if uf.Find(a) == uf.Find(b) {
+				spanning = false
+				break
+			}
+			uf.Union(a, b)
+			cost += edge.Cost
+		}
+		if spanning && cost < cheapest {
+			cheapest = cost
+		}
+	}
+	if math.Abs(total-cheapest) > 1e-9 {
+		t.Errorf("expected total cost %v, got %v", cheapest, total)
+	}
+}
+
+func TestAddRedundantConnectionsCoversBridges(t *testing.T) {
+	// Two triangles far apart: every node has two connections within its
+	// cluster, and a single connection joins the clusters
+	var nodes []*MeshNode
+	for i, longitude := range []float64{0, 1, 2, 60, 61, 62} {
+		nodes = append(nodes, &MeshNode{
+			ID:       fmt.Sprintf("node-%d", i),
+			Location: &GeoLocation{Longitude: longitude},
+		})
+	}
+	manager := NewMeshTopologyManager(NewMeshTopology(nil, zap.NewNop()), nil, zap.NewNop())
+	mst := manager.buildMinimumSpanningTree(nodes)
+	connections := manager.addRedundantConnections(nodes, mst)
+
+	if bridges := findBridges(nodes, connections); len(bridges) != 0 {
+		t.Errorf("expected no bridges, got %d", len(bridges))
+	}
+	for i := range connections {
+		remaining := append(append([]*MeshConnection{}, connections[:i]...), connections[i+1:]...)
+		if !connected(nodes, remaining) {
+			t.Errorf("mesh falls apart without %s-%s", connections[i].SourceNode, connections[i].TargetNode)
+		}
+	}
+
+	// The triangles joined by one connection have that bridge
+	triangles := []*MeshConnection{
+		{SourceNode: "node-0", TargetNode: "node-1"},
+		{SourceNode: "node-1", TargetNode: "node-2"},
+		{SourceNode: "node-0", TargetNode: "node-2"},
+		{SourceNode: "node-3", TargetNode: "node-4"},
+		{SourceNode: "node-4", TargetNode: "node-5"},
+		{SourceNode: "node-3", TargetNode: "node-5"},
+		{SourceNode: "node-2", TargetNode: "node-3"},
+	}
+	if bridges := findBridges(nodes, triangles); len(bridges) != 1 || bridges[0] != triangles[6] {
+		t.Errorf("expected the joining connection as the only bridge, got %v", bridges)
+	}
+}
+
+func TestAddRedundantConnections(t *testing.T) {
+	nodes := equatorNodes()
+	manager := NewMeshTopologyManager(NewMeshTopology(nil, zap.NewNop()), nil, zap.NewNop())
+	mst := manager.buildMinimumSpanningTree(nodes)
+	connections := manager.addRedundantConnections(nodes, mst)
+
+	degree := make(map[string]int)
+	for _, conn := range connections {
+		degree[conn.SourceNode]++
+		degree[conn.TargetNode]++
+	}
+	for _, node := range nodes {
+		if degree[node.ID] < DefaultMinDegree {
+			t.Errorf("%s has %d connections", node.ID, degree[node.ID])
+		}
+	}
+
+	// Losing any one tree connection leaves the mesh connected
+	for i := range mst {
+		var remaining []*MeshConnection
+		for _, conn := range connections {
+			if conn != mst[i] {
+				remaining = append(remaining, conn)
+			}
+		}
+		if !connected(nodes, remaining) {
+			t.Errorf("mesh falls apart without %s-%s", mst[i].SourceNode, mst[i].TargetNode)
+		}
+	}
+
+	// Slow connections are not added
+	manager.config.MaxLatency = 15 * time.Millisecond
+	for _, conn := range manager.addRedundantConnections(nodes, mst)[len(mst):] {
+		if conn.Latency > manager.config.MaxLatency {
+			t.Errorf("added connection %s-%s with latency %v", conn.SourceNode, conn.TargetNode, conn.Latency)
+		}
+	}
+}